@@ -0,0 +1,447 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// AdminService the full name of the gRPC admin service, which
+	// can be used to restrict it to a set of principals
+	AdminService = "catly.Admin"
+	// the number of objects listed from storage at a time when measuring usage
+	usageBatchSize = 1000
+	// the value returned in place of secrets in the server's config
+	redacted = "[redacted]"
+)
+
+var (
+	errObjectsUnsupported = newRequestError(
+		codes.Unimplemented,
+		catly.ErrorReason_ReasonUnknown,
+		"images cannot be managed by this admin service",
+	)
+	errScrubUnsupported = newRequestError(
+		codes.Unimplemented,
+		catly.ErrorReason_ReasonUnknown,
+		"integrity scrubbing is not enabled on this server",
+	)
+)
+
+// Scrubber specifies the interface that integrity
+// scrubbers need to implement for the admin api
+type Scrubber interface {
+	Name() string
+	Corrupt() []*storage.CorruptObject
+	Trigger() bool
+}
+
+// Cache specifies the interface that caches
+// need to implement to be purged by the admin api
+type Cache interface {
+	Purge()
+}
+
+// Indexer specifies the interface that a metadata
+// index needs to implement for the admin api
+type Indexer interface {
+	Rebuild(ctx context.Context) error
+	Len() int
+}
+
+// AdminOption configures optional behaviour of the gRPC admin service
+type AdminOption func(rs *AdminResource)
+
+// WithScrubbers sets the scrubbers that report corrupt objects
+func WithScrubbers(scrubbers ...Scrubber) AdminOption {
+	return func(rs *AdminResource) {
+		rs.scrubbers = scrubbers
+	}
+}
+
+// WithIndexer sets the metadata index that can be rebuilt from storage
+func WithIndexer(index Indexer) AdminOption {
+	return func(rs *AdminResource) {
+		rs.index = index
+	}
+}
+
+// WithObjects sets the object service whose images are measured and deleted
+func WithObjects(objects *GRPCResource) AdminOption {
+	return func(rs *AdminResource) {
+		rs.objects = objects
+	}
+}
+
+// WithConfig sets the configuration the server was started with. The
+// values of any secrets are redacted when the configuration is requested
+func WithConfig(config map[string]string, secrets ...string) AdminOption {
+	return func(rs *AdminResource) {
+		rs.config = config
+		rs.secrets = secrets
+	}
+}
+
+// WithCache adds a cache that can be purged, identified by its name
+func WithCache(name string, cache Cache) AdminOption {
+	return func(rs *AdminResource) {
+		rs.caches[name] = cache
+	}
+}
+
+// AdminResource an implementation of the gRPC admin service
+type AdminResource struct {
+	scrubbers []Scrubber
+	index     Indexer
+	objects   *GRPCResource
+	config    map[string]string
+	secrets   []string
+	caches    map[string]Cache
+}
+
+// NewAdminResource creates a new grpc implementation of the admin service
+func NewAdminResource(opts ...AdminOption) *AdminResource {
+	rs := &AdminResource{
+		caches: make(map[string]Cache),
+	}
+
+	for _, opt := range opts {
+		opt(rs)
+	}
+
+	return rs
+}
+
+// ListCorruptObjects lists the objects found to be corrupt by each of the scrubbers
+func (rs *AdminResource) ListCorruptObjects(ctx context.Context, req *catly.ListCorruptObjectsRequest) (*catly.ListCorruptObjectsResponse, error) {
+	resp := &catly.ListCorruptObjectsResponse{
+		Objects: []*catly.CorruptObject{},
+	}
+
+	for _, s := range rs.scrubbers {
+		for _, obj := range s.Corrupt() {
+			resp.Objects = append(resp.Objects, &catly.CorruptObject{
+				Store:            obj.Store,
+				Name:             obj.Name,
+				ExpectedChecksum: obj.Expected,
+				ActualChecksum:   obj.Actual,
+				Detected:         obj.Detected.Unix(),
+				Status:           corruptStatus(obj.Status),
+			})
+		}
+	}
+
+	return resp, nil
+}
+
+// RebuildIndex rebuilds the metadata index from storage
+func (rs *AdminResource) RebuildIndex(ctx context.Context, req *catly.RebuildIndexRequest) (*catly.RebuildIndexResponse, error) {
+	if rs.index == nil {
+		return nil, errSearchUnsupported.err()
+	}
+
+	err := rs.index.Rebuild(ctx)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	return &catly.RebuildIndexResponse{
+		Objects: int64(rs.index.Len()),
+	}, nil
+}
+
+// GetUsage counts the images held in storage, along with their total size,
+// by content type. Every image in storage is read from its listing, so
+// this may take some time for large stores
+func (rs *AdminResource) GetUsage(ctx context.Context, req *catly.GetUsageRequest) (*catly.GetUsageResponse, error) {
+	if rs.objects == nil {
+		return nil, errObjectsUnsupported.err()
+	}
+
+	_, rerr := rs.objects.bucket(req.Bucket)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	resp := &catly.GetUsageResponse{
+		ContentTypes: []*catly.ContentTypeUsage{},
+	}
+
+	types := make(map[string]*catly.ContentTypeUsage)
+
+	var prefix string
+	if req.Bucket != "" {
+		prefix = storage.ObjectID(req.Bucket, "")
+	}
+
+	var after string
+
+	for {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		objects, err := rs.objects.storage.ListObjects(prefix, after, usageBatchSize)
+		if err != nil {
+			return nil, storageError(err).err()
+		}
+
+		for _, obj := range objects {
+			if storage.IsInternal(obj.Name) {
+				continue
+			}
+
+			contentType := mime.TypeByExtension(filepath.Ext(obj.Name))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			usage, ok := types[contentType]
+			if !ok {
+				usage = &catly.ContentTypeUsage{ContentType: contentType}
+				types[contentType] = usage
+				resp.ContentTypes = append(resp.ContentTypes, usage)
+			}
+
+			usage.Objects++
+			usage.Bytes += obj.Size
+			resp.Objects++
+			resp.Bytes += obj.Size
+		}
+
+		if len(objects) < usageBatchSize {
+			break
+		}
+
+		after = objects[len(objects)-1].Name
+	}
+
+	sort.Slice(resp.ContentTypes, func(i, j int) bool {
+		return resp.ContentTypes[i].ContentType < resp.ContentTypes[j].ContentType
+	})
+
+	return resp, nil
+}
+
+// ForceDelete deletes an image by the name it is stored with, including
+// its bucket. Unlike the object service, the image's name and bucket are
+// not validated, so images that could not otherwise be deleted can be
+// removed. Metadata left behind by images missing from storage is deleted
+func (rs *AdminResource) ForceDelete(ctx context.Context, req *catly.ForceDeleteRequest) (*catly.ForceDeleteResponse, error) {
+	if rs.objects == nil {
+		return nil, errObjectsUnsupported.err()
+	}
+
+	existed, rerr := rs.objects.forceDelete(req.Name)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	log.Warn().
+		Str("file", req.Name).
+		Msg("force deleted image")
+
+	return &catly.ForceDeleteResponse{
+		Existed: existed,
+	}, nil
+}
+
+// SetLogLevel changes the level of the messages logged by the server
+func (rs *AdminResource) SetLogLevel(ctx context.Context, req *catly.SetLogLevelRequest) (*catly.SetLogLevelResponse, error) {
+	level, err := zerolog.ParseLevel(req.Level)
+	if err != nil || level == zerolog.NoLevel {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonUnknown,
+			fmt.Sprintf("log level '%s' is invalid", req.Level),
+		).err()
+	}
+
+	previous := zerolog.GlobalLevel()
+
+	log.Info().Msg(fmt.Sprintf("changing log level from %s to %s", previous, level))
+
+	zerolog.SetGlobalLevel(level)
+
+	return &catly.SetLogLevelResponse{
+		Previous: previous.String(),
+	}, nil
+}
+
+// GetConfig returns the configuration the server was started with in name order
+func (rs *AdminResource) GetConfig(ctx context.Context, req *catly.GetConfigRequest) (*catly.GetConfigResponse, error) {
+	resp := &catly.GetConfigResponse{
+		Values: make([]*catly.ConfigValue, 0, len(rs.config)),
+	}
+
+	for name, value := range rs.config {
+		v := &catly.ConfigValue{
+			Name:  name,
+			Value: value,
+		}
+
+		// only secrets that have been set are redacted, so
+		// it can be seen which secrets have not been configured
+		if value != "" && contains(rs.secrets, name) {
+			v.Value = redacted
+			v.Redacted = true
+		}
+
+		resp.Values = append(resp.Values, v)
+	}
+
+	sort.Slice(resp.Values, func(i, j int) bool {
+		return resp.Values[i].Name < resp.Values[j].Name
+	})
+
+	return resp, nil
+}
+
+// PurgeCache purges each of the requested caches, or every cache if none are requested
+func (rs *AdminResource) PurgeCache(ctx context.Context, req *catly.PurgeCacheRequest) (*catly.PurgeCacheResponse, error) {
+	names := req.Caches
+
+	if len(names) < 1 {
+		for name := range rs.caches {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		_, ok := rs.caches[name]
+		if !ok {
+			return nil, newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonUnknown,
+				fmt.Sprintf("cache '%s' does not exist", name),
+			).err()
+		}
+	}
+
+	resp := &catly.PurgeCacheResponse{
+		Purged: []string{},
+	}
+
+	for _, name := range names {
+		if contains(resp.Purged, name) {
+			continue
+		}
+
+		rs.caches[name].Purge()
+		resp.Purged = append(resp.Purged, name)
+	}
+
+	sort.Strings(resp.Purged)
+
+	log.Info().Msg(fmt.Sprintf("purged caches: %v", resp.Purged))
+
+	return resp, nil
+}
+
+// StartScrub triggers a scrub of each of the requested stores, or every store if none
+// are requested. The scrubs run in the background, so the response is returned before
+// they are complete. Any corrupt objects they find are reported by ListCorruptObjects
+func (rs *AdminResource) StartScrub(ctx context.Context, req *catly.StartScrubRequest) (*catly.StartScrubResponse, error) {
+	if len(rs.scrubbers) < 1 {
+		return nil, errScrubUnsupported.err()
+	}
+
+	scrubbers := make(map[string]Scrubber, len(rs.scrubbers))
+
+	for _, s := range rs.scrubbers {
+		scrubbers[s.Name()] = s
+	}
+
+	for _, name := range req.Stores {
+		_, ok := scrubbers[name]
+		if !ok {
+			return nil, newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonUnknown,
+				fmt.Sprintf("store '%s' is not scrubbed", name),
+			).err()
+		}
+	}
+
+	resp := &catly.StartScrubResponse{
+		Started: []string{},
+	}
+
+	for _, s := range rs.scrubbers {
+		if len(req.Stores) > 0 && !contains(req.Stores, s.Name()) {
+			continue
+		}
+
+		if s.Trigger() {
+			resp.Started = append(resp.Started, s.Name())
+		}
+	}
+
+	return resp, nil
+}
+
+// forceDelete deletes an image and its metadata by the name it is stored
+// with, returning whether the image's data was found in storage
+func (rs *GRPCResource) forceDelete(id string) (bool, *requestError) {
+	if id == "" || storage.IsInternal(id) {
+		return false, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidName,
+			"name does not refer to an image",
+		)
+	}
+
+	info, _ := rs.storage.StatObject(id)
+
+	var md *storage.Metadata
+
+	if rs.index != nil {
+		md, _ = rs.index.Metadata(id)
+	}
+
+	existed := true
+
+	err := rs.storage.DeleteObject(id)
+	if err != nil {
+		if !errors.Is(err, storage.ErrFileDoesNotExist) {
+			return false, storageError(err)
+		}
+
+		// images that have neither data nor metadata cannot be deleted
+		if md == nil {
+			return false, storageError(err)
+		}
+
+		existed = false
+	}
+
+	rs.deleteMetadata(id)
+
+	if existed {
+		rs.publishDeleted(id, info, md)
+	}
+
+	return existed, nil
+}
+
+func corruptStatus(status storage.CorruptStatus) catly.CorruptStatus {
+	switch status {
+	case storage.CorruptQuarantined:
+		return catly.CorruptStatus_CorruptQuarantined
+	case storage.CorruptRepaired:
+		return catly.CorruptStatus_CorruptRepaired
+	}
+
+	return catly.CorruptStatus_CorruptFlagged
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testScrubber struct {
+	name      string
+	corrupt   []*storage.CorruptObject
+	triggered bool
+}
+
+func (s *testScrubber) Name() string {
+	return s.name
+}
+
+func (s *testScrubber) Corrupt() []*storage.CorruptObject {
+	return s.corrupt
+}
+
+func (s *testScrubber) Trigger() bool {
+	if s.triggered {
+		return false
+	}
+
+	s.triggered = true
+
+	return true
+}
+
+type testCache struct {
+	purged int
+}
+
+func (c *testCache) Purge() {
+	c.purged++
+}
+
+func TestAdminListCorruptObjects(t *testing.T) {
+	detected := time.Now()
+
+	rs := NewAdminResource(
+		WithScrubbers(
+			&testScrubber{
+				name: "disk1",
+				corrupt: []*storage.CorruptObject{
+					{Store: "disk1", Name: "cat.jpg", Expected: "abc", Actual: "abd", Detected: detected, Status: storage.CorruptRepaired},
+				},
+			},
+			&testScrubber{
+				name: "disk2",
+				corrupt: []*storage.CorruptObject{
+					{Store: "disk2", Name: "dog.jpg", Expected: "def", Actual: "deg", Detected: detected, Status: storage.CorruptQuarantined},
+				},
+			},
+		),
+	)
+
+	resp, err := rs.ListCorruptObjects(context.Background(), &catly.ListCorruptObjectsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+
+	assert.Equal(t, "disk1", resp.Objects[0].Store)
+	assert.Equal(t, "cat.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "abc", resp.Objects[0].ExpectedChecksum)
+	assert.Equal(t, "abd", resp.Objects[0].ActualChecksum)
+	assert.Equal(t, detected.Unix(), resp.Objects[0].Detected)
+	assert.Equal(t, catly.CorruptStatus_CorruptRepaired, resp.Objects[0].Status)
+
+	assert.Equal(t, "disk2", resp.Objects[1].Store)
+	assert.Equal(t, catly.CorruptStatus_CorruptQuarantined, resp.Objects[1].Status)
+
+	// no scrubbers configured
+	resp, err = NewAdminResource().ListCorruptObjects(context.Background(), &catly.ListCorruptObjectsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, resp.Objects, 0)
+}
+
+func TestAdminRebuildIndex(t *testing.T) {
+	m := storage.NewMemoryStore()
+
+	for _, id := range []string{"cat.jpg", "dog.jpg"} {
+		require.NoError(t, m.WriteObject(id, bytes.NewReader([]byte("meow"))))
+	}
+
+	x := storage.NewIndex(m)
+
+	resp, err := NewAdminResource(WithIndexer(x)).RebuildIndex(context.Background(), &catly.RebuildIndexRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Objects)
+
+	results := x.Search(&storage.Query{ContentType: "image/jpeg"})
+	assert.Len(t, results, 2)
+
+	// no index configured
+	_, err = NewAdminResource().RebuildIndex(context.Background(), &catly.RebuildIndexRequest{})
+	assert.Error(t, err)
+}
+
+func TestAdminGetUsage(t *testing.T) {
+	m := storage.NewMemoryStore()
+
+	objects := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithBuckets(storage.NewBuckets(m)),
+		WithIndex(storage.NewIndex(m)),
+	)
+
+	require.NoError(t, objects.buckets.CreateBucket(&storage.Bucket{Name: "cats"}))
+
+	for id, size := range map[string]int{"cat.jpg": 10, "cats/cat.png": 20, "cats/grumpy.png": 30, "readme": 5} {
+		require.NoError(t, m.WriteObject(id, bytes.NewReader(make([]byte, size))))
+	}
+
+	rs := NewAdminResource(WithObjects(objects))
+
+	// bucket settings and metadata are not counted
+	resp, err := rs.GetUsage(context.Background(), &catly.GetUsageRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), resp.Objects)
+	assert.Equal(t, int64(65), resp.Bytes)
+	require.Len(t, resp.ContentTypes, 3)
+	assert.Equal(t, "application/octet-stream", resp.ContentTypes[0].ContentType)
+	assert.Equal(t, int64(5), resp.ContentTypes[0].Bytes)
+	assert.Equal(t, "image/jpeg", resp.ContentTypes[1].ContentType)
+	assert.Equal(t, "image/png", resp.ContentTypes[2].ContentType)
+	assert.Equal(t, int64(2), resp.ContentTypes[2].Objects)
+	assert.Equal(t, int64(50), resp.ContentTypes[2].Bytes)
+
+	resp, err = rs.GetUsage(context.Background(), &catly.GetUsageRequest{Bucket: "cats"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Objects)
+	assert.Equal(t, int64(50), resp.Bytes)
+	require.Len(t, resp.ContentTypes, 1)
+
+	_, err = rs.GetUsage(context.Background(), &catly.GetUsageRequest{Bucket: "dogs"})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+
+	// no object service configured
+	_, err = NewAdminResource().GetUsage(context.Background(), &catly.GetUsageRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAdminForceDelete(t *testing.T) {
+	m := storage.NewMemoryStore()
+	x := storage.NewIndex(m)
+
+	objects := NewGRPCResource("http://127.0.0.1:8080/", m, WithIndex(x))
+
+	// images with names that cannot be used with the object service can be deleted
+	require.NoError(t, m.WriteObject("missing/cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	rs := NewAdminResource(WithObjects(objects))
+
+	resp, err := rs.ForceDelete(context.Background(), &catly.ForceDeleteRequest{Name: "missing/cat.jpg"})
+	require.NoError(t, err)
+	assert.True(t, resp.Existed)
+
+	_, err = m.StatObject("missing/cat.jpg")
+	assert.ErrorIs(t, err, storage.ErrFileDoesNotExist)
+
+	// metadata is deleted for images that are missing from storage
+	require.NoError(t, x.PutMetadata(&storage.Metadata{Name: "dog.jpg", Description: "woof"}))
+
+	resp, err = rs.ForceDelete(context.Background(), &catly.ForceDeleteRequest{Name: "dog.jpg"})
+	require.NoError(t, err)
+	assert.False(t, resp.Existed)
+
+	_, err = x.Metadata("dog.jpg")
+	assert.Error(t, err)
+
+	_, err = rs.ForceDelete(context.Background(), &catly.ForceDeleteRequest{Name: "dog.jpg"})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonObjectNotFound)
+
+	for _, name := range []string{"", ".buckets/cats", ".metadata/dog.jpg"} {
+		_, err = rs.ForceDelete(context.Background(), &catly.ForceDeleteRequest{Name: name})
+		assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName)
+	}
+}
+
+func TestAdminSetLogLevel(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	rs := NewAdminResource()
+
+	resp, err := rs.SetLogLevel(context.Background(), &catly.SetLogLevelRequest{Level: "debug"})
+	require.NoError(t, err)
+	assert.Equal(t, "info", resp.Previous)
+	assert.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+
+	for _, level := range []string{"", "loud"} {
+		_, err = rs.SetLogLevel(context.Background(), &catly.SetLogLevelRequest{Level: level})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	assert.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+}
+
+func TestAdminGetConfig(t *testing.T) {
+	rs := NewAdminResource(
+		WithConfig(
+			map[string]string{
+				"CATLY_HTTP_PORT":      "8080",
+				"CATLY_ENCRYPTION_KEY": "c2VjcmV0",
+				"CATLY_UPLOAD_URL_KEY": "",
+				"CATLY_STORAGE_PATH":   "/var/lib/catly",
+			},
+			"CATLY_ENCRYPTION_KEY",
+			"CATLY_UPLOAD_URL_KEY",
+		),
+	)
+
+	resp, err := rs.GetConfig(context.Background(), &catly.GetConfigRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Values, 4)
+
+	assert.Equal(t, "CATLY_ENCRYPTION_KEY", resp.Values[0].Name)
+	assert.Equal(t, redacted, resp.Values[0].Value)
+	assert.True(t, resp.Values[0].Redacted)
+
+	assert.Equal(t, "CATLY_HTTP_PORT", resp.Values[1].Name)
+	assert.Equal(t, "8080", resp.Values[1].Value)
+	assert.False(t, resp.Values[1].Redacted)
+
+	// secrets that are not set are not redacted
+	assert.Equal(t, "CATLY_UPLOAD_URL_KEY", resp.Values[3].Name)
+	assert.Empty(t, resp.Values[3].Value)
+	assert.False(t, resp.Values[3].Redacted)
+}
+
+func TestAdminPurgeCache(t *testing.T) {
+	buckets := &testCache{}
+	thumbnails := &testCache{}
+
+	rs := NewAdminResource(
+		WithCache("buckets", buckets),
+		WithCache("thumbnails", thumbnails),
+	)
+
+	resp, err := rs.PurgeCache(context.Background(), &catly.PurgeCacheRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"buckets", "thumbnails"}, resp.Purged)
+	assert.Equal(t, 1, buckets.purged)
+	assert.Equal(t, 1, thumbnails.purged)
+
+	resp, err = rs.PurgeCache(context.Background(), &catly.PurgeCacheRequest{Caches: []string{"buckets", "buckets"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"buckets"}, resp.Purged)
+	assert.Equal(t, 2, buckets.purged)
+	assert.Equal(t, 1, thumbnails.purged)
+
+	// nothing is purged if any of the caches do not exist
+	_, err = rs.PurgeCache(context.Background(), &catly.PurgeCacheRequest{Caches: []string{"buckets", "missing"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 2, buckets.purged)
+}
+
+func TestAdminStartScrub(t *testing.T) {
+	disk1 := &testScrubber{name: "disk1"}
+	disk2 := &testScrubber{name: "disk2"}
+
+	rs := NewAdminResource(WithScrubbers(disk1, disk2))
+
+	resp, err := rs.StartScrub(context.Background(), &catly.StartScrubRequest{Stores: []string{"disk2"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"disk2"}, resp.Started)
+	assert.False(t, disk1.triggered)
+	assert.True(t, disk2.triggered)
+
+	// stores that already have a scrub waiting are not started again
+	resp, err = rs.StartScrub(context.Background(), &catly.StartScrubRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"disk1"}, resp.Started)
+
+	_, err = rs.StartScrub(context.Background(), &catly.StartScrubRequest{Stores: []string{"disk3"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// no scrubbers configured
+	_, err = NewAdminResource().StartScrub(context.Background(), &catly.StartScrubRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
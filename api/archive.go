@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the maximum number of failed objects reported when importing an archive
+const importFailureLimit = 1000
+
+var errNoArchive = newRequestError(
+	codes.InvalidArgument,
+	catly.ErrorReason_ReasonNoData,
+	"no archive was sent",
+)
+
+// Export streams a tar archive of every object in storage, along with a
+// manifest of their names, checksums and metadata. The metadata of each
+// image is taken from the index if one is set, rather than being exported
+// as a separate object
+func (rs *AdminResource) Export(req *catly.ExportRequest, stream catly.Admin_ExportServer) error {
+	if rs.objects == nil {
+		return errObjectsUnsupported.err()
+	}
+
+	opts := &storage.ExportOptions{
+		Compress: req.Gzip,
+	}
+
+	if rs.objects.index != nil {
+		opts.Index = rs.objects.index
+	}
+
+	w := &chunkWriter{
+		stream: stream,
+	}
+
+	manifest, err := storage.Export(stream.Context(), rs.objects.storage, w, opts)
+	if err != nil {
+		if w.err != nil {
+			return w.err
+		}
+		if stream.Context().Err() != nil {
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+		return storageError(err).err()
+	}
+
+	log.Info().
+		Msg(fmt.Sprintf("exported %d objects", len(manifest.Objects)))
+
+	return nil
+}
+
+// Import writes the objects in an archive created by Export to storage.
+// Objects that fail to import are reported in the response, and do not
+// stop the import. The options set on the first chunk apply to the archive
+func (rs *AdminResource) Import(stream catly.Admin_ImportServer) error {
+	if rs.objects == nil {
+		return errObjectsUnsupported.err()
+	}
+
+	chunk, err := stream.Recv()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errNoArchive.err()
+		}
+		return err
+	}
+
+	r := &chunkReader{
+		recvData: func() ([]byte, error) {
+			chunk, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			return chunk.Data, nil
+		},
+	}
+
+	err = r.add(chunk.Data)
+	if err != nil {
+		return err
+	}
+
+	resp := &catly.ImportResponse{
+		Failures: []*catly.ImportFailure{},
+	}
+
+	opts := &storage.ImportOptions{
+		Overwrite:     chunk.Overwrite,
+		Verify:        chunk.Verify,
+		MaxObjectSize: int64(rs.objects.maxObjectSize),
+		Progress: func(p storage.ImportProgress) {
+			if p.Status != storage.ImportFailed || len(resp.Failures) >= importFailureLimit {
+				return
+			}
+
+			resp.Failures = append(resp.Failures, &catly.ImportFailure{
+				Name:  p.Name,
+				Error: p.Err.Error(),
+			})
+		},
+	}
+
+	if rs.objects.index != nil {
+		opts.Index = rs.objects.index
+	}
+
+	result, err := storage.Import(stream.Context(), rs.objects.storage, r, opts)
+
+	// the settings of imported buckets may have replaced those that are cached
+	if c, ok := rs.objects.buckets.(Cache); ok {
+		c.Purge()
+	}
+
+	if err != nil {
+		if r.err != nil {
+			return r.err
+		}
+		if stream.Context().Err() != nil {
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+		return storageError(err).err()
+	}
+
+	log.Info().
+		Msg(fmt.Sprintf("imported %d objects, skipped %d and failed %d", result.Imported, result.Skipped, result.Failed))
+
+	resp.Imported = result.Imported
+	resp.Skipped = result.Skipped
+	resp.Failed = result.Failed
+	resp.Bytes = result.Bytes
+
+	return stream.SendAndClose(resp)
+}
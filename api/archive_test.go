@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func testAdminServer(t *testing.T) (*grpc.Server, catly.AdminClient, *storage.MemoryStore, *storage.Index) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+
+	m := storage.NewMemoryStore()
+	x := storage.NewIndex(m)
+
+	objects := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithBuckets(storage.NewBuckets(m)),
+		WithIndex(x),
+	)
+
+	s := grpc.NewServer()
+	catly.RegisterAdminServer(s, NewAdminResource(WithObjects(objects)))
+	go s.Serve(listener)
+
+	conn, err := grpc.Dial("127.0.0.1:8000", grpc.WithInsecure())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return s, catly.NewAdminClient(conn), m, x
+}
+
+func exportArchive(t *testing.T, c catly.AdminClient, gzip bool) []byte {
+	stream, err := c.Export(context.Background(), &catly.ExportRequest{Gzip: gzip})
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		archive.Write(chunk.Data)
+	}
+
+	return archive.Bytes()
+}
+
+func importArchive(c catly.AdminClient, archive []byte, overwrite bool) (*catly.ImportResponse, error) {
+	stream, err := c.Import(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	first := true
+
+	for first || len(archive) > 0 {
+		n := len(archive)
+		if n > downloadChunkSize {
+			n = downloadChunkSize
+		}
+
+		err = stream.Send(&catly.ImportChunk{
+			Overwrite: overwrite && first,
+			Verify:    first,
+			Data:      archive[:n],
+		})
+
+		if err != nil {
+			break
+		}
+
+		archive = archive[n:]
+		first = false
+	}
+
+	return stream.CloseAndRecv()
+}
+
+func TestAdminExportImport(t *testing.T) {
+	s, c, m, x := testAdminServer(t)
+
+	data := bytes.Repeat([]byte("meow"), downloadChunkSize)
+
+	require.NoError(t, storage.NewBuckets(m).CreateBucket(&storage.Bucket{Name: "cats"}))
+	require.NoError(t, m.WriteObject("cats/tabby.jpg", bytes.NewReader(data)))
+	require.NoError(t, m.WriteObject("dog.png", bytes.NewReader([]byte("woof"))))
+	require.NoError(t, x.PutMetadata(&storage.Metadata{Name: "cats/tabby.jpg", Owner: "alice"}))
+
+	archive := exportArchive(t, c, true)
+
+	s.Stop()
+
+	// import into an empty server
+	s, c, m, x = testAdminServer(t)
+	defer s.Stop()
+
+	resp, err := importArchive(c, archive, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.Imported)
+	assert.Zero(t, resp.Failed)
+	assert.Empty(t, resp.Failures)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.ReadObject("cats/tabby.jpg", &buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	_, err = storage.NewBuckets(m).Bucket("cats")
+	assert.NoError(t, err)
+
+	md, err := x.Metadata("cats/tabby.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", md.Owner)
+
+	// existing objects are skipped unless they are overwritten
+	resp, err = importArchive(c, archive, false)
+	require.NoError(t, err)
+	assert.Zero(t, resp.Imported)
+	assert.Equal(t, int64(3), resp.Skipped)
+
+	resp, err = importArchive(c, archive, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.Imported)
+	assert.Greater(t, resp.Bytes, int64(len(data)))
+
+	_, err = importArchive(c, []byte("not an archive"), false)
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnknown)
+
+	stream, err := c.Import(context.Background())
+	require.NoError(t, err)
+
+	_, err = stream.CloseAndRecv()
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonNoData)
+}
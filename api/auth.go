@@ -0,0 +1,363 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the number of invalid tokens a client can send before it is blocked
+	DefaultAuthFailureBurst = 10
+	// the rate at which a client can continue to send invalid tokens once blocked
+	DefaultAuthFailuresPerSecond = 0.1
+)
+
+// TokenAuthenticator authenticates gRPC requests using the bearer
+// token provided in the authorization metadata of the request.
+// Clients that repeatedly send invalid tokens are blocked by their
+// ip address, so tokens cannot be guessed by brute force
+type TokenAuthenticator struct {
+	mu sync.RWMutex
+	// tokens maps bearer tokens to the principal they belong to
+	tokens map[string]string
+
+	failuresMu   sync.Mutex
+	failures     map[string]*authFailures
+	failureRate  float64
+	failureBurst int
+	lastSweep    time.Time
+	now          func() time.Time
+}
+
+type authFailures struct {
+	bucket  tokenBucket
+	blocked time.Time
+	seen    time.Time
+}
+
+// AuthOption configures a token authenticator
+type AuthOption func(a *TokenAuthenticator)
+
+// WithAuthFailureLimit limits the rate at which each client can send
+// invalid tokens. A rate of zero disables the limit
+func WithAuthFailureLimit(rate float64, burst int) AuthOption {
+	return func(a *TokenAuthenticator) {
+		a.failureRate = rate
+		a.failureBurst = burst
+	}
+}
+
+// NewTokenAuthenticator creates a new authenticator from a
+// map of bearer tokens to the principals they belong to
+func NewTokenAuthenticator(tokens map[string]string, opts ...AuthOption) *TokenAuthenticator {
+	a := &TokenAuthenticator{
+		tokens:       tokens,
+		failures:     make(map[string]*authFailures),
+		failureRate:  DefaultAuthFailuresPerSecond,
+		failureBurst: DefaultAuthFailureBurst,
+		now:          time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// SetTokens replaces the tokens accepted by the authenticator
+func (a *TokenAuthenticator) SetTokens(tokens map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tokens = tokens
+}
+
+// authenticate checks the request's token, returning a
+// context containing the principal the token belongs to
+func (a *TokenAuthenticator) authenticate(ctx context.Context) (context.Context, error) {
+	key := grpcClientKey(ctx)
+
+	rerr := a.blocked(key)
+	if rerr != nil {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", rerr.retryAfterSeconds()))
+		return nil, status.Error(codes.ResourceExhausted, rerr.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) < 1 {
+		return nil, status.Error(codes.Unauthenticated, "authorization token is required")
+	}
+
+	principal := a.principal(values[0])
+	if principal == "" {
+		a.failed(key)
+		return nil, status.Error(codes.Unauthenticated, "authorization token is invalid")
+	}
+
+	return ContextWithPrincipal(ctx, principal), nil
+}
+
+// principal returns the principal a bearer token belongs
+// to, or an empty string if the token is not accepted
+func (a *TokenAuthenticator) principal(authorization string) string {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// compare every token in constant time, so we don't
+	// leak any information about the tokens we accept
+	var principal string
+
+	for t, p := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			principal = p
+		}
+	}
+
+	return principal
+}
+
+// blocked checks if a client has sent too many invalid tokens
+func (a *TokenAuthenticator) blocked(key string) *rateLimitError {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	now := a.now()
+
+	f, ok := a.failures[key]
+	if !ok || !now.Before(f.blocked) {
+		return nil
+	}
+
+	return &rateLimitError{
+		reason:     "too many invalid authorization tokens",
+		retryAfter: f.blocked.Sub(now),
+	}
+}
+
+// failed records an invalid token sent by a client, blocking
+// the client if it has exceeded the rate of failures allowed
+func (a *TokenAuthenticator) failed(key string) {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	if a.failureRate <= 0 {
+		return
+	}
+
+	now := a.now()
+
+	a.sweep(now)
+
+	f, ok := a.failures[key]
+	if !ok {
+		f = &authFailures{}
+		a.failures[key] = f
+	}
+
+	f.seen = now
+
+	burst := float64(a.failureBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	wait, ok := f.bucket.take(now, a.failureRate, burst, 1)
+	if ok {
+		return
+	}
+
+	f.blocked = now.Add(wait)
+
+	log.Warn().
+		Str("client", key).
+		Msg("client blocked after sending too many invalid authorization tokens")
+}
+
+// sweep removes clients that have not failed to authenticate
+// recently. This must be called while holding the failures lock
+func (a *TokenAuthenticator) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+
+	a.lastSweep = now
+
+	for k, f := range a.failures {
+		if now.Sub(f.seen) > rateLimitIdleTimeout && !now.Before(f.blocked) {
+			delete(a.failures, k)
+		}
+	}
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that
+// rejects any requests that are not authenticated
+func (a *TokenAuthenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that
+// rejects any streams that are not authenticated
+func (a *TokenAuthenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// Middleware returns a HTTP handler that rejects any requests that
+// are not authenticated with a bearer token in their Authorization header
+func (a *TokenAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := httpClientKey(r)
+
+		rerr := a.blocked(key)
+		if rerr != nil {
+			w.Header().Set("Retry-After", rerr.retryAfterSeconds())
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("too many requests"))
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+
+		var principal string
+
+		if authorization != "" {
+			principal = a.principal(authorization)
+			if principal == "" {
+				a.failed(key)
+			}
+		}
+
+		if principal == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("authorization token is required"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), principal)))
+	})
+}
+
+// Identify returns a HTTP handler that adds the principal of a request's bearer
+// token to its context, so the request can be identified by handlers that run
+// before it is authenticated. Requests without a valid token are passed on as
+// they are, to be rejected by any handlers that require authentication
+func (a *TokenAuthenticator) Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal := a.principal(authorization)
+		if principal == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), principal)))
+	})
+}
+
+// ServiceAuthorizer restricts the methods of a gRPC service to a set of
+// principals. It must run after the requests have been authenticated.
+// Requests for the methods of other services are not restricted
+type ServiceAuthorizer struct {
+	prefix     string
+	principals map[string]bool
+}
+
+// NewServiceAuthorizer creates a new authorizer that only allows
+// the principals to use the methods of the named gRPC service
+func NewServiceAuthorizer(service string, principals ...string) *ServiceAuthorizer {
+	a := &ServiceAuthorizer{
+		prefix:     "/" + service + "/",
+		principals: make(map[string]bool, len(principals)),
+	}
+
+	for _, p := range principals {
+		a.principals[p] = true
+	}
+
+	return a
+}
+
+// authorize checks that the principal making the request can use the method
+func (a *ServiceAuthorizer) authorize(ctx context.Context, method string) error {
+	if !strings.HasPrefix(method, a.prefix) {
+		return nil
+	}
+
+	principal, _ := PrincipalFromContext(ctx)
+
+	if !a.principals[principal] {
+		return status.Error(codes.PermissionDenied, "principal is not permitted to use this service")
+	}
+
+	return nil
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that rejects
+// any requests from principals that are not permitted
+func (a *ServiceAuthorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that rejects
+// any streams from principals that are not permitted
+func (a *ServiceAuthorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// contextStream overrides the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+	})
+
+	// no token
+	_, err := a.authenticate(context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// invalid token
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+
+	_, err = a.authenticate(ctx)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// valid token
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cr3t"))
+
+	ctx, err = a.authenticate(ctx)
+	require.NoError(t, err)
+
+	principal, ok := PrincipalFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, "team-cats", principal)
+
+	// replaced tokens
+	a.SetTokens(map[string]string{
+		"n3w-s3cr3t": "team-cats",
+	})
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cr3t"))
+
+	_, err = a.authenticate(ctx)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestTokenAuthenticatorFailureLimit(t *testing.T) {
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+	}, WithAuthFailureLimit(1, 3))
+
+	now := time.Now()
+	a.now = func() time.Time {
+		return now
+	}
+
+	peerContext := func(addr, token string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234},
+		})
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	// the client is blocked once it has used its burst of failures
+	for i := 0; i < 3; i++ {
+		_, err := a.authenticate(peerContext("10.0.0.1", "wrong"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	_, err := a.authenticate(peerContext("10.0.0.1", "wrong"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// valid tokens are also rejected while the client is blocked
+	_, err = a.authenticate(peerContext("10.0.0.1", "s3cr3t"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// other clients are unaffected
+	_, err = a.authenticate(peerContext("10.0.0.2", "s3cr3t"))
+	require.NoError(t, err)
+
+	now = now.Add(time.Second)
+
+	_, err = a.authenticate(peerContext("10.0.0.1", "s3cr3t"))
+	require.NoError(t, err)
+
+	// requests made over http are blocked in the same way
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/search", nil)
+		r.RemoteAddr = "10.0.0.3:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusUnauthorized, request("wrong").Code)
+	}
+
+	rec := request("s3cr3t")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+
+	assert.Equal(t, http.StatusOK, request("s3cr3t").Code)
+}
+
+func TestTokenAuthenticatorInterceptors(t *testing.T) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+	})
+
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(a.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(a.StreamServerInterceptor()),
+	)
+
+	catly.RegisterObjectServer(s, NewGRPCResource("http://127.0.0.1:8080/", storage.NewMemoryStore()))
+
+	go s.Serve(listener)
+
+	c := testGRPCClient(t)
+
+	_, err = c.List(context.Background(), &catly.ListObjectsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cr3t")
+
+	_, err = c.List(ctx, &catly.ListObjectsRequest{})
+	require.NoError(t, err)
+
+	stream, err := c.Download(context.Background(), &catly.DownloadObjectRequest{Name: "cat.jpg"})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err = c.Download(ctx, &catly.DownloadObjectRequest{Name: "cat.jpg"})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServiceAuthorizer(t *testing.T) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+		"4dm1n":  "ops",
+	})
+
+	z := NewServiceAuthorizer(AdminService, "ops")
+
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(a.UnaryServerInterceptor(), z.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(a.StreamServerInterceptor(), z.StreamServerInterceptor()),
+	)
+
+	catly.RegisterObjectServer(s, NewGRPCResource("http://127.0.0.1:8080/", storage.NewMemoryStore()))
+	catly.RegisterAdminServer(s, NewAdminResource())
+
+	go s.Serve(listener)
+
+	conn, err := grpc.Dial("127.0.0.1:8000", grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	c := catly.NewObjectClient(conn)
+	ac := catly.NewAdminClient(conn)
+
+	user := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cr3t")
+	admin := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer 4dm1n")
+
+	_, err = ac.GetConfig(user, &catly.GetConfigRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = ac.GetConfig(admin, &catly.GetConfigRequest{})
+	require.NoError(t, err)
+
+	// the methods of other services are not restricted
+	_, err = c.List(user, &catly.ListObjectsRequest{})
+	require.NoError(t, err)
+
+	_, err = c.List(admin, &catly.ListObjectsRequest{})
+	require.NoError(t, err)
+}
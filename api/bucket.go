@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"google.golang.org/grpc/codes"
+)
+
+// the content types of the images that can be uploaded
+var supportedTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// BucketReader specifies the interface that bucket
+// storage needs to implement for the http/web api
+type BucketReader interface {
+	Bucket(name string) (*storage.Bucket, error)
+}
+
+// BucketStorage specifies the interface that bucket storage
+// needs to implement for the bucket operations of the gRPC api
+type BucketStorage interface {
+	BucketReader
+	CreateBucket(bucket *storage.Bucket) error
+	ListBuckets() ([]*storage.Bucket, error)
+	DeleteBucket(name string) error
+}
+
+// WithBuckets sets the storage for buckets, so that images can be stored in separate buckets
+func WithBuckets(buckets BucketStorage) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.buckets = buckets
+	}
+}
+
+// CreateBucket handles requests to create a bucket
+func (rs *GRPCResource) CreateBucket(ctx context.Context, req *catly.CreateBucketRequest) (*catly.Bucket, error) {
+	if rs.buckets == nil {
+		return nil, errBucketsUnsupported.err()
+	}
+
+	if req.Bucket == nil || !storage.ValidBucketName(req.Bucket.Name) {
+		return nil, errInvalidBucketName.err()
+	}
+
+	if req.Bucket.MaxObjectSize < 0 {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidName,
+			"bucket max object size must not be negative",
+		).err()
+	}
+
+	for _, t := range req.Bucket.AllowedTypes {
+		if !contains(supportedTypes, t) {
+			return nil, newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonUnsupportedContent,
+				fmt.Sprintf("bucket allowed type '%s' is not supported", t),
+			).err()
+		}
+	}
+
+	bucket := &storage.Bucket{
+		Name:          req.Bucket.Name,
+		Visibility:    storage.VisibilityPublic,
+		MaxObjectSize: req.Bucket.MaxObjectSize,
+		AllowedTypes:  req.Bucket.AllowedTypes,
+	}
+
+	if req.Bucket.Visibility == catly.BucketVisibility_BucketPrivate {
+		bucket.Visibility = storage.VisibilityPrivate
+	}
+
+	err := rs.buckets.CreateBucket(bucket)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	return bucketInfo(bucket), nil
+}
+
+// ListBuckets handles requests to list buckets in name order
+func (rs *GRPCResource) ListBuckets(ctx context.Context, req *catly.ListBucketsRequest) (*catly.ListBucketsResponse, error) {
+	resp := &catly.ListBucketsResponse{
+		Buckets: []*catly.Bucket{},
+	}
+
+	if rs.buckets == nil {
+		return resp, nil
+	}
+
+	buckets, err := rs.buckets.ListBuckets()
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	for _, bucket := range buckets {
+		resp.Buckets = append(resp.Buckets, bucketInfo(bucket))
+	}
+
+	return resp, nil
+}
+
+// DeleteBucket handles requests to delete an empty bucket
+func (rs *GRPCResource) DeleteBucket(ctx context.Context, req *catly.DeleteBucketRequest) (*catly.DeleteBucketResponse, error) {
+	if rs.buckets == nil {
+		return nil, errBucketsUnsupported.err()
+	}
+
+	if !storage.ValidBucketName(req.Name) {
+		return nil, errInvalidBucketName.err()
+	}
+
+	err := rs.buckets.DeleteBucket(req.Name)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	return &catly.DeleteBucketResponse{}, nil
+}
+
+// bucket returns the settings of the bucket an image is stored in,
+// or nil if the image is not stored in a bucket
+func (rs *GRPCResource) bucket(name string) (*storage.Bucket, *requestError) {
+	if name == "" {
+		return nil, nil
+	}
+
+	if rs.buckets == nil {
+		return nil, errBucketsUnsupported
+	}
+
+	if !storage.ValidBucketName(name) {
+		return nil, errInvalidBucketName
+	}
+
+	bucket, err := rs.buckets.Bucket(name)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return bucket, nil
+}
+
+// public checks that the images in a bucket can be served over HTTP. Private
+// buckets are reported as not found, so that their names are not revealed
+func (rs *GRPCResource) public(bucket string) *requestError {
+	b, rerr := rs.bucket(bucket)
+	if rerr != nil {
+		return rerr
+	}
+
+	if b != nil && b.Visibility != storage.VisibilityPublic {
+		return storageError(storage.ErrBucketDoesNotExist)
+	}
+
+	return nil
+}
+
+// object validates the name of an image and the bucket it is stored in,
+// returning the bucket's settings and the id of the image in storage
+func (rs *GRPCResource) object(bucket, name string) (*storage.Bucket, string, *requestError) {
+	rerr := validateName(name)
+	if rerr != nil {
+		return nil, "", rerr
+	}
+
+	b, rerr := rs.bucket(bucket)
+	if rerr != nil {
+		return nil, "", rerr
+	}
+
+	return b, storage.ObjectID(bucket, name), nil
+}
+
+// maxSize returns the maximum size of an image that can be uploaded to a bucket
+func (rs *GRPCResource) maxSize(bucket *storage.Bucket) int {
+	if bucket == nil || bucket.MaxObjectSize < 1 {
+		return rs.maxObjectSize
+	}
+
+	if rs.maxObjectSize > 0 && int64(rs.maxObjectSize) < bucket.MaxObjectSize {
+		return rs.maxObjectSize
+	}
+
+	return int(bucket.MaxObjectSize)
+}
+
+func bucketInfo(bucket *storage.Bucket) *catly.Bucket {
+	b := &catly.Bucket{
+		Name:          bucket.Name,
+		Visibility:    catly.BucketVisibility_BucketPublic,
+		MaxObjectSize: bucket.MaxObjectSize,
+		AllowedTypes:  bucket.AllowedTypes,
+		Created:       bucket.Created.Unix(),
+	}
+
+	if bucket.Visibility == storage.VisibilityPrivate {
+		b.Visibility = catly.BucketVisibility_BucketPrivate
+	}
+
+	return b
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
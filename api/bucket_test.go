@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func assertReason(t *testing.T, err error, code codes.Code, reason catly.ErrorReason) {
+	require.Error(t, err)
+
+	st := status.Convert(err)
+	assert.Equal(t, code, st.Code())
+
+	require.NotEmpty(t, st.Details())
+
+	ed, ok := st.Details()[0].(*catly.ErrorDetails)
+	require.True(t, ok)
+	assert.Equal(t, reason, ed.Reason)
+}
+
+func TestBucketCreateListDelete(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	b, err := c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{
+			Name:          "avatars",
+			Visibility:    catly.BucketVisibility_BucketPrivate,
+			MaxObjectSize: 1024,
+			AllowedTypes:  []string{"image/png"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "avatars", b.Name)
+	assert.Equal(t, catly.BucketVisibility_BucketPrivate, b.Visibility)
+	assert.Equal(t, int64(1024), b.MaxObjectSize)
+	assert.Equal(t, []string{"image/png"}, b.AllowedTypes)
+	assert.NotZero(t, b.Created)
+
+	_, err = c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "avatars"},
+	})
+	assertReason(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonBucketExists)
+
+	_, err = c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "Bad_Name"},
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName)
+
+	_, err = c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "documents", AllowedTypes: []string{"application/pdf"}},
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent)
+
+	_, err = c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "emoji"},
+	})
+	require.NoError(t, err)
+
+	resp, err := c.ListBuckets(context.Background(), &catly.ListBucketsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Buckets, 2)
+	assert.Equal(t, "avatars", resp.Buckets[0].Name)
+	assert.Equal(t, "emoji", resp.Buckets[1].Name)
+	assert.Equal(t, catly.BucketVisibility_BucketPublic, resp.Buckets[1].Visibility)
+
+	// buckets must be empty before they are deleted
+	require.NoError(t, m.WriteObject("emoji/cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	_, err = c.DeleteBucket(context.Background(), &catly.DeleteBucketRequest{Name: "emoji"})
+	assertReason(t, err, codes.FailedPrecondition, catly.ErrorReason_ReasonBucketNotEmpty)
+
+	require.NoError(t, m.DeleteObject("emoji/cat.jpg"))
+
+	_, err = c.DeleteBucket(context.Background(), &catly.DeleteBucketRequest{Name: "emoji"})
+	require.NoError(t, err)
+
+	_, err = c.DeleteBucket(context.Background(), &catly.DeleteBucketRequest{Name: "emoji"})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+}
+
+func TestBucketUpload(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	data := make([]byte, 1<<11)
+	rand.Read(data)
+
+	_, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+		Data:   data,
+	})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Bucket: "../avatars",
+		Name:   "cat.jpg",
+		Data:   data,
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName)
+
+	_, err = c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "avatars", MaxObjectSize: 1 << 10},
+	})
+	require.NoError(t, err)
+
+	// the bucket's maximum size is applied
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+		Data:   data,
+	})
+	assertUploadError(t, err, codes.ResourceExhausted, catly.ErrorReason_ReasonObjectTooLarge, "image exceeds the maximum size of 1024 bytes")
+
+	resp, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+		Data:   data[:1<<10],
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/avatars/cat.jpg", resp.Url)
+
+	var buf bytes.Buffer
+
+	err = m.ReadObject("avatars/cat.jpg", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, data[:1<<10], buf.Bytes())
+
+	// the same name can be used in a different bucket
+	resp, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat.jpg",
+		Data: data,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", resp.Url)
+
+	info, err := c.Stat(context.Background(), &catly.StatObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, "avatars", info.Bucket)
+	assert.Equal(t, int64(1<<10), info.Size)
+	assert.Equal(t, "http://127.0.0.1:8080/avatars/cat.jpg", info.Url)
+
+	_, err = c.Delete(context.Background(), &catly.DeleteObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	_, err = m.StatObject("cat.jpg")
+	require.NoError(t, err)
+}
+
+func TestBucketUploadAllowedTypes(t *testing.T) {
+	s, _ := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	_, err := c.CreateBucket(context.Background(), &catly.CreateBucketRequest{
+		Bucket: &catly.Bucket{Name: "avatars", AllowedTypes: []string{"image/png"}},
+	})
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Bucket: "avatars",
+		Name:   "cat.jpg",
+		Data:   []byte("meow"),
+	})
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent, "uploaded image content of 'image/jpeg' is not allowed in bucket 'avatars'")
+}
+
+func TestBucketList(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	buckets := storage.NewBuckets(m)
+
+	require.NoError(t, buckets.CreateBucket(&storage.Bucket{Name: "cats"}))
+
+	for _, name := range []string{"cat-1.jpg", "cats/cat-2.jpg", "cats/cat-3.jpg", "cat-4.jpg", "dog.jpg"} {
+		err := m.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	// images in buckets are not listed with images outside of a bucket
+	resp, err := c.List(context.Background(), &catly.ListObjectsRequest{
+		Prefix:   "cat",
+		PageSize: 2,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+	assert.Equal(t, "cat-1.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "cat-4.jpg", resp.Objects[1].Name)
+	assert.Equal(t, "cat-4.jpg", resp.NextPageToken)
+
+	resp, err = c.List(context.Background(), &catly.ListObjectsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 3)
+
+	resp, err = c.List(context.Background(), &catly.ListObjectsRequest{
+		Bucket:   "cats",
+		PageSize: 1,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat-2.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "cats", resp.Objects[0].Bucket)
+
+	resp, err = c.List(context.Background(), &catly.ListObjectsRequest{
+		Bucket:    "cats",
+		PageToken: resp.NextPageToken,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat-3.jpg", resp.Objects[0].Name)
+	assert.Empty(t, resp.NextPageToken)
+
+	_, err = c.List(context.Background(), &catly.ListObjectsRequest{
+		Bucket: "dogs",
+	})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errNoData = newRequestError(
+		codes.InvalidArgument,
+		catly.ErrorReason_ReasonNoData,
+		"image upload contains no valid data",
+	)
+	errInvalidBucketName = newRequestError(
+		codes.InvalidArgument,
+		catly.ErrorReason_ReasonInvalidName,
+		storage.ErrInvalidBucketName.Error(),
+	)
+	errBucketsUnsupported = newRequestError(
+		codes.Unimplemented,
+		catly.ErrorReason_ReasonUnknown,
+		"buckets are not supported by this server",
+	)
+)
+
+// requestError describes why a request has failed
+type requestError struct {
+	code   codes.Code
+	reason catly.ErrorReason
+	msg    string
+}
+
+func newRequestError(code codes.Code, reason catly.ErrorReason, msg string) *requestError {
+	return &requestError{
+		code:   code,
+		reason: reason,
+		msg:    msg,
+	}
+}
+
+// storageError converts an error returned by storage into a request error
+func storageError(err error) *requestError {
+	switch {
+	case errors.Is(err, storage.ErrFileExists):
+		return newRequestError(codes.AlreadyExists, catly.ErrorReason_ReasonObjectExists, err.Error())
+	case errors.Is(err, storage.ErrFileDoesNotExist):
+		return newRequestError(codes.NotFound, catly.ErrorReason_ReasonObjectNotFound, err.Error())
+	case errors.Is(err, storage.ErrStorageFull):
+		return newRequestError(codes.ResourceExhausted, catly.ErrorReason_ReasonStorageFull, err.Error())
+	case errors.Is(err, storage.ErrBucketDoesNotExist):
+		return newRequestError(codes.NotFound, catly.ErrorReason_ReasonBucketNotFound, err.Error())
+	case errors.Is(err, storage.ErrBucketExists):
+		return newRequestError(codes.AlreadyExists, catly.ErrorReason_ReasonBucketExists, err.Error())
+	case errors.Is(err, storage.ErrBucketNotEmpty):
+		return newRequestError(codes.FailedPrecondition, catly.ErrorReason_ReasonBucketNotEmpty, err.Error())
+	case errors.Is(err, storage.ErrInvalidBucketName), errors.Is(err, storage.ErrInvalidFileName):
+		return newRequestError(codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName, err.Error())
+	case errors.Is(err, storage.ErrInvalidArchive):
+		return newRequestError(codes.InvalidArgument, catly.ErrorReason_ReasonUnknown, err.Error())
+	}
+
+	return newRequestError(codes.Internal, catly.ErrorReason_ReasonInternal, err.Error())
+}
+
+// statusError converts a gRPC status error back into a request error,
+// using the reason attached to the status details
+func statusError(err error) *requestError {
+	st := status.Convert(err)
+
+	rerr := newRequestError(st.Code(), catly.ErrorReason_ReasonUnknown, st.Message())
+
+	for _, d := range st.Details() {
+		ed, ok := d.(*catly.ErrorDetails)
+		if ok {
+			rerr.reason = ed.Reason
+			break
+		}
+	}
+
+	return rerr
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// err creates a gRPC status for the failed request, with
+// the reason for the failure attached to the status details
+func (e *requestError) err(details ...proto.Message) error {
+	st := status.New(e.code, e.msg)
+
+	details = append([]proto.Message{
+		&catly.ErrorDetails{
+			Reason:  e.reason,
+			Message: e.msg,
+		},
+	}, details...)
+
+	ds, err := st.WithDetails(details...)
+	if err != nil {
+		return st.Err()
+	}
+
+	return ds.Err()
+}
+
+// uploadErr creates a gRPC status for a failed upload. Along with the
+// reason for the failure, a response containing the legacy status and
+// error fields that older clients expect is attached to the status details,
+// as well as any similar images that caused the upload to be rejected
+func (e *requestError) uploadErr(similar ...*catly.SimilarObject) error {
+	return e.err(&catly.UploadObjectResponse{
+		Status:  catly.ObjectStatus_ObjectERR,
+		Error:   e.msg,
+		Similar: similar,
+	})
+}
+
+// requestErrorHTTP responds to a HTTP request with the status that corresponds to a request error
+func requestErrorHTTP(w http.ResponseWriter, r *http.Request, rerr *requestError) {
+	status := rerr.httpStatus()
+
+	if status == http.StatusInternalServerError {
+		log.Error().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("error", rerr.Error()).
+			Msg("upload failed")
+	}
+
+	w.Header().Set("X-Catly-Reason", rerr.reason.String())
+
+	httpError(w, status, rerr.Error())
+}
+
+// httpStatus returns the HTTP status that corresponds to a request error
+func (e *requestError) httpStatus() int {
+	status := http.StatusInternalServerError
+
+	switch e.code {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		status = http.StatusBadRequest
+	case codes.NotFound:
+		status = http.StatusNotFound
+	case codes.AlreadyExists:
+		status = http.StatusConflict
+	case codes.Unimplemented:
+		status = http.StatusNotImplemented
+	case codes.ResourceExhausted:
+		status = http.StatusInsufficientStorage
+
+		if e.reason == catly.ErrorReason_ReasonObjectTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+	}
+
+	return status
+}
+
+// httpError responds to a HTTP request with a status and plain text message
+func httpError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"mime"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/purehyperbole/catly/storage"
+)
+
+// the types of events published when images change
+const (
+	// EventObjectCreated is published when an image has been uploaded
+	EventObjectCreated = "object.created"
+	// EventObjectDeleted is published when an image has been deleted
+	EventObjectDeleted = "object.deleted"
+)
+
+// Event describes a change to an image
+type Event struct {
+	// ID the unique id of the event
+	ID string `json:"id"`
+	// Type the type of the event, such as 'object.created'
+	Type string `json:"type"`
+	// Time the time the event happened
+	Time time.Time `json:"time"`
+	// Object the image that changed
+	Object *EventObject `json:"object"`
+}
+
+// EventObject describes the image an event is about
+type EventObject struct {
+	// Name the name of the image, without its bucket
+	Name string `json:"name"`
+	// Bucket the bucket the image is stored in, if any
+	Bucket string `json:"bucket,omitempty"`
+	// URL the url the image can be accessed from
+	URL string `json:"url"`
+	// Size the size of the image in bytes
+	Size int64 `json:"size"`
+	// ContentType the mime type of the image
+	ContentType string `json:"content_type"`
+	// Owner the authenticated principal that uploaded the image, if any
+	Owner string `json:"owner,omitempty"`
+}
+
+// EventPublisher specifies the interface that needs to be
+// implemented to be notified of changes to images
+type EventPublisher interface {
+	Publish(e *Event)
+}
+
+// WithEvents sets the publishers that are notified when images
+// are uploaded or deleted. Publishers are called synchronously,
+// so should not block while handling an event
+func WithEvents(publishers ...EventPublisher) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.publishers = append(rs.publishers, publishers...)
+	}
+}
+
+// publishCreated publishes an event for an image that has been uploaded
+func (rs *GRPCResource) publishCreated(ctx context.Context, id string, size int64) {
+	if len(rs.publishers) < 1 {
+		return
+	}
+
+	owner, _ := PrincipalFromContext(ctx)
+
+	rs.publish(EventObjectCreated, id, size, owner)
+}
+
+// publishDeleted publishes an event for an image that has been deleted.
+// info and md are the stat and metadata of the image before it was deleted
+func (rs *GRPCResource) publishDeleted(id string, info *storage.ObjectInfo, md *storage.Metadata) {
+	if len(rs.publishers) < 1 {
+		return
+	}
+
+	var size int64
+	var owner string
+
+	if info != nil {
+		size = info.Size
+	}
+
+	if md != nil {
+		owner = md.Owner
+	}
+
+	rs.publish(EventObjectDeleted, id, size, owner)
+}
+
+func (rs *GRPCResource) publish(eventType, id string, size int64, owner string) {
+	bucket, name := storage.SplitObjectID(id)
+
+	e := &Event{
+		ID:   uuid.New().String(),
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Object: &EventObject{
+			Name:        name,
+			Bucket:      bucket,
+			URL:         rs.url(id),
+			Size:        size,
+			ContentType: mime.TypeByExtension(filepath.Ext(name)),
+			Owner:       owner,
+		},
+	}
+
+	for _, p := range rs.publishers {
+		p.Publish(e)
+	}
+}
@@ -0,0 +1,337 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultFetchTimeout the default time allowed to fetch an image from a url
+	DefaultFetchTimeout = 30 * time.Second
+	// DefaultFetchRedirects the default number of redirects followed when fetching an image
+	DefaultFetchRedirects = 5
+)
+
+var (
+	// ErrSchemeNotAllowed is returned when fetching a url with a scheme that is not allowed
+	ErrSchemeNotAllowed = errors.New("url scheme is not allowed")
+	// ErrAddressNotAllowed is returned when fetching a url from a private, loopback or link-local address
+	ErrAddressNotAllowed = errors.New("url resolves to an address that is not allowed")
+	// ErrTooManyRedirects is returned when fetching a url is redirected too many times
+	ErrTooManyRedirects = errors.New("url redirected too many times")
+	// ErrFetchTooLarge is returned when the image fetched from a url exceeds the maximum size
+	ErrFetchTooLarge = errors.New("fetched image is too large")
+)
+
+var errFetchUnsupported = newRequestError(
+	codes.Unimplemented,
+	catly.ErrorReason_ReasonUnknown,
+	"uploading from a url is not supported by this server",
+)
+
+// addresses that are not publicly routable, in addition to
+// the loopback, private and link-local ranges
+var reservedNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+)
+
+// FetchOption configures optional behaviour of a fetcher
+type FetchOption func(f *Fetcher)
+
+// WithFetchSchemes sets the url schemes that images can be fetched from
+func WithFetchSchemes(schemes ...string) FetchOption {
+	return func(f *Fetcher) {
+		f.schemes = schemes
+	}
+}
+
+// WithFetchTimeout sets the time allowed to fetch an image, including any redirects
+func WithFetchTimeout(timeout time.Duration) FetchOption {
+	return func(f *Fetcher) {
+		f.timeout = timeout
+	}
+}
+
+// WithFetchRedirects sets the maximum number of redirects followed when fetching an image
+func WithFetchRedirects(redirects int) FetchOption {
+	return func(f *Fetcher) {
+		f.redirects = redirects
+	}
+}
+
+// WithURLUploads allows images to be uploaded from a url, using the fetcher to fetch them
+func WithURLUploads(fetcher *Fetcher) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.fetcher = fetcher
+	}
+}
+
+// Fetcher fetches images from urls on behalf of clients. To prevent clients
+// from using the server to make requests to internal services, only urls with
+// an allowed scheme are fetched, and connections to addresses that are not
+// publicly routable are refused. Every connection is checked after the url's
+// host has been resolved, including connections made to follow redirects
+type Fetcher struct {
+	client    *http.Client
+	schemes   []string
+	timeout   time.Duration
+	redirects int
+	blocked   func(ip net.IP) bool
+}
+
+// NewFetcher creates a new fetcher that fetches images over http and https
+func NewFetcher(opts ...FetchOption) *Fetcher {
+	f := &Fetcher{
+		schemes:   []string{"http", "https"},
+		timeout:   DefaultFetchTimeout,
+		redirects: DefaultFetchRedirects,
+		blocked:   blockedIP,
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: f.timeout,
+		Control: f.control,
+	}
+
+	f.client = &http.Client{
+		// proxies are not used, as the address of the proxy would be checked instead of the url's
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: f.checkRedirect,
+		Timeout:       f.timeout,
+	}
+
+	return f
+}
+
+// Fetch fetches the data at a url, failing if it exceeds the maximum size
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string, maxSize int) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if !f.allowed(u) {
+		return nil, ErrSchemeNotAllowed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "catly")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with status %d", resp.StatusCode)
+	}
+
+	if maxSize > 0 && resp.ContentLength > int64(maxSize) {
+		return nil, ErrFetchTooLarge
+	}
+
+	var r io.Reader = resp.Body
+
+	// read one more byte than the maximum size, to detect images that are too large
+	if maxSize > 0 {
+		r = io.LimitReader(resp.Body, int64(maxSize)+1)
+	}
+
+	var buf bytes.Buffer
+
+	_, err = buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && buf.Len() > maxSize {
+		return nil, ErrFetchTooLarge
+	}
+
+	return buf.Bytes(), nil
+}
+
+// control refuses connections to addresses that are not allowed. It is called
+// with the resolved address of every connection, so hosts cannot avoid the
+// check by resolving to a different address once they have been checked
+func (f *Fetcher) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || f.blocked(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, host)
+	}
+
+	return nil
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.redirects {
+		return ErrTooManyRedirects
+	}
+
+	if !f.allowed(req.URL) {
+		return ErrSchemeNotAllowed
+	}
+
+	return nil
+}
+
+func (f *Fetcher) allowed(u *url.URL) bool {
+	return u.Host != "" && contains(f.schemes, strings.ToLower(u.Scheme))
+}
+
+// blockedIP reports whether an address is not publicly routable
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks[i] = n
+	}
+
+	return networks
+}
+
+// UploadFromURL handles requests to upload an image that is fetched from a url
+func (rs *GRPCResource) UploadFromURL(ctx context.Context, req *catly.UploadFromURLRequest) (*catly.UploadObjectResponse, error) {
+	if rs.fetcher == nil {
+		return nil, errFetchUnsupported.uploadErr()
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil || !rs.fetcher.allowed(u) {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidURL,
+			fmt.Sprintf("url should be absolute, with a scheme of %s", strings.Join(rs.fetcher.schemes, " or ")),
+		).uploadErr()
+	}
+
+	name := req.Name
+
+	if name == "" {
+		name, _ = url.PathUnescape(path.Base(u.Path))
+	}
+
+	// check the name and bucket before the image is fetched
+	bucket, _, rerr := rs.object(req.Bucket, name)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
+	}
+
+	data, err := rs.fetcher.Fetch(ctx, u.String(), rs.maxSize(bucket))
+	if err != nil {
+		return nil, fetchError(err, rs.maxSize(bucket)).uploadErr()
+	}
+
+	err = admitUpload(ctx, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	// the fetched image is validated as if it had been uploaded
+	return rs.Upload(ctx, &catly.UploadObjectRequest{
+		Name:        name,
+		Bucket:      req.Bucket,
+		Data:        data,
+		Tags:        req.Tags,
+		Description: req.Description,
+		Duplicates:  req.Duplicates,
+		MaxDistance: req.MaxDistance,
+	})
+}
+
+// fetchError converts an error encountered while fetching an image into a request error
+func fetchError(err error, maxSize int) *requestError {
+	switch {
+	case errors.Is(err, ErrFetchTooLarge):
+		return errTooLarge(maxSize)
+	case errors.Is(err, ErrSchemeNotAllowed), errors.Is(err, ErrAddressNotAllowed), errors.Is(err, ErrTooManyRedirects):
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidURL,
+			fmt.Sprintf("failed to fetch image: %s", unwrapURLError(err).Error()),
+		)
+	}
+
+	return newRequestError(
+		codes.FailedPrecondition,
+		catly.ErrorReason_ReasonFetchFailed,
+		fmt.Sprintf("failed to fetch image: %s", unwrapURLError(err).Error()),
+	)
+}
+
+// unwrapURLError removes the method and url from errors returned by the http
+// client, so that the errors reported to clients are not repetitive
+func unwrapURLError(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return uerr.Err
+	}
+
+	return err
+}
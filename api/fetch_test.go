@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"image/color"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// testFetcher creates a fetcher that allows connections to the
+// loopback address, so that it can fetch from a test server
+func testFetcher(opts ...FetchOption) *Fetcher {
+	return NewFetcher(append([]FetchOption{
+		func(f *Fetcher) {
+			f.blocked = func(ip net.IP) bool {
+				return !ip.IsLoopback() && blockedIP(ip)
+			}
+		},
+	}, opts...)...)
+}
+
+func TestBlockedIP(t *testing.T) {
+	cases := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"8.8.8.8", false},
+		{"151.101.1.69", false},
+		{"2606:4700::1111", false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.blocked, blockedIP(net.ParseIP(c.address)), c.address)
+	}
+}
+
+func TestFetcherBlocksPrivateAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer ts.Close()
+
+	_, err := NewFetcher().Fetch(context.Background(), ts.URL, 1024)
+	assert.ErrorIs(t, err, ErrAddressNotAllowed)
+
+	// addresses are also checked after a redirect
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://127.0.0.2/cat.png", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	f := NewFetcher()
+	f.blocked = func(ip net.IP) bool {
+		return !ip.Equal(net.IPv4(127, 0, 0, 1))
+	}
+
+	_, err = f.Fetch(context.Background(), redirect.URL, 1024)
+	assert.ErrorIs(t, err, ErrAddressNotAllowed)
+}
+
+func TestFetcher(t *testing.T) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("meow"))
+	})
+
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/redirect", http.StatusFound)
+	})
+
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://127.0.0.1/cat.png", http.StatusFound)
+	})
+
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		// stream the response, so there is no content length
+		for i := 0; i < 4; i++ {
+			w.Write(make([]byte, 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f := testFetcher(WithFetchRedirects(2))
+
+	data, err := f.Fetch(context.Background(), ts.URL+"/cat.png", 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), data)
+
+	_, err = f.Fetch(context.Background(), ts.URL+"/missing.png", 1024)
+	assert.Error(t, err)
+
+	_, err = f.Fetch(context.Background(), ts.URL+"/redirect", 1024)
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+
+	_, err = f.Fetch(context.Background(), ts.URL+"/ftp", 1024)
+	assert.ErrorIs(t, err, ErrSchemeNotAllowed)
+
+	_, err = f.Fetch(context.Background(), "file:///etc/passwd", 1024)
+	assert.ErrorIs(t, err, ErrSchemeNotAllowed)
+
+	_, err = f.Fetch(context.Background(), ts.URL+"/large", 1024)
+	assert.ErrorIs(t, err, ErrFetchTooLarge)
+
+	_, err = f.Fetch(context.Background(), ts.URL+"/large", 2048)
+	assert.NoError(t, err)
+}
+
+func TestObjectUploadFromURL(t *testing.T) {
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/images/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img)
+	})
+
+	mux.HandleFunc("/images/not-a-cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s, m := testGRPCServerWithDetector(t, 1<<20, http.DetectContentType, WithURLUploads(testFetcher()))
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	// the image is named after the url if no name is provided
+	resp, err := c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url:  ts.URL + "/images/cat.png",
+		Tags: map[string]string{"animal": "cat"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.png", resp.Url)
+
+	info, err := m.StatObject("cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img)), info.Size)
+
+	resp, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url:  ts.URL + "/images/cat.png",
+		Name: "another-cat.png",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/another-cat.png", resp.Url)
+
+	// fetched images are validated like uploaded images
+	_, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url: ts.URL + "/images/cat.png",
+	})
+	assertReason(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonObjectExists)
+
+	_, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url: ts.URL + "/images/not-a-cat.png",
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent)
+
+	_, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url: "gopher://127.0.0.1/cat.png",
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidURL)
+
+	_, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url: ts.URL + "/images/missing.png",
+	})
+	assertReason(t, err, codes.FailedPrecondition, catly.ErrorReason_ReasonFetchFailed)
+}
+
+func TestObjectUploadFromURLBlocked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer ts.Close()
+
+	s, _ := testGRPCServerWithDetector(t, 1<<20, http.DetectContentType, WithURLUploads(NewFetcher()))
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	_, err := c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url:  ts.URL,
+		Name: "secrets.png",
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidURL)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -11,92 +12,498 @@ import (
 	"strings"
 
 	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// the number of bytes needed to detect the content type of an upload
+	sniffLen = 512
+	// the default and maximum number of objects returned by List
+	defaultPageSize = 100
+	maxPageSize     = 1000
 )
 
 type contentDetectorFunc func(data []byte) string
 
+// GRPCOption configures optional behaviour of the gRPC object service
+type GRPCOption func(rs *GRPCResource)
+
+// WithMaxObjectSize sets the maximum size in bytes of an object that can be uploaded
+func WithMaxObjectSize(size int) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.maxObjectSize = size
+	}
+}
+
 // WritableStorage specifies the interface that storage
 // backends will need to implement for the gRPC api
 type WritableStorage interface {
 	WriteObject(id string, r io.Reader) error
 }
 
+// ObjectStorage specifies the full interface that storage backends
+// will need to implement to support all operations of the gRPC api
+type ObjectStorage interface {
+	ReadableStorage
+	WritableStorage
+	StatObject(id string) (*storage.ObjectInfo, error)
+	ListObjects(prefix, after string, limit int) ([]*storage.ObjectInfo, error)
+	DeleteObject(id string) error
+}
+
 // GRPCResource an implementation of the gRPC object service
 type GRPCResource struct {
 	address         string
-	storage         WritableStorage
+	storage         ObjectStorage
+	buckets         BucketStorage
+	index           MetadataIndex
+	publishers      []EventPublisher
+	broker          *EventBroker
+	fetcher         *Fetcher
+	signer          *UploadSigner
+	views           bool
 	contentDetector contentDetectorFunc
+	maxObjectSize   int
 }
 
 // NewGRPCResource creates a new grpc implementation of the object service
-func NewGRPCResource(address string, ws WritableStorage) *GRPCResource {
-	return &GRPCResource{
+func NewGRPCResource(address string, st ObjectStorage, opts ...GRPCOption) *GRPCResource {
+	rs := &GRPCResource{
 		address:         address,
-		storage:         ws,
+		storage:         st,
 		contentDetector: http.DetectContentType,
 	}
+
+	for _, opt := range opts {
+		opt(rs)
+	}
+
+	return rs
 }
 
 // Upload handles upload requests for images
 func (rs *GRPCResource) Upload(ctx context.Context, req *catly.UploadObjectRequest) (*catly.UploadObjectResponse, error) {
-	// check the name of the file is present and not too large
-	if len(req.Name) > 256 || len(req.Name) < 1 {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  "image name should be between 1 and 256 characters",
-		}, nil
+	// check the name of the file and the bucket it is uploaded to are valid
+	bucket, id, rerr := rs.object(req.Bucket, req.Name)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
 	}
 
-	// check there are no slashes to prevent someone from trying to escape
-	// to other parts of the filesystem (if file storage is used)
-	if strings.ContainsRune(req.Name, '/') {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  "image name contains invalid characters",
-		}, nil
+	rerr = validateMetadata(req.Tags, req.Description)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
+	}
+
+	maxDistance, rerr := rs.validateDuplicates(req.Duplicates, req.MaxDistance)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
 	}
 
 	// check that data has been provided
 	if len(req.Data) < 1 {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  "image upload contains no valid data",
-		}, nil
+		return nil, errNoData.uploadErr()
 	}
 
-	// get a best effort guess at the data's contents
-	mt := rs.contentDetector(req.Data)
+	// check the data does not exceed the maximum object size
+	maxSize := rs.maxSize(bucket)
 
-	if mt != "image/jpeg" && mt != "image/png" && mt != "image/gif" {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  fmt.Sprintf("uploaded image content of '%s' is not supported", mt),
-		}, nil
+	if maxSize > 0 && len(req.Data) > maxSize {
+		return nil, errTooLarge(maxSize).uploadErr()
 	}
 
-	// check that the detected mime type matches the file extension
-	// provided by the user
-	ext := filepath.Ext(req.Name)
+	// check the data is a supported image
+	rerr = rs.validateContent(bucket, req.Name, req.Data)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
+	}
 
-	if mt != mime.TypeByExtension(ext) {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  fmt.Sprintf("uploaded image extension '%s' does not match it's content type of '%s'", ext, mt),
-		}, nil
+	// hash the image so that similar images can be found
+	hash := rs.hash(req.Data)
+
+	similar, rerr := rs.duplicates(req.Duplicates, maxDistance, hash, id)
+	if rerr != nil {
+		return nil, rerr.uploadErr(similar...)
 	}
 
 	// write the object to the underlying storage implementation
-	err := rs.storage.WriteObject(req.Name, bytes.NewReader(req.Data))
+	err := rs.storage.WriteObject(id, bytes.NewReader(req.Data))
 	if err != nil {
-		return &catly.UploadObjectResponse{
-			Status: catly.ObjectStatus_ObjectERR,
-			Error:  err.Error(),
-		}, nil
+		return nil, storageError(err).uploadErr()
 	}
 
+	// record the image's tags and metadata so it can be searched for
+	rerr = rs.putMetadata(ctx, id, req.Tags, req.Description, hash)
+	if rerr != nil {
+		return nil, rerr.uploadErr()
+	}
+
+	rs.publishCreated(ctx, id, int64(len(req.Data)))
+
 	// generate the URL and return it to the uploader
 	return &catly.UploadObjectResponse{
-		Status: catly.ObjectStatus_ObjectOK,
-		Url:    fmt.Sprintf("%s%s", rs.address, req.Name),
+		Status:  catly.ObjectStatus_ObjectOK,
+		Url:     rs.url(id),
+		Similar: similar,
+		ViewUrl: rs.viewURL(id),
 	}, nil
 }
+
+// UploadStream handles upload requests for images that are sent as a stream of chunks
+func (rs *GRPCResource) UploadStream(stream catly.Object_UploadStreamServer) error {
+	// the first chunk of the stream must contain the file's name and metadata
+	chunk, err := stream.Recv()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errNoData.uploadErr()
+		}
+		return err
+	}
+
+	bucket, id, rerr := rs.object(chunk.Bucket, chunk.Name)
+	if rerr != nil {
+		return rerr.uploadErr()
+	}
+
+	rerr = validateMetadata(chunk.Tags, chunk.Description)
+	if rerr != nil {
+		return rerr.uploadErr()
+	}
+
+	maxDistance, rerr := rs.validateDuplicates(chunk.Duplicates, chunk.MaxDistance)
+	if rerr != nil {
+		return rerr.uploadErr()
+	}
+
+	maxSize := rs.maxSize(bucket)
+
+	r := &chunkReader{
+		recvData: func() ([]byte, error) {
+			chunk, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			return chunk.Data, nil
+		},
+		maxSize: maxSize,
+		tooLarge: func() error {
+			return errTooLarge(maxSize).uploadErr()
+		},
+	}
+
+	err = r.add(chunk.Data)
+	if err != nil {
+		return err
+	}
+
+	// buffer enough of the stream to detect the content of the image
+	head, err := r.peek(sniffLen)
+	if err != nil {
+		return err
+	}
+
+	if len(head) < 1 {
+		return errNoData.uploadErr()
+	}
+
+	rerr = rs.validateContent(bucket, chunk.Name, head)
+	if rerr != nil {
+		return rerr.uploadErr()
+	}
+
+	// stream the rest of the object to the underlying storage implementation,
+	// hashing the image as it is written so that similar images can be found
+	var body io.Reader = r
+	var hr *hashingReader
+
+	if rs.index != nil {
+		hr = newHashingReader(r)
+		body = hr
+	}
+
+	err = rs.storage.WriteObject(id, body)
+
+	var hash string
+
+	if hr != nil {
+		if r.err != nil {
+			hash = hr.hash(r.err)
+		} else {
+			hash = hr.hash(err)
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if err != nil {
+		return storageError(err).uploadErr()
+	}
+
+	similar, rerr := rs.duplicates(chunk.Duplicates, maxDistance, hash, id)
+	if rerr != nil {
+		// the image has already been written, so it must be removed
+		derr := rs.storage.DeleteObject(id)
+		if derr != nil {
+			log.Error().Str("file", id).Msg(fmt.Sprintf("failed to delete rejected image: %s", derr.Error()))
+		}
+
+		return rerr.uploadErr(similar...)
+	}
+
+	rerr = rs.putMetadata(stream.Context(), id, chunk.Tags, chunk.Description, hash)
+	if rerr != nil {
+		return rerr.uploadErr()
+	}
+
+	rs.publishCreated(stream.Context(), id, int64(r.read))
+
+	return stream.SendAndClose(&catly.UploadObjectResponse{
+		Status:  catly.ObjectStatus_ObjectOK,
+		Url:     rs.url(id),
+		Similar: similar,
+		ViewUrl: rs.viewURL(id),
+	})
+}
+
+// Download handles requests to download an image as a stream of chunks
+func (rs *GRPCResource) Download(req *catly.DownloadObjectRequest, stream catly.Object_DownloadServer) error {
+	_, id, rerr := rs.object(req.Bucket, req.Name)
+	if rerr != nil {
+		return rerr.err()
+	}
+
+	w := &chunkWriter{
+		stream: stream,
+	}
+
+	err := rs.storage.ReadObject(id, w)
+	if err != nil {
+		if w.err != nil {
+			return w.err
+		}
+		return storageError(err).err()
+	}
+
+	return nil
+}
+
+// Stat handles requests for information about an image
+func (rs *GRPCResource) Stat(ctx context.Context, req *catly.StatObjectRequest) (*catly.ObjectInfo, error) {
+	_, id, rerr := rs.object(req.Bucket, req.Name)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	info, err := rs.storage.StatObject(id)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	return rs.objectInfo(info), nil
+}
+
+// List handles requests to list images in name order
+func (rs *GRPCResource) List(ctx context.Context, req *catly.ListObjectsRequest) (*catly.ListObjectsResponse, error) {
+	if len(req.Prefix) > 256 || strings.ContainsRune(req.Prefix, '/') {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidName,
+			"image prefix is invalid",
+		).err()
+	}
+
+	_, rerr := rs.bucket(req.Bucket)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	pageSize := int(req.PageSize)
+
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	prefix := storage.ObjectID(req.Bucket, req.Prefix)
+
+	var after string
+	if req.PageToken != "" {
+		after = storage.ObjectID(req.Bucket, req.PageToken)
+	}
+
+	resp := &catly.ListObjectsResponse{
+		Objects: make([]*catly.ObjectInfo, 0, pageSize),
+	}
+
+	for len(resp.Objects) < pageSize {
+		limit := pageSize - len(resp.Objects)
+
+		objects, err := rs.storage.ListObjects(prefix, after, limit)
+		if err != nil {
+			return nil, storageError(err).err()
+		}
+
+		var skipped bool
+
+		for _, obj := range objects {
+			// images in buckets are listed alongside images that are not in a bucket,
+			// so skip past all of the images in a bucket when they are found. the byte
+			// 0xff never appears in utf-8, so it sorts after every image in the bucket
+			bucket, _ := storage.SplitObjectID(obj.Name)
+			if bucket != req.Bucket {
+				after = bucket + "/\xff"
+				skipped = true
+				break
+			}
+
+			resp.Objects = append(resp.Objects, rs.objectInfo(obj))
+			after = obj.Name
+		}
+
+		if !skipped && len(objects) < limit {
+			break
+		}
+	}
+
+	// if the page is full, there may be more objects to list
+	if len(resp.Objects) == pageSize {
+		resp.NextPageToken = resp.Objects[len(resp.Objects)-1].Name
+	}
+
+	return resp, nil
+}
+
+// Delete handles requests to delete an image
+func (rs *GRPCResource) Delete(ctx context.Context, req *catly.DeleteObjectRequest) (*catly.DeleteObjectResponse, error) {
+	_, id, rerr := rs.object(req.Bucket, req.Name)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	// the image is described by events, so must be looked up before it is deleted
+	var info *storage.ObjectInfo
+	var md *storage.Metadata
+
+	if len(rs.publishers) > 0 {
+		info, _ = rs.storage.StatObject(id)
+
+		if rs.index != nil {
+			md, _ = rs.index.Metadata(id)
+		}
+	}
+
+	err := rs.storage.DeleteObject(id)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	rs.deleteMetadata(id)
+	rs.publishDeleted(id, info, md)
+
+	return &catly.DeleteObjectResponse{}, nil
+}
+
+// validateName checks that an image's name is valid
+func validateName(name string) *requestError {
+	// check the name of the file is present and not too large
+	if len(name) > 256 || len(name) < 1 {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidName,
+			"image name should be between 1 and 256 characters",
+		)
+	}
+
+	// check there are no slashes to prevent someone from trying to escape
+	// to other parts of the filesystem (if file storage is used)
+	if strings.ContainsRune(name, '/') {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidName,
+			"image name contains invalid characters",
+		)
+	}
+
+	return nil
+}
+
+// validateContent checks the image's data is of a type supported by
+// the bucket, and that it matches the extension of the image's name
+func (rs *GRPCResource) validateContent(bucket *storage.Bucket, name string, data []byte) *requestError {
+	// get a best effort guess at the data's contents
+	mt := rs.contentDetector(data)
+
+	if !contains(supportedTypes, mt) {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonUnsupportedContent,
+			fmt.Sprintf("uploaded image content of '%s' is not supported", mt),
+		)
+	}
+
+	if bucket != nil && len(bucket.AllowedTypes) > 0 && !contains(bucket.AllowedTypes, mt) {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonUnsupportedContent,
+			fmt.Sprintf("uploaded image content of '%s' is not allowed in bucket '%s'", mt, bucket.Name),
+		)
+	}
+
+	// check that the detected mime type matches the file extension
+	// provided by the user
+	ext := filepath.Ext(name)
+
+	if mt != mime.TypeByExtension(ext) {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonExtensionMismatch,
+			fmt.Sprintf("uploaded image extension '%s' does not match it's content type of '%s'", ext, mt),
+		)
+	}
+
+	return nil
+}
+
+func errTooLarge(maxSize int) *requestError {
+	return newRequestError(
+		codes.ResourceExhausted,
+		catly.ErrorReason_ReasonObjectTooLarge,
+		fmt.Sprintf("image exceeds the maximum size of %d bytes", maxSize),
+	)
+}
+
+func (rs *GRPCResource) url(name string) string {
+	return fmt.Sprintf("%s%s", rs.address, name)
+}
+
+func (rs *GRPCResource) objectInfo(info *storage.ObjectInfo) *catly.ObjectInfo {
+	bucket, name := storage.SplitObjectID(info.Name)
+
+	oi := &catly.ObjectInfo{
+		Name:        name,
+		Bucket:      bucket,
+		Size:        info.Size,
+		ContentType: mime.TypeByExtension(filepath.Ext(name)),
+		Created:     info.Created.Unix(),
+		Url:         rs.url(info.Name),
+		Checksum:    info.Checksum,
+	}
+
+	// include the tags the image was uploaded with, if they have been indexed
+	if rs.index != nil {
+		md, err := rs.index.Metadata(info.Name)
+		if err == nil {
+			oi.Tags = md.Tags
+			oi.Description = md.Description
+			oi.Owner = md.Owner
+		}
+	}
+
+	return oi
+}
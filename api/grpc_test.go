@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"testing"
@@ -13,6 +15,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func testGRPCServer(t *testing.T, maxRequestSize int) (net.Listener, *storage.MemoryStore) {
@@ -21,7 +25,7 @@ func testGRPCServer(t *testing.T, maxRequestSize int) (net.Listener, *storage.Me
 	})
 }
 
-func testGRPCServerWithDetector(t *testing.T, maxRequestSize int, detector contentDetectorFunc) (net.Listener, *storage.MemoryStore) {
+func testGRPCServerWithDetector(t *testing.T, maxRequestSize int, detector contentDetectorFunc, opts ...GRPCOption) (net.Listener, *storage.MemoryStore) {
 	listener, err := net.Listen("tcp", ":8000")
 	require.NoError(t, err)
 
@@ -35,6 +39,10 @@ func testGRPCServerWithDetector(t *testing.T, maxRequestSize int, detector conte
 	r := NewGRPCResource(
 		"http://127.0.0.1:8080/",
 		m,
+		append([]GRPCOption{
+			WithBuckets(storage.NewBuckets(m)),
+			WithIndex(storage.NewIndex(m)),
+		}, opts...)...,
 	)
 
 	r.contentDetector = detector
@@ -45,6 +53,30 @@ func testGRPCServerWithDetector(t *testing.T, maxRequestSize int, detector conte
 	return listener, m
 }
 
+// assertUploadError checks the status of a failed upload, as well as the
+// error details and legacy response that are attached to it
+func assertUploadError(t *testing.T, err error, code codes.Code, reason catly.ErrorReason, msg string) {
+	require.Error(t, err)
+
+	st := status.Convert(err)
+	assert.Equal(t, code, st.Code())
+	assert.Equal(t, msg, st.Message())
+
+	details := st.Details()
+	require.Len(t, details, 2)
+
+	ed, ok := details[0].(*catly.ErrorDetails)
+	require.True(t, ok)
+	assert.Equal(t, reason, ed.Reason)
+	assert.Equal(t, msg, ed.Message)
+
+	legacy, ok := details[1].(*catly.UploadObjectResponse)
+	require.True(t, ok)
+	assert.Equal(t, catly.ObjectStatus_ObjectERR, legacy.Status)
+	assert.Equal(t, msg, legacy.Error)
+	assert.Empty(t, legacy.Url)
+}
+
 func testGRPCClient(t *testing.T) catly.ObjectClient {
 	conn, err := grpc.Dial("127.0.0.1:8000", grpc.WithInsecure())
 	require.NoError(t, err)
@@ -97,11 +129,8 @@ func TestObjectUploadNameConflict(t *testing.T) {
 		Data: data2,
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, storage.ErrFileExists.Error(), resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err = c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonObjectExists, storage.ErrFileExists.Error())
 
 	var b bytes.Buffer
 
@@ -123,11 +152,8 @@ func TestObjectUploadFileExtensionMismatch(t *testing.T) {
 		Data: data,
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, "uploaded image extension '.png' does not match it's content type of 'image/jpeg'", resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err := c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonExtensionMismatch, "uploaded image extension '.png' does not match it's content type of 'image/jpeg'")
 }
 
 func TestObjectUploadUnsupportedContent(t *testing.T) {
@@ -143,11 +169,8 @@ func TestObjectUploadUnsupportedContent(t *testing.T) {
 		Data: data,
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, "uploaded image content of 'application/octet-stream' is not supported", resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err := c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent, "uploaded image content of 'application/octet-stream' is not supported")
 }
 
 func TestObjectUploadNameTooLarge(t *testing.T) {
@@ -165,11 +188,8 @@ func TestObjectUploadNameTooLarge(t *testing.T) {
 		Data: data,
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, "image name should be between 1 and 256 characters", resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err := c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName, "image name should be between 1 and 256 characters")
 }
 
 func TestObjectUploadNameInvalidCharacter(t *testing.T) {
@@ -185,11 +205,8 @@ func TestObjectUploadNameInvalidCharacter(t *testing.T) {
 		Data: data,
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, "image name contains invalid characters", resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err := c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName, "image name contains invalid characters")
 }
 
 func TestObjectUploadNoData(t *testing.T) {
@@ -204,11 +221,8 @@ func TestObjectUploadNoData(t *testing.T) {
 		Name: "cat.jpg",
 	}
 
-	resp, err := c.Upload(context.Background(), req)
-	require.NoError(t, err)
-	assert.Equal(t, catly.ObjectStatus_ObjectERR, resp.Status)
-	assert.Equal(t, "image upload contains no valid data", resp.Error)
-	assert.Empty(t, resp.Url)
+	_, err := c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonNoData, "image upload contains no valid data")
 }
 
 func TestObjectUploadFileTooLarge(t *testing.T) {
@@ -226,4 +240,399 @@ func TestObjectUploadFileTooLarge(t *testing.T) {
 
 	_, err := c.Upload(context.Background(), req)
 	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestObjectUploadExceedsMaxObjectSize(t *testing.T) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := grpc.NewServer()
+
+	r := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		storage.NewMemoryStore(),
+		WithMaxObjectSize(1<<10),
+	)
+
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	catly.RegisterObjectServer(s, r)
+
+	go s.Serve(listener)
+
+	c := testGRPCClient(t)
+
+	data := make([]byte, 1<<11)
+	rand.Read(data)
+
+	req := &catly.UploadObjectRequest{
+		Name: "cat.jpg",
+		Data: data,
+	}
+
+	_, err = c.Upload(context.Background(), req)
+	assertUploadError(t, err, codes.ResourceExhausted, catly.ErrorReason_ReasonObjectTooLarge, "image exceeds the maximum size of 1024 bytes")
+}
+
+func TestObjectUploadStorageFull(t *testing.T) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := grpc.NewServer()
+
+	r := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		storage.NewMemoryStore(storage.WithMaxObjects(1)),
+	)
+
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	catly.RegisterObjectServer(s, r)
+
+	go s.Serve(listener)
+
+	c := testGRPCClient(t)
+
+	data := make([]byte, 1<<10)
+	rand.Read(data)
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat.jpg",
+		Data: data,
+	})
+
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat2.jpg",
+		Data: data,
+	})
+
+	assertUploadError(t, err, codes.ResourceExhausted, catly.ErrorReason_ReasonStorageFull, storage.ErrStorageFull.Error())
+}
+
+// statFailingStore fails to stat objects
+type statFailingStore struct {
+	*storage.MemoryStore
+}
+
+func (s statFailingStore) StatObject(id string) (*storage.ObjectInfo, error) {
+	return nil, errors.New("replica unavailable")
+}
+
+func TestObjectUploadMetadataFailure(t *testing.T) {
+	data := make([]byte, 1<<10)
+	rand.Read(data)
+
+	tests := []struct {
+		name    string
+		storage func(m *storage.MemoryStore) ObjectStorage
+		index   func(m *storage.MemoryStore) MetadataIndex
+	}{
+		{
+			name: "index",
+			storage: func(m *storage.MemoryStore) ObjectStorage {
+				return m
+			},
+			index: func(m *storage.MemoryStore) MetadataIndex {
+				return storage.NewIndex(&failingStore{MemoryStore: storage.NewMemoryStore(), failing: true})
+			},
+		},
+		{
+			name: "stat",
+			storage: func(m *storage.MemoryStore) ObjectStorage {
+				return statFailingStore{m}
+			},
+			index: func(m *storage.MemoryStore) MetadataIndex {
+				return storage.NewIndex(m)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", ":8000")
+			require.NoError(t, err)
+			defer listener.Close()
+
+			m := storage.NewMemoryStore()
+
+			r := NewGRPCResource("http://127.0.0.1:8080/", tc.storage(m), WithIndex(tc.index(m)))
+
+			r.contentDetector = func(data []byte) string {
+				return "image/jpeg"
+			}
+
+			s := grpc.NewServer()
+			catly.RegisterObjectServer(s, r)
+
+			go s.Serve(listener)
+
+			c := testGRPCClient(t)
+
+			_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+				Name: "cat.jpg",
+				Data: data,
+			})
+
+			require.Error(t, err)
+			assert.Equal(t, codes.Internal, status.Code(err))
+
+			// the image is removed, so the upload can be retried
+			_, err = m.StatObject("cat.jpg")
+			assert.ErrorIs(t, err, storage.ErrFileDoesNotExist)
+
+			stream, err := c.UploadStream(context.Background())
+			require.NoError(t, err)
+
+			require.NoError(t, stream.Send(&catly.UploadObjectChunk{Name: "cat.jpg", Data: data}))
+
+			_, err = stream.CloseAndRecv()
+			require.Error(t, err)
+			assert.Equal(t, codes.Internal, status.Code(err))
+
+			_, err = m.StatObject("cat.jpg")
+			assert.ErrorIs(t, err, storage.ErrFileDoesNotExist)
+		})
+	}
+}
+
+func TestObjectUploadStream(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	for i := 0; i < len(data); i += 1 << 16 {
+		chunk := &catly.UploadObjectChunk{
+			Data: data[i : i+1<<16],
+		}
+
+		if i == 0 {
+			chunk.Name = "cat.jpg"
+		}
+
+		err = stream.Send(chunk)
+		require.NoError(t, err)
+	}
+
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, catly.ObjectStatus_ObjectOK, resp.Status)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", resp.Url)
+
+	var b bytes.Buffer
+
+	err = m.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+}
+
+func TestObjectUploadStreamNoData(t *testing.T) {
+	s, _ := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	err = stream.Send(&catly.UploadObjectChunk{
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	_, err = stream.CloseAndRecv()
+	assertUploadError(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonNoData, "image upload contains no valid data")
+}
+
+func TestObjectUploadStreamTooLarge(t *testing.T) {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	m := storage.NewMemoryStore()
+
+	s := grpc.NewServer()
+
+	r := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithMaxObjectSize(1<<16),
+	)
+
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	catly.RegisterObjectServer(s, r)
+
+	go s.Serve(listener)
+
+	c := testGRPCClient(t)
+
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	data := make([]byte, 1<<15)
+	rand.Read(data)
+
+	for i := 0; i < 4; i++ {
+		err = stream.Send(&catly.UploadObjectChunk{
+			Name: "cat.jpg",
+			Data: data,
+		})
+
+		if err != nil {
+			break
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	assertUploadError(t, err, codes.ResourceExhausted, catly.ErrorReason_ReasonObjectTooLarge, "image exceeds the maximum size of 65536 bytes")
+
+	// check nothing was stored
+	_, err = m.StatObject("cat.jpg")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+}
+
+func TestObjectDownload(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	data := make([]byte, 1<<18)
+	rand.Read(data)
+
+	err := m.WriteObject("cat.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	stream, err := c.Download(context.Background(), &catly.DownloadObjectRequest{
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(chunk.Data), downloadChunkSize)
+
+		b.Write(chunk.Data)
+	}
+
+	assert.Equal(t, data, b.Bytes())
+}
+
+func TestObjectDownloadNotFound(t *testing.T) {
+	s, _ := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	stream, err := c.Download(context.Background(), &catly.DownloadObjectRequest{
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestObjectStat(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	err := m.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	info, err := c.Stat(context.Background(), &catly.StatObjectRequest{
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, "image/jpeg", info.ContentType)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", info.Url)
+	assert.NotZero(t, info.Created)
+
+	_, err = c.Stat(context.Background(), &catly.StatObjectRequest{
+		Name: "../../cat.jpg",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = c.Stat(context.Background(), &catly.StatObjectRequest{
+		Name: "invisible-cat.jpg",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestObjectList(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	for _, name := range []string{"cat-1.jpg", "cat-2.jpg", "cat-3.jpg", "dog.jpg"} {
+		err := m.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	resp, err := c.List(context.Background(), &catly.ListObjectsRequest{
+		Prefix:   "cat-",
+		PageSize: 2,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+	assert.Equal(t, "cat-1.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "cat-2.jpg", resp.Objects[1].Name)
+	assert.Equal(t, "cat-2.jpg", resp.NextPageToken)
+
+	resp, err = c.List(context.Background(), &catly.ListObjectsRequest{
+		Prefix:    "cat-",
+		PageSize:  2,
+		PageToken: resp.NextPageToken,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat-3.jpg", resp.Objects[0].Name)
+	assert.Empty(t, resp.NextPageToken)
+}
+
+func TestObjectDelete(t *testing.T) {
+	s, m := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	err := m.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	_, err = c.Delete(context.Background(), &catly.DeleteObjectRequest{
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	_, err = m.StatObject("cat.jpg")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	_, err = c.Delete(context.Background(), &catly.DeleteObjectRequest{
+		Name: "cat.jpg",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
 }
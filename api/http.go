@@ -1,12 +1,17 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/purehyperbole/catly/storage"
@@ -19,16 +24,43 @@ type ReadableStorage interface {
 	ReadObject(id string, w io.Writer) error
 }
 
+// HTTPOption configures optional behaviour of the http/web api
+type HTTPOption func(rs *HTTPResource)
+
+// WithPublicBuckets serves images from buckets with public visibility.
+// Images in private buckets are not served
+func WithPublicBuckets(buckets BucketReader) HTTPOption {
+	return func(rs *HTTPResource) {
+		rs.buckets = buckets
+	}
+}
+
+// WithSearch serves searches for images by their tags and metadata.
+// Images in private buckets are not included in search results
+func WithSearch(index SearchIndex) HTTPOption {
+	return func(rs *HTTPResource) {
+		rs.index = index
+	}
+}
+
 // HTTPResource def
 type HTTPResource struct {
 	storage ReadableStorage
+	buckets BucketReader
+	index   SearchIndex
 }
 
 // NewHTTPResource creates a new server for http calls
-func NewHTTPResource(s ReadableStorage) *HTTPResource {
-	return &HTTPResource{
+func NewHTTPResource(s ReadableStorage, opts ...HTTPOption) *HTTPResource {
+	rs := &HTTPResource{
 		storage: s,
 	}
+
+	for _, opt := range opts {
+		opt(rs)
+	}
+
+	return rs
 }
 
 // GetObject handles GET requests for an object
@@ -53,13 +85,14 @@ func (rs *HTTPResource) GetObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileID := strings.TrimPrefix(r.URL.Path, "/")
+	// images in a bucket are requested as /{bucket}/{name}
+	bucket, name := storage.SplitObjectID(strings.TrimPrefix(r.URL.Path, "/"))
 
 	// fail if someone is trying to potentially access different paths
 	// on the filesystem, or the image name is too large.
 	// we should probably do more to sanitise the fileID here, but
 	// it should be good for now
-	if strings.ContainsRune(fileID, '/') || len(fileID) > 256 {
+	if strings.ContainsRune(name, '/') || len(name) > 256 || (bucket != "" && !storage.ValidBucketName(bucket)) {
 		log.Warn().
 			Str("id", id).
 			Str("method", r.Method).
@@ -71,12 +104,20 @@ func (rs *HTTPResource) GetObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// set the content type, get the object and write it to the response
-	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(fileID)))
+	fileID := storage.ObjectID(bucket, name)
+
+	// images in private buckets are not served, and are reported as not
+	// found so that the names of private images are not revealed
+	err := rs.public(bucket)
+	if err == nil {
+		// set the content type, get the object and write it to the response
+		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+
+		err = rs.storage.ReadObject(fileID, w)
+	}
 
-	err := rs.storage.ReadObject(fileID, w)
 	if err != nil {
-		if errors.Is(err, storage.ErrFileDoesNotExist) {
+		if errors.Is(err, storage.ErrFileDoesNotExist) || errors.Is(err, storage.ErrBucketDoesNotExist) {
 			log.Warn().
 				Str("id", id).
 				Str("method", r.Method).
@@ -99,5 +140,213 @@ func (rs *HTTPResource) GetObject(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("internal server error"))
 		return
 	}
+}
+
+// public checks that images in a bucket can be served
+func (rs *HTTPResource) public(bucket string) error {
+	if bucket == "" {
+		return nil
+	}
+
+	if rs.buckets == nil {
+		return storage.ErrBucketDoesNotExist
+	}
+
+	b, err := rs.buckets.Bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	if b.Visibility != storage.VisibilityPublic {
+		return storage.ErrFileDoesNotExist
+	}
+
+	return nil
+}
+
+// searchResult an image found by a search
+type searchResult struct {
+	Name        string            `json:"name"`
+	Bucket      string            `json:"bucket,omitempty"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type"`
+	Created     time.Time         `json:"created"`
+	URL         string            `json:"url"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// searchResponse a page of images found by a search
+type searchResponse struct {
+	Objects       []*searchResult `json:"objects"`
+	NextPageToken string          `json:"next_page_token,omitempty"`
+}
+
+// Search handles GET requests to search for images by their tags and metadata
+func (rs *HTTPResource) Search(w http.ResponseWriter, r *http.Request) {
+	id := uuid.New().String()
+
+	log.Info().
+		Str("id", id).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("query", r.URL.RawQuery).
+		Msg("search requested")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+
+	if rs.index == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("search is not supported"))
+		return
+	}
+
+	q, pageSize, err := parseQuery(r.URL.Query())
+	if err != nil {
+		log.Warn().
+			Str("id", id).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("error", err.Error()).
+			Msg("bad search query")
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad request: " + err.Error()))
+		return
+	}
+
+	// images in private buckets are excluded from the results, so
+	// keep searching until the page is full or there are no more images
+	public := make(map[string]bool)
+
+	resp := &searchResponse{
+		Objects: make([]*searchResult, 0, pageSize),
+	}
+
+	for len(resp.Objects) < pageSize {
+		q.Limit = pageSize - len(resp.Objects)
+
+		results := rs.index.Search(q)
+
+		for _, md := range results {
+			q.After = md.Name
+
+			bucket, name := storage.SplitObjectID(md.Name)
+
+			visible, ok := public[bucket]
+			if !ok {
+				visible = rs.public(bucket) == nil
+				public[bucket] = visible
+			}
+
+			if !visible {
+				continue
+			}
+
+			resp.Objects = append(resp.Objects, &searchResult{
+				Name:        name,
+				Bucket:      bucket,
+				Size:        md.Size,
+				ContentType: md.ContentType,
+				Created:     md.Created,
+				URL:         "/" + md.Name,
+				Owner:       md.Owner,
+				Description: md.Description,
+				Tags:        md.Tags,
+			})
+		}
+
+		if len(results) < q.Limit {
+			break
+		}
+	}
+
+	// if the page is full, there may be more objects to find
+	if len(resp.Objects) == pageSize {
+		resp.NextPageToken = q.After
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Warn().
+			Str("id", id).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("error", err.Error()).
+			Msg("could not write search results")
+	}
+}
+
+// parseQuery parses the filters of a search from the parameters of a
+// request's url. Tags are specified as 'tag=key' or 'tag=key:value'
+func parseQuery(params url.Values) (*storage.Query, int, error) {
+	q := &storage.Query{
+		Bucket:      params.Get("bucket"),
+		Owner:       params.Get("owner"),
+		ContentType: params.Get("type"),
+		After:       params.Get("page_token"),
+	}
+
+	if q.Bucket != "" && !storage.ValidBucketName(q.Bucket) {
+		return nil, 0, storage.ErrInvalidBucketName
+	}
+
+	for _, tag := range params["tag"] {
+		if q.Tags == nil {
+			q.Tags = make(map[string]string)
+		}
+
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 2 {
+			q.Tags[kv[0]] = kv[1]
+		} else {
+			q.Tags[kv[0]] = ""
+		}
+	}
+
+	var err error
+
+	for param, v := range map[string]*int64{"min_size": &q.MinSize, "max_size": &q.MaxSize} {
+		if params.Get(param) == "" {
+			continue
+		}
+
+		*v, err = strconv.ParseInt(params.Get(param), 10, 64)
+		if err != nil || *v < 0 {
+			return nil, 0, fmt.Errorf("%s must be a positive number of bytes", param)
+		}
+	}
+
+	for param, v := range map[string]*time.Time{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if params.Get(param) == "" {
+			continue
+		}
+
+		*v, err = time.Parse(time.RFC3339, params.Get(param))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s must be an RFC 3339 time, such as 2006-01-02T15:04:05Z", param)
+		}
+	}
+
+	pageSize := defaultPageSize
+
+	if params.Get("page_size") != "" {
+		pageSize, err = strconv.Atoi(params.Get("page_size"))
+		if err != nil || pageSize < 1 {
+			return nil, 0, errors.New("page_size must be a positive number")
+		}
+
+		if pageSize > maxPageSize {
+			pageSize = maxPageSize
+		}
+	}
 
+	return q, pageSize, nil
 }
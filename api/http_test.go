@@ -15,7 +15,7 @@ import (
 
 func testHTTPResource(t *testing.T) (*HTTPResource, *storage.MemoryStore) {
 	m := storage.NewMemoryStore()
-	r := NewHTTPResource(m)
+	r := NewHTTPResource(m, WithPublicBuckets(storage.NewBuckets(m)))
 	return r, m
 }
 
@@ -94,3 +94,41 @@ func TestHTTPGetObjectNameInvalidCharacter(t *testing.T) {
 	r.GetObject(rec, req)
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
 }
+
+func TestHTTPGetObjectBucket(t *testing.T) {
+	r, m := testHTTPResource(t)
+
+	buckets := storage.NewBuckets(m)
+
+	require.NoError(t, buckets.CreateBucket(&storage.Bucket{Name: "public", Visibility: storage.VisibilityPublic}))
+	require.NoError(t, buckets.CreateBucket(&storage.Bucket{Name: "private", Visibility: storage.VisibilityPrivate}))
+
+	for _, name := range []string{"public/cat.jpg", "private/cat.jpg"} {
+		err := m.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	tests := map[string]int{
+		"/public/cat.jpg":    http.StatusOK,
+		"/public/dog.jpg":    http.StatusNotFound,
+		"/private/cat.jpg":   http.StatusNotFound,
+		"/missing/cat.jpg":   http.StatusNotFound,
+		"/.buckets/public":   http.StatusBadRequest,
+		"/public/cats/a.jpg": http.StatusBadRequest,
+	}
+
+	for path, code := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+
+		r.GetObject(rec, req)
+		assert.Equal(t, code, rec.Code, path)
+
+		if code == http.StatusOK {
+			assert.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+			assert.Equal(t, "meow", rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+
+	// register the decoders for the supported image types
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// the size of the grid an image is reduced to when it is hashed. each row has
+	// one more column than the number of bits it contributes to the hash, as each
+	// bit compares the brightness of adjacent columns
+	hashWidth  = 9
+	hashHeight = 8
+	// the maximum number of pixels sampled in each direction of a grid cell
+	hashSamples = 16
+	// the maximum number of pixels in an image that will be decoded to hash it
+	maxHashPixels = 40 << 20
+)
+
+// PerceptualHash computes a difference hash (dHash) of an image, returned as 16
+// hex characters. Images that look alike have hashes that differ by only a few
+// bits, even if they have been resized or re-encoded. The first frame of an
+// animated GIF is hashed. Images with more than maxHashPixels pixels are not
+// decoded, as small files can describe images that are too large to hold in memory
+func PerceptualHash(r io.Reader) (string, error) {
+	// keep the header read when checking the image's size, so
+	// the image can be decoded without reading the data again
+	var header bytes.Buffer
+
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if cfg.Width*cfg.Height > maxHashPixels {
+		return "", fmt.Errorf("failed to decode image: image has more than %d pixels", maxHashPixels)
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	b := img.Bounds()
+
+	if b.Dx() < 1 || b.Dy() < 1 {
+		return "", fmt.Errorf("failed to decode image: image is empty")
+	}
+
+	// reduce the image to a small grid of the average brightness of each cell
+	var grid [hashHeight][hashWidth]uint64
+
+	for y := 0; y < hashHeight; y++ {
+		y0 := b.Min.Y + y*b.Dy()/hashHeight
+		y1 := b.Min.Y + (y+1)*b.Dy()/hashHeight
+
+		for x := 0; x < hashWidth; x++ {
+			x0 := b.Min.X + x*b.Dx()/hashWidth
+			x1 := b.Min.X + (x+1)*b.Dx()/hashWidth
+
+			grid[y][x] = brightness(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+
+			if grid[y][x] < grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// brightness returns the average brightness of a region of an image, sampling
+// no more than hashSamples pixels in each direction so large images are fast
+// to hash. Regions smaller than a pixel are sampled from their nearest pixel
+func brightness(img image.Image, x0, y0, x1, y1 int) uint64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+
+	stepX := (x1 - x0 + hashSamples - 1) / hashSamples
+	stepY := (y1 - y0 + hashSamples - 1) / hashSamples
+
+	var total, samples uint64
+
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+
+			// the same weights used by color.GrayModel
+			total += (19595*uint64(r) + 38470*uint64(g) + 7471*uint64(b) + 1<<15) >> 16
+			samples++
+		}
+	}
+
+	return total / samples
+}
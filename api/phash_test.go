@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPicture draws a picture of a sun over some hills at the specified
+// size, so the same picture can be rendered at different resolutions
+func testPicture(width, height int, sun color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx := float64(x) / float64(width)
+			fy := float64(y) / float64(height)
+
+			c := color.RGBA{R: uint8(100*fy + 120*fx), G: uint8(150 * fy), B: uint8(255 - 100*fx), A: 255}
+
+			dx, dy := fx-0.7, fy-0.25
+
+			switch {
+			case dx*dx+dy*dy < 0.02:
+				r, g, b, _ := sun.RGBA()
+				c = color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: 255}
+			case fy > 0.6+0.15*(fx-0.5)*(fx-0.5)*4:
+				c = color.RGBA{R: 30, G: uint8(120 + 60*fx), B: 40, A: 255}
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func testPNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T, img image.Image, quality int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}))
+	return buf.Bytes()
+}
+
+func hashDistance(t *testing.T, a, b string) int {
+	ha, err := strconv.ParseUint(a, 16, 64)
+	require.NoError(t, err)
+
+	hb, err := strconv.ParseUint(b, 16, 64)
+	require.NoError(t, err)
+
+	return bits.OnesCount64(ha ^ hb)
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := testPicture(640, 480, color.RGBA{R: 255, G: 220, A: 255})
+
+	hash, err := PerceptualHash(bytes.NewReader(testPNG(t, original)))
+	require.NoError(t, err)
+	assert.Len(t, hash, 16)
+
+	var gifData bytes.Buffer
+	require.NoError(t, gif.Encode(&gifData, original, nil))
+
+	copies := map[string][]byte{
+		"re-encoded": testJPEG(t, original, 40),
+		"resized":    testPNG(t, testPicture(160, 120, color.RGBA{R: 255, G: 220, A: 255})),
+		"stretched":  testJPEG(t, testPicture(1000, 400, color.RGBA{R: 255, G: 220, A: 255}), 80),
+		"gif":        gifData.Bytes(),
+	}
+
+	for name, data := range copies {
+		h, err := PerceptualHash(bytes.NewReader(data))
+		require.NoError(t, err, name)
+		assert.LessOrEqual(t, hashDistance(t, hash, h), 6, name)
+	}
+
+	// a different picture is not similar
+	h, err := PerceptualHash(bytes.NewReader(testPNG(t, upsideDown(original))))
+	require.NoError(t, err)
+	assert.Greater(t, hashDistance(t, hash, h), defaultMaxDistance)
+
+	_, err = PerceptualHash(bytes.NewReader([]byte("not an image")))
+	assert.Error(t, err)
+}
+
+func TestPerceptualHashTooLarge(t *testing.T) {
+	data := testPNG(t, testPicture(16, 16, color.RGBA{R: 255, G: 220, A: 255}))
+
+	// declare a 30000x30000 image in the IHDR chunk, which follows the
+	// signature and the chunk's length and type, and update its checksum
+	binary.BigEndian.PutUint32(data[16:], 30000)
+	binary.BigEndian.PutUint32(data[20:], 30000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 30000, cfg.Width)
+
+	_, err = PerceptualHash(bytes.NewReader(data))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pixels")
+}
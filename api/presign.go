@@ -0,0 +1,547 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultUploadURLExpiry the default time an upload url can be used for
+	DefaultUploadURLExpiry = 15 * time.Minute
+	// MaxUploadURLExpiry the maximum time an upload url can be used for
+	MaxUploadURLExpiry = 24 * time.Hour
+	// UploadURLPath the path that images are uploaded to with an upload url
+	UploadURLPath = "/upload"
+	// how often used upload urls that have expired are forgotten
+	uploadURLExpireInterval = time.Minute
+)
+
+var (
+	errUploadURLsUnsupported = newRequestError(
+		codes.Unimplemented,
+		catly.ErrorReason_ReasonUnknown,
+		"upload urls are not supported by this server",
+	)
+	errUploadURLInvalid = errors.New("upload url is invalid")
+	errUploadURLExpired = errors.New("upload url has expired")
+	errUploadURLUsed    = errors.New("upload url has already been used")
+	errUploadURLInUse   = errors.New("upload url is already being used")
+)
+
+// WithUploadURLs allows signed urls to be created, which can be
+// used once to upload an image over http without a token
+func WithUploadURLs(signer *UploadSigner) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.signer = signer
+	}
+}
+
+// NonceStorage specifies the interface for recording the nonces
+// of upload urls that have been used, so they cannot be used again
+type NonceStorage interface {
+	Used(nonce string, expires time.Time) (bool, error)
+	Use(nonce string, expires time.Time) error
+	Expire(now time.Time) (int, error)
+}
+
+// UploadSignerOption configures optional behaviour of the upload signer
+type UploadSignerOption func(s *UploadSigner)
+
+// WithUsedNonces records the upload urls that have been used in storage,
+// so that they cannot be used again after the server is restarted
+func WithUsedNonces(nonces NonceStorage) UploadSignerOption {
+	return func(s *UploadSigner) {
+		s.nonces = nonces
+	}
+}
+
+// UploadSigner signs and verifies upload urls, and records the urls that
+// have been used so that each can only be used once. Used urls are held in
+// memory until they expire, and in storage if it is set, otherwise a url that
+// is used before the server is restarted can be used again after it is
+// restarted. Urls are bound to the name of an image, so an image cannot be
+// overwritten by reusing a url
+type UploadSigner struct {
+	key    []byte
+	nonces NonceStorage
+	mu     sync.Mutex
+	// the nonces of urls that have been used or are being used, and when they expire
+	used map[string]*usedNonce
+	now  func() time.Time
+}
+
+type usedNonce struct {
+	expires  time.Time
+	complete bool
+}
+
+// uploadGrant the upload that an upload url allows
+type uploadGrant struct {
+	name         string
+	bucket       string
+	maxSize      int64
+	contentTypes []string
+	owner        string
+	expires      time.Time
+	nonce        string
+}
+
+// NewUploadSigner creates a new upload signer that signs urls with the key
+func NewUploadSigner(key []byte, opts ...UploadSignerOption) *UploadSigner {
+	s := &UploadSigner{
+		key:  key,
+		used: make(map[string]*usedNonce),
+		now:  time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Run periodically removes the used urls that have expired from storage
+func (s *UploadSigner) Run(ctx context.Context) {
+	if s.nonces == nil {
+		return
+	}
+
+	ticker := time.NewTicker(uploadURLExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := s.nonces.Expire(s.now())
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("failed to remove expired upload urls: %s", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sign returns the signed query parameters of an upload url
+func (s *UploadSigner) sign(g *uploadGrant) url.Values {
+	v := url.Values{}
+
+	v.Set("name", g.name)
+	v.Set("expires", strconv.FormatInt(g.expires.Unix(), 10))
+	v.Set("nonce", g.nonce)
+
+	if g.bucket != "" {
+		v.Set("bucket", g.bucket)
+	}
+
+	if g.maxSize > 0 {
+		v.Set("max_size", strconv.FormatInt(g.maxSize, 10))
+	}
+
+	if len(g.contentTypes) > 0 {
+		v.Set("types", strings.Join(g.contentTypes, ","))
+	}
+
+	if g.owner != "" {
+		v.Set("owner", g.owner)
+	}
+
+	v.Set("signature", s.signature(v))
+
+	return v
+}
+
+// verify checks the signature of an upload url's query
+// parameters, returning the upload it allows
+func (s *UploadSigner) verify(v url.Values) (*uploadGrant, error) {
+	signature, err := hex.DecodeString(v.Get("signature"))
+	if err != nil {
+		return nil, errUploadURLInvalid
+	}
+
+	expected, _ := hex.DecodeString(s.signature(v))
+
+	if !hmac.Equal(signature, expected) {
+		return nil, errUploadURLInvalid
+	}
+
+	expires, err := strconv.ParseInt(v.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, errUploadURLInvalid
+	}
+
+	g := &uploadGrant{
+		name:    v.Get("name"),
+		bucket:  v.Get("bucket"),
+		owner:   v.Get("owner"),
+		expires: time.Unix(expires, 0),
+		nonce:   v.Get("nonce"),
+	}
+
+	if s.now().After(g.expires) {
+		return nil, errUploadURLExpired
+	}
+
+	if ms := v.Get("max_size"); ms != "" {
+		g.maxSize, err = strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			return nil, errUploadURLInvalid
+		}
+	}
+
+	if types := v.Get("types"); types != "" {
+		g.contentTypes = strings.Split(types, ",")
+	}
+
+	return g, nil
+}
+
+// signature returns the hex encoded HMAC-SHA256 of the query parameters,
+// excluding the signature. Parameters are encoded in key order, so the
+// same parameters always have the same signature
+func (s *UploadSigner) signature(v url.Values) string {
+	unsigned := url.Values{}
+
+	for key, values := range v {
+		if key != "signature" {
+			unsigned[key] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(unsigned.Encode()))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// claim marks an upload url as being used, failing if it
+// has already been used or is being used by another request
+func (s *UploadSigner) claim(g *uploadGrant) error {
+	s.mu.Lock()
+
+	now := s.now()
+
+	// forget urls that have expired, as they can no longer be used
+	for nonce, u := range s.used {
+		if now.After(u.expires) {
+			delete(s.used, nonce)
+		}
+	}
+
+	u, ok := s.used[g.nonce]
+	if ok {
+		s.mu.Unlock()
+
+		if u.complete {
+			return errUploadURLUsed
+		}
+
+		return errUploadURLInUse
+	}
+
+	u = &usedNonce{expires: g.expires}
+	s.used[g.nonce] = u
+
+	s.mu.Unlock()
+
+	if s.nonces == nil {
+		return nil
+	}
+
+	// the url may have been used before the server was restarted
+	used, err := s.nonces.Used(g.nonce, g.expires)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err != nil:
+		delete(s.used, g.nonce)
+		return err
+	case used:
+		u.complete = true
+		return errUploadURLUsed
+	}
+
+	return nil
+}
+
+// release marks an upload url as used if the upload succeeded,
+// or allows it to be used again if the upload failed
+func (s *UploadSigner) release(g *uploadGrant, uploaded bool) {
+	if uploaded && s.nonces != nil {
+		err := s.nonces.Use(g.nonce, g.expires)
+		if err != nil {
+			log.Error().Str("nonce", g.nonce).Msg(fmt.Sprintf("failed to record used upload url: %s", err.Error()))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !uploaded {
+		delete(s.used, g.nonce)
+		return
+	}
+
+	if u, ok := s.used[g.nonce]; ok {
+		u.complete = true
+	}
+}
+
+// CreateUploadURL handles requests to create a signed url that an image can be uploaded to
+func (rs *GRPCResource) CreateUploadURL(ctx context.Context, req *catly.CreateUploadURLRequest) (*catly.CreateUploadURLResponse, error) {
+	if rs.signer == nil {
+		return nil, errUploadURLsUnsupported.err()
+	}
+
+	bucket, id, rerr := rs.object(req.Bucket, req.Name)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	maxSize := int64(rs.maxSize(bucket))
+
+	if req.MaxSize < 0 || (maxSize > 0 && req.MaxSize > maxSize) {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonObjectTooLarge,
+			fmt.Sprintf("max size should be between 0 and %d bytes", maxSize),
+		).err()
+	}
+
+	if req.MaxSize > 0 {
+		maxSize = req.MaxSize
+	}
+
+	for _, ct := range req.ContentTypes {
+		if !contains(supportedTypes, ct) || (bucket != nil && len(bucket.AllowedTypes) > 0 && !contains(bucket.AllowedTypes, ct)) {
+			return nil, newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonUnsupportedContent,
+				fmt.Sprintf("content type '%s' is not supported", ct),
+			).err()
+		}
+	}
+
+	expiresIn := time.Duration(req.ExpiresIn) * time.Second
+
+	if expiresIn == 0 {
+		expiresIn = DefaultUploadURLExpiry
+	}
+
+	if expiresIn < 0 || expiresIn > MaxUploadURLExpiry {
+		return nil, newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonUnknown,
+			fmt.Sprintf("expires in should be between 1 and %d seconds", int(MaxUploadURLExpiry/time.Second)),
+		).err()
+	}
+
+	// fail early if the name is in use, as the url could never be used
+	_, err := rs.storage.StatObject(id)
+	if err == nil {
+		return nil, storageError(storage.ErrFileExists).err()
+	}
+
+	g := &uploadGrant{
+		name:         req.Name,
+		bucket:       req.Bucket,
+		maxSize:      maxSize,
+		contentTypes: req.ContentTypes,
+		expires:      rs.signer.now().Add(expiresIn).Truncate(time.Second),
+		nonce:        uuid.New().String(),
+	}
+
+	g.owner, _ = PrincipalFromContext(ctx)
+
+	return &catly.CreateUploadURLResponse{
+		Url:     rs.address + strings.TrimPrefix(UploadURLPath, "/") + "?" + rs.signer.sign(g).Encode(),
+		Expires: g.expires.Unix(),
+	}, nil
+}
+
+// UploadURLResource handles uploads to signed upload urls over HTTP,
+// which allow browsers to upload images directly to the server
+type UploadURLResource struct {
+	objects *GRPCResource
+}
+
+// NewUploadURLResource creates a new handler for uploads to signed upload
+// urls. Uploaded images are validated and stored by the gRPC object service
+func NewUploadURLResource(objects *GRPCResource) *UploadURLResource {
+	return &UploadURLResource{
+		objects: objects,
+	}
+}
+
+// ServeHTTP handles PUT requests with the image as the body, or POST requests
+// with the image as the body or the first file of a multipart form
+func (u *UploadURLResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the signature authorises the upload, so any site can upload to the url
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "PUT, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPut, http.MethodPost:
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rs := u.objects
+
+	if rs.signer == nil {
+		httpError(w, http.StatusNotFound, "upload urls are not supported")
+		return
+	}
+
+	g, err := rs.signer.verify(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	err = rs.signer.claim(g)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUploadURLUsed):
+			httpError(w, http.StatusGone, err.Error())
+		case errors.Is(err, errUploadURLInUse):
+			httpError(w, http.StatusConflict, err.Error())
+		default:
+			requestErrorHTTP(w, r, storageError(err))
+		}
+
+		return
+	}
+
+	url, rerr := u.upload(r, g)
+
+	rs.signer.release(g, rerr == nil)
+
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	log.Info().
+		Str("file", storage.ObjectID(g.bucket, g.name)).
+		Str("owner", g.owner).
+		Msg("image uploaded with upload url")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": url,
+	})
+}
+
+// upload reads the image from the request, checks it is allowed by
+// the upload url and uploads it as if it had been uploaded over gRPC
+func (u *UploadURLResource) upload(r *http.Request, g *uploadGrant) (string, *requestError) {
+	rs := u.objects
+
+	body, _, rerr := uploadBody(r)
+	if rerr != nil {
+		return "", rerr
+	}
+
+	var lr io.Reader = body
+
+	// read one more byte than the maximum size, to detect images that are too large
+	if g.maxSize > 0 {
+		lr = io.LimitReader(body, g.maxSize+1)
+	}
+
+	data, err := io.ReadAll(lr)
+	if err != nil {
+		return "", newRequestError(codes.InvalidArgument, catly.ErrorReason_ReasonNoData, "failed to read upload: "+err.Error())
+	}
+
+	if g.maxSize > 0 && int64(len(data)) > g.maxSize {
+		return "", errTooLarge(int(g.maxSize))
+	}
+
+	if len(g.contentTypes) > 0 && len(data) > 0 {
+		mt := rs.contentDetector(data)
+
+		if !contains(g.contentTypes, mt) {
+			return "", newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonUnsupportedContent,
+				fmt.Sprintf("uploaded image content of '%s' is not allowed by the upload url", mt),
+			)
+		}
+	}
+
+	ctx := r.Context()
+
+	// the image is owned by the principal that created the url
+	if g.owner != "" {
+		ctx = ContextWithPrincipal(ctx, g.owner)
+	}
+
+	resp, err := rs.Upload(ctx, &catly.UploadObjectRequest{
+		Name:   g.name,
+		Bucket: g.bucket,
+		Data:   data,
+	})
+
+	if err != nil {
+		return "", statusError(err)
+	}
+
+	return resp.Url, nil
+}
+
+// uploadBody returns the image sent with a request, which is either the body of
+// the request or the first file of a multipart form, along with the file's name
+func uploadBody(r *http.Request) (io.Reader, string, *requestError) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		return r.Body, "", nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", newRequestError(codes.InvalidArgument, catly.ErrorReason_ReasonNoData, "multipart form is invalid")
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, "", errNoData
+		}
+
+		if part.FileName() != "" {
+			return part, part.FileName(), nil
+		}
+	}
+}
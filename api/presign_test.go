@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func testUploadURLServer(t *testing.T, opts ...GRPCOption) (*httptest.Server, *GRPCResource, *storage.MemoryStore) {
+	m := storage.NewMemoryStore()
+	x := storage.NewIndex(m)
+
+	rs := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		append([]GRPCOption{
+			WithMaxObjectSize(1 << 20),
+			WithBuckets(storage.NewBuckets(m)),
+			WithIndex(x),
+		}, opts...)...,
+	)
+
+	return httptest.NewServer(NewUploadURLResource(rs)), rs, m
+}
+
+// uploadTo uploads to the path and query of an upload url on the test server
+func uploadTo(t *testing.T, s *httptest.Server, uploadURL, contentType string, body []byte) *http.Response {
+	u, err := url.Parse(uploadURL)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPut, s.URL+u.RequestURI(), bytes.NewReader(body))
+	require.NoError(t, err)
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestUploadURL(t *testing.T) {
+	signer := NewUploadSigner([]byte("s3cr3t"))
+
+	s, rs, m := testUploadURLServer(t, WithUploadURLs(signer))
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	ctx := ContextWithPrincipal(context.Background(), "team-cats")
+
+	resp, err := rs.CreateUploadURL(ctx, &catly.CreateUploadURLRequest{
+		Name:         "cat.png",
+		ContentTypes: []string{"image/png"},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp.Url, "http://127.0.0.1:8080/upload?"))
+	assert.InDelta(t, time.Now().Add(DefaultUploadURLExpiry).Unix(), resp.Expires, 2)
+
+	// the signature is checked before the upload is accepted
+	tampered := strings.Replace(resp.Url, "cat.png", "dog.png", 1)
+
+	hr := uploadTo(t, s, tampered, "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusForbidden, hr.StatusCode)
+
+	hr = uploadTo(t, s, resp.Url, "", img)
+	require.Equal(t, http.StatusCreated, hr.StatusCode)
+	assert.Equal(t, "*", hr.Header.Get("Access-Control-Allow-Origin"))
+
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(hr.Body).Decode(&body))
+	hr.Body.Close()
+	assert.Equal(t, "http://127.0.0.1:8080/cat.png", body["url"])
+
+	info, err := m.StatObject("cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img)), info.Size)
+
+	// the image is owned by the principal that created the url
+	md, err := rs.index.Metadata("cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, "team-cats", md.Owner)
+
+	// urls can only be used once
+	hr = uploadTo(t, s, resp.Url, "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusGone, hr.StatusCode)
+
+	// names that are in use cannot be signed
+	_, err = rs.CreateUploadURL(ctx, &catly.CreateUploadURLRequest{Name: "cat.png"})
+	assertReason(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonObjectExists)
+
+	// urls cannot be used after they expire
+	resp, err = rs.CreateUploadURL(ctx, &catly.CreateUploadURLRequest{
+		Name:      "dog.png",
+		ExpiresIn: 60,
+	})
+	require.NoError(t, err)
+
+	signer.now = func() time.Time {
+		return time.Now().Add(2 * time.Minute)
+	}
+
+	hr = uploadTo(t, s, resp.Url, "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusForbidden, hr.StatusCode)
+
+	// urls signed with a different key are rejected
+	other := NewUploadSigner([]byte("w00f"))
+	g := &uploadGrant{name: "dog.png", expires: time.Now().Add(time.Hour), nonce: "meow"}
+
+	hr = uploadTo(t, s, "http://127.0.0.1:8080/upload?"+other.sign(g).Encode(), "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusForbidden, hr.StatusCode)
+}
+
+func TestUploadURLRestart(t *testing.T) {
+	nonces := storage.NewMemoryStore()
+
+	signer := NewUploadSigner([]byte("s3cr3t"), WithUsedNonces(storage.NewNonces(nonces)))
+
+	s, rs, m := testUploadURLServer(t, WithUploadURLs(signer))
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	resp, err := rs.CreateUploadURL(context.Background(), &catly.CreateUploadURLRequest{Name: "cat.png"})
+	require.NoError(t, err)
+
+	hr := uploadTo(t, s, resp.Url, "", img)
+	hr.Body.Close()
+	require.Equal(t, http.StatusCreated, hr.StatusCode)
+
+	// the image is removed, so the url could replace it if it was not recorded
+	require.NoError(t, m.DeleteObject("cat.png"))
+
+	// a new signer with the same storage, as if the server had restarted
+	rs.signer = NewUploadSigner([]byte("s3cr3t"), WithUsedNonces(storage.NewNonces(nonces)))
+
+	hr = uploadTo(t, s, resp.Url, "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusGone, hr.StatusCode)
+
+	_, err = m.StatObject("cat.png")
+	assert.ErrorIs(t, err, storage.ErrFileDoesNotExist)
+}
+
+func TestUploadURLLimits(t *testing.T) {
+	s, rs, m := testUploadURLServer(t, WithUploadURLs(NewUploadSigner([]byte("s3cr3t"))))
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	resp, err := rs.CreateUploadURL(context.Background(), &catly.CreateUploadURLRequest{
+		Name:         "cat.png",
+		MaxSize:      int64(len(img)),
+		ContentTypes: []string{"image/jpeg"},
+	})
+	require.NoError(t, err)
+
+	hr := uploadTo(t, s, resp.Url, "", append(img, 0))
+	hr.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, hr.StatusCode)
+	assert.Equal(t, "ReasonObjectTooLarge", hr.Header.Get("X-Catly-Reason"))
+
+	hr = uploadTo(t, s, resp.Url, "", img)
+	hr.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, hr.StatusCode)
+	assert.Equal(t, "ReasonUnsupportedContent", hr.Header.Get("X-Catly-Reason"))
+
+	_, err = m.StatObject("cat.png")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	// failed uploads do not use the url, so images can be uploaded from a multipart form
+	resp, err = rs.CreateUploadURL(context.Background(), &catly.CreateUploadURLRequest{
+		Name:         "cat.png",
+		ContentTypes: []string{"image/png"},
+	})
+	require.NoError(t, err)
+
+	var form bytes.Buffer
+
+	mw := multipart.NewWriter(&form)
+	require.NoError(t, mw.WriteField("caption", "meow"))
+
+	fw, err := mw.CreateFormFile("image", "cat.png")
+	require.NoError(t, err)
+
+	_, err = fw.Write(img)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	hr = uploadTo(t, s, resp.Url, "text/plain", []byte("<html></html>"))
+	hr.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, hr.StatusCode)
+
+	hr = uploadTo(t, s, resp.Url, mw.FormDataContentType(), form.Bytes())
+	hr.Body.Close()
+	assert.Equal(t, http.StatusCreated, hr.StatusCode)
+
+	info, err := m.StatObject("cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img)), info.Size)
+}
+
+func TestCreateUploadURLInvalid(t *testing.T) {
+	_, rs, _ := testUploadURLServer(t)
+
+	_, err := rs.CreateUploadURL(context.Background(), &catly.CreateUploadURLRequest{Name: "cat.png"})
+	assertReason(t, err, codes.Unimplemented, catly.ErrorReason_ReasonUnknown)
+
+	s, rs, _ := testUploadURLServer(t, WithUploadURLs(NewUploadSigner([]byte("s3cr3t"))))
+	defer s.Close()
+
+	cases := []struct {
+		req    *catly.CreateUploadURLRequest
+		code   codes.Code
+		reason catly.ErrorReason
+	}{
+		{&catly.CreateUploadURLRequest{}, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidName},
+		{&catly.CreateUploadURLRequest{Name: "cat.png", Bucket: "missing"}, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound},
+		{&catly.CreateUploadURLRequest{Name: "cat.png", MaxSize: 2 << 20}, codes.InvalidArgument, catly.ErrorReason_ReasonObjectTooLarge},
+		{&catly.CreateUploadURLRequest{Name: "cat.png", MaxSize: -1}, codes.InvalidArgument, catly.ErrorReason_ReasonObjectTooLarge},
+		{&catly.CreateUploadURLRequest{Name: "cat.png", ContentTypes: []string{"text/html"}}, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent},
+		{&catly.CreateUploadURLRequest{Name: "cat.png", ExpiresIn: 48 * 60 * 60}, codes.InvalidArgument, catly.ErrorReason_ReasonUnknown},
+	}
+
+	for _, c := range cases {
+		_, err := rs.CreateUploadURL(context.Background(), c.req)
+		assertReason(t, err, c.code, c.reason)
+	}
+}
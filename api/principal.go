@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc/peer"
+)
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns a copy of the context that
+// carries the authenticated principal making the request
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the authenticated principal
+// stored in the context, if there is one
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	p, ok := ctx.Value(principalKey{}).(string)
+	return p, ok && p != ""
+}
+
+// grpcClientKey identifies the client making a gRPC request.
+// authenticated principals are preferred, falling back to the
+// ip address of the peer
+func grpcClientKey(ctx context.Context) string {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return "principal:" + p
+	}
+
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == nil {
+		return "ip:unknown"
+	}
+
+	return "ip:" + hostFromAddr(pr.Addr.String())
+}
+
+// httpClientKey identifies the client making a HTTP request.
+// authenticated principals are preferred, falling back to the
+// ip address of the remote connection
+func httpClientKey(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return "principal:" + p
+	}
+
+	return "ip:" + hostFromAddr(r.RemoteAddr)
+}
+
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how often idle clients are removed from the limiter
+	rateLimitSweepInterval = time.Minute
+	// how long a client must be idle before it is removed
+	rateLimitIdleTimeout = 10 * time.Minute
+)
+
+// RateLimits specifies the limits that are applied to each client.
+// A limit with a value of zero is disabled
+type RateLimits struct {
+	// RequestsPerSecond the sustained rate of requests a client can make
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// RequestBurst the number of requests a client can make in a burst.
+	// Defaults to the requests per second if not set
+	RequestBurst int `json:"request_burst"`
+	// UploadBytesPerSecond the sustained rate of bytes a client can upload
+	UploadBytesPerSecond int64 `json:"upload_bytes_per_second"`
+	// UploadBurstBytes the number of bytes a client can upload in a burst.
+	// Defaults to the upload bytes per second if not set
+	UploadBurstBytes int64 `json:"upload_burst_bytes"`
+	// MaxConcurrentUploads the number of uploads a client can have in flight
+	MaxConcurrentUploads int `json:"max_concurrent_uploads"`
+}
+
+// RateLimiter applies per client rate and concurrency limits to
+// gRPC and HTTP requests. Clients are identified by their authenticated
+// principal, or by their ip address if they are unauthenticated
+type RateLimiter struct {
+	mu        sync.Mutex
+	limits    RateLimits
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type clientLimiter struct {
+	requests tokenBucket
+	bytes    tokenBucket
+	uploads  int
+	seen     time.Time
+}
+
+// rateLimitError is returned when a client has exceeded one of its limits
+type rateLimitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %s", e.reason)
+}
+
+// retryAfterSeconds the number of seconds a client should wait, rounded up
+func (e *rateLimitError) retryAfterSeconds() string {
+	s := int(math.Ceil(e.retryAfter.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+
+	return strconv.Itoa(s)
+}
+
+// NewRateLimiter creates a new rate limiter with the given limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		clients: make(map[string]*clientLimiter),
+		now:     time.Now,
+	}
+}
+
+// Limits returns the limits currently being applied
+func (l *RateLimiter) Limits() RateLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limits
+}
+
+// SetLimits replaces the limits applied to all clients. The state
+// of existing clients is preserved, so this can be safely called
+// while the server is handling requests
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+}
+
+// admit checks that a client's request is within its limits. Uploads are
+// additionally counted against the client's upload byte rate and concurrent
+// upload limits, and must call the returned release function once completed
+func (l *RateLimiter) admit(key string, upload bool, size int64) (func(), *rateLimitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	c := l.client(key, now)
+
+	// check the concurrency limit first, as it does not consume any tokens
+	if upload && l.limits.MaxConcurrentUploads > 0 && c.uploads >= l.limits.MaxConcurrentUploads {
+		return nil, &rateLimitError{
+			reason:     "too many concurrent uploads",
+			retryAfter: time.Second,
+		}
+	}
+
+	if l.limits.RequestsPerSecond > 0 {
+		burst := float64(l.limits.RequestBurst)
+		if burst <= 0 {
+			burst = math.Max(l.limits.RequestsPerSecond, 1)
+		}
+
+		wait, ok := c.requests.take(now, l.limits.RequestsPerSecond, burst, 1)
+		if !ok {
+			return nil, &rateLimitError{
+				reason:     "too many requests",
+				retryAfter: wait,
+			}
+		}
+	}
+
+	if !upload {
+		return func() {}, nil
+	}
+
+	rerr := l.takeBytes(c, now, size)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	c.uploads++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			c.uploads--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// admitBytes counts data received from a streamed
+// upload against the client's upload byte rate
+func (l *RateLimiter) admitBytes(key string, size int64) *rateLimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	return l.takeBytes(l.client(key, now), now, size)
+}
+
+// takeBytes takes tokens from a client's upload byte bucket. This
+// must be called while holding the limiter's lock
+func (l *RateLimiter) takeBytes(c *clientLimiter, now time.Time, size int64) *rateLimitError {
+	if l.limits.UploadBytesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := float64(l.limits.UploadBurstBytes)
+	if burst <= 0 {
+		burst = float64(l.limits.UploadBytesPerSecond)
+	}
+
+	wait, ok := c.bytes.take(now, float64(l.limits.UploadBytesPerSecond), burst, float64(size))
+	if !ok {
+		return &rateLimitError{
+			reason:     "upload bandwidth exceeded",
+			retryAfter: wait,
+		}
+	}
+
+	return nil
+}
+
+// client returns the state of a client, creating it if it does
+// not exist. This must be called while holding the limiter's lock
+func (l *RateLimiter) client(key string, now time.Time) *clientLimiter {
+	l.sweep(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{}
+		l.clients[key] = c
+	}
+
+	c.seen = now
+
+	return c
+}
+
+// sweep removes any idle clients from the limiter. This must
+// be called while holding the limiter's lock
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for k, c := range l.clients {
+		if c.uploads == 0 && now.Sub(c.seen) > rateLimitIdleTimeout {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that rejects
+// requests from clients that have exceeded their limits
+func (l *RateLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		upload, size := uploadSize(req)
+
+		key := grpcClientKey(ctx)
+
+		release, rerr := l.admit(key, upload, size)
+		if rerr != nil {
+			log.Warn().
+				Str("client", key).
+				Str("method", info.FullMethod).
+				Str("error", rerr.Error()).
+				Msg("request rate limited")
+
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", rerr.retryAfterSeconds()))
+
+			return nil, status.Error(codes.ResourceExhausted, rerr.Error())
+		}
+
+		defer release()
+
+		// the size of images fetched from a url is only known once they have
+		// been fetched, so they are counted against the upload byte rate then
+		if _, ok := req.(*catly.UploadFromURLRequest); ok {
+			ctx = context.WithValue(ctx, uploadLimitKey{}, func(size int64) error {
+				rerr := l.admitBytes(key, size)
+				if rerr == nil {
+					return nil
+				}
+
+				log.Warn().
+					Str("client", key).
+					Str("method", info.FullMethod).
+					Str("error", rerr.Error()).
+					Msg("request rate limited")
+
+				grpc.SetHeader(ctx, metadata.Pairs("retry-after", rerr.retryAfterSeconds()))
+
+				return status.Error(codes.ResourceExhausted, rerr.Error())
+			})
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+type uploadLimitKey struct{}
+
+// admitUpload counts the size of an upload that was not known when the request
+// was admitted against the client's upload byte rate, if the request is limited
+func admitUpload(ctx context.Context, size int64) error {
+	admit, ok := ctx.Value(uploadLimitKey{}).(func(size int64) error)
+	if !ok {
+		return nil
+	}
+
+	return admit(size)
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that rejects streams
+// from clients that have exceeded their limits. Client streams are treated
+// as uploads, with each received chunk counted against the upload byte rate
+func (l *RateLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		key := grpcClientKey(ss.Context())
+
+		release, rerr := l.admit(key, info.IsClientStream, 0)
+		if rerr != nil {
+			log.Warn().
+				Str("client", key).
+				Str("method", info.FullMethod).
+				Str("error", rerr.Error()).
+				Msg("request rate limited")
+
+			ss.SetHeader(metadata.Pairs("retry-after", rerr.retryAfterSeconds()))
+
+			return status.Error(codes.ResourceExhausted, rerr.Error())
+		}
+
+		defer release()
+
+		if info.IsClientStream {
+			ss = &rateLimitedStream{
+				ServerStream: ss,
+				limiter:      l,
+				key:          key,
+			}
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// rateLimitedStream counts uploaded chunks against a client's upload byte rate
+type rateLimitedStream struct {
+	grpc.ServerStream
+	limiter *RateLimiter
+	key     string
+}
+
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+
+	chunk, ok := m.(*catly.UploadObjectChunk)
+	if !ok {
+		return nil
+	}
+
+	rerr := s.limiter.admitBytes(s.key, int64(len(chunk.Data)))
+	if rerr != nil {
+		s.SetHeader(metadata.Pairs("retry-after", rerr.retryAfterSeconds()))
+		return status.Error(codes.ResourceExhausted, rerr.Error())
+	}
+
+	return nil
+}
+
+// Middleware returns a HTTP handler that rejects requests from
+// clients that have exceeded their limits
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload := r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch
+
+		size := r.ContentLength
+		if size < 0 {
+			size = 0
+		}
+
+		key := httpClientKey(r)
+
+		release, rerr := l.admit(key, upload, size)
+		if rerr != nil {
+			log.Warn().
+				Str("client", key).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Str("error", rerr.Error()).
+				Msg("request rate limited")
+
+			w.Header().Set("Retry-After", rerr.retryAfterSeconds())
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("too many requests"))
+			return
+		}
+
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadSize determines if a gRPC request is an upload and the size of its data.
+// Uploads from a url are admitted with a size of zero, as their size is not known
+func uploadSize(req interface{}) (bool, int64) {
+	switch r := req.(type) {
+	case *catly.UploadObjectRequest:
+		return true, int64(len(r.Data))
+	case *catly.UploadFromURLRequest:
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// tokenBucket a simple token bucket that is refilled lazily
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take attempts to remove n tokens from the bucket, returning how long the
+// caller should wait if there are not enough available. Requests that are
+// larger than the bucket's burst are allowed once the bucket is full, which
+// will leave the bucket in debt until it has been refilled
+func (b *tokenBucket) take(now time.Time, rate, burst, n float64) (time.Duration, bool) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*rate, burst)
+	}
+
+	b.last = now
+
+	need := math.Min(n, burst)
+
+	if b.tokens < need {
+		return time.Duration((need - b.tokens) / rate * float64(time.Second)), false
+	}
+
+	b.tokens -= n
+
+	return 0, true
+}
@@ -0,0 +1,393 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func testRateLimitedGRPCServer(t *testing.T, limiter *RateLimiter, opts ...GRPCOption) net.Listener {
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(limiter.UnaryServerInterceptor()),
+	)
+
+	r := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		storage.NewMemoryStore(),
+		opts...,
+	)
+
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	catly.RegisterObjectServer(s, r)
+
+	go s.Serve(listener)
+
+	return listener
+}
+
+func testClock(l *RateLimiter) *time.Time {
+	now := time.Now()
+	l.now = func() time.Time {
+		return now
+	}
+	return &now
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+
+	now := time.Now()
+
+	// bucket starts full
+	_, ok := b.take(now, 1, 2, 1)
+	assert.True(t, ok)
+	_, ok = b.take(now, 1, 2, 1)
+	assert.True(t, ok)
+
+	wait, ok := b.take(now, 1, 2, 1)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// refills over time
+	_, ok = b.take(now.Add(time.Second), 1, 2, 1)
+	assert.True(t, ok)
+
+	// requests larger than the burst are allowed when full
+	_, ok = b.take(now.Add(time.Hour), 1, 2, 10)
+	assert.True(t, ok)
+
+	_, ok = b.take(now.Add(time.Hour+time.Second), 1, 2, 1)
+	assert.False(t, ok)
+}
+
+func TestRateLimiterRequests(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		RequestsPerSecond: 1,
+		RequestBurst:      2,
+	})
+
+	now := testClock(l)
+
+	for i := 0; i < 2; i++ {
+		release, err := l.admit("ip:127.0.0.1", false, 0)
+		require.Nil(t, err)
+		release()
+	}
+
+	_, err := l.admit("ip:127.0.0.1", false, 0)
+	require.NotNil(t, err)
+	assert.Equal(t, "1", err.retryAfterSeconds())
+
+	// other clients are unaffected
+	_, err = l.admit("ip:127.0.0.2", false, 0)
+	require.Nil(t, err)
+
+	*now = now.Add(time.Second)
+
+	_, err = l.admit("ip:127.0.0.1", false, 0)
+	require.Nil(t, err)
+}
+
+func TestRateLimiterUploadBytes(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		UploadBytesPerSecond: 1024,
+	})
+
+	now := testClock(l)
+
+	release, err := l.admit("ip:127.0.0.1", true, 1024)
+	require.Nil(t, err)
+	release()
+
+	_, err = l.admit("ip:127.0.0.1", true, 512)
+	require.NotNil(t, err)
+	assert.Equal(t, 500*time.Millisecond, err.retryAfter)
+
+	*now = now.Add(time.Second / 2)
+
+	release, err = l.admit("ip:127.0.0.1", true, 512)
+	require.Nil(t, err)
+	release()
+}
+
+func TestRateLimiterConcurrentUploads(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		MaxConcurrentUploads: 2,
+	})
+
+	r1, err := l.admit("ip:127.0.0.1", true, 1)
+	require.Nil(t, err)
+	r2, err := l.admit("ip:127.0.0.1", true, 1)
+	require.Nil(t, err)
+
+	_, err = l.admit("ip:127.0.0.1", true, 1)
+	require.NotNil(t, err)
+
+	// non-upload requests are not affected
+	_, err = l.admit("ip:127.0.0.1", false, 0)
+	require.Nil(t, err)
+
+	// releasing multiple times should only count once
+	r1()
+	r1()
+
+	r3, err := l.admit("ip:127.0.0.1", true, 1)
+	require.Nil(t, err)
+
+	_, err = l.admit("ip:127.0.0.1", true, 1)
+	require.NotNil(t, err)
+
+	r2()
+	r3()
+}
+
+func TestRateLimiterSetLimits(t *testing.T) {
+	l := NewRateLimiter(RateLimits{})
+
+	testClock(l)
+
+	for i := 0; i < 10; i++ {
+		_, err := l.admit("ip:127.0.0.1", false, 0)
+		require.Nil(t, err)
+	}
+
+	l.SetLimits(RateLimits{
+		RequestsPerSecond: 1,
+	})
+
+	assert.Equal(t, float64(1), l.Limits().RequestsPerSecond)
+
+	_, err := l.admit("ip:127.0.0.1", false, 0)
+	require.Nil(t, err)
+	_, err = l.admit("ip:127.0.0.1", false, 0)
+	require.NotNil(t, err)
+}
+
+func TestRateLimiterPrincipal(t *testing.T) {
+	ctx := ContextWithPrincipal(context.Background(), "team-cats")
+	assert.Equal(t, "principal:team-cats", grpcClientKey(ctx))
+
+	req, err := http.NewRequest(http.MethodGet, "/cat.jpg", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:4123"
+
+	assert.Equal(t, "ip:10.0.0.1", httpClientKey(req))
+	assert.Equal(t, "principal:team-cats", httpClientKey(req.WithContext(ctx)))
+}
+
+func TestRateLimiterGRPCInterceptor(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		RequestsPerSecond: 1,
+	})
+
+	testClock(l)
+
+	s := testRateLimitedGRPCServer(t, l)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	resp, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat.jpg",
+		Data: data,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, catly.ObjectStatus_ObjectOK, resp.Status)
+
+	var header metadata.MD
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat2.jpg",
+		Data: data,
+	}, grpc.Header(&header))
+
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"1"}, header.Get("retry-after"))
+}
+
+func TestRateLimiterUploadFromURL(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		UploadBytesPerSecond: 1024,
+		MaxConcurrentUploads: 1,
+	})
+
+	testClock(l)
+
+	// uploads from a url count against the concurrent upload limit
+	release, rerr := l.admit("ip:127.0.0.1", true, 0)
+	require.Nil(t, rerr)
+
+	upload, size := uploadSize(&catly.UploadFromURLRequest{Url: "http://127.0.0.1/cat.jpg"})
+	assert.True(t, upload)
+	assert.Zero(t, size)
+
+	_, rerr = l.admit("ip:127.0.0.1", upload, size)
+	require.NotNil(t, rerr)
+
+	release()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	}))
+	defer ts.Close()
+
+	s := testRateLimitedGRPCServer(t, l, WithURLUploads(testFetcher()))
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	_, err := c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url:  ts.URL + "/cat.jpg",
+		Name: "cat.jpg",
+	})
+	require.NoError(t, err)
+
+	// the fetched bytes are counted against the upload byte rate
+	var header metadata.MD
+
+	_, err = c.UploadFromURL(context.Background(), &catly.UploadFromURLRequest{
+		Url:  ts.URL + "/cat.jpg",
+		Name: "cat2.jpg",
+	}, grpc.Header(&header))
+
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"1"}, header.Get("retry-after"))
+}
+
+func TestRateLimiterHTTPMiddleware(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		RequestsPerSecond: 1,
+	})
+
+	testClock(l)
+
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "/cat.jpg", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:4123"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+}
+
+func TestRateLimiterHTTPPrincipals(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		RequestsPerSecond: 1,
+	})
+
+	testClock(l)
+
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+		"w00f":   "team-dogs",
+	})
+
+	h := a.Identify(l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	request := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, "/search", nil)
+		require.NoError(t, err)
+		req.RemoteAddr = "10.0.0.1:4123"
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// principals behind the same address are limited separately
+	assert.Equal(t, http.StatusOK, request("s3cr3t"))
+	assert.Equal(t, http.StatusTooManyRequests, request("s3cr3t"))
+	assert.Equal(t, http.StatusOK, request("w00f"))
+
+	// and separately from unauthenticated requests
+	assert.Equal(t, http.StatusOK, request(""))
+	assert.Equal(t, http.StatusTooManyRequests, request("wrong"))
+}
+
+func TestRateLimiterGRPCStreamInterceptor(t *testing.T) {
+	l := NewRateLimiter(RateLimits{
+		UploadBytesPerSecond: 1024,
+	})
+
+	testClock(l)
+
+	listener, err := net.Listen("tcp", ":8000")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	s := grpc.NewServer(
+		grpc.StreamInterceptor(l.StreamServerInterceptor()),
+	)
+
+	r := NewGRPCResource("http://127.0.0.1:8080/", storage.NewMemoryStore())
+
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	catly.RegisterObjectServer(s, r)
+
+	go s.Serve(listener)
+
+	c := testGRPCClient(t)
+
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = stream.Send(&catly.UploadObjectChunk{
+			Name: "cat.jpg",
+			Data: data,
+		})
+
+		if err != nil {
+			break
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// the limits of the tags and description an image can be uploaded with
+	maxTags           = 32
+	maxTagKeyLen      = 128
+	maxTagValueLen    = 256
+	maxDescriptionLen = 1024
+)
+
+var errSearchUnsupported = newRequestError(
+	codes.Unimplemented,
+	catly.ErrorReason_ReasonUnknown,
+	"search is not supported by this server",
+)
+
+// SearchIndex specifies the interface that a metadata
+// index needs to implement to search for images
+type SearchIndex interface {
+	Search(q *storage.Query) []*storage.Metadata
+}
+
+// MetadataIndex specifies the interface that a metadata index
+// needs to implement to record the metadata of uploaded images
+type MetadataIndex interface {
+	SearchIndex
+	PutMetadata(md *storage.Metadata) error
+	Metadata(id string) (*storage.Metadata, error)
+	DeleteMetadata(id string) error
+	Similar(hash string, maxDistance, limit int, exclude string) ([]*storage.SimilarObject, error)
+}
+
+// WithIndex sets the index that records the tags and metadata
+// of uploaded images, so that images can be searched for
+func WithIndex(index MetadataIndex) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.index = index
+	}
+}
+
+// Search handles requests to search for images by their tags and metadata
+func (rs *GRPCResource) Search(ctx context.Context, req *catly.SearchRequest) (*catly.SearchResponse, error) {
+	if rs.index == nil {
+		return nil, errSearchUnsupported.err()
+	}
+
+	_, rerr := rs.bucket(req.Bucket)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	pageSize := int(req.PageSize)
+
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	q := &storage.Query{
+		Bucket:      req.Bucket,
+		Tags:        req.Tags,
+		Owner:       req.Owner,
+		ContentType: req.ContentType,
+		MinSize:     req.MinSize,
+		MaxSize:     req.MaxSize,
+		After:       req.PageToken,
+		Limit:       pageSize,
+	}
+
+	if req.CreatedAfter > 0 {
+		q.CreatedAfter = time.Unix(req.CreatedAfter, 0)
+	}
+
+	if req.CreatedBefore > 0 {
+		q.CreatedBefore = time.Unix(req.CreatedBefore, 0)
+	}
+
+	results := rs.index.Search(q)
+
+	resp := &catly.SearchResponse{
+		Objects: make([]*catly.ObjectInfo, len(results)),
+	}
+
+	for i, md := range results {
+		resp.Objects[i] = rs.metadataInfo(md)
+	}
+
+	// if the page is full, there may be more objects to find
+	if len(results) == pageSize {
+		resp.NextPageToken = results[len(results)-1].Name
+	}
+
+	return resp, nil
+}
+
+// putMetadata records the metadata of an uploaded image. If the metadata
+// cannot be recorded, the image is deleted so the upload can be retried
+func (rs *GRPCResource) putMetadata(ctx context.Context, id string, tags map[string]string, description, hash string) *requestError {
+	if rs.index == nil {
+		return nil
+	}
+
+	err := rs.indexMetadata(ctx, id, tags, description, hash)
+	if err != nil {
+		derr := rs.storage.DeleteObject(id)
+		if derr != nil {
+			log.Error().Str("file", id).Msg(fmt.Sprintf("failed to delete image without metadata: %s", derr.Error()))
+		}
+
+		return storageError(err)
+	}
+
+	return nil
+}
+
+// indexMetadata adds the metadata of an uploaded image to the index
+func (rs *GRPCResource) indexMetadata(ctx context.Context, id string, tags map[string]string, description, hash string) error {
+	info, err := rs.storage.StatObject(id)
+	if err != nil {
+		return err
+	}
+
+	md := storage.ObjectMetadata(info)
+	md.Owner, _ = PrincipalFromContext(ctx)
+	md.Description = description
+	md.PerceptualHash = hash
+
+	if len(tags) > 0 {
+		md.Tags = tags
+	}
+
+	return rs.index.PutMetadata(md)
+}
+
+// deleteMetadata removes the metadata of a deleted image
+func (rs *GRPCResource) deleteMetadata(id string) {
+	if rs.index == nil {
+		return
+	}
+
+	err := rs.index.DeleteMetadata(id)
+	if err != nil {
+		log.Warn().Str("file", id).Msg(fmt.Sprintf("failed to delete metadata: %s", err.Error()))
+	}
+}
+
+// validateMetadata checks the tags and description of an image are valid
+func validateMetadata(tags map[string]string, description string) *requestError {
+	if len(tags) > maxTags {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidMetadata,
+			fmt.Sprintf("image has more than %d tags", maxTags),
+		)
+	}
+
+	for key, value := range tags {
+		// tags are queried over http as key:value, so keys cannot contain a ':'
+		if len(key) < 1 || len(key) > maxTagKeyLen || strings.ContainsRune(key, ':') {
+			return newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonInvalidMetadata,
+				fmt.Sprintf("tag keys should be between 1 and %d characters, and not contain a ':'", maxTagKeyLen),
+			)
+		}
+
+		if len(value) > maxTagValueLen {
+			return newRequestError(
+				codes.InvalidArgument,
+				catly.ErrorReason_ReasonInvalidMetadata,
+				fmt.Sprintf("tag values should be no more than %d characters", maxTagValueLen),
+			)
+		}
+	}
+
+	if len(description) > maxDescriptionLen {
+		return newRequestError(
+			codes.InvalidArgument,
+			catly.ErrorReason_ReasonInvalidMetadata,
+			fmt.Sprintf("image description should be no more than %d characters", maxDescriptionLen),
+		)
+	}
+
+	return nil
+}
+
+func (rs *GRPCResource) metadataInfo(md *storage.Metadata) *catly.ObjectInfo {
+	bucket, name := storage.SplitObjectID(md.Name)
+
+	return &catly.ObjectInfo{
+		Name:        name,
+		Bucket:      bucket,
+		Size:        md.Size,
+		ContentType: md.ContentType,
+		Created:     md.Created.Unix(),
+		Url:         rs.url(md.Name),
+		Tags:        md.Tags,
+		Description: md.Description,
+		Owner:       md.Owner,
+	}
+}
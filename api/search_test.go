@@ -0,0 +1,217 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSearch(t *testing.T) {
+	s, _ := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	_, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:        "cat.jpg",
+		Data:        []byte("meow"),
+		Tags:        map[string]string{"grumpy": "", "colour": "orange"},
+		Description: "a grumpy cat",
+	})
+	require.NoError(t, err)
+
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	err = stream.Send(&catly.UploadObjectChunk{
+		Name: "kitten.jpg",
+		Data: []byte("mew"),
+		Tags: map[string]string{"colour": "black"},
+	})
+	require.NoError(t, err)
+
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	resp, err := c.Search(context.Background(), &catly.SearchRequest{
+		Tags: map[string]string{"grumpy": ""},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "a grumpy cat", resp.Objects[0].Description)
+	assert.Equal(t, map[string]string{"grumpy": "", "colour": "orange"}, resp.Objects[0].Tags)
+	assert.Equal(t, int64(4), resp.Objects[0].Size)
+	assert.Equal(t, "image/jpeg", resp.Objects[0].ContentType)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", resp.Objects[0].Url)
+	assert.Empty(t, resp.NextPageToken)
+
+	// the tags of an image are included when it is stat'd
+	info, err := c.Stat(context.Background(), &catly.StatObjectRequest{Name: "kitten.jpg"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"colour": "black"}, info.Tags)
+
+	resp, err = c.Search(context.Background(), &catly.SearchRequest{
+		MinSize:      4,
+		CreatedAfter: time.Now().Add(-time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat.jpg", resp.Objects[0].Name)
+
+	// results are paginated
+	resp, err = c.Search(context.Background(), &catly.SearchRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat.jpg", resp.NextPageToken)
+
+	resp, err = c.Search(context.Background(), &catly.SearchRequest{PageSize: 1, PageToken: resp.NextPageToken})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "kitten.jpg", resp.Objects[0].Name)
+
+	// deleted images are removed from the index
+	_, err = c.Delete(context.Background(), &catly.DeleteObjectRequest{Name: "cat.jpg"})
+	require.NoError(t, err)
+
+	resp, err = c.Search(context.Background(), &catly.SearchRequest{Tags: map[string]string{"grumpy": ""}})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Objects)
+
+	_, err = c.Search(context.Background(), &catly.SearchRequest{Bucket: "missing"})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+}
+
+func TestSearchInvalidMetadata(t *testing.T) {
+	s, _ := testGRPCServer(t, 1<<20)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	tooMany := make(map[string]string)
+
+	for i := 0; i <= maxTags; i++ {
+		tooMany[strings.Repeat("a", i+1)] = ""
+	}
+
+	tests := map[string]*catly.UploadObjectRequest{
+		"too many tags":       {Tags: tooMany},
+		"empty key":           {Tags: map[string]string{"": "grumpy"}},
+		"key contains colon":  {Tags: map[string]string{"mood:grumpy": ""}},
+		"key too long":        {Tags: map[string]string{strings.Repeat("a", maxTagKeyLen+1): ""}},
+		"value too long":      {Tags: map[string]string{"mood": strings.Repeat("a", maxTagValueLen+1)}},
+		"description too big": {Description: strings.Repeat("a", maxDescriptionLen+1)},
+	}
+
+	for name, req := range tests {
+		req.Name = "cat.jpg"
+		req.Data = []byte("meow")
+
+		t.Run(name, func(t *testing.T) {
+			_, err := c.Upload(context.Background(), req)
+			assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidMetadata)
+		})
+	}
+}
+
+func TestSearchOwner(t *testing.T) {
+	m := storage.NewMemoryStore()
+	x := storage.NewIndex(m)
+
+	r := NewGRPCResource("http://127.0.0.1:8080/", m, WithIndex(x))
+	r.contentDetector = func(data []byte) string {
+		return "image/jpeg"
+	}
+
+	ctx := ContextWithPrincipal(context.Background(), "team-cats")
+
+	_, err := r.Upload(ctx, &catly.UploadObjectRequest{Name: "cat.jpg", Data: []byte("meow")})
+	require.NoError(t, err)
+
+	_, err = r.Upload(context.Background(), &catly.UploadObjectRequest{Name: "dog.jpg", Data: []byte("woof")})
+	require.NoError(t, err)
+
+	resp, err := r.Search(context.Background(), &catly.SearchRequest{Owner: "team-cats"})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "cat.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "team-cats", resp.Objects[0].Owner)
+}
+
+func TestHTTPSearch(t *testing.T) {
+	m := storage.NewMemoryStore()
+	x := storage.NewIndex(m)
+	buckets := storage.NewBuckets(m)
+
+	r := NewHTTPResource(m, WithPublicBuckets(buckets), WithSearch(x))
+
+	require.NoError(t, buckets.CreateBucket(&storage.Bucket{Name: "public", Visibility: storage.VisibilityPublic}))
+	require.NoError(t, buckets.CreateBucket(&storage.Bucket{Name: "private", Visibility: storage.VisibilityPrivate}))
+
+	for _, id := range []string{"cat.jpg", "private/cat.jpg", "private/kitten.jpg", "public/cat.jpg"} {
+		require.NoError(t, m.WriteObject(id, bytes.NewReader([]byte("meow"))))
+
+		require.NoError(t, x.PutMetadata(&storage.Metadata{
+			Name:        id,
+			Owner:       "team-cats",
+			ContentType: "image/jpeg",
+			Size:        4,
+			Created:     time.Now(),
+			Tags:        map[string]string{"mood": "grumpy"},
+		}))
+	}
+
+	search := func(query string) (int, *searchResponse) {
+		req, err := http.NewRequest(http.MethodGet, "/search?"+query, nil)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+
+		r.Search(rec, req)
+
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var resp searchResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+		return rec.Code, &resp
+	}
+
+	// images in private buckets are not included in the results
+	code, resp := search("tag=mood:grumpy&owner=team-cats&type=image/jpeg&min_size=1&created_after=2006-01-02T15:04:05Z")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Objects, 2)
+	assert.Equal(t, "cat.jpg", resp.Objects[0].Name)
+	assert.Equal(t, "/cat.jpg", resp.Objects[0].URL)
+	assert.Equal(t, "cat.jpg", resp.Objects[1].Name)
+	assert.Equal(t, "public", resp.Objects[1].Bucket)
+	assert.Equal(t, "/public/cat.jpg", resp.Objects[1].URL)
+
+	// pages are filled with the images that can be served
+	code, resp = search("tag=mood&page_size=1&page_token=cat.jpg")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "public/cat.jpg", resp.NextPageToken)
+
+	code, resp = search("tag=mood:happy")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Objects)
+
+	for _, query := range []string{"min_size=-1", "max_size=big", "created_after=yesterday", "page_size=0", "bucket=.buckets"} {
+		code, _ = search(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
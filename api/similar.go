@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// the default maximum number of bits the perceptual hashes of similar images differ by
+	defaultMaxDistance = 10
+	// the maximum number of bits that perceptual hashes can differ by
+	hashBits = 64
+	// the default and maximum number of similar images returned by FindSimilar
+	defaultSimilarLimit = 10
+	maxSimilarLimit     = 100
+)
+
+var (
+	errSimilarUnsupported = newRequestError(
+		codes.Unimplemented,
+		catly.ErrorReason_ReasonUnknown,
+		"finding similar images is not supported by this server",
+	)
+	errInvalidDistance = newRequestError(
+		codes.InvalidArgument,
+		catly.ErrorReason_ReasonInvalidMetadata,
+		fmt.Sprintf("max distance should be between 0 and %d bits", hashBits),
+	)
+	errUnhashable = newRequestError(
+		codes.InvalidArgument,
+		catly.ErrorReason_ReasonUnsupportedContent,
+		"image could not be decoded to find similar images",
+	)
+)
+
+// FindSimilar handles requests to find the images that look most similar to a stored image or a sample
+func (rs *GRPCResource) FindSimilar(ctx context.Context, req *catly.FindSimilarRequest) (*catly.FindSimilarResponse, error) {
+	if rs.index == nil {
+		return nil, errSimilarUnsupported.err()
+	}
+
+	maxDistance, rerr := distance(req.MaxDistance)
+	if rerr != nil {
+		return nil, rerr.err()
+	}
+
+	limit := int(req.Limit)
+
+	if limit < 1 {
+		limit = defaultSimilarLimit
+	}
+
+	if limit > maxSimilarLimit {
+		limit = maxSimilarLimit
+	}
+
+	var hash, exclude string
+
+	if len(req.Data) > 0 {
+		if rs.maxObjectSize > 0 && len(req.Data) > rs.maxObjectSize {
+			return nil, errTooLarge(rs.maxObjectSize).err()
+		}
+
+		var err error
+
+		hash, err = PerceptualHash(bytes.NewReader(req.Data))
+		if err != nil {
+			return nil, errUnhashable.err()
+		}
+	} else {
+		_, id, rerr := rs.object(req.Bucket, req.Name)
+		if rerr != nil {
+			return nil, rerr.err()
+		}
+
+		hash, rerr = rs.storedHash(id)
+		if rerr != nil {
+			return nil, rerr.err()
+		}
+
+		exclude = id
+	}
+
+	similar, err := rs.index.Similar(hash, maxDistance, limit, exclude)
+	if err != nil {
+		return nil, storageError(err).err()
+	}
+
+	return &catly.FindSimilarResponse{
+		Objects: rs.similarInfo(similar),
+	}, nil
+}
+
+// storedHash returns the perceptual hash of a stored image. Images stored
+// before they were hashed are hashed, and their hash is recorded
+func (rs *GRPCResource) storedHash(id string) (string, *requestError) {
+	md, err := rs.index.Metadata(id)
+	if err != nil {
+		info, err := rs.storage.StatObject(id)
+		if err != nil {
+			return "", storageError(err)
+		}
+
+		md = storage.ObjectMetadata(info)
+	}
+
+	if md.PerceptualHash != "" {
+		return md.PerceptualHash, nil
+	}
+
+	var buf bytes.Buffer
+
+	err = rs.storage.ReadObject(id, &buf)
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	md.PerceptualHash, err = PerceptualHash(&buf)
+	if err != nil {
+		return "", errUnhashable
+	}
+
+	err = rs.index.PutMetadata(md)
+	if err != nil {
+		log.Warn().Str("file", id).Msg(fmt.Sprintf("failed to record perceptual hash: %s", err.Error()))
+	}
+
+	return md.PerceptualHash, nil
+}
+
+// duplicates finds the stored images that look similar to an upload, according
+// to the upload's duplicate policy. If the policy is to reject similar images,
+// an error is returned along with the similar images that were found
+func (rs *GRPCResource) duplicates(policy catly.DuplicatePolicy, maxDistance int, hash, id string) ([]*catly.SimilarObject, *requestError) {
+	if policy == catly.DuplicatePolicy_DuplicateAllow || hash == "" {
+		return nil, nil
+	}
+
+	similar, err := rs.index.Similar(hash, maxDistance, defaultSimilarLimit, id)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	if len(similar) < 1 {
+		return nil, nil
+	}
+
+	log.Info().Str("file", id).Msg(fmt.Sprintf("image looks similar to %d stored images", len(similar)))
+
+	if policy == catly.DuplicatePolicy_DuplicateReject {
+		return rs.similarInfo(similar), newRequestError(
+			codes.AlreadyExists,
+			catly.ErrorReason_ReasonDuplicate,
+			fmt.Sprintf("image looks similar to '%s'", similar[0].Metadata.Name),
+		)
+	}
+
+	return rs.similarInfo(similar), nil
+}
+
+// hash computes the perceptual hash of an uploaded image, if the
+// metadata of images is being indexed and the image can be decoded
+func (rs *GRPCResource) hash(data []byte) string {
+	if rs.index == nil {
+		return ""
+	}
+
+	hash, err := PerceptualHash(bytes.NewReader(data))
+	if err != nil {
+		log.Debug().Msg(fmt.Sprintf("failed to hash uploaded image: %s", err.Error()))
+	}
+
+	return hash
+}
+
+// validateDuplicates checks that an upload's duplicate policy can be applied,
+// returning the maximum distance between the hashes of similar images
+func (rs *GRPCResource) validateDuplicates(policy catly.DuplicatePolicy, maxDistance int32) (int, *requestError) {
+	if policy != catly.DuplicatePolicy_DuplicateAllow && rs.index == nil {
+		return 0, errSimilarUnsupported
+	}
+
+	return distance(maxDistance)
+}
+
+// distance returns the maximum distance between the hashes of similar images
+func distance(maxDistance int32) (int, *requestError) {
+	if maxDistance < 0 || maxDistance > hashBits {
+		return 0, errInvalidDistance
+	}
+
+	if maxDistance == 0 {
+		return defaultMaxDistance, nil
+	}
+
+	return int(maxDistance), nil
+}
+
+// hashingReader computes the perceptual hash of the data read from
+// an upload's stream while it is being written to storage
+type hashingReader struct {
+	io.Reader
+	pw   *io.PipeWriter
+	done chan string
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	pr, pw := io.Pipe()
+
+	h := &hashingReader{
+		Reader: io.TeeReader(r, pw),
+		pw:     pw,
+		done:   make(chan string, 1),
+	}
+
+	go func() {
+		hash, err := PerceptualHash(pr)
+		if err != nil {
+			log.Debug().Msg(fmt.Sprintf("failed to hash uploaded image: %s", err.Error()))
+		}
+
+		// the decoder may not read all of the data, so
+		// discard the rest to avoid blocking the upload
+		io.Copy(io.Discard, pr)
+
+		h.done <- hash
+	}()
+
+	return h
+}
+
+// hash returns the perceptual hash of the data that has been read, which is
+// empty if the data could not be hashed. err is any error that stopped the data
+// from being read to the end
+func (h *hashingReader) hash(err error) string {
+	h.pw.CloseWithError(err)
+	return <-h.done
+}
+
+func (rs *GRPCResource) similarInfo(similar []*storage.SimilarObject) []*catly.SimilarObject {
+	objects := make([]*catly.SimilarObject, len(similar))
+
+	for i, s := range similar {
+		objects[i] = &catly.SimilarObject{
+			Object:   rs.metadataInfo(s.Metadata),
+			Distance: int32(s.Distance),
+		}
+	}
+
+	return objects
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSimilarUpload(t *testing.T) {
+	s, m := testGRPCServerWithDetector(t, 1<<22, http.DetectContentType)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	yellow := color.RGBA{R: 255, G: 220, A: 255}
+
+	_, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "cat.png",
+		Data: testPNG(t, testPicture(640, 480, yellow)),
+	})
+	require.NoError(t, err)
+
+	// similar images are returned when flagged
+	resp, err := c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:       "small-cat.jpg",
+		Data:       testJPEG(t, testPicture(160, 120, yellow), 60),
+		Duplicates: catly.DuplicatePolicy_DuplicateFlag,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Similar, 1)
+	assert.Equal(t, "cat.png", resp.Similar[0].Object.Name)
+	assert.LessOrEqual(t, resp.Similar[0].Distance, int32(defaultMaxDistance))
+
+	// and cause the upload to fail when rejected
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:       "another-cat.jpg",
+		Data:       testJPEG(t, testPicture(800, 600, yellow), 30),
+		Duplicates: catly.DuplicatePolicy_DuplicateReject,
+	})
+	assertReason(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonDuplicate)
+
+	legacy, ok := status.Convert(err).Details()[1].(*catly.UploadObjectResponse)
+	require.True(t, ok)
+	require.Len(t, legacy.Similar, 2)
+
+	_, err = m.StatObject("another-cat.jpg")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	// rejected images uploaded as a stream are removed
+	stream, err := c.UploadStream(context.Background())
+	require.NoError(t, err)
+
+	err = stream.Send(&catly.UploadObjectChunk{
+		Name:        "streamed-cat.png",
+		Data:        testPNG(t, testPicture(320, 240, yellow)),
+		Duplicates:  catly.DuplicatePolicy_DuplicateReject,
+		MaxDistance: 16,
+	})
+	require.NoError(t, err)
+
+	_, err = stream.CloseAndRecv()
+	assertReason(t, err, codes.AlreadyExists, catly.ErrorReason_ReasonDuplicate)
+
+	_, err = m.StatObject("streamed-cat.png")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	// images that are not similar can be uploaded
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:       "night.png",
+		Data:       testPNG(t, upsideDown(testPicture(640, 480, yellow))),
+		Duplicates: catly.DuplicatePolicy_DuplicateReject,
+	})
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:        "dog.png",
+		Data:        testPNG(t, testPicture(64, 48, yellow)),
+		MaxDistance: 65,
+	})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonInvalidMetadata)
+}
+
+func TestFindSimilar(t *testing.T) {
+	s, m := testGRPCServerWithDetector(t, 1<<22, http.DetectContentType)
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	yellow := color.RGBA{R: 255, G: 220, A: 255}
+
+	uploads := map[string][]byte{
+		"cat.png":       testPNG(t, testPicture(640, 480, yellow)),
+		"small-cat.jpg": testJPEG(t, testPicture(160, 120, yellow), 60),
+		"night.png":     testPNG(t, upsideDown(testPicture(640, 480, yellow))),
+	}
+
+	for name, data := range uploads {
+		_, err := c.Upload(context.Background(), &catly.UploadObjectRequest{Name: name, Data: data})
+		require.NoError(t, err)
+	}
+
+	resp, err := c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Name: "cat.png"})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "small-cat.jpg", resp.Objects[0].Object.Name)
+	assert.Equal(t, "http://127.0.0.1:8080/small-cat.jpg", resp.Objects[0].Object.Url)
+
+	resp, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Data: testJPEG(t, testPicture(300, 200, yellow), 50)})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+	assert.LessOrEqual(t, resp.Objects[0].Distance, resp.Objects[1].Distance)
+
+	resp, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Data: testJPEG(t, testPicture(300, 200, yellow), 50), Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+
+	resp, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Name: "cat.png", MaxDistance: hashBits})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+
+	// images stored before they were hashed are hashed when they are first compared
+	require.NoError(t, m.WriteObject("old-cat.png", bytes.NewReader(uploads["cat.png"])))
+
+	resp, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Name: "old-cat.png"})
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 2)
+	assert.Equal(t, "cat.png", resp.Objects[0].Object.Name)
+	assert.Equal(t, int32(0), resp.Objects[0].Distance)
+
+	_, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Name: "missing.png"})
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonObjectNotFound)
+
+	_, err = c.FindSimilar(context.Background(), &catly.FindSimilarRequest{Data: []byte("not an image")})
+	assertReason(t, err, codes.InvalidArgument, catly.ErrorReason_ReasonUnsupportedContent)
+}
+
+// upsideDown returns a copy of an image rotated by 180 degrees
+func upsideDown(img image.Image) image.Image {
+	b := img.Bounds()
+	flipped := image.NewRGBA(b)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			flipped.Set(b.Max.X-1-x+b.Min.X, b.Max.Y-1-y+b.Min.Y, img.At(x, y))
+		}
+	}
+
+	return flipped
+}
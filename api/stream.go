@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"io"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+)
+
+// the maximum size of the chunks sent when downloading an object
+const downloadChunkSize = 1 << 16
+
+// chunkReceiver receives the data of the next chunk sent to a stream
+type chunkReceiver func() ([]byte, error)
+
+// chunkSender is implemented by streams that send chunks of data
+type chunkSender interface {
+	Send(chunk *catly.ObjectChunk) error
+}
+
+// chunkReader reads the data from a stream of uploaded chunks
+type chunkReader struct {
+	recvData chunkReceiver
+	buf      []byte
+	read     int
+	eof      bool
+	maxSize  int
+	tooLarge func() error
+	// err records any error encountered while receiving from
+	// the stream, so it can be reported back to the client
+	err error
+}
+
+// peek returns up to n bytes from the start of the stream without consuming them
+func (r *chunkReader) peek(n int) ([]byte, error) {
+	for len(r.buf) < n && !r.eof {
+		err := r.recv()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.buf) < n {
+		return r.buf, nil
+	}
+
+	return r.buf[:n], nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) < 1 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// recv receives the next chunk from the stream
+func (r *chunkReader) recv() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	data, err := r.recvData()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			r.eof = true
+			return nil
+		}
+
+		r.err = err
+
+		return err
+	}
+
+	return r.add(data)
+}
+
+// add buffers data received from the stream, checking
+// that the upload has not exceeded the maximum size
+func (r *chunkReader) add(data []byte) error {
+	r.read += len(data)
+
+	if r.maxSize > 0 && r.read > r.maxSize {
+		r.err = r.tooLarge()
+		return r.err
+	}
+
+	r.buf = append(r.buf, data...)
+
+	return nil
+}
+
+// chunkWriter writes data to a stream as a series of chunks
+type chunkWriter struct {
+	stream chunkSender
+	// err records any error encountered while sending to the stream
+	err error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		n := len(p)
+		if n > downloadChunkSize {
+			n = downloadChunkSize
+		}
+
+		w.err = w.stream.Send(&catly.ObjectChunk{
+			Data: p[:n],
+		})
+
+		if w.err != nil {
+			return written, w.err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// the maximum width and height of a thumbnail
+	thumbnailSize = 320
+	// the maximum number of pixels sampled in each direction when a thumbnail pixel is averaged
+	thumbnailSamples = 4
+	// the maximum number of pixels in an image that thumbnails are generated for,
+	// so that large images cannot be used to exhaust the server's memory
+	maxThumbnailPixels = 40 << 20
+)
+
+// fitBounds returns the size of an image that is scaled down to fit within
+// the maximum width and height, keeping its aspect ratio. A maximum of zero
+// does not limit that dimension
+func fitBounds(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	return width, height
+}
+
+// thumbnail scales an image down to fit within the maximum size. Each pixel of the
+// thumbnail is the average of a grid of samples from the area of the image it covers
+func thumbnail(img image.Image, size int) *image.NRGBA {
+	b := img.Bounds()
+
+	tw, th := fitBounds(b.Dx(), b.Dy(), size, size)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+
+	for y := 0; y < th; y++ {
+		y0 := b.Min.Y + y*b.Dy()/th
+		y1 := b.Min.Y + (y+1)*b.Dy()/th
+
+		for x := 0; x < tw; x++ {
+			x0 := b.Min.X + x*b.Dx()/tw
+			x1 := b.Min.X + (x+1)*b.Dx()/tw
+
+			dst.SetNRGBA(x, y, average(img, x0, y0, x1, y1))
+		}
+	}
+
+	return dst
+}
+
+// average returns the average color of an area of an image, sampling at most
+// thumbnailSamples pixels in each direction. Colors are averaged with their alpha
+// premultiplied, so transparent pixels do not darken the pixels around them
+func average(img image.Image, x0, y0, x1, y1 int) color.NRGBA {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+
+	xs := x1 - x0
+	if xs > thumbnailSamples {
+		xs = thumbnailSamples
+	}
+
+	ys := y1 - y0
+	if ys > thumbnailSamples {
+		ys = thumbnailSamples
+	}
+
+	var r, g, b, a, n uint64
+
+	for j := 0; j < ys; j++ {
+		y := y0 + j*(y1-y0)/ys
+
+		for i := 0; i < xs; i++ {
+			x := x0 + i*(x1-x0)/xs
+
+			pr, pg, pb, pa := img.At(x, y).RGBA()
+
+			r += uint64(pr)
+			g += uint64(pg)
+			b += uint64(pb)
+			a += uint64(pa)
+			n++
+		}
+	}
+
+	if a == 0 {
+		return color.NRGBA{}
+	}
+
+	// convert the premultiplied averages back to 8 bit non-premultiplied colors
+	return color.NRGBA{
+		R: uint8(r * 0xff / a),
+		G: uint8(g * 0xff / a),
+		B: uint8(b * 0xff / a),
+		A: uint8(a / n >> 8),
+	}
+}
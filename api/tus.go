@@ -0,0 +1,597 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// TusVersion the version of the tus resumable upload protocol that is supported
+	TusVersion = "1.0.0"
+	// DefaultTusPath the default path that resumable uploads are created at
+	DefaultTusPath = "/uploads/"
+	// DefaultTusExpiry the default time an incomplete upload is held after data was last sent
+	DefaultTusExpiry = 24 * time.Hour
+	// the extensions to the tus protocol that are supported
+	tusExtensions = "creation,expiration,termination"
+	// the content type of the data sent to append to an upload
+	tusContentType = "application/offset+octet-stream"
+	// how often uploads are checked to see if they have expired
+	tusExpireInterval = time.Minute
+)
+
+// the headers used by the tus protocol
+const (
+	tusResumableHeader  = "Tus-Resumable"
+	tusVersionHeader    = "Tus-Version"
+	tusExtensionHeader  = "Tus-Extension"
+	tusMaxSizeHeader    = "Tus-Max-Size"
+	uploadOffsetHeader  = "Upload-Offset"
+	uploadLengthHeader  = "Upload-Length"
+	uploadMetaHeader    = "Upload-Metadata"
+	uploadExpiresHeader = "Upload-Expires"
+	// TusURLHeader the url of the image, sent once an upload has been completed
+	TusURLHeader = "X-Catly-URL"
+)
+
+// PartialStorage specifies the interface that storage backends need
+// to implement to hold resumable uploads until they are complete
+type PartialStorage interface {
+	CreatePartial(p *storage.PartialUpload) error
+	GetPartial(id string) (*storage.PartialUpload, error)
+	AppendPartial(id string, offset int64, r io.Reader) (int64, error)
+	OpenPartial(id string) (io.ReadSeekCloser, error)
+	DeletePartial(id string) error
+	ExpirePartials(before time.Time) (int, error)
+}
+
+// TusOption configures optional behaviour of resumable uploads
+type TusOption func(t *TusResource)
+
+// WithTusPath sets the path that uploads are created at, which
+// is the prefix of the url of every upload. It must end in a '/'
+func WithTusPath(path string) TusOption {
+	return func(t *TusResource) {
+		t.path = path
+	}
+}
+
+// WithTusExpiry sets the time an incomplete upload is held after data
+// was last sent to it, before it expires and is deleted
+func WithTusExpiry(expiry time.Duration) TusOption {
+	return func(t *TusResource) {
+		t.expiry = expiry
+	}
+}
+
+// TusResource handles resumable uploads over HTTP using the tus protocol
+// (https://tus.io/protocols/resumable-upload.html), with the creation,
+// expiration and termination extensions. The data of an upload is held
+// in partial storage until it is complete, then validated and written to
+// storage as if it had been uploaded over gRPC.
+//
+// The name of an image and the bucket it is uploaded to are set with the
+// 'name' and 'bucket' keys of the upload's metadata, or the 'filename' key
+// that many tus clients send. Tags are set with keys prefixed with 'tag.',
+// and the description with the 'description' key
+type TusResource struct {
+	objects  *GRPCResource
+	partials PartialStorage
+	path     string
+	expiry   time.Duration
+	mu       sync.Mutex
+	// the uploads that are currently being appended to or deleted
+	locked map[string]struct{}
+}
+
+// tusUpload the image an upload will be stored as
+type tusUpload struct {
+	name        string
+	bucket      string
+	description string
+	tags        map[string]string
+}
+
+// NewTusResource creates a new handler for resumable uploads. Complete
+// uploads are validated and stored by the gRPC object service
+func NewTusResource(objects *GRPCResource, partials PartialStorage, opts ...TusOption) *TusResource {
+	t := &TusResource{
+		objects:  objects,
+		partials: partials,
+		path:     DefaultTusPath,
+		expiry:   DefaultTusExpiry,
+		locked:   make(map[string]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// Run deletes uploads that have expired until the context is cancelled
+func (t *TusResource) Run(ctx context.Context) {
+	ticker := time.NewTicker(tusExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		t.expire(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP handles the requests of the tus protocol
+func (t *TusResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// some clients cannot send PATCH or DELETE requests
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+		r.Method = override
+	}
+
+	w.Header().Set(tusResumableHeader, TusVersion)
+
+	if r.Method == http.MethodOptions {
+		t.options(w)
+		return
+	}
+
+	if r.Header.Get(tusResumableHeader) != TusVersion {
+		w.Header().Set(tusVersionHeader, TusVersion)
+		httpError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, t.path)
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		t.create(w, r)
+	case id == "":
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	case r.Method == http.MethodHead:
+		t.head(w, r, id)
+	case r.Method == http.MethodPatch:
+		t.patch(w, r, id)
+	case r.Method == http.MethodDelete:
+		t.terminate(w, r, id)
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// options describes the features of the protocol that are supported
+func (t *TusResource) options(w http.ResponseWriter) {
+	w.Header().Set(tusVersionHeader, TusVersion)
+	w.Header().Set(tusExtensionHeader, tusExtensions)
+
+	if t.objects.maxObjectSize > 0 {
+		w.Header().Set(tusMaxSizeHeader, strconv.Itoa(t.objects.maxObjectSize))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// create creates a new upload, checking the image can be stored
+// before any of its data is sent
+func (t *TusResource) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+	if err != nil || length < 0 {
+		httpError(w, http.StatusBadRequest, "Upload-Length must be a non-negative integer")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get(uploadMetaHeader))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u := tusObject(metadata)
+
+	rs := t.objects
+
+	bucket, id, rerr := rs.object(u.bucket, u.name)
+	if rerr == nil {
+		rerr = validateMetadata(u.tags, u.description)
+	}
+
+	if rerr == nil && length < 1 {
+		rerr = errNoData
+	}
+
+	if maxSize := rs.maxSize(bucket); rerr == nil && maxSize > 0 && length > int64(maxSize) {
+		rerr = errTooLarge(maxSize)
+	}
+
+	// fail early if the name is in use, so the data is not sent needlessly
+	if rerr == nil {
+		_, err = rs.storage.StatObject(id)
+		if err == nil {
+			rerr = storageError(storage.ErrFileExists)
+		}
+	}
+
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	owner, _ := PrincipalFromContext(r.Context())
+
+	p := &storage.PartialUpload{
+		ID:       uuid.New().String(),
+		Length:   length,
+		Metadata: metadata,
+		Owner:    owner,
+		Created:  time.Now().UTC(),
+		Modified: time.Now(),
+	}
+
+	err = t.partials.CreatePartial(p)
+	if err != nil {
+		requestErrorHTTP(w, r, storageError(err))
+		return
+	}
+
+	log.Info().
+		Str("upload", p.ID).
+		Str("file", id).
+		Msg(fmt.Sprintf("created resumable upload of %d bytes", length))
+
+	w.Header().Set("Location", t.path+p.ID)
+	w.Header().Set(uploadExpiresHeader, t.expires(p))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// head reports how much of an upload has been received
+func (t *TusResource) head(w http.ResponseWriter, r *http.Request, id string) {
+	p, ok := t.upload(w, r, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(p.Offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(p.Length, 10))
+	w.Header().Set(uploadExpiresHeader, t.expires(p))
+
+	if len(p.Metadata) > 0 {
+		w.Header().Set(uploadMetaHeader, formatTusMetadata(p.Metadata))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch appends data to an upload, storing the image once all of its data has been received
+func (t *TusResource) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		httpError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		httpError(w, http.StatusBadRequest, "Upload-Offset must be a non-negative integer")
+		return
+	}
+
+	if !t.lock(id) {
+		httpError(w, http.StatusLocked, "upload is already in progress")
+		return
+	}
+
+	defer t.unlock(id)
+
+	p, ok := t.upload(w, r, id)
+	if !ok {
+		return
+	}
+
+	p.Offset, err = t.partials.AppendPartial(id, offset, r.Body)
+	p.Modified = time.Now()
+
+	switch {
+	case errors.Is(err, storage.ErrOffsetMismatch):
+		httpError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset does not match the upload's offset of %d", p.Offset))
+		return
+	case errors.Is(err, storage.ErrPartialTooLarge):
+		httpError(w, http.StatusRequestEntityTooLarge, "upload exceeds its Upload-Length")
+		return
+	case err != nil:
+		// the data received so far has been kept, so the client can resume
+		log.Warn().
+			Str("upload", id).
+			Str("error", err.Error()).
+			Msg(fmt.Sprintf("resumable upload interrupted at %d bytes", p.Offset))
+
+		httpError(w, http.StatusInternalServerError, "failed to receive upload")
+		return
+	}
+
+	if p.Offset == p.Length {
+		url, rerr := t.commit(r.Context(), p)
+
+		// the upload is no longer needed once it has been stored, or if it can never
+		// be. uploads that fail with a server error are kept, so storing the image
+		// can be retried by sending an empty PATCH at the end of the upload
+		if rerr == nil || rerr.httpStatus() < http.StatusInternalServerError {
+			derr := t.partials.DeletePartial(id)
+			if derr != nil {
+				log.Error().Str("upload", id).Msg(fmt.Sprintf("failed to delete completed upload: %s", derr.Error()))
+			}
+		}
+
+		if rerr != nil {
+			requestErrorHTTP(w, r, rerr)
+			return
+		}
+
+		w.Header().Set(TusURLHeader, url)
+	} else {
+		w.Header().Set(uploadExpiresHeader, t.expires(p))
+	}
+
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(p.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// terminate deletes an upload that is no longer needed
+func (t *TusResource) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	if !t.lock(id) {
+		httpError(w, http.StatusLocked, "upload is in progress")
+		return
+	}
+
+	defer t.unlock(id)
+
+	_, ok := t.upload(w, r, id)
+	if !ok {
+		return
+	}
+
+	err := t.partials.DeletePartial(id)
+	if err != nil && !errors.Is(err, storage.ErrFileDoesNotExist) {
+		requestErrorHTTP(w, r, storageError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commit validates the data of a complete upload and writes it to storage,
+// returning the url of the image
+func (t *TusResource) commit(ctx context.Context, p *storage.PartialUpload) (string, *requestError) {
+	u := tusObject(p.Metadata)
+
+	rs := t.objects
+
+	bucket, id, rerr := rs.object(u.bucket, u.name)
+	if rerr != nil {
+		return "", rerr
+	}
+
+	fd, err := t.partials.OpenPartial(p.ID)
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	defer fd.Close()
+
+	head := make([]byte, sniffLen)
+
+	n, err := io.ReadFull(fd, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", storageError(err)
+	}
+
+	if n < 1 {
+		return "", errNoData
+	}
+
+	rerr = rs.validateContent(bucket, u.name, head[:n])
+	if rerr != nil {
+		return "", rerr
+	}
+
+	_, err = fd.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	// hash the image as it is written so that similar images can be found
+	var body io.Reader = fd
+	var hr *hashingReader
+
+	if rs.index != nil {
+		hr = newHashingReader(fd)
+		body = hr
+	}
+
+	err = rs.storage.WriteObject(id, body)
+
+	var hash string
+
+	if hr != nil {
+		hash = hr.hash(err)
+	}
+
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	rerr = rs.putMetadata(ctx, id, u.tags, u.description, hash)
+	if rerr != nil {
+		return "", rerr
+	}
+
+	rs.publishCreated(ctx, id, p.Length)
+
+	log.Info().
+		Str("upload", p.ID).
+		Str("file", id).
+		Msg("completed resumable upload")
+
+	return rs.url(id), nil
+}
+
+// upload gets an upload, responding with an error if it cannot be
+// found, has expired or was created by a different principal
+func (t *TusResource) upload(w http.ResponseWriter, r *http.Request, id string) (*storage.PartialUpload, bool) {
+	p, err := t.partials.GetPartial(id)
+	if err != nil {
+		if errors.Is(err, storage.ErrFileDoesNotExist) || errors.Is(err, storage.ErrInvalidFileName) {
+			httpError(w, http.StatusNotFound, "upload not found")
+		} else {
+			requestErrorHTTP(w, r, storageError(err))
+		}
+
+		return nil, false
+	}
+
+	// uploads created by other principals are reported as not found
+	owner, _ := PrincipalFromContext(r.Context())
+	if p.Owner != owner {
+		httpError(w, http.StatusNotFound, "upload not found")
+		return nil, false
+	}
+
+	if t.expiry > 0 && time.Since(p.Modified) > t.expiry {
+		httpError(w, http.StatusNotFound, "upload has expired")
+		return nil, false
+	}
+
+	return p, true
+}
+
+// expire deletes the uploads that have not been sent any data since they expired
+func (t *TusResource) expire(now time.Time) {
+	if t.expiry < 1 {
+		return
+	}
+
+	expired, err := t.partials.ExpirePartials(now.Add(-t.expiry))
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("failed to delete expired uploads: %s", err.Error()))
+		return
+	}
+
+	if expired > 0 {
+		log.Info().Msg(fmt.Sprintf("deleted %d expired uploads", expired))
+	}
+}
+
+// expires returns the time an upload expires, formatted for the Upload-Expires header
+func (t *TusResource) expires(p *storage.PartialUpload) string {
+	return p.Modified.Add(t.expiry).UTC().Format(http.TimeFormat)
+}
+
+func (t *TusResource) lock(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.locked[id]; ok {
+		return false
+	}
+
+	t.locked[id] = struct{}{}
+
+	return true
+}
+
+func (t *TusResource) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.locked, id)
+}
+
+// tusObject returns the image an upload will be stored as from its metadata
+func tusObject(metadata map[string]string) *tusUpload {
+	u := &tusUpload{
+		name:        metadata["name"],
+		bucket:      metadata["bucket"],
+		description: metadata["description"],
+	}
+
+	if u.name == "" {
+		u.name = metadata["filename"]
+	}
+
+	for key, value := range metadata {
+		if !strings.HasPrefix(key, "tag.") {
+			continue
+		}
+
+		if u.tags == nil {
+			u.tags = make(map[string]string)
+		}
+
+		u.tags[strings.TrimPrefix(key, "tag.")] = value
+	}
+
+	return u
+}
+
+// parseTusMetadata parses the Upload-Metadata header, which is a comma
+// separated list of keys and base64 encoded values separated by a space
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) < 1 || len(parts) > 2 {
+			return nil, errors.New("Upload-Metadata is invalid")
+		}
+
+		var value []byte
+
+		if len(parts) == 2 {
+			var err error
+
+			value, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Upload-Metadata value for '%s' is not valid base64", parts[0])
+			}
+		}
+
+		if _, ok := metadata[parts[0]]; ok {
+			return nil, fmt.Errorf("Upload-Metadata key '%s' is repeated", parts[0])
+		}
+
+		metadata[parts[0]] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// formatTusMetadata formats metadata for the Upload-Metadata header
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
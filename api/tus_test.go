@@ -0,0 +1,325 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTusServer(t *testing.T, opts ...TusOption) (*httptest.Server, *TusResource, *storage.MemoryStore) {
+	d, err := os.MkdirTemp("/tmp", "tus-*")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll(d)
+	})
+
+	partials, err := storage.NewPartialStore(d)
+	require.NoError(t, err)
+
+	m := storage.NewMemoryStore()
+
+	rs := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithMaxObjectSize(1<<20),
+		WithBuckets(storage.NewBuckets(m)),
+		WithIndex(storage.NewIndex(m)),
+	)
+
+	tr := NewTusResource(rs, partials, opts...)
+
+	return httptest.NewServer(tr), tr, m
+}
+
+func tusRequest(t *testing.T, method, url string, body []byte, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+
+	req.Header.Set("Tus-Resumable", TusVersion)
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	resp.Body.Close()
+
+	return resp
+}
+
+func tusCreate(t *testing.T, server string, length int, metadata string) *http.Response {
+	return tusRequest(t, http.MethodPost, server+DefaultTusPath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	})
+}
+
+func tusPatch(t *testing.T, location string, offset int, data []byte) *http.Response {
+	return tusRequest(t, http.MethodPatch, location, data, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestTusUpload(t *testing.T) {
+	s, _, m := testTusServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	resp := tusRequest(t, http.MethodOptions, s.URL+DefaultTusPath, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Version"))
+	assert.Equal(t, "creation,expiration,termination", resp.Header.Get("Tus-Extension"))
+	assert.Equal(t, "1048576", resp.Header.Get("Tus-Max-Size"))
+
+	// 'cat.png' and 'cute' base64 encoded
+	resp = tusCreate(t, s.URL, len(img), "filename Y2F0LnBuZw==,tag.cute,description Y3V0ZQ==")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Upload-Expires"))
+
+	location := s.URL + resp.Header.Get("Location")
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(img)), resp.Header.Get("Upload-Length"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	half := len(img) / 2
+
+	resp = tusPatch(t, location, 0, img[:half])
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(half), resp.Header.Get("Upload-Offset"))
+	assert.Empty(t, resp.Header.Get(TusURLHeader))
+
+	// the image is not stored until the upload is complete
+	_, err := m.StatObject("cat.png")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, strconv.Itoa(half), resp.Header.Get("Upload-Offset"))
+
+	// data must be sent from the end of the upload
+	resp = tusPatch(t, location, 0, img)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodPatch, location, img[half:], map[string]string{
+		"Upload-Offset": strconv.Itoa(half),
+	})
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp = tusPatch(t, location, half, img[half:])
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(img)), resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, "http://127.0.0.1:8080/cat.png", resp.Header.Get(TusURLHeader))
+
+	info, err := m.StatObject("cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img)), info.Size)
+
+	// completed uploads are removed
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// failingStore fails to write objects while failing is set
+type failingStore struct {
+	*storage.MemoryStore
+	failing bool
+}
+
+func (s *failingStore) WriteObject(id string, r io.Reader) error {
+	if s.failing {
+		return errors.New("replica unavailable")
+	}
+
+	return s.MemoryStore.WriteObject(id, r)
+}
+
+func TestTusUploadRetry(t *testing.T) {
+	s, tr, m := testTusServer(t)
+	defer s.Close()
+
+	fs := &failingStore{MemoryStore: m, failing: true}
+	tr.objects.storage = fs
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	resp := tusCreate(t, s.URL, len(img), "filename Y2F0LnBuZw==")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location := s.URL + resp.Header.Get("Location")
+
+	resp = tusPatch(t, location, 0, img)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// the upload is kept after a server error, so it can be stored again
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(img)), resp.Header.Get("Upload-Offset"))
+
+	fs.failing = false
+
+	resp = tusPatch(t, location, len(img), nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.png", resp.Header.Get(TusURLHeader))
+
+	_, err := m.StatObject("cat.png")
+	require.NoError(t, err)
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTusUploadInvalid(t *testing.T) {
+	s, _, m := testTusServer(t)
+	defer s.Close()
+
+	require.NoError(t, m.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	resp := tusRequest(t, http.MethodPost, s.URL+DefaultTusPath, nil, map[string]string{
+		"Tus-Resumable": "0.2.2",
+		"Upload-Length": "10",
+	})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Version"))
+
+	resp = tusRequest(t, http.MethodPost, s.URL+DefaultTusPath, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = tusCreate(t, s.URL, 10, "name !!!")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// 'dog.jpg'
+	resp = tusCreate(t, s.URL, 2<<20, "name ZG9nLmpwZw==")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, "ReasonObjectTooLarge", resp.Header.Get("X-Catly-Reason"))
+
+	// 'cat.jpg'
+	resp = tusCreate(t, s.URL, 10, "name Y2F0LmpwZw==")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// 'missing'
+	resp = tusCreate(t, s.URL, 10, "name ZG9nLmpwZw==,bucket bWlzc2luZw==")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// uploads that are not images are rejected once complete
+	data := []byte("<html></html>")
+
+	resp = tusCreate(t, s.URL, len(data), "name ZG9nLmpwZw==")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location := s.URL + resp.Header.Get("Location")
+
+	resp = tusPatch(t, location, 0, append(data, data...))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = tusPatch(t, location, len(data), data)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodPost, s.URL+DefaultTusPath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "name ZG9nLmpwZw==",
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location = s.URL + resp.Header.Get("Location")
+
+	resp = tusPatch(t, location, 0, data)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "ReasonUnsupportedContent", resp.Header.Get("X-Catly-Reason"))
+
+	_, err := m.StatObject("dog.jpg")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTusTerminateAndExpire(t *testing.T) {
+	s, tr, _ := testTusServer(t, WithTusExpiry(time.Hour))
+	defer s.Close()
+
+	resp := tusCreate(t, s.URL, 10, "name Y2F0LmpwZw==")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location := s.URL + resp.Header.Get("Location")
+
+	resp = tusRequest(t, http.MethodDelete, location, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodDelete, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = tusCreate(t, s.URL, 10, "name Y2F0LmpwZw==")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location = s.URL + resp.Header.Get("Location")
+
+	// uploads are kept until they expire
+	tr.expire(time.Now())
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tr.expire(time.Now().Add(2 * time.Hour))
+
+	resp = tusRequest(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTusUploadOwner(t *testing.T) {
+	_, tr, _ := testTusServer(t)
+
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+		"w00f":   "team-dogs",
+	})
+
+	s := httptest.NewServer(a.Middleware(tr))
+	defer s.Close()
+
+	resp := tusRequest(t, http.MethodPost, s.URL+DefaultTusPath, nil, map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "name Y2F0LmpwZw==",
+	})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodPost, s.URL+DefaultTusPath, nil, map[string]string{
+		"Authorization":   "Bearer s3cr3t",
+		"Upload-Length":   "10",
+		"Upload-Metadata": "name Y2F0LmpwZw==",
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	location := s.URL + resp.Header.Get("Location")
+
+	// uploads can only be resumed by the principal that created them
+	resp = tusRequest(t, http.MethodHead, location, nil, map[string]string{
+		"Authorization": "Bearer w00f",
+	})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = tusRequest(t, http.MethodHead, location, nil, map[string]string{
+		"Authorization": "Bearer s3cr3t",
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
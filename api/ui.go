@@ -0,0 +1,433 @@
+package api
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// UIPath the path the web ui is served from. It is not a valid bucket
+	// name, so images in buckets are never served from the same paths
+	UIPath = "/_ui/"
+	// the number of images shown on each page of the gallery
+	uiPageSize = 48
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiFuncs the functions available to the templates of the web ui
+var uiFuncs = template.FuncMap{
+	"objectPath": objectPath,
+	"pagePath": func(id string) string {
+		return UIPath + "i" + objectPath(id)
+	},
+	"thumbnailPath": func(id string) string {
+		return UIPath + "t" + objectPath(id)
+	},
+	"size": formatSize,
+	"time": func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format("2 Jan 2006 15:04 MST")
+	},
+	"uiPath": func() string {
+		return UIPath
+	},
+}
+
+// UIOption configures optional behaviour of the web ui
+type UIOption func(u *UIResource)
+
+// WithUIAuthenticator requires images uploaded from the web ui to be
+// authenticated with a bearer token. The ui prompts for a token if needed
+func WithUIAuthenticator(a *TokenAuthenticator) UIOption {
+	return func(u *UIResource) {
+		u.upload = a.Middleware(http.HandlerFunc(u.uploadImage))
+	}
+}
+
+// UIResource serves a web ui for uploading and browsing images. Images
+// are uploaded and listed with the gRPC object service, and images in
+// private buckets are not shown, as they cannot be served over HTTP
+type UIResource struct {
+	objects   *GRPCResource
+	templates map[string]*template.Template
+	static    http.Handler
+	upload    http.Handler
+}
+
+// uiObject an image shown by the web ui
+type uiObject struct {
+	*catly.ObjectInfo
+	// ID the name of the image, including its bucket
+	ID string
+}
+
+// NewUIResource creates a new web ui for the object service
+func NewUIResource(objects *GRPCResource, opts ...UIOption) *UIResource {
+	u := &UIResource{
+		objects:   objects,
+		templates: make(map[string]*template.Template),
+	}
+
+	// each page is parsed with the layout it is rendered in
+	for _, page := range []string{"gallery", "image", "error"} {
+		u.templates[page] = template.Must(
+			template.New(page).Funcs(uiFuncs).ParseFS(uiFiles, "ui/templates/layout.html", "ui/templates/"+page+".html"),
+		)
+	}
+
+	static, _ := fs.Sub(uiFiles, "ui/static")
+	u.static = http.StripPrefix(UIPath+"static/", http.FileServer(http.FS(static)))
+	u.upload = http.HandlerFunc(u.uploadImage)
+
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	return u
+}
+
+// ServeHTTP routes requests to the pages of the web ui
+func (u *UIResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, UIPath)
+
+	if p == "upload" {
+		u.upload.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch {
+	case p == "":
+		u.gallery(w, r)
+	case strings.HasPrefix(p, "static/"):
+		u.static.ServeHTTP(w, r)
+	case strings.HasPrefix(p, "i/"):
+		u.image(w, r, strings.TrimPrefix(p, "i/"))
+	case strings.HasPrefix(p, "t/"):
+		u.thumbnail(w, r, strings.TrimPrefix(p, "t/"))
+	default:
+		u.render(w, http.StatusNotFound, "error", "page not found")
+	}
+}
+
+// gallery renders a page of the images in a bucket
+func (u *UIResource) gallery(w http.ResponseWriter, r *http.Request) {
+	bucket := r.URL.Query().Get("bucket")
+
+	rerr := u.objects.public(bucket)
+	if rerr != nil {
+		u.renderError(w, rerr)
+		return
+	}
+
+	resp, err := u.objects.List(r.Context(), &catly.ListObjectsRequest{
+		Bucket:    bucket,
+		PageToken: r.URL.Query().Get("page"),
+		PageSize:  uiPageSize,
+	})
+
+	if err != nil {
+		u.renderError(w, statusError(err))
+		return
+	}
+
+	objects := make([]*uiObject, len(resp.Objects))
+
+	for i, obj := range resp.Objects {
+		objects[i] = &uiObject{ObjectInfo: obj, ID: storage.ObjectID(obj.Bucket, obj.Name)}
+	}
+
+	var next string
+
+	if resp.NextPageToken != "" {
+		q := url.Values{"page": {resp.NextPageToken}}
+
+		if bucket != "" {
+			q.Set("bucket", bucket)
+		}
+
+		next = UIPath + "?" + q.Encode()
+	}
+
+	u.render(w, http.StatusOK, "gallery", map[string]interface{}{
+		"Bucket":  bucket,
+		"Buckets": u.publicBuckets(),
+		"Objects": objects,
+		"First":   r.URL.Query().Get("page") == "",
+		"Next":    next,
+	})
+}
+
+// image renders the page of an image, with links that can be copied
+func (u *UIResource) image(w http.ResponseWriter, r *http.Request, id string) {
+	bucket, name := storage.SplitObjectID(id)
+
+	rerr := u.objects.public(bucket)
+	if rerr != nil {
+		u.renderError(w, rerr)
+		return
+	}
+
+	info, err := u.objects.Stat(r.Context(), &catly.StatObjectRequest{
+		Name:   name,
+		Bucket: bucket,
+	})
+
+	if err != nil {
+		u.renderError(w, statusError(err))
+		return
+	}
+
+	u.render(w, http.StatusOK, "image", &uiObject{ObjectInfo: info, ID: id})
+}
+
+// thumbnail serves a scaled down copy of an image. Images that
+// are already small enough are served without being scaled
+func (u *UIResource) thumbnail(w http.ResponseWriter, r *http.Request, id string) {
+	bucket, name := storage.SplitObjectID(id)
+
+	rs := u.objects
+
+	rerr := u.objects.public(bucket)
+	if rerr == nil {
+		_, _, rerr = rs.object(bucket, name)
+	}
+
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	info, err := rs.storage.StatObject(id)
+	if err != nil {
+		requestErrorHTTP(w, r, storageError(err))
+		return
+	}
+
+	// images cannot be replaced, so the thumbnail only changes if
+	// the image is deleted and another is uploaded with its name
+	etag := fmt.Sprintf(`"%x-%x"`, info.Created.UnixNano(), info.Size)
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	err = rs.storage.ReadObject(id, &buf)
+	if err != nil {
+		requestErrorHTTP(w, r, storageError(err))
+		return
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+
+	// images that cannot be decoded, or are too large to be decoded
+	// safely, are left for the browser to scale instead
+	if err != nil || cfg.Width*cfg.Height > maxThumbnailPixels {
+		http.Redirect(w, r, objectPath(id), http.StatusFound)
+		return
+	}
+
+	if cfg.Width <= thumbnailSize && cfg.Height <= thumbnailSize {
+		w.Header().Set("Content-Type", "image/"+format)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		http.Redirect(w, r, objectPath(id), http.StatusFound)
+		return
+	}
+
+	var out bytes.Buffer
+
+	// jpeg images have no transparency, so they are encoded
+	// as smaller jpegs. anything else is encoded as a png
+	if format == "jpeg" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		err = jpeg.Encode(&out, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 85})
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		err = png.Encode(&out, thumbnail(img, thumbnailSize))
+	}
+
+	if err != nil {
+		requestErrorHTTP(w, r, newRequestError(codes.Internal, catly.ErrorReason_ReasonInternal, err.Error()))
+		return
+	}
+
+	w.Write(out.Bytes())
+}
+
+// uploadImage handles uploads from the web ui. The image is sent as the body of the
+// request, or as the first file of a multipart form, and is uploaded with the name
+// and bucket in the request's query. The name of the file is used if no name is set
+func (u *UIResource) uploadImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rs := u.objects
+
+	body, filename, rerr := uploadBody(r)
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = path.Base(filename)
+	}
+
+	var lr io.Reader = body
+
+	// read one more byte than the maximum size, so the upload is rejected as too large
+	if rs.maxObjectSize > 0 {
+		lr = io.LimitReader(body, int64(rs.maxObjectSize)+1)
+	}
+
+	data, err := io.ReadAll(lr)
+	if err != nil {
+		requestErrorHTTP(w, r, newRequestError(codes.InvalidArgument, catly.ErrorReason_ReasonNoData, "failed to read upload: "+err.Error()))
+		return
+	}
+
+	resp, err := rs.Upload(r.Context(), &catly.UploadObjectRequest{
+		Name:        name,
+		Bucket:      r.URL.Query().Get("bucket"),
+		Description: r.URL.Query().Get("description"),
+		Data:        data,
+	})
+
+	if err != nil {
+		requestErrorHTTP(w, r, statusError(err))
+		return
+	}
+
+	id := storage.ObjectID(r.URL.Query().Get("bucket"), name)
+
+	log.Info().
+		Str("file", id).
+		Msg("image uploaded from web ui")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"name": id,
+		"url":  resp.Url,
+		"page": UIPath + "i" + objectPath(id),
+	})
+}
+
+// publicBuckets returns the names of the buckets that can be shown
+func (u *UIResource) publicBuckets() []string {
+	if u.objects.buckets == nil {
+		return nil
+	}
+
+	buckets, err := u.objects.buckets.ListBuckets()
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("failed to list buckets for web ui")
+
+		return nil
+	}
+
+	var names []string
+
+	for _, b := range buckets {
+		if b.Visibility == storage.VisibilityPublic {
+			names = append(names, b.Name)
+		}
+	}
+
+	return names
+}
+
+// render writes a page of the web ui
+func (u *UIResource) render(w http.ResponseWriter, status int, page string, data interface{}) {
+	var buf bytes.Buffer
+
+	err := u.templates[page].ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		log.Error().
+			Str("page", page).
+			Str("error", err.Error()).
+			Msg("failed to render web ui page")
+
+		httpError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// renderError writes a page describing why a request failed
+func (u *UIResource) renderError(w http.ResponseWriter, rerr *requestError) {
+	w.Header().Set("X-Catly-Reason", rerr.reason.String())
+	u.render(w, rerr.httpStatus(), "error", rerr.Error())
+}
+
+// objectPath returns the escaped path an image is served from over HTTP
+func objectPath(id string) string {
+	bucket, name := storage.SplitObjectID(id)
+
+	if bucket == "" {
+		return "/" + url.PathEscape(name)
+	}
+
+	return "/" + bucket + "/" + url.PathEscape(name)
+}
+
+// formatSize formats a number of bytes for display
+func formatSize(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,174 @@
+// catly web ui: drag and drop uploads and copy buttons
+(function () {
+  "use strict";
+
+  var tokenKey = "catly-token";
+
+  // copy the text of a button's data-copy attribute to the clipboard
+  document.querySelectorAll("[data-copy]").forEach(function (button) {
+    button.addEventListener("click", function () {
+      var label = button.textContent;
+
+      copy(button.getAttribute("data-copy")).then(function () {
+        button.textContent = "Copied!";
+      }, function () {
+        button.textContent = "Copy failed";
+      }).then(function () {
+        setTimeout(function () {
+          button.textContent = label;
+        }, 1500);
+      });
+    });
+  });
+
+  function copy(text) {
+    if (navigator.clipboard && window.isSecureContext) {
+      return navigator.clipboard.writeText(text);
+    }
+
+    // the clipboard api is only available to secure pages, so fall back to
+    // selecting the text in a hidden field for servers without tls
+    return new Promise(function (resolve, reject) {
+      var field = document.createElement("textarea");
+      field.value = text;
+      field.style.position = "fixed";
+      field.style.opacity = "0";
+      document.body.appendChild(field);
+      field.select();
+
+      var copied = document.execCommand("copy");
+      document.body.removeChild(field);
+
+      if (copied) {
+        resolve();
+      } else {
+        reject();
+      }
+    });
+  }
+
+  var dropzone = document.getElementById("dropzone");
+  if (!dropzone) {
+    return;
+  }
+
+  var files = document.getElementById("files");
+  var list = document.getElementById("uploads");
+  var tokenForm = document.getElementById("token");
+  var pending = [];
+
+  ["dragenter", "dragover"].forEach(function (event) {
+    dropzone.addEventListener(event, function (e) {
+      e.preventDefault();
+      dropzone.classList.add("over");
+    });
+  });
+
+  ["dragleave", "drop"].forEach(function (event) {
+    dropzone.addEventListener(event, function (e) {
+      e.preventDefault();
+      dropzone.classList.remove("over");
+    });
+  });
+
+  dropzone.addEventListener("drop", function (e) {
+    uploadAll(e.dataTransfer.files);
+  });
+
+  files.addEventListener("change", function () {
+    uploadAll(files.files);
+    files.value = "";
+  });
+
+  // uploads that were rejected for a missing token are retried once a token is saved
+  tokenForm.addEventListener("submit", function (e) {
+    e.preventDefault();
+
+    localStorage.setItem(tokenKey, tokenForm.elements.token.value);
+    tokenForm.hidden = true;
+
+    var retry = pending;
+    pending = [];
+
+    retry.forEach(function (u) {
+      upload(u.file, u.item);
+    });
+  });
+
+  function uploadAll(selected) {
+    Array.prototype.forEach.call(selected, function (file) {
+      var item = document.createElement("li");
+      item.appendChild(document.createElement("progress"));
+      item.appendChild(document.createElement("span"));
+      list.appendChild(item);
+
+      upload(file, item);
+    });
+  }
+
+  function upload(file, item) {
+    var progress = item.querySelector("progress");
+    var status = item.querySelector("span");
+
+    status.className = "";
+    status.textContent = file.name;
+    progress.value = 0;
+
+    var params = new URLSearchParams({ name: file.name });
+
+    if (dropzone.dataset.bucket) {
+      params.set("bucket", dropzone.dataset.bucket);
+    }
+
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", dropzone.dataset.upload + "?" + params.toString());
+    xhr.setRequestHeader("Content-Type", "application/octet-stream");
+
+    var token = localStorage.getItem(tokenKey);
+    if (token) {
+      xhr.setRequestHeader("Authorization", "Bearer " + token);
+    }
+
+    xhr.upload.addEventListener("progress", function (e) {
+      if (e.lengthComputable) {
+        progress.value = e.loaded / e.total;
+      }
+    });
+
+    xhr.addEventListener("load", function () {
+      if (xhr.status === 401) {
+        localStorage.removeItem(tokenKey);
+        pending.push({ file: file, item: item });
+        status.textContent = file.name + ": waiting for a token";
+        tokenForm.hidden = false;
+        tokenForm.elements.token.focus();
+        return;
+      }
+
+      if (xhr.status !== 201) {
+        failed(status, file.name + ": " + (xhr.responseText || xhr.statusText));
+        return;
+      }
+
+      var resp = JSON.parse(xhr.responseText);
+      var link = document.createElement("a");
+
+      progress.value = 1;
+      link.href = resp.page;
+      link.textContent = resp.name;
+      status.textContent = "";
+      status.appendChild(link);
+    });
+
+    xhr.addEventListener("error", function () {
+      failed(status, file.name + ": the server could not be reached");
+    });
+
+    xhr.send(file);
+  }
+
+  function failed(status, message) {
+    status.className = "failed";
+    status.textContent = message;
+  }
+})();
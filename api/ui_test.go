@@ -0,0 +1,255 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUIServer(t *testing.T, opts ...UIOption) (*httptest.Server, *storage.MemoryStore) {
+	m := storage.NewMemoryStore()
+
+	rs := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithMaxObjectSize(1<<20),
+		WithBuckets(storage.NewBuckets(m)),
+		WithIndex(storage.NewIndex(m)),
+	)
+
+	require.NoError(t, rs.buckets.CreateBucket(&storage.Bucket{Name: "cats"}))
+	require.NoError(t, rs.buckets.CreateBucket(&storage.Bucket{Name: "secret", Visibility: storage.VisibilityPrivate}))
+
+	return httptest.NewServer(NewUIResource(rs, opts...)), m
+}
+
+func uiGet(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	require.NoError(t, err)
+
+	return resp, buf.String()
+}
+
+func TestUIGallery(t *testing.T) {
+	s, m := testUIServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	for i := 0; i < uiPageSize+2; i++ {
+		require.NoError(t, m.WriteObject(fmt.Sprintf("cat-%02d.png", i), bytes.NewReader(img)))
+	}
+
+	require.NoError(t, m.WriteObject("cats/grumpy cat.png", bytes.NewReader(img)))
+	require.NoError(t, m.WriteObject("secret/hidden.png", bytes.NewReader(img)))
+
+	resp, body := uiGet(t, s.URL+UIPath)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `src="/_ui/t/cat-00.png"`)
+	assert.Contains(t, body, `href="/_ui/i/cat-47.png"`)
+	assert.NotContains(t, body, "cat-48.png")
+	assert.Contains(t, body, `href="/_ui/?page=cat-47.png"`)
+
+	// only public buckets are shown
+	assert.Contains(t, body, `href="/_ui/?bucket=cats"`)
+	assert.NotContains(t, body, "secret")
+
+	resp, body = uiGet(t, s.URL+UIPath+"?page=cat-47.png")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "cat-49.png")
+	assert.NotContains(t, body, "cat-47.png")
+	assert.NotContains(t, body, "Next page")
+
+	resp, body = uiGet(t, s.URL+UIPath+"?bucket=cats")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `src="/_ui/t/cats/grumpy%20cat.png"`)
+	assert.NotContains(t, body, "cat-00.png")
+
+	resp, _ = uiGet(t, s.URL+UIPath+"?bucket=secret")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = uiGet(t, s.URL+UIPath+"?bucket=missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = uiGet(t, s.URL+UIPath+"static/ui.js")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "data-copy")
+
+	resp, _ = uiGet(t, s.URL+UIPath+"missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUIImage(t *testing.T) {
+	s, m := testUIServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	require.NoError(t, m.WriteObject("cats/grumpy cat.png", bytes.NewReader(img)))
+	require.NoError(t, m.WriteObject("secret/hidden.png", bytes.NewReader(img)))
+
+	resp, body := uiGet(t, s.URL+UIPath+"i/cats/grumpy%20cat.png")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `<img src="/cats/grumpy%20cat.png" alt="grumpy cat.png">`)
+	assert.Contains(t, body, `data-copy="http://127.0.0.1:8080/cats/grumpy cat.png"`)
+	assert.Contains(t, body, `data-copy="![grumpy cat.png](http://127.0.0.1:8080/cats/grumpy cat.png)"`)
+	assert.Contains(t, body, "image/png")
+
+	resp, _ = uiGet(t, s.URL+UIPath+"i/cats/missing.png")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = uiGet(t, s.URL+UIPath+"i/secret/hidden.png")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUIThumbnail(t *testing.T) {
+	s, m := testUIServer(t)
+	defer s.Close()
+
+	small := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+	solid := image.NewNRGBA(image.Rect(0, 0, 1280, 640))
+	draw.Draw(solid, solid.Bounds(), image.NewUniform(color.NRGBA{B: 255, A: 128}), image.Point{}, draw.Src)
+
+	large := testPNG(t, solid)
+
+	require.NoError(t, m.WriteObject("small.png", bytes.NewReader(small)))
+	require.NoError(t, m.WriteObject("cats/large.png", bytes.NewReader(large)))
+	require.NoError(t, m.WriteObject("broken.png", bytes.NewReader([]byte("meow"))))
+
+	// small images are served as they are
+	resp, body := uiGet(t, s.URL+UIPath+"t/small.png")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(small), body)
+
+	resp, body = uiGet(t, s.URL+UIPath+"t/cats/large.png")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	thumb, _, err := image.Decode(strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, thumbnailSize, thumbnailSize/2), thumb.Bounds())
+
+	// transparency is kept when the image is scaled
+	assert.Equal(t, color.NRGBA{B: 255, A: 128}, color.NRGBAModel.Convert(thumb.At(10, 10)))
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+UIPath+"t/cats/large.png", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+
+	cached, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	cached.Body.Close()
+	assert.Equal(t, http.StatusNotModified, cached.StatusCode)
+
+	// images that cannot be scaled are left to the browser
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err = client.Get(s.URL + UIPath + "t/broken.png")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/broken.png", resp.Header.Get("Location"))
+
+	resp, _ = uiGet(t, s.URL+UIPath+"t/missing.png")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUIUpload(t *testing.T) {
+	a := NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+	})
+
+	s, m := testUIServer(t, WithUIAuthenticator(a))
+	defer s.Close()
+
+	img := testPNG(t, testPicture(64, 48, color.RGBA{R: 255, G: 220, A: 255}))
+
+	upload := func(query, token string, data []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, s.URL+UIPath+"upload?"+query, bytes.NewReader(data))
+		require.NoError(t, err)
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	resp := upload("name=cat.png&bucket=cats", "", img)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = upload("name=cat.png&bucket=cats", "s3cr3t", img)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+
+	assert.Equal(t, "cats/cat.png", body["name"])
+	assert.Equal(t, "http://127.0.0.1:8080/cats/cat.png", body["url"])
+	assert.Equal(t, "/_ui/i/cats/cat.png", body["page"])
+
+	info, err := m.StatObject("cats/cat.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img)), info.Size)
+
+	resp = upload("name=cat.png&bucket=cats", "s3cr3t", img)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = upload("name=cat.png", "s3cr3t", []byte("<html></html>"))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "ReasonUnsupportedContent", resp.Header.Get("X-Catly-Reason"))
+
+	resp = upload("name=huge.png", "s3cr3t", make([]byte, 2<<20))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestFitBounds(t *testing.T) {
+	cases := []struct {
+		width, height       int
+		maxWidth, maxHeight int
+		expected            image.Point
+	}{
+		{100, 50, 320, 320, image.Pt(100, 50)},
+		{640, 320, 320, 320, image.Pt(320, 160)},
+		{320, 1280, 320, 320, image.Pt(80, 320)},
+		{10000, 1, 320, 320, image.Pt(320, 1)},
+		{640, 320, 0, 100, image.Pt(200, 100)},
+		{640, 320, 400, 0, image.Pt(400, 200)},
+		{640, 320, 0, 0, image.Pt(640, 320)},
+	}
+
+	for _, c := range cases {
+		w, h := fitBounds(c.width, c.height, c.maxWidth, c.maxHeight)
+		assert.Equal(t, c.expected, image.Pt(w, h))
+	}
+}
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"image"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ViewPath the path the view pages of images are served from. It is not
+	// a valid bucket name, so images in buckets are never served from it
+	ViewPath = "/v/"
+	// OEmbedPath the path of the oEmbed endpoint for images and their view pages
+	OEmbedPath = "/oembed"
+	// how long consumers of the oEmbed endpoint may cache responses, in seconds
+	oembedCacheAge = 86400
+	// the number of bytes read from the start of an image to find its dimensions
+	viewHeaderSize = 64 << 10
+)
+
+// errHeaderRead stops reading an image once enough of it has been read
+var errHeaderRead = errors.New("image header read")
+
+// WithViewPages includes the url of each uploaded image's view
+// page, which is served by a ViewResource, in upload responses
+func WithViewPages() GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.views = true
+	}
+}
+
+// viewURL returns the url of the view page of an image, if view pages are enabled
+func (rs *GRPCResource) viewURL(id string) string {
+	if !rs.views {
+		return ""
+	}
+
+	return rs.address + strings.TrimPrefix(ViewPath, "/") + strings.TrimPrefix(objectPath(id), "/")
+}
+
+// ViewResource serves a page for each image with OpenGraph and Twitter
+// card metadata, so that a preview of the image is shown when its page is
+// shared, along with an oEmbed endpoint describing images and their pages
+type ViewResource struct {
+	objects  *GRPCResource
+	template *template.Template
+}
+
+// viewObject an image shown by a view page
+type viewObject struct {
+	*catly.ObjectInfo
+	// ID the name of the image, including its bucket
+	ID string
+	// URL the escaped url of the image
+	URL string
+	// ViewURL the escaped url of the image's view page
+	ViewURL string
+	// OEmbedURL the url of the oEmbed response for the image's view page
+	OEmbedURL string
+	// Width the width of the image in pixels, or zero if it cannot be decoded
+	Width int
+	// Height the height of the image in pixels, or zero if it cannot be decoded
+	Height int
+}
+
+// oembedResponse an oEmbed response describing an image
+type oembedResponse struct {
+	Type         string `json:"type"`
+	Version      string `json:"version"`
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	CacheAge     int    `json:"cache_age"`
+	URL          string `json:"url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// NewViewResource creates a new server for the view pages of images
+func NewViewResource(objects *GRPCResource) *ViewResource {
+	return &ViewResource{
+		objects: objects,
+		template: template.Must(
+			template.New("view").Funcs(uiFuncs).ParseFS(uiFiles, "ui/templates/layout.html", "ui/templates/view.html"),
+		),
+	}
+}
+
+// View handles GET requests for the view page of an image
+func (v *ViewResource) View(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	obj, rerr := v.describe(r.Context(), strings.TrimPrefix(r.URL.Path, ViewPath))
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	err := v.template.ExecuteTemplate(&buf, "layout", obj)
+	if err != nil {
+		log.Error().
+			Str("file", obj.ID).
+			Str("error", err.Error()).
+			Msg("failed to render view page")
+
+		httpError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// OEmbed handles GET requests for the oEmbed response of an image, which can be requested
+// with the url of the image or its view page. Only json responses are supported
+func (v *ViewResource) OEmbed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	params := r.URL.Query()
+
+	format := params.Get("format")
+	if format != "" && format != "json" {
+		httpError(w, http.StatusNotImplemented, "only the json format is supported")
+		return
+	}
+
+	var maxWidth, maxHeight int
+	var err error
+
+	for param, max := range map[string]*int{"maxwidth": &maxWidth, "maxheight": &maxHeight} {
+		if params.Get(param) == "" {
+			continue
+		}
+
+		*max, err = strconv.Atoi(params.Get(param))
+		if err != nil || *max < 1 {
+			httpError(w, http.StatusBadRequest, param+" must be a positive number")
+			return
+		}
+	}
+
+	id, ok := v.objectID(params.Get("url"))
+	if !ok {
+		httpError(w, http.StatusNotFound, "url is not an image served by this server")
+		return
+	}
+
+	obj, rerr := v.describe(r.Context(), id)
+	if rerr != nil {
+		requestErrorHTTP(w, r, rerr)
+		return
+	}
+
+	// photos must have dimensions, so images that cannot be decoded cannot be embedded
+	if obj.Width < 1 {
+		httpError(w, http.StatusNotFound, "image cannot be embedded")
+		return
+	}
+
+	width, height := fitBounds(obj.Width, obj.Height, maxWidth, maxHeight)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&oembedResponse{
+		Type:         "photo",
+		Version:      "1.0",
+		Title:        obj.Name,
+		AuthorName:   obj.Owner,
+		ProviderName: "catly",
+		ProviderURL:  v.objects.address,
+		CacheAge:     oembedCacheAge,
+		URL:          obj.URL,
+		Width:        width,
+		Height:       height,
+	})
+}
+
+// objectID returns the id of the image that a url of
+// an image, or the url of its view page, refers to
+func (v *ViewResource) objectID(rawURL string) (string, bool) {
+	base, err := url.Parse(v.objects.address)
+	if err != nil {
+		return "", false
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) || !strings.HasPrefix(u.Path, base.Path) {
+		return "", false
+	}
+
+	id := strings.TrimPrefix(u.Path, base.Path)
+	id = strings.TrimPrefix(id, strings.TrimPrefix(ViewPath, "/"))
+
+	return id, id != ""
+}
+
+// describe returns the details of an image that are shown on its view page
+func (v *ViewResource) describe(ctx context.Context, id string) (*viewObject, *requestError) {
+	rs := v.objects
+
+	bucket, name := storage.SplitObjectID(id)
+
+	rerr := rs.public(bucket)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	info, err := rs.Stat(ctx, &catly.StatObjectRequest{
+		Name:   name,
+		Bucket: bucket,
+	})
+
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	id = storage.ObjectID(bucket, name)
+	escaped := strings.TrimPrefix(objectPath(id), "/")
+
+	obj := &viewObject{
+		ObjectInfo: info,
+		ID:         id,
+		URL:        rs.address + escaped,
+		ViewURL:    rs.address + strings.TrimPrefix(ViewPath, "/") + escaped,
+	}
+
+	obj.OEmbedURL = rs.address + strings.TrimPrefix(OEmbedPath, "/") + "?" + url.Values{
+		"url":    {obj.ViewURL},
+		"format": {"json"},
+	}.Encode()
+
+	// only the header of the image is read and decoded, to find its dimensions
+	hw := &headerWriter{size: viewHeaderSize}
+
+	err = rs.storage.ReadObject(id, hw)
+	if err != nil && !hw.full() {
+		return nil, storageError(err)
+	}
+
+	cfg, _, err := image.DecodeConfig(&hw.buf)
+	if err == nil {
+		obj.Width = cfg.Width
+		obj.Height = cfg.Height
+	}
+
+	return obj, nil
+}
+
+// headerWriter buffers the start of an image, failing
+// writes once its size has been reached so the rest
+// of the image is not read
+type headerWriter struct {
+	buf  bytes.Buffer
+	size int
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	remaining := w.size - w.buf.Len()
+
+	if len(p) > remaining {
+		w.buf.Write(p[:remaining])
+		return remaining, errHeaderRead
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *headerWriter) full() bool {
+	return w.buf.Len() >= w.size
+}
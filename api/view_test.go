@@ -0,0 +1,193 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testViewServer(t *testing.T) (*httptest.Server, *GRPCResource, *storage.MemoryStore) {
+	m := storage.NewMemoryStore()
+
+	rs := NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		WithBuckets(storage.NewBuckets(m)),
+		WithIndex(storage.NewIndex(m)),
+		WithViewPages(),
+	)
+
+	require.NoError(t, rs.buckets.CreateBucket(&storage.Bucket{Name: "cats"}))
+	require.NoError(t, rs.buckets.CreateBucket(&storage.Bucket{Name: "secret", Visibility: storage.VisibilityPrivate}))
+
+	v := NewViewResource(rs)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ViewPath, v.View)
+	mux.HandleFunc(OEmbedPath, v.OEmbed)
+
+	return httptest.NewServer(mux), rs, m
+}
+
+func TestViewPage(t *testing.T) {
+	s, rs, m := testViewServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(640, 480, color.RGBA{R: 255, G: 220, A: 255}))
+
+	resp, err := rs.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name:        "grumpy cat.png",
+		Bucket:      "cats",
+		Description: "a very <grumpy> cat",
+		Data:        img,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/cats/grumpy cat.png", resp.Url)
+	assert.Equal(t, "http://127.0.0.1:8080/v/cats/grumpy%20cat.png", resp.ViewUrl)
+
+	require.NoError(t, m.WriteObject("secret/hidden.png", bytes.NewReader(img)))
+
+	hr, body := uiGet(t, s.URL+ViewPath+"cats/grumpy%20cat.png")
+	require.Equal(t, http.StatusOK, hr.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", hr.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<meta property="og:title" content="grumpy cat.png">`)
+	assert.Contains(t, body, `<meta property="og:url" content="http://127.0.0.1:8080/v/cats/grumpy%20cat.png">`)
+	assert.Contains(t, body, `<meta property="og:image" content="http://127.0.0.1:8080/cats/grumpy%20cat.png">`)
+	assert.Contains(t, body, `<meta property="og:image:type" content="image/png">`)
+	assert.Contains(t, body, `<meta property="og:image:width" content="640">`)
+	assert.Contains(t, body, `<meta property="og:image:height" content="480">`)
+	assert.Contains(t, body, `<meta property="og:description" content="a very &lt;grumpy&gt; cat">`)
+	assert.Contains(t, body, `<meta name="twitter:card" content="summary_large_image">`)
+	assert.Contains(t, body, `<link rel="alternate" type="application/json+oembed" href="http://127.0.0.1:8080/oembed?format=json&amp;url=http%3A%2F%2F127.0.0.1%3A8080%2Fv%2Fcats%2Fgrumpy%2520cat.png"`)
+
+	hr, _ = uiGet(t, s.URL+ViewPath+"cats/missing.png")
+	assert.Equal(t, http.StatusNotFound, hr.StatusCode)
+
+	hr, _ = uiGet(t, s.URL+ViewPath+"secret/hidden.png")
+	assert.Equal(t, http.StatusNotFound, hr.StatusCode)
+
+	// view urls are only returned when view pages are enabled
+	rs.views = false
+
+	resp, err = rs.Upload(context.Background(), &catly.UploadObjectRequest{
+		Name: "another cat.png",
+		Data: img,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, resp.ViewUrl)
+}
+
+// readCountingStore counts the bytes of objects that are read
+type readCountingStore struct {
+	*storage.MemoryStore
+	read int
+}
+
+func (s *readCountingStore) ReadObject(id string, w io.Writer) error {
+	return s.MemoryStore.ReadObject(id, writerFunc(func(p []byte) (int, error) {
+		n, err := w.Write(p)
+		s.read += n
+		return n, err
+	}))
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestViewPageLargeImage(t *testing.T) {
+	s, rs, m := testViewServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(640, 480, color.RGBA{R: 255, G: 220, A: 255}))
+	img = append(img, make([]byte, 1<<20)...)
+
+	require.NoError(t, m.WriteObject("cats/big.png", bytes.NewReader(img)))
+
+	cs := &readCountingStore{MemoryStore: m}
+	rs.storage = cs
+
+	// only the start of the image is read to find its dimensions
+	hr, body := uiGet(t, s.URL+ViewPath+"cats/big.png")
+	require.Equal(t, http.StatusOK, hr.StatusCode)
+	assert.Contains(t, body, `<meta property="og:image:width" content="640">`)
+	assert.Contains(t, body, `<meta property="og:image:height" content="480">`)
+	assert.LessOrEqual(t, cs.read, viewHeaderSize)
+}
+
+func TestOEmbed(t *testing.T) {
+	s, _, m := testViewServer(t)
+	defer s.Close()
+
+	img := testPNG(t, testPicture(640, 480, color.RGBA{R: 255, G: 220, A: 255}))
+
+	require.NoError(t, m.WriteObject("cats/cat.png", bytes.NewReader(img)))
+	require.NoError(t, m.WriteObject("secret/hidden.png", bytes.NewReader(img)))
+	require.NoError(t, m.WriteObject("broken.png", bytes.NewReader([]byte("meow"))))
+
+	oembed := func(params url.Values) (*http.Response, map[string]interface{}) {
+		resp, err := http.Get(s.URL + OEmbedPath + "?" + params.Encode())
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		var body map[string]interface{}
+
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+
+		return resp, body
+	}
+
+	resp, body := oembed(url.Values{"url": {"http://127.0.0.1:8080/v/cats/cat.png"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, map[string]interface{}{
+		"type":          "photo",
+		"version":       "1.0",
+		"title":         "cat.png",
+		"provider_name": "catly",
+		"provider_url":  "http://127.0.0.1:8080/",
+		"cache_age":     float64(oembedCacheAge),
+		"url":           "http://127.0.0.1:8080/cats/cat.png",
+		"width":         float64(640),
+		"height":        float64(480),
+	}, body)
+
+	// the url of the image can be used instead of its view page
+	resp, body = oembed(url.Values{"url": {"http://127.0.0.1:8080/cats/cat.png"}, "maxwidth": {"320"}, "format": {"json"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(320), body["width"])
+	assert.Equal(t, float64(240), body["height"])
+
+	resp, _ = oembed(url.Values{"url": {"http://127.0.0.1:8080/v/cats/cat.png"}, "format": {"xml"}})
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	resp, _ = oembed(url.Values{"url": {"http://127.0.0.1:8080/v/cats/cat.png"}, "maxheight": {"-1"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	for _, u := range []string{
+		"http://example.com/v/cats/cat.png",
+		"http://127.0.0.1:8080/v/cats/missing.png",
+		"http://127.0.0.1:8080/v/secret/hidden.png",
+		"http://127.0.0.1:8080/broken.png",
+		"",
+	} {
+		resp, _ = oembed(url.Values{"url": {u}})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, u)
+	}
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// DefaultEventHistory the default number of recent events held so watchers can resume
+	DefaultEventHistory = 1024
+	// DefaultWatchBuffer the default number of events buffered for each watcher
+	DefaultWatchBuffer = 256
+)
+
+var errWatchUnsupported = newRequestError(
+	codes.Unimplemented,
+	catly.ErrorReason_ReasonUnknown,
+	"watching for events is not supported by this server",
+)
+
+// WithWatch streams the events published by the broker to watchers
+func WithWatch(broker *EventBroker) GRPCOption {
+	return func(rs *GRPCResource) {
+		rs.broker = broker
+		rs.publishers = append(rs.publishers, broker)
+	}
+}
+
+// EventBroker numbers events and streams them to watchers. The most recent
+// events are held so that watchers that reconnect can resume from the last
+// event they saw. Each watcher has a bounded buffer, and events are dropped
+// for watchers that are too slow to keep up
+type EventBroker struct {
+	mu       sync.Mutex
+	sequence uint64
+	history  []*sequencedEvent
+	next     int
+	buffer   int
+	watchers map[*watcher]struct{}
+}
+
+// sequencedEvent an event and its sequence number
+type sequencedEvent struct {
+	sequence uint64
+	event    *Event
+}
+
+// watchedEvent an event sent to a watcher, with the number of events
+// the watcher missed immediately before it
+type watchedEvent struct {
+	*sequencedEvent
+	dropped uint64
+}
+
+type watcher struct {
+	events  chan *watchedEvent
+	filter  func(e *Event) bool
+	dropped uint64
+}
+
+// NewEventBroker creates a new event broker that holds the number of recent
+// events specified by history, and buffers up to buffer events for each watcher
+func NewEventBroker(history, buffer int) *EventBroker {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	return &EventBroker{
+		history:  make([]*sequencedEvent, 0, history),
+		buffer:   buffer,
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// Publish numbers an event and sends it to each watcher that it matches
+func (b *EventBroker) Publish(e *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sequence++
+
+	se := &sequencedEvent{
+		sequence: b.sequence,
+		event:    e,
+	}
+
+	if cap(b.history) > 0 {
+		if len(b.history) < cap(b.history) {
+			b.history = append(b.history, se)
+		} else {
+			b.history[b.next] = se
+			b.next = (b.next + 1) % len(b.history)
+		}
+	}
+
+	for w := range b.watchers {
+		if !w.filter(e) {
+			continue
+		}
+
+		select {
+		case w.events <- &watchedEvent{sequencedEvent: se, dropped: w.dropped}:
+			w.dropped = 0
+		default:
+			w.dropped++
+		}
+	}
+}
+
+// Sequence returns the sequence number of the most recent event
+func (b *EventBroker) Sequence() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sequence
+}
+
+// watch registers a watcher for events that match the filter. If after is
+// not zero, the held events with a greater sequence number that match the
+// filter are returned, and must be sent before any events from the watcher
+func (b *EventBroker) watch(after uint64, filter func(e *Event) bool) (*watcher, []*watchedEvent, *requestError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// sequence numbers start from zero when the server is restarted
+	if after > b.sequence {
+		return nil, nil, newRequestError(
+			codes.OutOfRange,
+			catly.ErrorReason_ReasonUnknown,
+			fmt.Sprintf("event %d has not happened yet, the server may have been restarted", after),
+		)
+	}
+
+	w := &watcher{
+		events: make(chan *watchedEvent, b.buffer),
+		filter: filter,
+	}
+
+	b.watchers[w] = struct{}{}
+
+	if after < 1 {
+		return w, nil, nil
+	}
+
+	var replay []*watchedEvent
+
+	// events that are no longer held are reported as dropped
+	var dropped uint64
+
+	if oldest := b.sequence - uint64(len(b.history)) + 1; after+1 < oldest {
+		dropped = oldest - after - 1
+	}
+
+	for i := range b.history {
+		se := b.history[(b.next+i)%len(b.history)]
+
+		if se.sequence <= after || !filter(se.event) {
+			continue
+		}
+
+		replay = append(replay, &watchedEvent{sequencedEvent: se, dropped: dropped})
+		dropped = 0
+	}
+
+	w.dropped = dropped
+
+	return w, replay, nil
+}
+
+// unwatch removes a watcher
+func (b *EventBroker) unwatch(w *watcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.watchers, w)
+}
+
+// Watch handles requests to stream an event for every image that is uploaded or deleted
+func (rs *GRPCResource) Watch(req *catly.WatchRequest, stream catly.Object_WatchServer) error {
+	if rs.broker == nil {
+		return errWatchUnsupported.err()
+	}
+
+	if req.Bucket != "" {
+		_, rerr := rs.bucket(req.Bucket)
+		if rerr != nil {
+			return rerr.err()
+		}
+	}
+
+	filter := func(e *Event) bool {
+		if req.Bucket != "" && e.Object.Bucket != req.Bucket {
+			return false
+		}
+
+		if req.ContentType != "" && e.Object.ContentType != req.ContentType {
+			return false
+		}
+
+		return strings.HasPrefix(e.Object.Name, req.Prefix)
+	}
+
+	w, replay, rerr := rs.broker.watch(req.AfterSequence, filter)
+	if rerr != nil {
+		return rerr.err()
+	}
+
+	defer rs.broker.unwatch(w)
+
+	// send the headers, so the client knows it is receiving events
+	err := stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return err
+	}
+
+	for _, we := range replay {
+		err = stream.Send(watchEvent(we))
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case we := <-w.events:
+			err = stream.Send(watchEvent(we))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func watchEvent(we *watchedEvent) *catly.WatchEvent {
+	e := we.event
+
+	info := &catly.ObjectInfo{
+		Name:        e.Object.Name,
+		Bucket:      e.Object.Bucket,
+		Size:        e.Object.Size,
+		ContentType: e.Object.ContentType,
+		Url:         e.Object.URL,
+		Owner:       e.Object.Owner,
+	}
+
+	var eventType catly.EventType
+
+	switch e.Type {
+	case EventObjectCreated:
+		eventType = catly.EventType_EventObjectCreated
+		info.Created = e.Time.Unix()
+	case EventObjectDeleted:
+		eventType = catly.EventType_EventObjectDeleted
+	}
+
+	return &catly.WatchEvent{
+		Sequence: we.sequence,
+		Type:     eventType,
+		Time:     e.Time.Unix(),
+		Object:   info,
+		Dropped:  we.dropped,
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := NewEventBroker(4, 2)
+
+	all := func(e *Event) bool { return true }
+
+	w, replay, rerr := b.watch(0, all)
+	require.Nil(t, rerr)
+	assert.Empty(t, replay)
+
+	for _, name := range []string{"1.jpg", "2.jpg", "3.jpg", "4.jpg", "5.jpg", "6.jpg"} {
+		b.Publish(testEvent(name))
+	}
+
+	assert.Equal(t, uint64(6), b.Sequence())
+
+	// the watcher's buffer holds two events, so the rest are dropped
+	we := <-w.events
+	assert.Equal(t, uint64(1), we.sequence)
+	assert.Equal(t, uint64(0), we.dropped)
+
+	we = <-w.events
+	assert.Equal(t, uint64(2), we.sequence)
+
+	// and the number dropped is reported with the next event
+	b.Publish(testEvent("7.jpg"))
+
+	we = <-w.events
+	assert.Equal(t, uint64(7), we.sequence)
+	assert.Equal(t, uint64(4), we.dropped)
+
+	b.unwatch(w)
+
+	// watchers can resume from events that are still held
+	w, replay, rerr = b.watch(5, all)
+	require.Nil(t, rerr)
+	require.Len(t, replay, 2)
+	assert.Equal(t, uint64(6), replay[0].sequence)
+	assert.Equal(t, uint64(0), replay[0].dropped)
+	assert.Equal(t, uint64(7), replay[1].sequence)
+	b.unwatch(w)
+
+	// and events that are no longer held are reported as dropped
+	w, replay, rerr = b.watch(1, func(e *Event) bool { return e.Object.Name != "4.jpg" })
+	require.Nil(t, rerr)
+	require.Len(t, replay, 3)
+	assert.Equal(t, uint64(5), replay[0].sequence)
+	assert.Equal(t, uint64(2), replay[0].dropped)
+	assert.Equal(t, uint64(0), replay[1].dropped)
+	b.unwatch(w)
+
+	_, _, rerr = b.watch(8, all)
+	require.NotNil(t, rerr)
+	assert.Equal(t, codes.OutOfRange, rerr.code)
+}
+
+func TestObjectWatch(t *testing.T) {
+	s, _ := testGRPCServerWithDetector(t, 1<<20, func(data []byte) string {
+		return "image/jpeg"
+	}, WithWatch(NewEventBroker(DefaultEventHistory, DefaultWatchBuffer)))
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.CreateBucket(ctx, &catly.CreateBucketRequest{Bucket: &catly.Bucket{Name: "cats"}})
+	require.NoError(t, err)
+
+	watch, err := c.Watch(ctx, &catly.WatchRequest{Bucket: "cats", Prefix: "grumpy-"})
+	require.NoError(t, err)
+
+	// wait until the watch has started
+	_, err = watch.Header()
+	require.NoError(t, err)
+
+	uploads := []*catly.UploadObjectRequest{
+		{Name: "grumpy-cat.jpg", Data: make([]byte, 100)},
+		{Name: "grumpy-cat.jpg", Bucket: "cats", Data: make([]byte, 200)},
+		{Name: "happy-cat.jpg", Bucket: "cats", Data: make([]byte, 300)},
+		{Name: "grumpy-kitten.jpg", Bucket: "cats", Data: make([]byte, 400)},
+	}
+
+	for _, req := range uploads {
+		_, err = c.Upload(ctx, req)
+		require.NoError(t, err)
+	}
+
+	_, err = c.Delete(ctx, &catly.DeleteObjectRequest{Name: "grumpy-cat.jpg", Bucket: "cats"})
+	require.NoError(t, err)
+
+	e, err := watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), e.Sequence)
+	assert.Equal(t, catly.EventType_EventObjectCreated, e.Type)
+	assert.Equal(t, "grumpy-cat.jpg", e.Object.Name)
+	assert.Equal(t, "cats", e.Object.Bucket)
+	assert.Equal(t, int64(200), e.Object.Size)
+	assert.Equal(t, "http://127.0.0.1:8080/cats/grumpy-cat.jpg", e.Object.Url)
+	assert.Equal(t, uint64(0), e.Dropped)
+
+	e, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), e.Sequence)
+	assert.Equal(t, "grumpy-kitten.jpg", e.Object.Name)
+
+	e, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), e.Sequence)
+	assert.Equal(t, catly.EventType_EventObjectDeleted, e.Type)
+	assert.Equal(t, "grumpy-cat.jpg", e.Object.Name)
+
+	// watchers can resume after the last event they received
+	resumed, err := c.Watch(ctx, &catly.WatchRequest{AfterSequence: 2, ContentType: "image/jpeg"})
+	require.NoError(t, err)
+
+	for _, sequence := range []uint64{3, 4, 5} {
+		e, err = resumed.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, sequence, e.Sequence)
+	}
+
+	missing, err := c.Watch(ctx, &catly.WatchRequest{Bucket: "dogs"})
+	require.NoError(t, err)
+
+	_, err = missing.Recv()
+	assertReason(t, err, codes.NotFound, catly.ErrorReason_ReasonBucketNotFound)
+}
@@ -0,0 +1,506 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultWebhookAttempts the default number of times an event is sent to an endpoint
+	DefaultWebhookAttempts = 12
+	// DefaultWebhookBackoff the default time to wait before the first retry
+	DefaultWebhookBackoff = time.Second
+	// DefaultWebhookMaxBackoff the maximum time to wait between retries
+	DefaultWebhookMaxBackoff = time.Hour
+	// DefaultWebhookTimeout the default time to wait for an endpoint to respond
+	DefaultWebhookTimeout = 10 * time.Second
+	// the number of events that are sent concurrently
+	webhookWorkers = 4
+	// the number of deliveries read from the outbox at a time
+	outboxBatchSize = 100
+)
+
+// the headers sent with every webhook request
+const (
+	// WebhookEventHeader the type of the event
+	WebhookEventHeader = "X-Catly-Event"
+	// WebhookDeliveryHeader the unique id of the delivery, which is the
+	// same for every attempt to send an event to an endpoint
+	WebhookDeliveryHeader = "X-Catly-Delivery"
+	// WebhookTimestampHeader the unix time the request was signed at
+	WebhookTimestampHeader = "X-Catly-Timestamp"
+	// WebhookSignatureHeader the hex encoded HMAC-SHA256 of the timestamp
+	// and body of the request, prefixed with 'sha256='
+	WebhookSignatureHeader = "X-Catly-Signature"
+)
+
+// WebhookEndpoint an endpoint that events are sent to
+type WebhookEndpoint struct {
+	// URL the url events are POSTed to
+	URL string `json:"url"`
+	// Secret the secret requests to the endpoint are signed with
+	Secret string `json:"secret"`
+	// Events the types of events sent to the endpoint. All events are sent if not set
+	Events []string `json:"events,omitempty"`
+}
+
+// WebhookOutbox specifies the interface that storage backends need to
+// implement to hold the events that have not yet been sent to an endpoint
+type WebhookOutbox interface {
+	ReadObject(id string, w io.Writer) error
+	WriteObject(id string, r io.Reader) error
+	ListObjects(prefix, after string, limit int) ([]*storage.ObjectInfo, error)
+	DeleteObject(id string) error
+}
+
+// outboxReplacer is implemented by outboxes that can atomically replace a
+// stored delivery, so it is never missing while it is being updated
+type outboxReplacer interface {
+	ReplaceObject(id string, r io.Reader) error
+}
+
+// WebhookOption configures optional behaviour of the webhook dispatcher
+type WebhookOption func(d *WebhookDispatcher)
+
+// WithWebhookRetries sets the number of times an event is sent to an endpoint
+// before it is dropped, and the initial time to wait between attempts. The
+// time waited is doubled after every attempt, up to the maximum backoff
+func WithWebhookRetries(attempts int, backoff, maxBackoff time.Duration) WebhookOption {
+	return func(d *WebhookDispatcher) {
+		d.attempts = attempts
+		d.backoff = backoff
+		d.maxBackoff = maxBackoff
+	}
+}
+
+// WithWebhookClient sets the http client used to send events
+func WithWebhookClient(client *http.Client) WebhookOption {
+	return func(d *WebhookDispatcher) {
+		d.client = client
+	}
+}
+
+// WebhookDispatcher sends signed events to webhook endpoints. Events are
+// held in an outbox until they have been sent, so that events that have
+// not been sent when the server is stopped are sent when it is restarted.
+// Failed requests are retried with an exponential backoff
+type WebhookDispatcher struct {
+	mu         sync.Mutex
+	outbox     WebhookOutbox
+	client     *http.Client
+	endpoints  []*WebhookEndpoint
+	pending    map[string]*delivery
+	wake       chan struct{}
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	now        func() time.Time
+}
+
+// delivery an event that is being sent to an endpoint
+type delivery struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       *Event    `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	sending     bool
+}
+
+// NewWebhookDispatcher creates a new webhook dispatcher that sends events to
+// the endpoints, loading any events that have not been sent from the outbox
+func NewWebhookDispatcher(outbox WebhookOutbox, endpoints []*WebhookEndpoint, opts ...WebhookOption) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		outbox:     outbox,
+		client:     &http.Client{Timeout: DefaultWebhookTimeout},
+		endpoints:  endpoints,
+		pending:    make(map[string]*delivery),
+		wake:       make(chan struct{}, 1),
+		attempts:   DefaultWebhookAttempts,
+		backoff:    DefaultWebhookBackoff,
+		maxBackoff: DefaultWebhookMaxBackoff,
+		now:        time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	var after string
+
+	for {
+		objects, err := outbox.ListObjects("", after, outboxBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list webhook outbox: %w", err)
+		}
+
+		for _, obj := range objects {
+			var buf bytes.Buffer
+
+			err = outbox.ReadObject(obj.Name, &buf)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read webhook outbox: %w", err)
+			}
+
+			var dl delivery
+
+			err = json.Unmarshal(buf.Bytes(), &dl)
+			if err != nil {
+				log.Warn().Str("delivery", obj.Name).Msg(fmt.Sprintf("skipping invalid webhook delivery: %s", err.Error()))
+				continue
+			}
+
+			d.pending[dl.ID] = &dl
+		}
+
+		if len(objects) < outboxBatchSize {
+			break
+		}
+
+		after = objects[len(objects)-1].Name
+	}
+
+	if len(d.pending) > 0 {
+		log.Info().Msg(fmt.Sprintf("loaded %d webhook deliveries from outbox", len(d.pending)))
+	}
+
+	return d, nil
+}
+
+// SetEndpoints replaces the endpoints that events are sent to. Events that
+// have not been sent to an endpoint that has been removed are dropped
+func (d *WebhookDispatcher) SetEndpoints(endpoints []*WebhookEndpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.endpoints = endpoints
+}
+
+// Pending returns the number of events that have not yet been sent
+func (d *WebhookDispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.pending)
+}
+
+// Publish adds an event to the outbox of each endpoint that accepts events of its type
+func (d *WebhookDispatcher) Publish(e *Event) {
+	d.mu.Lock()
+
+	var deliveries []*delivery
+
+	for _, ep := range d.endpoints {
+		if len(ep.Events) > 0 && !contains(ep.Events, e.Type) {
+			continue
+		}
+
+		deliveries = append(deliveries, &delivery{
+			ID:          uuid.New().String(),
+			URL:         ep.URL,
+			Event:       e,
+			NextAttempt: d.now(),
+		})
+	}
+
+	d.mu.Unlock()
+
+	// deliveries are stored without holding the lock, so
+	// publishers are not blocked by each other's writes
+	for _, dl := range deliveries {
+		// the event is still sent if it cannot be stored,
+		// but will be lost if the server is restarted
+		err := d.store(dl, false)
+		if err != nil {
+			log.Error().Str("delivery", dl.ID).Msg(fmt.Sprintf("failed to store webhook delivery: %s", err.Error()))
+		}
+	}
+
+	if len(deliveries) < 1 {
+		return
+	}
+
+	d.mu.Lock()
+
+	for _, dl := range deliveries {
+		d.pending[dl.ID] = dl
+	}
+
+	d.mu.Unlock()
+
+	d.notify()
+}
+
+// Run sends events to their endpoints until the context is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	sem := make(chan struct{}, webhookWorkers)
+	timer := time.NewTimer(0)
+
+	defer timer.Stop()
+
+	for {
+		due, next := d.due()
+
+		for _, dl := range due {
+			go func(dl *delivery) {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+
+				d.send(ctx, dl)
+
+				<-sem
+			}(dl)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if !next.IsZero() {
+			timer.Reset(next.Sub(d.now()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// due returns the deliveries that are due to be sent, and
+// the time the next delivery that is not yet due should be sent
+func (d *WebhookDispatcher) due() ([]*delivery, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+
+	var due []*delivery
+	var next time.Time
+
+	for _, dl := range d.pending {
+		if dl.sending {
+			continue
+		}
+
+		if !dl.NextAttempt.After(now) {
+			dl.sending = true
+			due = append(due, dl)
+			continue
+		}
+
+		if next.IsZero() || dl.NextAttempt.Before(next) {
+			next = dl.NextAttempt
+		}
+	}
+
+	return due, next
+}
+
+// send sends an event to its endpoint, scheduling a retry if it fails
+func (d *WebhookDispatcher) send(ctx context.Context, dl *delivery) {
+	d.mu.Lock()
+	ep := d.endpoint(dl.URL)
+	d.mu.Unlock()
+
+	if ep == nil {
+		log.Warn().Str("delivery", dl.ID).Msg(fmt.Sprintf("dropping webhook delivery to removed endpoint %s", dl.URL))
+		d.finish(dl, nil)
+		return
+	}
+
+	err := d.post(ctx, ep, dl)
+
+	// the server may be stopping, in which case the delivery will be sent when it restarts
+	if ctx.Err() != nil {
+		d.mu.Lock()
+		dl.sending = false
+		d.mu.Unlock()
+		return
+	}
+
+	d.finish(dl, err)
+}
+
+// post sends a signed request containing the event to the endpoint
+func (d *WebhookDispatcher) post(ctx context.Context, ep *WebhookEndpoint, dl *delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "catly-webhook")
+	req.Header.Set(WebhookEventHeader, dl.Event.Type)
+	req.Header.Set(WebhookDeliveryHeader, dl.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(ep.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// finish removes a delivery that has been sent, or has failed
+// too many times. Other failed deliveries are retried later
+func (d *WebhookDispatcher) finish(dl *delivery, err error) {
+	// wake the dispatcher, so it can schedule the next attempt
+	defer d.notify()
+
+	if err != nil {
+		d.mu.Lock()
+		dl.Attempts++
+		retry := dl.Attempts < d.attempts
+		if retry {
+			dl.NextAttempt = d.now().Add(d.retryBackoff(dl.Attempts))
+		}
+		d.mu.Unlock()
+
+		if retry {
+			log.Warn().Str("delivery", dl.ID).Msg(fmt.Sprintf("failed to send webhook to %s, will retry: %s", dl.URL, err.Error()))
+
+			// the delivery is still marked as sending while it is stored,
+			// so it cannot be sent and removed from the outbox meanwhile
+			serr := d.store(dl, true)
+			if serr != nil {
+				log.Error().Str("delivery", dl.ID).Msg(fmt.Sprintf("failed to store webhook delivery: %s", serr.Error()))
+			}
+
+			d.mu.Lock()
+			dl.sending = false
+			d.mu.Unlock()
+
+			return
+		}
+
+		log.Error().Str("delivery", dl.ID).Msg(fmt.Sprintf("failed to send webhook to %s after %d attempts: %s", dl.URL, dl.Attempts, err.Error()))
+	}
+
+	d.mu.Lock()
+	dl.sending = false
+	delete(d.pending, dl.ID)
+	d.mu.Unlock()
+
+	derr := d.outbox.DeleteObject(dl.ID)
+	if derr != nil && !errors.Is(derr, storage.ErrFileDoesNotExist) {
+		log.Error().Str("delivery", dl.ID).Msg(fmt.Sprintf("failed to remove webhook delivery from outbox: %s", derr.Error()))
+	}
+}
+
+// store writes a delivery to the outbox. Deliveries that have already been
+// stored are replaced atomically if the outbox supports it, otherwise the
+// earlier version must be removed before the delivery can be written
+func (d *WebhookDispatcher) store(dl *delivery, replace bool) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	if !replace {
+		return d.outbox.WriteObject(dl.ID, bytes.NewReader(data))
+	}
+
+	if rs, ok := d.outbox.(outboxReplacer); ok {
+		err = rs.ReplaceObject(dl.ID, bytes.NewReader(data))
+		if !errors.Is(err, storage.ErrFileDoesNotExist) {
+			return err
+		}
+
+		// the delivery was not stored when it was published
+		return d.outbox.WriteObject(dl.ID, bytes.NewReader(data))
+	}
+
+	err = d.outbox.DeleteObject(dl.ID)
+	if err != nil && !errors.Is(err, storage.ErrFileDoesNotExist) {
+		return err
+	}
+
+	return d.outbox.WriteObject(dl.ID, bytes.NewReader(data))
+}
+
+// retryBackoff returns the time to wait before sending an event again
+func (d *WebhookDispatcher) retryBackoff(attempts int) time.Duration {
+	backoff := d.backoff
+
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+
+	return backoff
+}
+
+func (d *WebhookDispatcher) endpoint(url string) *WebhookEndpoint {
+	for _, ep := range d.endpoints {
+		if ep.URL == url {
+			return ep
+		}
+	}
+
+	return nil
+}
+
+func (d *WebhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SignWebhook returns the signature of a webhook request, which is the hex encoded
+// HMAC-SHA256 of the timestamp and body joined with a '.', prefixed with 'sha256='.
+// Receivers can verify a request by comparing the signature they compute from the
+// request's timestamp and body with the signature header, and should reject
+// requests with old timestamps to prevent them from being replayed
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventRecorder records the events it is published
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (r *eventRecorder) Publish(e *Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+// webhookReceiver records the events sent to it, failing the first requests
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+	events   []*Event
+	headers  []http.Header
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	wr.requests++
+
+	if wr.failures > 0 {
+		wr.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	if r.Header.Get(WebhookSignatureHeader) != SignWebhook("s3cr3t", r.Header.Get(WebhookTimestampHeader), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var e Event
+
+	if json.Unmarshal(body, &e) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wr.events = append(wr.events, &e)
+	wr.headers = append(wr.headers, r.Header)
+}
+
+func (wr *webhookReceiver) received() int {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	return len(wr.events)
+}
+
+func testEvent(name string) *Event {
+	return &Event{
+		ID:   name,
+		Type: EventObjectCreated,
+		Time: time.Now().UTC().Truncate(time.Second),
+		Object: &EventObject{
+			Name:        name,
+			URL:         "http://127.0.0.1:8080/" + name,
+			Size:        1024,
+			ContentType: "image/jpeg",
+			Owner:       "team-cats",
+		},
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	wr := &webhookReceiver{failures: 2}
+
+	hs := httptest.NewServer(wr)
+	defer hs.Close()
+
+	outbox := storage.NewMemoryStore()
+
+	endpoints := []*WebhookEndpoint{
+		{URL: hs.URL, Secret: "s3cr3t"},
+		{URL: hs.URL + "/deleted", Secret: "s3cr3t", Events: []string{EventObjectDeleted}},
+	}
+
+	d, err := NewWebhookDispatcher(outbox, endpoints, WithWebhookRetries(3, time.Millisecond, 10*time.Millisecond))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go d.Run(ctx)
+
+	e := testEvent("cat.jpg")
+	d.Publish(e)
+
+	// the event is retried until it is sent
+	require.Eventually(t, func() bool {
+		return wr.received() == 1 && d.Pending() == 0
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, 3, wr.requests)
+	assert.Equal(t, e, wr.events[0])
+	assert.Equal(t, EventObjectCreated, wr.headers[0].Get(WebhookEventHeader))
+	assert.NotEmpty(t, wr.headers[0].Get(WebhookDeliveryHeader))
+
+	objects, err := outbox.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	// events are dropped after they have failed too many times
+	wr.mu.Lock()
+	wr.failures = 3
+	wr.mu.Unlock()
+
+	d.Publish(testEvent("dog.jpg"))
+
+	require.Eventually(t, func() bool {
+		return d.Pending() == 0
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, 1, wr.received())
+}
+
+func TestWebhookDispatcherOutbox(t *testing.T) {
+	wr := &webhookReceiver{}
+
+	hs := httptest.NewServer(wr)
+	defer hs.Close()
+
+	outbox := storage.NewMemoryStore()
+
+	endpoints := []*WebhookEndpoint{
+		{URL: hs.URL, Secret: "s3cr3t"},
+	}
+
+	// events published while the dispatcher is not running are held in the outbox
+	d, err := NewWebhookDispatcher(outbox, endpoints)
+	require.NoError(t, err)
+
+	d.Publish(testEvent("cat.jpg"))
+	d.Publish(testEvent("kitten.jpg"))
+
+	objects, err := outbox.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	// and sent by a new dispatcher using the same outbox
+	d, err = NewWebhookDispatcher(outbox, endpoints)
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Pending())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go d.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return wr.received() == 2 && d.Pending() == 0
+	}, time.Second, time.Millisecond)
+
+	objects, err = outbox.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+// blockingOutbox blocks writes to the outbox until they are released
+type blockingOutbox struct {
+	*storage.MemoryStore
+	mu      sync.Mutex
+	deletes int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (o *blockingOutbox) WriteObject(id string, r io.Reader) error {
+	if o.blocked != nil {
+		o.blocked <- struct{}{}
+		<-o.release
+	}
+
+	return o.MemoryStore.WriteObject(id, r)
+}
+
+func (o *blockingOutbox) DeleteObject(id string) error {
+	o.mu.Lock()
+	o.deletes++
+	o.mu.Unlock()
+
+	return o.MemoryStore.DeleteObject(id)
+}
+
+func TestWebhookDispatcherStore(t *testing.T) {
+	wr := &webhookReceiver{failures: 1}
+
+	hs := httptest.NewServer(wr)
+	defer hs.Close()
+
+	outbox := &blockingOutbox{
+		MemoryStore: storage.NewMemoryStore(),
+		blocked:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+
+	endpoints := []*WebhookEndpoint{
+		{URL: hs.URL, Secret: "s3cr3t"},
+	}
+
+	d, err := NewWebhookDispatcher(outbox, endpoints, WithWebhookRetries(3, time.Hour, time.Hour))
+	require.NoError(t, err)
+
+	// publishers are not blocked while another event is being stored
+	go d.Publish(testEvent("cat.jpg"))
+	<-outbox.blocked
+
+	done := make(chan struct{})
+
+	go func() {
+		d.Pending()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatcher was locked while storing an event")
+	}
+
+	close(outbox.release)
+
+	require.Eventually(t, func() bool {
+		return d.Pending() == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go d.Run(ctx)
+
+	// failed deliveries are replaced in the outbox, rather than deleted and written again
+	require.Eventually(t, func() bool {
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		return wr.requests == 1
+	}, time.Second, time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		objects, err := outbox.ListObjects("", "", 0)
+		if err != nil || len(objects) != 1 {
+			return false
+		}
+
+		var buf bytes.Buffer
+
+		if outbox.ReadObject(objects[0].Name, &buf) != nil {
+			return false
+		}
+
+		var dl delivery
+
+		return json.Unmarshal(buf.Bytes(), &dl) == nil && dl.Attempts == 1
+	}, time.Second, time.Millisecond)
+
+	outbox.mu.Lock()
+	assert.Zero(t, outbox.deletes)
+	outbox.mu.Unlock()
+}
+
+func TestObjectEvents(t *testing.T) {
+	events := &eventRecorder{}
+
+	s, _ := testGRPCServerWithDetector(t, 1<<20, func(data []byte) string {
+		return "image/jpeg"
+	}, WithEvents(events))
+	c := testGRPCClient(t)
+	defer s.Close()
+
+	ctx := context.Background()
+
+	_, err := c.Upload(ctx, &catly.UploadObjectRequest{Name: "cat.jpg", Data: make([]byte, 100)})
+	require.NoError(t, err)
+
+	stream, err := c.UploadStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&catly.UploadObjectChunk{Name: "kitten.jpg", Data: make([]byte, 200)}))
+	require.NoError(t, stream.Send(&catly.UploadObjectChunk{Data: make([]byte, 50)}))
+
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	// failed uploads are not published
+	_, err = c.Upload(ctx, &catly.UploadObjectRequest{Name: "cat.jpg", Data: make([]byte, 100)})
+	require.Error(t, err)
+
+	_, err = c.Delete(ctx, &catly.DeleteObjectRequest{Name: "cat.jpg"})
+	require.NoError(t, err)
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	require.Len(t, events.events, 3)
+
+	assert.Equal(t, EventObjectCreated, events.events[0].Type)
+	assert.Equal(t, &EventObject{Name: "cat.jpg", URL: "http://127.0.0.1:8080/cat.jpg", Size: 100, ContentType: "image/jpeg"}, events.events[0].Object)
+	assert.NotEmpty(t, events.events[0].ID)
+
+	assert.Equal(t, EventObjectCreated, events.events[1].Type)
+	assert.Equal(t, "kitten.jpg", events.events[1].Object.Name)
+	assert.Equal(t, int64(250), events.events[1].Object.Size)
+
+	assert.Equal(t, EventObjectDeleted, events.events[2].Type)
+	assert.Equal(t, &EventObject{Name: "cat.jpg", URL: "http://127.0.0.1:8080/cat.jpg", Size: 100, ContentType: "image/jpeg"}, events.events[2].Object)
+}
@@ -0,0 +1,434 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Usage the number and size of the images held by the server
+type Usage struct {
+	// Objects the number of images
+	Objects int64 `json:"objects"`
+	// Bytes the total size of the images in bytes
+	Bytes int64 `json:"bytes"`
+	// ContentTypes the number and size of the images of each content type
+	ContentTypes []*ContentTypeUsage `json:"content_types"`
+}
+
+// ContentTypeUsage the number and size of the images of a content type
+type ContentTypeUsage struct {
+	// ContentType the mime type of the images
+	ContentType string `json:"content_type"`
+	// Objects the number of images
+	Objects int64 `json:"objects"`
+	// Bytes the total size of the images in bytes
+	Bytes int64 `json:"bytes"`
+}
+
+// ConfigValue a setting the server was started with
+type ConfigValue struct {
+	// Name the name of the environment variable the setting was read from
+	Name string `json:"name"`
+	// Value the value of the setting, which is replaced if it is a secret
+	Value string `json:"value"`
+	// Redacted whether the value is a secret that has been replaced
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// CorruptObject an image found to be corrupt by the server's integrity scrubber
+type CorruptObject struct {
+	// Store the store the corrupt image is held in
+	Store string `json:"store"`
+	// Name the name the image is stored with
+	Name string `json:"name"`
+	// ExpectedChecksum the checksum recorded when the image was written
+	ExpectedChecksum string `json:"expected_checksum"`
+	// ActualChecksum the checksum of the image's data when it was scrubbed
+	ActualChecksum string `json:"actual_checksum"`
+	// Detected the time the corruption was found
+	Detected time.Time `json:"detected"`
+	// Status what the scrubber did with the image: flagged, quarantined or repaired
+	Status string `json:"status"`
+}
+
+// ImportOptions configures how an archive is imported
+type ImportOptions struct {
+	// Overwrite replaces images that already exist, rather than skipping them
+	Overwrite bool
+	// Verify checks the checksum of each image before and after it is written
+	Verify bool
+}
+
+// ImportResult a summary of an imported archive
+type ImportResult struct {
+	// Imported the number of objects that were imported
+	Imported int64 `json:"imported"`
+	// Skipped the number of objects that already existed
+	Skipped int64 `json:"skipped"`
+	// Failed the number of objects that could not be imported
+	Failed int64 `json:"failed"`
+	// Bytes the total size of the objects that were imported
+	Bytes int64 `json:"bytes"`
+	// Failures the objects that could not be imported
+	Failures []*ImportFailure `json:"failures,omitempty"`
+}
+
+// ImportFailure an object that could not be imported
+type ImportFailure struct {
+	// Name the name the object is stored with
+	Name string `json:"name"`
+	// Error the reason the object could not be imported
+	Error string `json:"error"`
+}
+
+// Admin a client for the catly admin service. The service is only available
+// on the server's admin listener, or to principals permitted to administer it
+type Admin struct {
+	client *Client
+	admin  catly.AdminClient
+}
+
+// NewAdmin creates a new admin client connected to the server at the specified address
+func NewAdmin(address string, opts ...Option) (*Admin, error) {
+	c, err := New(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Admin{
+		client: c,
+		admin:  catly.NewAdminClient(c.conn),
+	}, nil
+}
+
+// Close closes the client's connection to the server
+func (a *Admin) Close() error {
+	return a.client.Close()
+}
+
+// Usage returns the number and size of the images held by the server. If
+// a bucket is specified, only the images in that bucket are counted
+func (a *Admin) Usage(ctx context.Context, bucket string) (*Usage, error) {
+	var usage *Usage
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.GetUsage(ctx, &catly.GetUsageRequest{Bucket: bucket}, opts...)
+		if err != nil {
+			return err
+		}
+
+		usage = &Usage{
+			Objects:      resp.Objects,
+			Bytes:        resp.Bytes,
+			ContentTypes: make([]*ContentTypeUsage, 0, len(resp.ContentTypes)),
+		}
+
+		for _, ct := range resp.ContentTypes {
+			usage.ContentTypes = append(usage.ContentTypes, &ContentTypeUsage{
+				ContentType: ct.ContentType,
+				Objects:     ct.Objects,
+				Bytes:       ct.Bytes,
+			})
+		}
+
+		return nil
+	})
+
+	return usage, err
+}
+
+// ForceDelete deletes an image by the name it is stored with, including its
+// bucket, without the name or bucket being validated. It returns false if
+// the image's data was missing from storage and only its metadata was deleted
+func (a *Admin) ForceDelete(ctx context.Context, name string) (bool, error) {
+	var existed bool
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.ForceDelete(ctx, &catly.ForceDeleteRequest{Name: name}, opts...)
+		if err != nil {
+			return err
+		}
+
+		existed = resp.Existed
+
+		return nil
+	})
+
+	return existed, err
+}
+
+// SetLogLevel changes the level of the messages logged by the server, returning the previous level
+func (a *Admin) SetLogLevel(ctx context.Context, level string) (string, error) {
+	var previous string
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.SetLogLevel(ctx, &catly.SetLogLevelRequest{Level: level}, opts...)
+		if err != nil {
+			return err
+		}
+
+		previous = resp.Previous
+
+		return nil
+	})
+
+	return previous, err
+}
+
+// Config returns the settings the server was started with in name order, with secrets redacted
+func (a *Admin) Config(ctx context.Context) ([]*ConfigValue, error) {
+	var values []*ConfigValue
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.GetConfig(ctx, &catly.GetConfigRequest{}, opts...)
+		if err != nil {
+			return err
+		}
+
+		values = make([]*ConfigValue, 0, len(resp.Values))
+
+		for _, v := range resp.Values {
+			values = append(values, &ConfigValue{
+				Name:     v.Name,
+				Value:    v.Value,
+				Redacted: v.Redacted,
+			})
+		}
+
+		return nil
+	})
+
+	return values, err
+}
+
+// PurgeCache purges the named caches held by the server, or every
+// cache if none are specified, returning the caches that were purged
+func (a *Admin) PurgeCache(ctx context.Context, caches ...string) ([]string, error) {
+	var purged []string
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.PurgeCache(ctx, &catly.PurgeCacheRequest{Caches: caches}, opts...)
+		if err != nil {
+			return err
+		}
+
+		purged = resp.Purged
+
+		return nil
+	})
+
+	return purged, err
+}
+
+// StartScrub starts an integrity scrub of the named stores, or every store if none are
+// specified, returning the stores a scrub was started on. Scrubs run in the background,
+// so any corrupt images they find are reported by CorruptObjects once they are complete
+func (a *Admin) StartScrub(ctx context.Context, stores ...string) ([]string, error) {
+	var started []string
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.StartScrub(ctx, &catly.StartScrubRequest{Stores: stores}, opts...)
+		if err != nil {
+			return err
+		}
+
+		started = resp.Started
+
+		return nil
+	})
+
+	return started, err
+}
+
+// CorruptObjects lists the images found to be corrupt by the server's integrity scrubber
+func (a *Admin) CorruptObjects(ctx context.Context) ([]*CorruptObject, error) {
+	var objects []*CorruptObject
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.ListCorruptObjects(ctx, &catly.ListCorruptObjectsRequest{}, opts...)
+		if err != nil {
+			return err
+		}
+
+		objects = make([]*CorruptObject, 0, len(resp.Objects))
+
+		for _, obj := range resp.Objects {
+			objects = append(objects, &CorruptObject{
+				Store:            obj.Store,
+				Name:             obj.Name,
+				ExpectedChecksum: obj.ExpectedChecksum,
+				ActualChecksum:   obj.ActualChecksum,
+				Detected:         time.Unix(obj.Detected, 0),
+				Status:           corruptStatus(obj.Status),
+			})
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
+
+// RebuildIndex rebuilds the server's search index from storage,
+// returning the number of images in the rebuilt index
+func (a *Admin) RebuildIndex(ctx context.Context) (int64, error) {
+	var objects int64
+
+	err := a.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) error {
+		resp, err := a.admin.RebuildIndex(ctx, &catly.RebuildIndexRequest{}, opts...)
+		if err != nil {
+			return err
+		}
+
+		objects = resp.Objects
+
+		return nil
+	})
+
+	return objects, err
+}
+
+// Export writes a tar archive of every object held by the server, along with
+// a manifest of their names, checksums and metadata, optionally compressed
+// with gzip. The export is only retried if no data has been written
+func (a *Admin) Export(ctx context.Context, w io.Writer, gzip bool) error {
+	return a.client.retry(ctx, func() error {
+		ctx, cancel := context.WithCancel(a.client.context(ctx))
+		defer cancel()
+
+		stream, err := a.admin.Export(ctx, &catly.ExportRequest{Gzip: gzip})
+		if err != nil {
+			return toError(err, nil)
+		}
+
+		var written bool
+
+		for {
+			chunk, err := stream.Recv()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				header, _ := stream.Header()
+
+				err = toError(err, header)
+				if written {
+					return &permanentError{err: err}
+				}
+
+				return err
+			}
+
+			_, err = w.Write(chunk.Data)
+			if err != nil {
+				return &permanentError{err: err}
+			}
+
+			written = true
+		}
+	})
+}
+
+// Import writes the objects in an archive created by Export to the server. Objects
+// that fail to import are reported in the result. As the archive is streamed to
+// the server as it is read, failed imports are not retried
+func (a *Admin) Import(ctx context.Context, r io.Reader, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+
+	ctx, cancel := context.WithCancel(a.client.context(ctx))
+	defer cancel()
+
+	stream, err := a.admin.Import(ctx)
+	if err != nil {
+		return nil, toError(err, nil)
+	}
+
+	buf := make([]byte, a.client.config.chunkSize)
+
+	chunk := &catly.ImportChunk{
+		Overwrite: opts.Overwrite,
+		Verify:    opts.Verify,
+	}
+
+	first := true
+
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && !errors.Is(rerr, io.EOF) && !errors.Is(rerr, io.ErrUnexpectedEOF) {
+			return nil, rerr
+		}
+
+		chunk.Data = buf[:n]
+
+		// always send the first chunk, as it contains the options
+		if n > 0 || first {
+			err = stream.Send(chunk)
+			if err != nil {
+				// the server has closed the stream, so the
+				// error will be returned by CloseAndRecv
+				break
+			}
+		}
+
+		chunk.Overwrite = false
+		chunk.Verify = false
+		first = false
+
+		if rerr != nil {
+			break
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		header, _ := stream.Header()
+		return nil, toError(err, header)
+	}
+
+	result := &ImportResult{
+		Imported: resp.Imported,
+		Skipped:  resp.Skipped,
+		Failed:   resp.Failed,
+		Bytes:    resp.Bytes,
+	}
+
+	for _, f := range resp.Failures {
+		result.Failures = append(result.Failures, &ImportFailure{
+			Name:  f.Name,
+			Error: f.Error,
+		})
+	}
+
+	return result, nil
+}
+
+// call makes a request to the admin service, retrying it if it fails with a transient error
+func (a *Admin) call(ctx context.Context, fn func(ctx context.Context, opts ...grpc.CallOption) error) error {
+	return a.client.retry(ctx, func() error {
+		var header metadata.MD
+
+		err := fn(a.client.context(ctx), grpc.Header(&header))
+
+		return toError(err, header)
+	})
+}
+
+func corruptStatus(status catly.CorruptStatus) string {
+	switch status {
+	case catly.CorruptStatus_CorruptQuarantined:
+		return "quarantined"
+	case catly.CorruptStatus_CorruptRepaired:
+		return "repaired"
+	}
+
+	return "flagged"
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Visibility who can download the images in a bucket
+type Visibility string
+
+const (
+	// VisibilityPublic images can be downloaded by anyone from their url
+	VisibilityPublic Visibility = "public"
+	// VisibilityPrivate images can only be downloaded with the client
+	VisibilityPrivate Visibility = "private"
+)
+
+// Bucket a namespace that holds images separately from other buckets
+type Bucket struct {
+	// Name the unique name of the bucket
+	Name string `json:"name"`
+	// Visibility who can download the images in the bucket
+	Visibility Visibility `json:"visibility"`
+	// MaxObjectSize the maximum size in bytes of images in the bucket. Zero is unlimited
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// AllowedTypes the content types of the images that can be stored in the bucket.
+	// If empty, all types supported by the server are allowed
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	// Created the time the bucket was created
+	Created time.Time `json:"created"`
+}
+
+// CreateBucket creates a bucket with the provided settings, returning the created bucket
+func (c *Client) CreateBucket(ctx context.Context, bucket *Bucket) (*Bucket, error) {
+	var created *Bucket
+
+	req := &catly.Bucket{
+		Name:          bucket.Name,
+		Visibility:    catly.BucketVisibility_BucketPublic,
+		MaxObjectSize: bucket.MaxObjectSize,
+		AllowedTypes:  bucket.AllowedTypes,
+	}
+
+	if bucket.Visibility == VisibilityPrivate {
+		req.Visibility = catly.BucketVisibility_BucketPrivate
+	}
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		resp, err := c.object.CreateBucket(c.context(ctx), &catly.CreateBucketRequest{
+			Bucket: req,
+		}, grpc.Header(&header))
+
+		if err != nil {
+			return toError(err, header)
+		}
+
+		created = bucketInfo(resp)
+
+		return nil
+	})
+
+	return created, err
+}
+
+// ListBuckets lists all buckets in name order
+func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	var buckets []*Bucket
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		resp, err := c.object.ListBuckets(c.context(ctx), &catly.ListBucketsRequest{}, grpc.Header(&header))
+		if err != nil {
+			return toError(err, header)
+		}
+
+		buckets = make([]*Bucket, len(resp.Buckets))
+
+		for i, b := range resp.Buckets {
+			buckets[i] = bucketInfo(b)
+		}
+
+		return nil
+	})
+
+	return buckets, err
+}
+
+// DeleteBucket deletes a bucket. Buckets must be empty before they can be deleted
+func (c *Client) DeleteBucket(ctx context.Context, name string) error {
+	return c.retry(ctx, func() error {
+		var header metadata.MD
+
+		_, err := c.object.DeleteBucket(c.context(ctx), &catly.DeleteBucketRequest{
+			Name: name,
+		}, grpc.Header(&header))
+
+		return toError(err, header)
+	})
+}
+
+// splitName splits the name of an image into the bucket it is stored in and its name
+func splitName(name string) (string, string) {
+	i := strings.IndexByte(name, '/')
+	if i < 0 {
+		return "", name
+	}
+
+	return name[:i], name[i+1:]
+}
+
+func bucketInfo(b *catly.Bucket) *Bucket {
+	bucket := &Bucket{
+		Name:          b.Name,
+		Visibility:    VisibilityPublic,
+		MaxObjectSize: b.MaxObjectSize,
+		AllowedTypes:  b.AllowedTypes,
+		Created:       time.Unix(b.Created, 0),
+	}
+
+	if b.Visibility == catly.BucketVisibility_BucketPrivate {
+		bucket.Visibility = VisibilityPrivate
+	}
+
+	return bucket
+}
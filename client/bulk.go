@@ -0,0 +1,474 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultWorkers the default number of files uploaded concurrently by a bulk upload
+	DefaultWorkers = 4
+	// maxRenames the maximum number of alternative names tried for a conflicting file
+	maxRenames = 100
+)
+
+// ConflictPolicy determines how a bulk upload handles a file
+// with a name that already exists on the server
+type ConflictPolicy int
+
+const (
+	// ConflictFail fails the upload of the conflicting file
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip skips the conflicting file
+	ConflictSkip
+	// ConflictRename uploads the file with a numbered suffix added to its name
+	ConflictRename
+)
+
+// ParseConflictPolicy parses the name of a conflict policy
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch policy {
+	case "fail":
+		return ConflictFail, nil
+	case "skip":
+		return ConflictSkip, nil
+	case "rename":
+		return ConflictRename, nil
+	}
+
+	return ConflictFail, fmt.Errorf("unknown conflict policy '%s'", policy)
+}
+
+// DuplicatePolicy determines how a bulk upload handles a
+// file that looks similar to an image that is already stored
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow uploads the file without checking for similar images
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateFlag uploads the file and records the similar images in its progress
+	DuplicateFlag
+	// DuplicateReject skips the file
+	DuplicateReject
+)
+
+// ParseDuplicatePolicy parses the name of a duplicate policy
+func ParseDuplicatePolicy(policy string) (DuplicatePolicy, error) {
+	switch policy {
+	case "allow":
+		return DuplicateAllow, nil
+	case "flag":
+		return DuplicateFlag, nil
+	case "reject":
+		return DuplicateReject, nil
+	}
+
+	return DuplicateAllow, fmt.Errorf("unknown duplicate policy '%s'", policy)
+}
+
+// FileStatus the status of a file in a bulk upload
+type FileStatus int
+
+const (
+	// FileUploading the file is being uploaded
+	FileUploading FileStatus = iota
+	// FileUploaded the file has been uploaded
+	FileUploaded
+	// FileSkipped the file was not uploaded
+	FileSkipped
+	// FileFailed the file failed to upload
+	FileFailed
+)
+
+func (s FileStatus) String() string {
+	switch s {
+	case FileUploading:
+		return "uploading"
+	case FileUploaded:
+		return "uploaded"
+	case FileSkipped:
+		return "skipped"
+	case FileFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// FileProgress the progress of a single file in a bulk upload
+type FileProgress struct {
+	// Path the path of the file
+	Path string
+	// Name the name the file is uploaded as
+	Name string
+	// Size the size of the file in bytes
+	Size int64
+	// Uploaded the number of bytes that have been sent
+	Uploaded int64
+	// Status the status of the file
+	Status FileStatus
+	// URL the url the uploaded file can be accessed from
+	URL string
+	// ViewURL the url of the uploaded file's view page, if the server has view pages enabled
+	ViewURL string
+	// Reason why the file was skipped
+	Reason string
+	// Similar the stored images the file looks similar to, if duplicates are flagged or rejected
+	Similar []*SimilarObject
+	// Err the error the file failed with
+	Err error
+}
+
+// BulkOptions configures a bulk upload
+type BulkOptions struct {
+	// Workers the number of files uploaded concurrently
+	Workers int
+	// Conflict how to handle files with names that already exist
+	Conflict ConflictPolicy
+	// Bucket if set, the bucket the files are uploaded to
+	Bucket string
+	// Tags if set, the key/value tags every file is uploaded with
+	Tags map[string]string
+	// Description if set, the description every file is uploaded with
+	Description string
+	// Duplicates how to handle files that look similar to stored images
+	Duplicates DuplicatePolicy
+	// MaxDistance the maximum number of bits the perceptual hashes of similar
+	// images differ by. If zero, the server's default is used
+	MaxDistance int
+	// Journal if set, successful uploads are recorded in the journal
+	// and files that have already been recorded are skipped
+	Journal *Journal
+	// Progress if set, is called with a copy of a file's progress whenever it
+	// changes. It is called concurrently from each of the upload's workers
+	Progress func(p FileProgress)
+}
+
+// UploadFiles uploads files concurrently, each named after the base name of
+// its path. The final progress of every file is returned in the order of the
+// provided paths. An error is only returned if the context is cancelled
+func (c *Client) UploadFiles(ctx context.Context, paths []string, opts *BulkOptions) ([]*FileProgress, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+
+	results := make([]*FileProgress, len(paths))
+	queue := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for idx := range queue {
+				results[idx] = c.uploadFile(ctx, paths[idx], opts)
+			}
+		}()
+	}
+
+	var err error
+
+	for i := range paths {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	if err != nil {
+		// report files that were never started as failed
+		for i, res := range results {
+			if res == nil {
+				results[i] = &FileProgress{
+					Path:   paths[i],
+					Name:   opts.name(paths[i]),
+					Status: FileFailed,
+					Err:    err,
+				}
+			}
+		}
+	}
+
+	return results, err
+}
+
+// UploadDir recursively uploads all JPEG, PNG and GIF images in a directory.
+// Other files are reported as skipped. As image names cannot contain a '/',
+// images in subdirectories are uploaded with the base name of the file
+func (c *Client) UploadDir(ctx context.Context, dir string, opts *BulkOptions) ([]*FileProgress, error) {
+	var paths []string
+	var skipped []*FileProgress
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		reason, ok := imageFile(path)
+		if !ok {
+			p := &FileProgress{
+				Path:   path,
+				Name:   opts.name(path),
+				Status: FileSkipped,
+				Reason: reason,
+			}
+
+			if opts != nil && opts.Progress != nil {
+				opts.Progress(*p)
+			}
+
+			skipped = append(skipped, p)
+
+			return nil
+		}
+
+		paths = append(paths, path)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := c.UploadFiles(ctx, paths, opts)
+
+	return append(results, skipped...), err
+}
+
+// name returns the name a file is uploaded as, which is
+// the base name of its path in the bucket it is uploaded to
+func (o *BulkOptions) name(path string) string {
+	if o == nil || o.Bucket == "" {
+		return filepath.Base(path)
+	}
+
+	return o.Bucket + "/" + filepath.Base(path)
+}
+
+// uploadFile uploads a single file, applying the bulk upload's journal and conflict policy
+func (c *Client) uploadFile(ctx context.Context, path string, opts *BulkOptions) *FileProgress {
+	p := &FileProgress{
+		Path:   path,
+		Name:   opts.name(path),
+		Status: FileUploading,
+	}
+
+	report := func() {
+		if opts.Progress != nil {
+			opts.Progress(*p)
+		}
+	}
+
+	finish := func(status FileStatus, err error) *FileProgress {
+		p.Status = status
+		p.Err = err
+		report()
+		return p
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return finish(FileFailed, err)
+	}
+
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return finish(FileFailed, err)
+	}
+
+	p.Size = info.Size()
+
+	if opts.Journal != nil {
+		e, ok := opts.Journal.Completed(path, info.Size(), info.ModTime())
+		if ok {
+			p.Name = e.Name
+			p.URL = e.URL
+			p.Uploaded = p.Size
+			p.Reason = "already uploaded"
+			return finish(FileSkipped, nil)
+		}
+	}
+
+	report()
+
+	r := &progressReader{
+		r: fd,
+		fn: func(n int64) {
+			p.Uploaded = n
+			report()
+		},
+	}
+
+	base := p.Name
+	ext := filepath.Ext(base)
+
+	uploadOpts := []UploadOption{
+		WithTags(opts.Tags),
+		WithDescription(opts.Description),
+		OnViewURL(func(url string) {
+			p.ViewURL = url
+		}),
+	}
+
+	switch opts.Duplicates {
+	case DuplicateFlag:
+		uploadOpts = append(uploadOpts, FlagDuplicates(opts.MaxDistance, func(similar []*SimilarObject) {
+			p.Similar = similar
+		}))
+	case DuplicateReject:
+		uploadOpts = append(uploadOpts, RejectDuplicates(opts.MaxDistance))
+	}
+
+	for attempt := 0; ; attempt++ {
+		p.URL, err = c.Upload(ctx, p.Name, r, uploadOpts...)
+		if err == nil {
+			break
+		}
+
+		var cerr *Error
+		if errors.Is(err, ErrDuplicate) && errors.As(err, &cerr) {
+			p.Reason = "looks similar to a stored image"
+			p.Similar = cerr.Similar
+
+			if len(cerr.Similar) > 0 {
+				p.Reason = fmt.Sprintf("looks similar to '%s'", cerr.Similar[0].Object.Name)
+			}
+
+			return finish(FileSkipped, nil)
+		}
+
+		if !errors.Is(err, ErrFileExists) {
+			return finish(FileFailed, err)
+		}
+
+		switch opts.Conflict {
+		case ConflictSkip:
+			p.Reason = "name already exists"
+			return finish(FileSkipped, nil)
+		case ConflictRename:
+			if attempt < maxRenames {
+				p.Name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), attempt+1, ext)
+
+				_, err = r.Seek(0, io.SeekStart)
+				if err != nil {
+					return finish(FileFailed, err)
+				}
+
+				continue
+			}
+		}
+
+		return finish(FileFailed, err)
+	}
+
+	p.Uploaded = p.Size
+
+	if opts.Journal != nil {
+		err = opts.Journal.Record(&JournalEntry{
+			Path:    path,
+			Name:    p.Name,
+			URL:     p.URL,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+
+		if err != nil {
+			return finish(FileFailed, fmt.Errorf("uploaded, but failed to record in journal: %w", err))
+		}
+	}
+
+	return finish(FileUploaded, nil)
+}
+
+// imageFile checks that a file is a JPEG, PNG or GIF image,
+// returning the reason it should be skipped if it is not
+func imageFile(path string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+	default:
+		return "not an image", false
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err.Error(), false
+	}
+
+	defer fd.Close()
+
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(fd, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return "empty file", false
+		}
+		return err.Error(), false
+	}
+
+	switch http.DetectContentType(buf[:n]) {
+	case "image/jpeg", "image/png", "image/gif":
+		return "", true
+	}
+
+	return "content is not a jpeg, png or gif image", false
+}
+
+// progressReader reports the number of bytes that have been read from a seekable reader
+type progressReader struct {
+	r    io.ReadSeeker
+	read int64
+	fn   func(n int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.fn(r.read)
+	}
+
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	r.read = pos
+
+	return pos, nil
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDir(t *testing.T, files map[string][]byte) string {
+	dir := t.TempDir()
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		require.NoError(t, err)
+
+		err = os.WriteFile(path, data, 0644)
+		require.NoError(t, err)
+	}
+
+	return dir
+}
+
+func resultsByPath(results []*FileProgress) map[string]*FileProgress {
+	m := make(map[string]*FileProgress)
+
+	for _, r := range results {
+		m[filepath.Base(filepath.Dir(r.Path))+"/"+filepath.Base(r.Path)] = r
+	}
+
+	return m
+}
+
+func TestClientUploadDir(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t, WithChunkSize(1024))
+	defer c.Close()
+
+	dir := testDir(t, map[string][]byte{
+		"a/cat.jpg":      testImage(4096),
+		"a/notes.txt":    []byte("not a cat"),
+		"b/cat.jpg":      testImage(4096),
+		"b/fake.png":     []byte("not a png"),
+		"b/c/kitten.jpg": testImage(100),
+	})
+
+	var mu sync.Mutex
+	var updates int
+
+	results, err := c.UploadDir(context.Background(), dir, &BulkOptions{
+		Workers:  2,
+		Conflict: ConflictRename,
+		Progress: func(p FileProgress) {
+			mu.Lock()
+			updates++
+			mu.Unlock()
+		},
+	})
+
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+	assert.Greater(t, updates, 5)
+
+	r := resultsByPath(results)
+
+	assert.Equal(t, FileSkipped, r["a/notes.txt"].Status)
+	assert.Equal(t, FileSkipped, r["b/fake.png"].Status)
+	assert.Equal(t, FileUploaded, r["c/kitten.jpg"].Status)
+	assert.Equal(t, int64(100), r["c/kitten.jpg"].Uploaded)
+
+	// both cats are uploaded, with one of them renamed
+	names := []string{r["a/cat.jpg"].Name, r["b/cat.jpg"].Name}
+	sort.Strings(names)
+	assert.Equal(t, []string{"cat-1.jpg", "cat.jpg"}, names)
+
+	for _, name := range names {
+		_, err = m.StatObject(name)
+		assert.NoError(t, err)
+	}
+}
+
+func TestClientUploadFilesConflict(t *testing.T) {
+	s, _ := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.Upload(context.Background(), "cat.jpg", bytes.NewReader(testImage(100)))
+	require.NoError(t, err)
+
+	dir := testDir(t, map[string][]byte{
+		"cat.jpg": testImage(100),
+	})
+
+	path := filepath.Join(dir, "cat.jpg")
+
+	results, err := c.UploadFiles(context.Background(), []string{path}, &BulkOptions{
+		Conflict: ConflictSkip,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileSkipped, results[0].Status)
+
+	results, err = c.UploadFiles(context.Background(), []string{path}, &BulkOptions{
+		Conflict: ConflictFail,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileFailed, results[0].Status)
+	assert.ErrorIs(t, results[0].Err, ErrFileExists)
+}
+
+func TestClientUploadFilesJournal(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	dir := testDir(t, map[string][]byte{
+		"cat.jpg": testImage(100),
+	})
+
+	path := filepath.Join(dir, "cat.jpg")
+
+	j, err := OpenJournal(filepath.Join(dir, "journal"))
+	require.NoError(t, err)
+
+	results, err := c.UploadFiles(context.Background(), []string{path}, &BulkOptions{
+		Journal: j,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileUploaded, results[0].Status)
+	assert.Equal(t, "http://127.0.0.1:8080/v/cat.jpg", results[0].ViewURL)
+	require.NoError(t, j.Close())
+
+	// remove the uploaded image, so resuming would succeed
+	// if the file was not recorded in the journal
+	require.NoError(t, m.DeleteObject("cat.jpg"))
+
+	j, err = OpenJournal(filepath.Join(dir, "journal"))
+	require.NoError(t, err)
+	defer j.Close()
+
+	results, err = c.UploadFiles(context.Background(), []string{path}, &BulkOptions{
+		Journal: j,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileSkipped, results[0].Status)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", results[0].URL)
+
+	// modified files are uploaded again
+	require.NoError(t, os.WriteFile(path, testImage(200), 0644))
+
+	results, err = c.UploadFiles(context.Background(), []string{path}, &BulkOptions{
+		Journal: j,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileUploaded, results[0].Status)
+}
+
+func TestJournalIncompleteEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := OpenJournal(path)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Record(&JournalEntry{Path: "/cats/tabby.jpg", Size: 4}))
+	require.NoError(t, j.Close())
+
+	// simulate an entry that was interrupted while it was being written
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+
+	_, err = fd.WriteString(`{"path":"/cats/gin`)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	j, err = OpenJournal(path)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Record(&JournalEntry{Path: "/cats/ginger.jpg", Size: 5}))
+	require.NoError(t, j.Close())
+
+	// entries recorded after the incomplete entry are not lost
+	j, err = OpenJournal(path)
+	require.NoError(t, err)
+	defer j.Close()
+
+	_, ok := j.Completed("/cats/tabby.jpg", 4, time.Time{})
+	assert.True(t, ok)
+
+	_, ok = j.Completed("/cats/ginger.jpg", 5, time.Time{})
+	assert.True(t, ok)
+}
+
+func TestClientUploadFilesDuplicates(t *testing.T) {
+	s, _ := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.Upload(context.Background(), "cat.png", bytes.NewReader(testPicture(t, 256, false)))
+	require.NoError(t, err)
+
+	dir := testDir(t, map[string][]byte{
+		"small-cat.png": testPicture(t, 64, false),
+		"dog.png":       testPicture(t, 64, true),
+	})
+
+	paths := []string{
+		filepath.Join(dir, "small-cat.png"),
+		filepath.Join(dir, "dog.png"),
+	}
+
+	results, err := c.UploadFiles(context.Background(), paths, &BulkOptions{
+		Duplicates: DuplicateReject,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileSkipped, results[0].Status)
+	assert.Equal(t, "looks similar to 'cat.png'", results[0].Reason)
+	require.Len(t, results[0].Similar, 1)
+	assert.Equal(t, FileUploaded, results[1].Status)
+
+	results, err = c.UploadFiles(context.Background(), paths, &BulkOptions{
+		Conflict:   ConflictRename,
+		Duplicates: DuplicateFlag,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, FileUploaded, results[0].Status)
+	require.Len(t, results[0].Similar, 1)
+	assert.Equal(t, FileUploaded, results[1].Status)
+	assert.Equal(t, "dog-1.png", results[1].Name)
+	require.Len(t, results[1].Similar, 1)
+	assert.Equal(t, "dog.png", results[1].Similar[0].Object.Name)
+}
@@ -0,0 +1,492 @@
+// Package client provides a client for uploading and managing images stored in catly.
+// Images stored in a bucket are named with the name of the bucket and the name of the
+// image separated by a '/', such as 'avatars/cat.png'
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// ObjectInfo describes an image stored in catly
+type ObjectInfo struct {
+	// Name the unique name of the image, including its bucket
+	Name string `json:"name"`
+	// Bucket the bucket the image is stored in, if any
+	Bucket string `json:"bucket,omitempty"`
+	// Size the size of the image in bytes
+	Size int64 `json:"size"`
+	// ContentType the mime type of the image
+	ContentType string `json:"content_type"`
+	// Created the time the image was uploaded
+	Created time.Time `json:"created"`
+	// URL the url the image can be accessed from
+	URL string `json:"url"`
+	// Checksum the hex encoded SHA-256 checksum of the image, if recorded by the server's storage
+	Checksum string `json:"checksum,omitempty"`
+	// Owner the authenticated principal that uploaded the image
+	Owner string `json:"owner,omitempty"`
+	// Description the description the image was uploaded with
+	Description string `json:"description,omitempty"`
+	// Tags the key/value tags the image was uploaded with
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Client a client for the catly object service
+type Client struct {
+	conn   *grpc.ClientConn
+	object catly.ObjectClient
+	config *config
+}
+
+// New creates a new client connected to the server at the specified address
+func New(address string, opts ...Option) (*Client, error) {
+	cfg := defaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithInsecure(),
+	}
+
+	if cfg.tls != nil {
+		dialOptions[0] = grpc.WithTransportCredentials(credentials.NewTLS(cfg.tls))
+	}
+
+	conn, err := grpc.Dial(address, append(dialOptions, cfg.dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:   conn,
+		object: catly.NewObjectClient(conn),
+		config: cfg,
+	}, nil
+}
+
+// Wrap creates a new client from an existing object client
+func Wrap(oc catly.ObjectClient, opts ...Option) *Client {
+	cfg := defaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Client{
+		object: oc,
+		config: cfg,
+	}
+}
+
+// Close closes the client's connection to the server
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+// Upload uploads an image, returning the url it can be accessed from. The image
+// is streamed to the server in chunks. Failed uploads will only be retried if
+// the reader implements io.Seeker, so the image can be read again from the start
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, opts ...UploadOption) (string, error) {
+	var url string
+
+	seeker, seekable := r.(io.Seeker)
+
+	var start int64
+
+	if seekable {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seekable = false
+		}
+		start = offset
+	}
+
+	var attempted bool
+
+	err := c.retry(ctx, func() error {
+		if attempted {
+			_, err := seeker.Seek(start, io.SeekStart)
+			if err != nil {
+				return &permanentError{err: err}
+			}
+		}
+
+		attempted = true
+
+		var err error
+
+		url, err = c.upload(ctx, name, r, opts)
+
+		// the reader cannot be rewound, so the upload can't be retried
+		var perr *permanentError
+		if err != nil && !seekable && !errors.As(err, &perr) {
+			return &permanentError{err: err}
+		}
+
+		return err
+	})
+
+	return url, err
+}
+
+func (c *Client) upload(ctx context.Context, name string, r io.Reader, opts []UploadOption) (string, error) {
+	ctx, cancel := context.WithCancel(c.context(ctx))
+	defer cancel()
+
+	stream, err := c.object.UploadStream(ctx)
+	if err != nil {
+		return "", toError(err, nil)
+	}
+
+	buf := make([]byte, c.config.chunkSize)
+
+	bucket, name := splitName(name)
+
+	chunk := &catly.UploadObjectChunk{
+		Name:   name,
+		Bucket: bucket,
+	}
+
+	u := &uploadConfig{chunk: chunk}
+
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && !errors.Is(rerr, io.EOF) && !errors.Is(rerr, io.ErrUnexpectedEOF) {
+			return "", &permanentError{err: rerr}
+		}
+
+		chunk.Data = buf[:n]
+
+		// always send the first chunk, as it contains the name
+		// and metadata of the image even if there is no data
+		if n > 0 || chunk.Name != "" {
+			err = stream.Send(chunk)
+			if err != nil {
+				// the server has closed the stream, so the
+				// error will be returned by CloseAndRecv
+				break
+			}
+		}
+
+		chunk.Name = ""
+		chunk.Bucket = ""
+		chunk.Tags = nil
+		chunk.Description = ""
+		chunk.Duplicates = catly.DuplicatePolicy_DuplicateAllow
+		chunk.MaxDistance = 0
+
+		if rerr != nil {
+			break
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		header, _ := stream.Header()
+		return "", toError(err, header)
+	}
+
+	// older servers report failures in the response instead of the status
+	if resp.Status != catly.ObjectStatus_ObjectOK {
+		return "", legacyError(resp)
+	}
+
+	if u.similar != nil && len(resp.Similar) > 0 {
+		u.similar(similarObjects(resp.Similar))
+	}
+
+	if u.viewURL != nil && resp.ViewUrl != "" {
+		u.viewURL(resp.ViewUrl)
+	}
+
+	return resp.Url, nil
+}
+
+// UploadFromURL uploads an image that the server fetches from a url, returning the
+// url of the uploaded image. If the name is empty or only names a bucket, such as
+// 'cats/', the image is named after the last segment of the url's path
+func (c *Client) UploadFromURL(ctx context.Context, url, name string, opts ...UploadOption) (string, error) {
+	bucket, name := splitName(name)
+
+	chunk := &catly.UploadObjectChunk{}
+
+	u := &uploadConfig{chunk: chunk}
+
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	req := &catly.UploadFromURLRequest{
+		Url:         url,
+		Name:        name,
+		Bucket:      bucket,
+		Tags:        chunk.Tags,
+		Description: chunk.Description,
+		Duplicates:  chunk.Duplicates,
+		MaxDistance: chunk.MaxDistance,
+	}
+
+	var resp *catly.UploadObjectResponse
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+		var err error
+
+		resp, err = c.object.UploadFromURL(c.context(ctx), req, grpc.Header(&header))
+		if err != nil {
+			return toError(err, header)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if u.similar != nil && len(resp.Similar) > 0 {
+		u.similar(similarObjects(resp.Similar))
+	}
+
+	if u.viewURL != nil && resp.ViewUrl != "" {
+		u.viewURL(resp.ViewUrl)
+	}
+
+	return resp.Url, nil
+}
+
+// Download downloads an image, writing it to the provided io.Writer. Failed
+// downloads will only be retried if no data has been written
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) error {
+	return c.retry(ctx, func() error {
+		ctx, cancel := context.WithCancel(c.context(ctx))
+		defer cancel()
+
+		bucket, name := splitName(name)
+
+		stream, err := c.object.Download(ctx, &catly.DownloadObjectRequest{
+			Name:   name,
+			Bucket: bucket,
+		})
+
+		if err != nil {
+			return toError(err, nil)
+		}
+
+		var written bool
+
+		for {
+			chunk, err := stream.Recv()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				header, _ := stream.Header()
+
+				err = toError(err, header)
+				if written {
+					return &permanentError{err: err}
+				}
+
+				return err
+			}
+
+			_, err = w.Write(chunk.Data)
+			if err != nil {
+				return &permanentError{err: err}
+			}
+
+			written = true
+		}
+	})
+}
+
+// Stat returns information about an image
+func (c *Client) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		bucket, name := splitName(name)
+
+		resp, err := c.object.Stat(c.context(ctx), &catly.StatObjectRequest{
+			Name:   name,
+			Bucket: bucket,
+		}, grpc.Header(&header))
+
+		if err != nil {
+			return toError(err, header)
+		}
+
+		info = objectInfo(resp)
+
+		return nil
+	})
+
+	return info, err
+}
+
+// List lists all images with names that start with the specified prefix. Images
+// in a bucket are listed with a prefix starting with the bucket's name and a '/'
+func (c *Client) List(ctx context.Context, prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	var pageToken string
+
+	for {
+		page, next, err := c.ListPage(ctx, prefix, pageToken, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page...)
+
+		if next == "" {
+			return objects, nil
+		}
+
+		pageToken = next
+	}
+}
+
+// ListPage lists a single page of images with names that start with the specified prefix.
+// The returned page token can be used to request the next page, and will be empty when
+// there are no more images to list. If page size is zero, the server's default is used
+func (c *Client) ListPage(ctx context.Context, prefix, pageToken string, pageSize int) ([]*ObjectInfo, string, error) {
+	var objects []*ObjectInfo
+	var next string
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		bucket, prefix := splitName(prefix)
+
+		resp, err := c.object.List(c.context(ctx), &catly.ListObjectsRequest{
+			Prefix:    prefix,
+			Bucket:    bucket,
+			PageToken: pageToken,
+			PageSize:  int32(pageSize),
+		}, grpc.Header(&header))
+
+		if err != nil {
+			return toError(err, header)
+		}
+
+		objects = make([]*ObjectInfo, len(resp.Objects))
+
+		for i, obj := range resp.Objects {
+			objects[i] = objectInfo(obj)
+		}
+
+		next = resp.NextPageToken
+
+		return nil
+	})
+
+	return objects, next, err
+}
+
+// Delete deletes an image
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.retry(ctx, func() error {
+		var header metadata.MD
+
+		bucket, name := splitName(name)
+
+		_, err := c.object.Delete(c.context(ctx), &catly.DeleteObjectRequest{
+			Name:   name,
+			Bucket: bucket,
+		}, grpc.Header(&header))
+
+		return toError(err, header)
+	})
+}
+
+// context adds the client's token to the request's context
+func (c *Client) context(ctx context.Context) context.Context {
+	if c.config.token == "" {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.config.token)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not
+// transient or the client's retries have been exhausted. The time
+// waited between each attempt is doubled, unless the server has
+// specified how long the client should wait
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	backoff := c.config.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			return perr.err
+		}
+
+		var e *Error
+		if !errors.As(err, &e) || !e.transient() || attempt >= c.config.retries {
+			return err
+		}
+
+		wait := backoff
+		if e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > c.config.maxBackoff {
+			backoff = c.config.maxBackoff
+		}
+	}
+}
+
+func objectInfo(info *catly.ObjectInfo) *ObjectInfo {
+	name := info.Name
+	if info.Bucket != "" {
+		name = info.Bucket + "/" + name
+	}
+
+	return &ObjectInfo{
+		Name:        name,
+		Bucket:      info.Bucket,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		Created:     time.Unix(info.Created, 0),
+		URL:         info.Url,
+		Checksum:    info.Checksum,
+		Owner:       info.Owner,
+		Description: info.Description,
+		Tags:        info.Tags,
+	}
+}
@@ -0,0 +1,563 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/purehyperbole/catly/api"
+	"github.com/purehyperbole/catly/protocol/catly"
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+}
+
+func testServer(t *testing.T, opts ...grpc.ServerOption) (net.Listener, *storage.MemoryStore) {
+	listener, err := net.Listen("tcp", ":8001")
+	require.NoError(t, err)
+
+	m := storage.NewMemoryStore()
+
+	s := grpc.NewServer(opts...)
+
+	index := storage.NewIndex(m)
+
+	objects := api.NewGRPCResource(
+		"http://127.0.0.1:8080/",
+		m,
+		api.WithIndex(index),
+		api.WithWatch(api.NewEventBroker(api.DefaultEventHistory, api.DefaultWatchBuffer)),
+		api.WithURLUploads(api.NewFetcher()),
+		api.WithUploadURLs(api.NewUploadSigner([]byte("s3cr3t"))),
+		api.WithViewPages(),
+	)
+
+	catly.RegisterObjectServer(s, objects)
+
+	catly.RegisterAdminServer(s, api.NewAdminResource(
+		api.WithObjects(objects),
+		api.WithIndexer(index),
+		api.WithConfig(map[string]string{"CATLY_HTTP_PORT": "8080", "CATLY_UPLOAD_URL_KEY": "s3cr3t"}, "CATLY_UPLOAD_URL_KEY"),
+		api.WithCache("buckets", storage.NewBuckets(m)),
+	))
+
+	go s.Serve(listener)
+
+	return listener, m
+}
+
+func testClient(t *testing.T, opts ...Option) *Client {
+	c, err := New("127.0.0.1:8001", opts...)
+	require.NoError(t, err)
+
+	return c
+}
+
+// testImage generates some random data with a jpeg header
+func testImage(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	copy(data, []byte{0xFF, 0xD8, 0xFF})
+	return data
+}
+
+func TestClientUpload(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t, WithChunkSize(1024))
+	defer c.Close()
+
+	data := testImage(1 << 16)
+
+	var viewURL string
+
+	url, err := c.Upload(context.Background(), "cat.jpg", bytes.NewReader(data), OnViewURL(func(u string) {
+		viewURL = u
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080/cat.jpg", url)
+	assert.Equal(t, "http://127.0.0.1:8080/v/cat.jpg", viewURL)
+
+	var b bytes.Buffer
+
+	err = m.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+
+	// upload an image with the same name
+	_, err = c.Upload(context.Background(), "cat.jpg", bytes.NewReader(data))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrFileExists))
+
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, codes.AlreadyExists, e.Code)
+	assert.Equal(t, catly.ErrorReason_ReasonObjectExists, e.Reason)
+
+	// upload something that's not an image
+	_, err = c.Upload(context.Background(), "cat.jpg", bytes.NewReader([]byte("meow")))
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+}
+
+func TestClientDownload(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	data := testImage(1 << 18)
+
+	err := m.WriteObject("cat.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+
+	err = c.Download(context.Background(), "cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+
+	err = c.Download(context.Background(), "invisible-cat.jpg", &b)
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+}
+
+func TestClientStatListDelete(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	for _, name := range []string{"cat-1.jpg", "cat-2.jpg", "cat-3.jpg", "dog.jpg"} {
+		err := m.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	info, err := c.Stat(context.Background(), "cat-1.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat-1.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, "image/jpeg", info.ContentType)
+	assert.Equal(t, "http://127.0.0.1:8080/cat-1.jpg", info.URL)
+
+	objects, next, err := c.ListPage(context.Background(), "cat-", "", 2)
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+	assert.Equal(t, "cat-2.jpg", next)
+
+	objects, err = c.List(context.Background(), "cat-")
+	require.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	err = c.Delete(context.Background(), "cat-1.jpg")
+	require.NoError(t, err)
+
+	_, err = c.Stat(context.Background(), "cat-1.jpg")
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+}
+
+func TestClientSearch(t *testing.T) {
+	s, _ := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.Upload(context.Background(), "cat.jpg", bytes.NewReader(testImage(1024)), WithTags(map[string]string{"grumpy": "", "colour": "orange"}), WithDescription("a grumpy cat"))
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), "kitten.jpg", bytes.NewReader(testImage(1024)), WithTags(map[string]string{"colour": "black"}))
+	require.NoError(t, err)
+
+	objects, err := c.Search(context.Background(), &Query{Tags: map[string]string{"grumpy": ""}})
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cat.jpg", objects[0].Name)
+	assert.Equal(t, "a grumpy cat", objects[0].Description)
+	assert.Equal(t, map[string]string{"grumpy": "", "colour": "orange"}, objects[0].Tags)
+
+	objects, err = c.Search(context.Background(), &Query{Tags: map[string]string{"colour": ""}, CreatedAfter: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+
+	page, next, err := c.SearchPage(context.Background(), &Query{ContentType: "image/jpeg"}, "", 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "cat.jpg", next)
+
+	info, err := c.Stat(context.Background(), "kitten.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"colour": "black"}, info.Tags)
+
+	_, err = c.Upload(context.Background(), "dog.jpg", bytes.NewReader(testImage(1024)), WithTags(map[string]string{"mood:grumpy": ""}))
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+}
+
+// testPicture encodes a png of a diagonal gradient, which
+// is reversed if flipped so that it looks different
+func testPicture(t *testing.T, size int, flipped bool) []byte {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := uint8((x*x + y*3) * 255 / (size*size + size*3))
+			if flipped {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	return buf.Bytes()
+}
+
+func TestClientSimilar(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.Upload(context.Background(), "cat.png", bytes.NewReader(testPicture(t, 256, false)))
+	require.NoError(t, err)
+
+	var similar []*SimilarObject
+
+	_, err = c.Upload(context.Background(), "small-cat.png", bytes.NewReader(testPicture(t, 64, false)), FlagDuplicates(0, func(s []*SimilarObject) {
+		similar = s
+	}))
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, "cat.png", similar[0].Object.Name)
+
+	_, err = c.Upload(context.Background(), "big-cat.png", bytes.NewReader(testPicture(t, 512, false)), RejectDuplicates(4))
+	require.True(t, errors.Is(err, ErrDuplicate))
+
+	var cerr *Error
+	require.True(t, errors.As(err, &cerr))
+	require.Len(t, cerr.Similar, 2)
+
+	_, err = m.StatObject("big-cat.png")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+
+	_, err = c.Upload(context.Background(), "dog.png", bytes.NewReader(testPicture(t, 256, true)), RejectDuplicates(0))
+	require.NoError(t, err)
+
+	similar, err = c.FindSimilar(context.Background(), "small-cat.png", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, "cat.png", similar[0].Object.Name)
+
+	similar, err = c.FindSimilarData(context.Background(), testPicture(t, 128, true), 0, 0)
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, "dog.png", similar[0].Object.Name)
+	assert.Equal(t, 0, similar[0].Distance)
+
+	_, err = c.FindSimilar(context.Background(), "missing.png", 0, 0)
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+}
+
+func TestClientWatch(t *testing.T) {
+	s, _ := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.Upload(context.Background(), "cat.jpg", bytes.NewReader(testImage(100)))
+	require.NoError(t, err)
+
+	events := make(chan *Event, 10)
+	errs := make(chan error, 1)
+
+	stop := errors.New("stop watching")
+
+	// resume after the first upload, so no events are missed while the watch starts
+	go func() {
+		errs <- c.Watch(context.Background(), &WatchFilter{Prefix: "kitten", After: 1}, func(e *Event) error {
+			events <- e
+
+			if e.Type == EventDeleted {
+				return stop
+			}
+
+			return nil
+		})
+	}()
+
+	_, err = c.Upload(context.Background(), "dog.jpg", bytes.NewReader(testImage(100)))
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), "kitten.jpg", bytes.NewReader(testImage(200)))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Delete(context.Background(), "kitten.jpg"))
+
+	assert.Equal(t, stop, <-errs)
+	require.Len(t, events, 2)
+
+	e := <-events
+	assert.Equal(t, uint64(3), e.Sequence)
+	assert.Equal(t, EventCreated, e.Type)
+	assert.Equal(t, "kitten.jpg", e.Object.Name)
+	assert.Equal(t, int64(200), e.Object.Size)
+
+	e = <-events
+	assert.Equal(t, uint64(4), e.Sequence)
+	assert.Equal(t, EventDeleted, e.Type)
+}
+
+func TestClientUploadFromURL(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testImage(100))
+	}))
+	defer ts.Close()
+
+	// the server refuses to fetch images from private addresses
+	_, err := c.UploadFromURL(context.Background(), ts.URL+"/cat.jpg", "")
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+
+	_, err = c.UploadFromURL(context.Background(), "file:///etc/passwd", "cat.jpg")
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+
+	_, err = m.StatObject("cat.jpg")
+	assert.Equal(t, storage.ErrFileDoesNotExist, err)
+}
+
+func TestClientCreateUploadURL(t *testing.T) {
+	s, m := testServer(t)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	u, err := c.CreateUploadURL(context.Background(), "cat.jpg", &UploadURLOptions{
+		MaxSize:      1024,
+		ContentTypes: []string{"image/jpeg"},
+		Expiry:       time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, u.URL, "http://127.0.0.1:8080/upload?")
+	assert.WithinDuration(t, time.Now().Add(time.Minute), u.Expires, 2*time.Second)
+
+	_, err = c.CreateUploadURL(context.Background(), "cat.jpg", &UploadURLOptions{
+		ContentTypes: []string{"text/html"},
+	})
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+
+	require.NoError(t, m.WriteObject("cat.jpg", bytes.NewReader(testImage(100))))
+
+	_, err = c.CreateUploadURL(context.Background(), "cat.jpg", nil)
+	assert.True(t, errors.Is(err, ErrFileExists))
+}
+
+func TestClientToken(t *testing.T) {
+	a := api.NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+	})
+
+	s, _ := testServer(
+		t,
+		grpc.UnaryInterceptor(a.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(a.StreamServerInterceptor()),
+	)
+	defer s.Close()
+
+	c := testClient(t)
+	defer c.Close()
+
+	_, err := c.List(context.Background(), "")
+	assert.True(t, errors.Is(err, ErrUnauthenticated))
+
+	c = testClient(t, WithToken("s3cr3t"))
+	defer c.Close()
+
+	_, err = c.List(context.Background(), "")
+	require.NoError(t, err)
+
+	_, err = c.Upload(context.Background(), "cat.jpg", bytes.NewReader(testImage(1024)))
+	require.NoError(t, err)
+}
+
+func TestAdmin(t *testing.T) {
+	a := api.NewTokenAuthenticator(map[string]string{
+		"s3cr3t": "team-cats",
+		"4dm1n":  "ops",
+	})
+
+	z := api.NewServiceAuthorizer(api.AdminService, "ops")
+
+	s, m := testServer(
+		t,
+		grpc.ChainUnaryInterceptor(a.UnaryServerInterceptor(), z.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(a.StreamServerInterceptor(), z.StreamServerInterceptor()),
+	)
+	defer s.Close()
+
+	require.NoError(t, m.WriteObject("cat.jpg", bytes.NewReader(testImage(1024))))
+	require.NoError(t, m.WriteObject("dog.png", bytes.NewReader(testImage(512))))
+
+	ac, err := NewAdmin("127.0.0.1:8001", WithToken("s3cr3t"))
+	require.NoError(t, err)
+	defer ac.Close()
+
+	_, err = ac.Usage(context.Background(), "")
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+
+	ac, err = NewAdmin("127.0.0.1:8001", WithToken("4dm1n"))
+	require.NoError(t, err)
+	defer ac.Close()
+
+	usage, err := ac.Usage(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Objects)
+	assert.Equal(t, int64(1536), usage.Bytes)
+	require.Len(t, usage.ContentTypes, 2)
+	assert.Equal(t, &ContentTypeUsage{ContentType: "image/jpeg", Objects: 1, Bytes: 1024}, usage.ContentTypes[0])
+
+	objects, err := ac.RebuildIndex(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), objects)
+
+	existed, err := ac.ForceDelete(context.Background(), "dog.png")
+	require.NoError(t, err)
+	assert.True(t, existed)
+
+	_, err = ac.ForceDelete(context.Background(), "dog.png")
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+
+	config, err := ac.Config(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []*ConfigValue{
+		{Name: "CATLY_HTTP_PORT", Value: "8080"},
+		{Name: "CATLY_UPLOAD_URL_KEY", Value: "[redacted]", Redacted: true},
+	}, config)
+
+	purged, err := ac.PurgeCache(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"buckets"}, purged)
+
+	_, err = ac.PurgeCache(context.Background(), "missing")
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	previous, err := ac.SetLogLevel(context.Background(), "error")
+	require.NoError(t, err)
+	assert.Equal(t, "fatal", previous)
+
+	corrupt, err := ac.CorruptObjects(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+
+	// the server has no scrubbers
+	_, err = ac.StartScrub(context.Background())
+	assert.Error(t, err)
+
+	var archive bytes.Buffer
+
+	require.NoError(t, ac.Export(context.Background(), &archive, true))
+
+	require.NoError(t, m.DeleteObject("cat.jpg"))
+
+	result, err := ac.Import(context.Background(), bytes.NewReader(archive.Bytes()), &ImportOptions{Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Imported)
+	assert.Equal(t, int64(1024), result.Bytes)
+	assert.Empty(t, result.Failures)
+
+	result, err = ac.Import(context.Background(), bytes.NewReader(archive.Bytes()), &ImportOptions{Overwrite: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Imported)
+
+	_, err = ac.Import(context.Background(), bytes.NewReader([]byte("not an archive")), nil)
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+}
+
+// flakyObjectClient fails requests with a transient error a number of times
+type flakyObjectClient struct {
+	catly.ObjectClient
+	failures int
+	calls    int
+}
+
+func (c *flakyObjectClient) Stat(ctx context.Context, in *catly.StatObjectRequest, opts ...grpc.CallOption) (*catly.ObjectInfo, error) {
+	c.calls++
+
+	if c.calls <= c.failures {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+
+	return &catly.ObjectInfo{Name: in.Name}, nil
+}
+
+func (c *flakyObjectClient) Delete(ctx context.Context, in *catly.DeleteObjectRequest, opts ...grpc.CallOption) (*catly.DeleteObjectResponse, error) {
+	c.calls++
+	return nil, status.Error(codes.NotFound, "not found")
+}
+
+func TestClientRetries(t *testing.T) {
+	oc := &flakyObjectClient{failures: 2}
+
+	c := Wrap(oc, WithRetries(2, time.Millisecond))
+
+	info, err := c.Stat(context.Background(), "cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, 3, oc.calls)
+
+	// exhaust the retries
+	oc = &flakyObjectClient{failures: 3}
+
+	c = Wrap(oc, WithRetries(2, time.Millisecond))
+
+	_, err = c.Stat(context.Background(), "cat.jpg")
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	assert.Equal(t, 3, oc.calls)
+
+	// errors that are not transient should not be retried
+	oc = &flakyObjectClient{}
+
+	c = Wrap(oc, WithRetries(2, time.Millisecond))
+
+	err = c.Delete(context.Background(), "cat.jpg")
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+	assert.Equal(t, 1, oc.calls)
+}
+
+func TestClientLegacyError(t *testing.T) {
+	err := legacyError(&catly.UploadObjectResponse{
+		Status: catly.ObjectStatus_ObjectERR,
+		Error:  storage.ErrFileExists.Error(),
+	})
+
+	assert.True(t, errors.Is(err, ErrFileExists))
+}
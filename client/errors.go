@@ -0,0 +1,198 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrFileExists is returned when uploading an image with a name that is already in use
+	ErrFileExists = errors.New("an image with the same name already exists")
+	// ErrFileDoesNotExist is returned when a requested image cannot be found
+	ErrFileDoesNotExist = errors.New("the requested image does not exist")
+	// ErrInvalidRequest is returned when an image or its name is rejected by the server
+	ErrInvalidRequest = errors.New("the request is invalid")
+	// ErrTooLarge is returned when an image exceeds the maximum size accepted by the server
+	ErrTooLarge = errors.New("the image is too large")
+	// ErrRateLimited is returned when the client has exceeded its rate limits
+	ErrRateLimited = errors.New("the client has been rate limited")
+	// ErrUnauthenticated is returned when the client's token is missing or invalid
+	ErrUnauthenticated = errors.New("the client is not authenticated")
+	// ErrPermissionDenied is returned when the client is not permitted to make a request
+	ErrPermissionDenied = errors.New("the client is not permitted to make the request")
+	// ErrStorageFull is returned when the server has no space left to store an image
+	ErrStorageFull = errors.New("the server's storage is full")
+	// ErrUnavailable is returned when the server cannot be reached
+	ErrUnavailable = errors.New("the server is unavailable")
+	// ErrBucketDoesNotExist is returned when a requested bucket cannot be found
+	ErrBucketDoesNotExist = errors.New("the requested bucket does not exist")
+	// ErrBucketExists is returned when creating a bucket with a name that is already in use
+	ErrBucketExists = errors.New("a bucket with the same name already exists")
+	// ErrBucketNotEmpty is returned when deleting a bucket that still contains images
+	ErrBucketNotEmpty = errors.New("the bucket is not empty")
+	// ErrDuplicate is returned when an image that looks similar to a stored image is rejected
+	ErrDuplicate = errors.New("the image looks similar to a stored image")
+	// ErrFetchFailed is returned when the server cannot fetch an image from a url
+	ErrFetchFailed = errors.New("the server failed to fetch the image")
+)
+
+// legacyFileExists is the error message older servers
+// return in upload responses when there is a name conflict
+const legacyFileExists = "the file you have uploaded must have a unique name"
+
+// Error an error returned by the catly server. It can be compared
+// to the package's sentinel errors with errors.Is
+type Error struct {
+	// Code the gRPC status code of the error
+	Code codes.Code
+	// Reason the reason the request failed, if provided by the server
+	Reason catly.ErrorReason
+	// Message the error message returned by the server
+	Message string
+	// RetryAfter how long the server has asked the client to wait before retrying
+	RetryAfter time.Duration
+	// Similar the stored images that a rejected duplicate image looks similar to
+	Similar []*SimilarObject
+	kind    error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the sentinel error that corresponds to the error
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// transient reports whether the request may succeed if retried
+func (e *Error) transient() bool {
+	switch e.Code {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	case codes.ResourceExhausted:
+		return e.kind == ErrRateLimited
+	}
+
+	return false
+}
+
+// toError converts an error returned from a gRPC request into an Error
+func toError(err error, header metadata.MD) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	e := &Error{
+		Code:    st.Code(),
+		Message: st.Message(),
+	}
+
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *catly.ErrorDetails:
+			e.Reason = d.Reason
+		case *catly.UploadObjectResponse:
+			if len(d.Similar) > 0 {
+				e.Similar = similarObjects(d.Similar)
+			}
+		}
+	}
+
+	if v := header.Get("retry-after"); len(v) > 0 {
+		s, err := strconv.Atoi(v[0])
+		if err == nil {
+			e.RetryAfter = time.Duration(s) * time.Second
+		}
+	}
+
+	switch e.Reason {
+	case catly.ErrorReason_ReasonObjectExists:
+		e.kind = ErrFileExists
+	case catly.ErrorReason_ReasonObjectNotFound:
+		e.kind = ErrFileDoesNotExist
+	case catly.ErrorReason_ReasonObjectTooLarge:
+		e.kind = ErrTooLarge
+	case catly.ErrorReason_ReasonStorageFull:
+		e.kind = ErrStorageFull
+	case catly.ErrorReason_ReasonBucketNotFound:
+		e.kind = ErrBucketDoesNotExist
+	case catly.ErrorReason_ReasonBucketExists:
+		e.kind = ErrBucketExists
+	case catly.ErrorReason_ReasonBucketNotEmpty:
+		e.kind = ErrBucketNotEmpty
+	case catly.ErrorReason_ReasonDuplicate:
+		e.kind = ErrDuplicate
+	case catly.ErrorReason_ReasonFetchFailed:
+		e.kind = ErrFetchFailed
+	case catly.ErrorReason_ReasonInvalidName,
+		catly.ErrorReason_ReasonNoData,
+		catly.ErrorReason_ReasonUnsupportedContent,
+		catly.ErrorReason_ReasonExtensionMismatch,
+		catly.ErrorReason_ReasonInvalidMetadata,
+		catly.ErrorReason_ReasonInvalidURL:
+		e.kind = ErrInvalidRequest
+	default:
+		e.kind = codeError(e.Code)
+	}
+
+	return e
+}
+
+// codeError returns the sentinel error for requests that failed without a reason
+func codeError(code codes.Code) error {
+	switch code {
+	case codes.AlreadyExists:
+		return ErrFileExists
+	case codes.NotFound:
+		return ErrFileDoesNotExist
+	case codes.InvalidArgument:
+		return ErrInvalidRequest
+	case codes.ResourceExhausted:
+		return ErrRateLimited
+	case codes.Unauthenticated:
+		return ErrUnauthenticated
+	case codes.PermissionDenied:
+		return ErrPermissionDenied
+	case codes.Unavailable:
+		return ErrUnavailable
+	}
+
+	return nil
+}
+
+// legacyError converts a failed upload response from an older server into an Error
+func legacyError(resp *catly.UploadObjectResponse) error {
+	e := &Error{
+		Code:    codes.Unknown,
+		Message: resp.Error,
+	}
+
+	if resp.Error == legacyFileExists {
+		e.Code = codes.AlreadyExists
+		e.Reason = catly.ErrorReason_ReasonObjectExists
+		e.kind = ErrFileExists
+	}
+
+	return e
+}
+
+// permanentError marks an error that must not be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
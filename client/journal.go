@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a file that has been successfully uploaded
+type JournalEntry struct {
+	// Path the absolute path of the uploaded file
+	Path string `json:"path"`
+	// Name the name the file was uploaded as
+	Name string `json:"name"`
+	// URL the url the file can be accessed from
+	URL string `json:"url"`
+	// Size the size of the file when it was uploaded
+	Size int64 `json:"size"`
+	// ModTime the modification time of the file when it was uploaded
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Journal records the files that have been successfully uploaded by
+// a bulk upload, so that an interrupted upload can be resumed
+type Journal struct {
+	mu      sync.Mutex
+	fd      *os.File
+	entries map[string]*JournalEntry
+}
+
+// OpenJournal opens the journal at the specified path, creating it if it does not
+// exist. Any entries that have already been recorded in the journal are loaded
+func OpenJournal(path string) (*Journal, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		fd:      fd,
+		entries: make(map[string]*JournalEntry),
+	}
+
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	// the last entry may be incomplete if the upload was interrupted
+	// while it was being written, so it is truncated to ensure new
+	// entries are not appended to the end of it
+	complete := bytes.LastIndexByte(data, '\n') + 1
+
+	if complete < len(data) {
+		err = fd.Truncate(int64(complete))
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+
+	for _, line := range bytes.Split(data[:complete], []byte{'\n'}) {
+		var e JournalEntry
+
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			continue
+		}
+
+		j.entries[e.Path] = &e
+	}
+
+	return j, nil
+}
+
+// Completed returns the entry for a file if it has been uploaded
+// and has not been modified since it was uploaded
+func (j *Journal) Completed(path string, size int64, modTime time.Time) (*JournalEntry, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e, ok := j.entries[path]
+	if !ok || e.Size != size || !e.ModTime.Equal(modTime) {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// Record adds an uploaded file to the journal, syncing it to disk
+func (j *Journal) Record(e *JournalEntry) error {
+	path, err := filepath.Abs(e.Path)
+	if err != nil {
+		return err
+	}
+
+	e.Path = path
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err = j.fd.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	j.entries[path] = e
+
+	return j.fd.Sync()
+}
+
+// Close closes the journal
+func (j *Journal) Close() error {
+	return j.fd.Close()
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+)
+
+const (
+	// DefaultChunkSize the default size of the chunks that images are uploaded in
+	DefaultChunkSize = 1 << 16
+	// DefaultRetries the default number of times a failed request will be retried
+	DefaultRetries = 3
+	// DefaultBackoff the default time to wait before the first retry
+	DefaultBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff the maximum time to wait between retries
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// Option configures optional behaviour of the client
+type Option func(c *config)
+
+type config struct {
+	tls         *tls.Config
+	token       string
+	retries     int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	chunkSize   int
+	dialOptions []grpc.DialOption
+}
+
+func defaultConfig() *config {
+	return &config{
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		chunkSize:  DefaultChunkSize,
+	}
+}
+
+// WithTLS connects to the server using TLS with the provided config
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *config) {
+		c.tls = cfg
+	}
+}
+
+// WithToken authenticates requests with the provided bearer token
+func WithToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
+
+// WithRetries sets the number of times a request that has failed with a
+// transient error will be retried, and the initial time to wait between
+// retries. The time waited is doubled after every attempt
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithChunkSize sets the size of the chunks images are uploaded in
+func WithChunkSize(size int) Option {
+	return func(c *config) {
+		c.chunkSize = size
+	}
+}
+
+// WithDialOptions sets additional options used when connecting to the server
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *config) {
+		c.dialOptions = append(c.dialOptions, opts...)
+	}
+}
+
+// UploadOption sets the metadata an image is uploaded with
+type UploadOption func(u *uploadConfig)
+
+type uploadConfig struct {
+	chunk   *catly.UploadObjectChunk
+	similar func(similar []*SimilarObject)
+	viewURL func(url string)
+}
+
+// WithTags uploads an image with key/value tags that it can be searched by
+func WithTags(tags map[string]string) UploadOption {
+	return func(u *uploadConfig) {
+		u.chunk.Tags = tags
+	}
+}
+
+// WithDescription uploads an image with a free text description
+func WithDescription(description string) UploadOption {
+	return func(u *uploadConfig) {
+		u.chunk.Description = description
+	}
+}
+
+// RejectDuplicates fails the upload with ErrDuplicate if the image looks similar
+// to a stored image. Images are similar if their perceptual hashes differ by no
+// more than the maximum distance in bits. If the maximum distance is zero,
+// the server's default is used
+func RejectDuplicates(maxDistance int) UploadOption {
+	return func(u *uploadConfig) {
+		u.chunk.Duplicates = catly.DuplicatePolicy_DuplicateReject
+		u.chunk.MaxDistance = int32(maxDistance)
+	}
+}
+
+// FlagDuplicates uploads the image and calls fn with the stored images that it
+// looks similar to, if there are any. Images are similar if their perceptual
+// hashes differ by no more than the maximum distance in bits. If the maximum
+// distance is zero, the server's default is used
+func FlagDuplicates(maxDistance int, fn func(similar []*SimilarObject)) UploadOption {
+	return func(u *uploadConfig) {
+		u.chunk.Duplicates = catly.DuplicatePolicy_DuplicateFlag
+		u.chunk.MaxDistance = int32(maxDistance)
+		u.similar = fn
+	}
+}
+
+// OnViewURL calls fn with the url of the uploaded image's view page, which shows
+// a preview card when it is shared. It is not called if the server does not
+// have view pages enabled
+func OnViewURL(fn func(url string)) UploadOption {
+	return func(u *uploadConfig) {
+		u.viewURL = fn
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// UploadURLOptions restricts what can be uploaded to an upload url
+type UploadURLOptions struct {
+	// MaxSize the maximum size of the image in bytes. The
+	// server's maximum size is used if it is not set
+	MaxSize int64
+	// ContentTypes the content types of the images that can be
+	// uploaded. Any supported image can be uploaded if it is not set
+	ContentTypes []string
+	// Expiry how long the url can be used for. The
+	// server's default is used if it is not set
+	Expiry time.Duration
+}
+
+// UploadURL a signed url that an image can be uploaded to once over
+// HTTP, with a PUT or POST request, without authenticating
+type UploadURL struct {
+	// URL the url to upload the image to
+	URL string `json:"url"`
+	// Expires the time the url can no longer be used
+	Expires time.Time `json:"expires"`
+}
+
+// CreateUploadURL creates a signed url that an image can be uploaded to once,
+// which can be given to a browser or another service to upload an image with
+// the name without access to the server's tokens. Options may be nil
+func (c *Client) CreateUploadURL(ctx context.Context, name string, opts *UploadURLOptions) (*UploadURL, error) {
+	bucket, name := splitName(name)
+
+	if opts == nil {
+		opts = &UploadURLOptions{}
+	}
+
+	req := &catly.CreateUploadURLRequest{
+		Name:         name,
+		Bucket:       bucket,
+		MaxSize:      opts.MaxSize,
+		ContentTypes: opts.ContentTypes,
+		ExpiresIn:    int64(opts.Expiry / time.Second),
+	}
+
+	var u *UploadURL
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		resp, err := c.object.CreateUploadURL(c.context(ctx), req, grpc.Header(&header))
+		if err != nil {
+			return toError(err, header)
+		}
+
+		u = &UploadURL{
+			URL:     resp.Url,
+			Expires: time.Unix(resp.Expires, 0),
+		}
+
+		return nil
+	})
+
+	return u, err
+}
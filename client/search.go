@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Query filters the images found by a search. Filters that are not
+// set match every image, and images must match every filter
+type Query struct {
+	// Bucket only find images in the bucket. Images in
+	// every bucket are searched if no bucket is set
+	Bucket string
+	// Tags only find images with every tag. A tag with
+	// an empty value matches any value of the tag
+	Tags map[string]string
+	// Owner only find images uploaded by the principal
+	Owner string
+	// ContentType only find images of the content type
+	ContentType string
+	// MinSize only find images of at least the size in bytes
+	MinSize int64
+	// MaxSize only find images of at most the size in bytes
+	MaxSize int64
+	// CreatedAfter only find images uploaded at or after the time
+	CreatedAfter time.Time
+	// CreatedBefore only find images uploaded before the time
+	CreatedBefore time.Time
+}
+
+// Search finds all images matching the query in name order
+func (c *Client) Search(ctx context.Context, query *Query) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	var pageToken string
+
+	for {
+		page, next, err := c.SearchPage(ctx, query, pageToken, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page...)
+
+		if next == "" {
+			return objects, nil
+		}
+
+		pageToken = next
+	}
+}
+
+// SearchPage finds a single page of images matching the query. The returned page token
+// can be used to request the next page, and will be empty when there are no more
+// images to find. If page size is zero, the server's default is used
+func (c *Client) SearchPage(ctx context.Context, query *Query, pageToken string, pageSize int) ([]*ObjectInfo, string, error) {
+	var objects []*ObjectInfo
+	var next string
+
+	req := &catly.SearchRequest{
+		Bucket:      query.Bucket,
+		Tags:        query.Tags,
+		Owner:       query.Owner,
+		ContentType: query.ContentType,
+		MinSize:     query.MinSize,
+		MaxSize:     query.MaxSize,
+		PageToken:   pageToken,
+		PageSize:    int32(pageSize),
+	}
+
+	if !query.CreatedAfter.IsZero() {
+		req.CreatedAfter = query.CreatedAfter.Unix()
+	}
+
+	if !query.CreatedBefore.IsZero() {
+		req.CreatedBefore = query.CreatedBefore.Unix()
+	}
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		resp, err := c.object.Search(c.context(ctx), req, grpc.Header(&header))
+		if err != nil {
+			return toError(err, header)
+		}
+
+		objects = make([]*ObjectInfo, len(resp.Objects))
+
+		for i, obj := range resp.Objects {
+			objects[i] = objectInfo(obj)
+		}
+
+		next = resp.NextPageToken
+
+		return nil
+	})
+
+	return objects, next, err
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// SimilarObject a stored image that looks similar to another image
+type SimilarObject struct {
+	// Object the stored image
+	Object *ObjectInfo `json:"object"`
+	// Distance the number of bits the perceptual hashes of the images differ by.
+	// Identical images have a distance of zero
+	Distance int `json:"distance"`
+}
+
+// FindSimilar finds the stored images that look most similar to a stored image,
+// closest first. Images are similar if their perceptual hashes differ by no more
+// than the maximum distance in bits. If the maximum distance or limit are zero,
+// the server's defaults are used
+func (c *Client) FindSimilar(ctx context.Context, name string, maxDistance, limit int) ([]*SimilarObject, error) {
+	bucket, name := splitName(name)
+
+	return c.findSimilar(ctx, &catly.FindSimilarRequest{
+		Name:        name,
+		Bucket:      bucket,
+		MaxDistance: int32(maxDistance),
+		Limit:       int32(limit),
+	})
+}
+
+// FindSimilarData finds the stored images that look most similar to a sample image,
+// closest first. Images are similar if their perceptual hashes differ by no more
+// than the maximum distance in bits. If the maximum distance or limit are zero,
+// the server's defaults are used
+func (c *Client) FindSimilarData(ctx context.Context, data []byte, maxDistance, limit int) ([]*SimilarObject, error) {
+	return c.findSimilar(ctx, &catly.FindSimilarRequest{
+		Data:        data,
+		MaxDistance: int32(maxDistance),
+		Limit:       int32(limit),
+	})
+}
+
+func (c *Client) findSimilar(ctx context.Context, req *catly.FindSimilarRequest) ([]*SimilarObject, error) {
+	var similar []*SimilarObject
+
+	err := c.retry(ctx, func() error {
+		var header metadata.MD
+
+		resp, err := c.object.FindSimilar(c.context(ctx), req, grpc.Header(&header))
+		if err != nil {
+			return toError(err, header)
+		}
+
+		similar = similarObjects(resp.Objects)
+
+		return nil
+	})
+
+	return similar, err
+}
+
+func similarObjects(objects []*catly.SimilarObject) []*SimilarObject {
+	similar := make([]*SimilarObject, len(objects))
+
+	for i, obj := range objects {
+		similar[i] = &SimilarObject{
+			Object:   objectInfo(obj.Object),
+			Distance: int(obj.Distance),
+		}
+	}
+
+	return similar
+}
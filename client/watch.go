@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/purehyperbole/catly/protocol/catly"
+	"google.golang.org/grpc/codes"
+)
+
+// the types of event sent to watchers
+const (
+	// EventCreated an image has been uploaded
+	EventCreated = "created"
+	// EventDeleted an image has been deleted
+	EventDeleted = "deleted"
+)
+
+// WatchFilter filters the events sent to a watcher. Filters that are not set
+// match every image, and images must match every filter
+type WatchFilter struct {
+	// Bucket only watch images in the bucket. Images in
+	// every bucket are watched if no bucket is set
+	Bucket string
+	// Prefix only watch images with names that start with the
+	// prefix. The prefix does not include the image's bucket
+	Prefix string
+	// ContentType only watch images of the content type
+	ContentType string
+	// After resume watching after the event with the sequence number, sending
+	// any events since then that are still held by the server first
+	After uint64
+}
+
+// Event an event describing an image that has been uploaded or deleted
+type Event struct {
+	// Sequence the sequence number of the event, which can be used to
+	// resume watching from the event. Sequence numbers start from one
+	// when the server is restarted
+	Sequence uint64 `json:"sequence"`
+	// Type the type of the event, either 'created' or 'deleted'
+	Type string `json:"type"`
+	// Time the time the event happened
+	Time time.Time `json:"time"`
+	// Object the image the event is about
+	Object *ObjectInfo `json:"object"`
+	// Dropped the number of events missed immediately before this event,
+	// because the watcher fell behind or the server no longer holds them
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Watch calls fn with an event for every image that is uploaded or deleted and
+// matches the filter, until the context is cancelled or fn returns an error. If
+// the connection to the server is lost, the watch is resumed after the last event
+// received. If the server has been restarted, events that happened while the
+// client was disconnected cannot be resumed, and only new events are sent
+func (c *Client) Watch(ctx context.Context, filter *WatchFilter, fn func(e *Event) error) error {
+	if filter == nil {
+		filter = &WatchFilter{}
+	}
+
+	req := &catly.WatchRequest{
+		Bucket:        filter.Bucket,
+		Prefix:        filter.Prefix,
+		ContentType:   filter.ContentType,
+		AfterSequence: filter.After,
+	}
+
+	backoff := c.config.backoff
+	retries := 0
+
+	for {
+		received, err := c.watch(ctx, req, fn)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			return perr.err
+		}
+
+		var e *Error
+		if errors.As(err, &e) && e.Code == codes.OutOfRange && req.AfterSequence > 0 {
+			// the server has restarted, so the watch cannot be resumed
+			req.AfterSequence = 0
+		} else if !errors.Is(err, io.EOF) && (!errors.As(err, &e) || !e.transient()) {
+			return err
+		}
+
+		// the watch was working, so start counting retries again
+		if received {
+			retries = 0
+			backoff = c.config.backoff
+		}
+
+		if retries >= c.config.retries {
+			return err
+		}
+
+		retries++
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > c.config.maxBackoff {
+			backoff = c.config.maxBackoff
+		}
+	}
+}
+
+// watch calls fn with each event from a single watch stream, recording the
+// sequence number of the last event so the watch can be resumed. It reports
+// whether any events were received before the stream failed
+func (c *Client) watch(ctx context.Context, req *catly.WatchRequest, fn func(e *Event) error) (bool, error) {
+	ctx, cancel := context.WithCancel(c.context(ctx))
+	defer cancel()
+
+	stream, err := c.object.Watch(ctx, req)
+	if err != nil {
+		return false, toError(err, nil)
+	}
+
+	var received bool
+
+	for {
+		we, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return received, err
+			}
+
+			header, _ := stream.Header()
+
+			return received, toError(err, header)
+		}
+
+		received = true
+		req.AfterSequence = we.Sequence
+
+		err = fn(watchEvent(we))
+		if err != nil {
+			return received, &permanentError{err: err}
+		}
+	}
+}
+
+func watchEvent(we *catly.WatchEvent) *Event {
+	e := &Event{
+		Sequence: we.Sequence,
+		Time:     time.Unix(we.Time, 0),
+		Object:   objectInfo(we.Object),
+		Dropped:  we.Dropped,
+	}
+
+	switch we.Type {
+	case catly.EventType_EventObjectCreated:
+		e.Type = EventCreated
+	case catly.EventType_EventObjectDeleted:
+		e.Type = EventDeleted
+	}
+
+	return e
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	exportGzip      bool
+	exportForce     bool
+	importOverwrite bool
+	importVerify    bool
+)
+
+// exportJSON the json output for an exported archive
+type exportJSON struct {
+	File  string `json:"file"`
+	Bytes int64  `json:"bytes"`
+}
+
+var exportCommand = &command{
+	run:   runExport,
+	usage: "<file|->",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&exportGzip, "gzip", false, "Compress the archive with gzip. Enabled for files ending in .gz or .tgz")
+		fs.BoolVar(&exportForce, "f", false, "Overwrite the archive file if it already exists")
+	},
+}
+
+var importCommand = &command{
+	run:   runImport,
+	usage: "<file|->",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&importOverwrite, "overwrite", false, "Replace images that already exist, rather than skipping them")
+		fs.BoolVar(&importVerify, "verify", true, "Verify the checksum of each image before and after it is written")
+	},
+}
+
+func runExport(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "export must specify a single archive file, or '-' for stdout")
+		return exitUsage
+	}
+
+	output := args[0]
+	gzip := exportGzip || strings.HasSuffix(output, ".gz") || strings.HasSuffix(output, ".tgz")
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	res := &exportJSON{
+		File: output,
+	}
+
+	if output == "-" {
+		w := &countingWriter{w: opts.stdout}
+
+		err = c.Export(ctx, w, gzip)
+		res.Bytes = w.n
+
+		// the archive has been written to stdout, so
+		// any results are written to stderr instead
+		opts.stdout = opts.stderr
+	} else {
+		res.Bytes, err = exportFile(ctx, c, output, gzip, exportForce)
+	}
+
+	if err != nil {
+		return opts.fail("failed to export archive", err)
+	}
+
+	if opts.json {
+		opts.printJSON(res)
+	} else if output != "-" {
+		fmt.Fprintf(opts.stdout, "exported %s archive to %s\n", formatSize(res.Bytes), output)
+	}
+
+	return exitOK
+}
+
+// exportFile exports an archive to a file, removing the file if the export fails
+func exportFile(ctx context.Context, c *client.Admin, path string, gzip, force bool) (int64, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	fd, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &countingWriter{w: fd}
+
+	err = c.Export(ctx, w, gzip)
+	if err != nil {
+		fd.Close()
+		os.Remove(path)
+		return 0, err
+	}
+
+	return w.n, fd.Close()
+}
+
+func runImport(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "import must specify a single archive file, or '-' for stdin")
+		return exitUsage
+	}
+
+	r := io.Reader(os.Stdin)
+
+	if args[0] != "-" {
+		fd, err := os.Open(args[0])
+		if err != nil {
+			return opts.fail("failed to open archive", err)
+		}
+
+		defer fd.Close()
+
+		r = fd
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	result, err := c.Import(ctx, r, &client.ImportOptions{
+		Overwrite: importOverwrite,
+		Verify:    importVerify,
+	})
+
+	if err != nil {
+		return opts.fail("failed to import archive", err)
+	}
+
+	if opts.json {
+		opts.printJSON(result)
+	} else {
+		for _, f := range result.Failures {
+			fmt.Fprintf(opts.stderr, "failed to import %s: %s\n", f.Name, f.Error)
+		}
+
+		fmt.Fprintf(
+			opts.stdout,
+			"imported %d objects (%s), skipped %d and failed %d\n",
+			result.Imported,
+			formatSize(result.Bytes),
+			result.Skipped,
+			result.Failed,
+		)
+	}
+
+	if result.Failed > 0 {
+		return exitError
+	}
+
+	return exitOK
+}
+
+// countingWriter counts the bytes written to a writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
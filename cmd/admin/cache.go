@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var purgeCommand = &command{
+	run:   runPurge,
+	usage: "[cache]...",
+}
+
+func runPurge(ctx context.Context, opts *options, args []string) int {
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	purged, err := c.PurgeCache(ctx, args...)
+	if err != nil {
+		return opts.fail("failed to purge caches", err)
+	}
+
+	if opts.json {
+		opts.printJSON(purged)
+	} else if len(purged) < 1 {
+		fmt.Fprintln(opts.stdout, "the server has no caches to purge")
+	} else {
+		fmt.Fprintf(opts.stdout, "purged %s\n", strings.Join(purged, ", "))
+	}
+
+	return exitOK
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+)
+
+var configCommand = &command{
+	run: runConfig,
+}
+
+func runConfig(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "config does not accept any arguments")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	values, err := c.Config(ctx)
+	if err != nil {
+		return opts.fail("failed to get config", err)
+	}
+
+	if opts.json {
+		opts.printJSON(values)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tVALUE")
+
+	for _, v := range values {
+		fmt.Fprintf(tw, "%s\t%s\n", v.Name, v.Value)
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// deleteJSON the json output for a force deleted image
+type deleteJSON struct {
+	Name    string       `json:"name"`
+	Existed bool         `json:"existed"`
+	Error   *errorOutput `json:"error,omitempty"`
+}
+
+var deleteCommand = &command{
+	run:   runDelete,
+	usage: "<name>...",
+}
+
+func runDelete(ctx context.Context, opts *options, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(opts.stderr, "rm must specify at least one image name")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	code := exitOK
+	results := make([]*deleteJSON, 0, len(args))
+
+	for _, name := range args {
+		res := &deleteJSON{
+			Name: name,
+		}
+
+		res.Existed, err = c.ForceDelete(ctx, name)
+		if err != nil {
+			res.Error = errorJSON(err)
+
+			if code == exitOK {
+				code = exitCode(err)
+			}
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "failed to delete %s: %s\n", name, err.Error())
+			}
+		} else if !opts.json {
+			if res.Existed {
+				fmt.Fprintf(opts.stdout, "deleted %s\n", name)
+			} else {
+				fmt.Fprintf(opts.stdout, "deleted metadata of %s, which was missing from storage\n", name)
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	if opts.json {
+		opts.printJSON(results)
+	}
+
+	return code
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var reindexCommand = &command{
+	run: runReindex,
+}
+
+func runReindex(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "reindex does not accept any arguments")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	objects, err := c.RebuildIndex(ctx)
+	if err != nil {
+		return opts.fail("failed to rebuild index", err)
+	}
+
+	if opts.json {
+		opts.printJSON(map[string]int64{"objects": objects})
+	} else {
+		fmt.Fprintf(opts.stdout, "rebuilt index of %d images\n", objects)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var logLevelCommand = &command{
+	run:   runLogLevel,
+	usage: "<trace|debug|info|warn|error|fatal|panic|disabled>",
+}
+
+func runLogLevel(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "log-level must specify a single level")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	previous, err := c.SetLogLevel(ctx, args[0])
+	if err != nil {
+		return opts.fail("failed to set log level", err)
+	}
+
+	if opts.json {
+		opts.printJSON(map[string]string{"level": args[0], "previous": previous})
+	} else {
+		fmt.Fprintf(opts.stdout, "changed log level from %s to %s\n", previous, args[0])
+	}
+
+	return exitOK
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+// exit codes returned for each class of error
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitInvalid
+	exitUnauthenticated
+	exitPermissionDenied
+	exitUnavailable
+)
+
+const usage = `catly-admin is a client for administering a catly server. The admin service
+is only available on the server's admin listener, or to admin principals
+
+Usage:
+	catly-admin [flags] <command> [command flags] [arguments]
+
+Commands:
+	usage       show the number and size of the images held by the server, by content type
+	rm          force delete one or more images by the name they are stored with
+	log-level   change the level of the messages logged by the server
+	config      show the configuration the server was started with, with secrets redacted
+	purge       purge the server's caches, or only the named caches
+	scrub       start an integrity scrub of every store, or only the named stores
+	corrupt     list the images found to be corrupt by the integrity scrubber
+	reindex     rebuild the search index from storage
+	export      write a tar archive of every image, with a manifest of their checksums and metadata
+	import      write the images in an archive created by export to the server
+
+Flags:
+`
+
+// command a subcommand of the admin client
+type command struct {
+	run   func(ctx context.Context, opts *options, args []string) int
+	usage string
+	flags func(fs *flag.FlagSet)
+}
+
+// options common to all commands
+type options struct {
+	server string
+	token  string
+	tls    bool
+	caFile string
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = map[string]*command{
+	"usage":     usageCommand,
+	"rm":        deleteCommand,
+	"log-level": logLevelCommand,
+	"config":    configCommand,
+	"purge":     purgeCommand,
+	"scrub":     scrubCommand,
+	"corrupt":   corruptCommand,
+	"reindex":   reindexCommand,
+	"export":    exportCommand,
+	"import":    importCommand,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	opts := &options{
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+
+	fs := flag.NewFlagSet("catly-admin", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	opts.register(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(opts.stderr, "unknown command '%s'\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+
+	// each command accepts the common flags after the command name
+	// as well as before it, along with any flags of its own
+	cfs := flag.NewFlagSet("catly-admin "+fs.Arg(0), flag.ContinueOnError)
+	cfs.Usage = func() {
+		fmt.Fprintf(cfs.Output(), "Usage:\n\tcatly-admin %s [flags] %s\n\nFlags:\n", fs.Arg(0), cmd.usage)
+		cfs.PrintDefaults()
+	}
+
+	opts.register(cfs)
+
+	if cmd.flags != nil {
+		cmd.flags(cfs)
+	}
+
+	err = cfs.Parse(fs.Args()[1:])
+	if err != nil {
+		return exitUsage
+	}
+
+	return cmd.run(context.Background(), opts, cfs.Args())
+}
+
+// register adds the common flags to a flag set, using
+// any values that have already been parsed as defaults
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", defaultString(o.server, "127.0.0.1:8000"), "Specifies the address of the server's admin or gRPC listener")
+	fs.StringVar(&o.token, "token", o.token, "Specifies the token of an admin principal used to authenticate with the server")
+	fs.BoolVar(&o.tls, "tls", o.tls, "Connect to the server using TLS")
+	fs.StringVar(&o.caFile, "ca", o.caFile, "Specifies a CA certificate file used to verify the server when using TLS")
+	fs.BoolVar(&o.json, "json", o.json, "Output results as json")
+}
+
+// client creates a new admin client from the common options
+func (o *options) client() (*client.Admin, error) {
+	var opts []client.Option
+
+	if o.token != "" {
+		opts = append(opts, client.WithToken(o.token))
+	}
+
+	if o.tls {
+		cfg, err := tlsConfig(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls config: %w", err)
+		}
+
+		opts = append(opts, client.WithTLS(cfg))
+	}
+
+	return client.NewAdmin(o.server, opts...)
+}
+
+// printJSON writes a value to stdout as json
+func (o *options) printJSON(v interface{}) {
+	enc := json.NewEncoder(o.stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// fail reports an error, returning the exit code for its class
+func (o *options) fail(pfx string, err error) int {
+	if o.json {
+		o.printJSON(errorJSON(err))
+	} else {
+		fmt.Fprintf(o.stderr, "%s: %s\n", pfx, err.Error())
+	}
+
+	return exitCode(err)
+}
+
+// errorOutput the json output for an error
+type errorOutput struct {
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func errorJSON(err error) *errorOutput {
+	if err == nil {
+		return nil
+	}
+
+	out := &errorOutput{
+		Message: err.Error(),
+	}
+
+	var e *client.Error
+	if errors.As(err, &e) {
+		out.Code = e.Code.String()
+		out.Reason = e.Reason.String()
+	}
+
+	return out
+}
+
+// exitCode returns the exit code for the class of an error
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, client.ErrFileDoesNotExist), errors.Is(err, client.ErrBucketDoesNotExist):
+		return exitNotFound
+	case errors.Is(err, client.ErrInvalidRequest):
+		return exitInvalid
+	case errors.Is(err, client.ErrUnauthenticated):
+		return exitUnauthenticated
+	case errors.Is(err, client.ErrPermissionDenied):
+		return exitPermissionDenied
+	case errors.Is(err, client.ErrUnavailable):
+		return exitUnavailable
+	}
+
+	return exitError
+}
+
+// tlsConfig creates a tls config that will verify the server using
+// the provided CA certificate, or the system's roots if not provided
+func tlsConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RootCAs = x509.NewCertPool()
+
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid certificates found in CA file")
+	}
+
+	return cfg, nil
+}
+
+func defaultString(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// formatSize formats a number of bytes in a human readable form
+func formatSize(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
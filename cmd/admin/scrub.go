@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var scrubCommand = &command{
+	run:   runScrub,
+	usage: "[store]...",
+}
+
+var corruptCommand = &command{
+	run: runCorrupt,
+}
+
+func runScrub(ctx context.Context, opts *options, args []string) int {
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	started, err := c.StartScrub(ctx, args...)
+	if err != nil {
+		return opts.fail("failed to start scrub", err)
+	}
+
+	if opts.json {
+		opts.printJSON(started)
+	} else if len(started) < 1 {
+		fmt.Fprintln(opts.stdout, "scrubs are already waiting to start")
+	} else {
+		fmt.Fprintf(opts.stdout, "started scrubbing %s\n", strings.Join(started, ", "))
+	}
+
+	return exitOK
+}
+
+func runCorrupt(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "corrupt does not accept any arguments")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	objects, err := c.CorruptObjects(ctx)
+	if err != nil {
+		return opts.fail("failed to list corrupt images", err)
+	}
+
+	if opts.json {
+		opts.printJSON(objects)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "STORE\tNAME\tSTATUS\tDETECTED")
+
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", obj.Store, obj.Name, obj.Status, obj.Detected.Format(time.RFC3339))
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+)
+
+var usageBucket string
+
+var usageCommand = &command{
+	run: runUsage,
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&usageBucket, "bucket", "", "Only count the images in the bucket")
+	},
+}
+
+func runUsage(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "usage does not accept any arguments")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	usage, err := c.Usage(ctx, usageBucket)
+	if err != nil {
+		return opts.fail("failed to get usage", err)
+	}
+
+	if opts.json {
+		opts.printJSON(usage)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "CONTENT TYPE\tIMAGES\tSIZE")
+
+	for _, ct := range usage.ContentTypes {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", ct.ContentType, ct.Objects, formatSize(ct.Bytes))
+	}
+
+	fmt.Fprintf(tw, "total\t%d\t%s\n", usage.Objects, formatSize(usage.Bytes))
+
+	tw.Flush()
+
+	return exitOK
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	bucketPrivate bool
+	bucketMaxSize int64
+	bucketTypes   string
+)
+
+var createBucketCommand = &command{
+	run:   runCreateBucket,
+	usage: "<name>",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&bucketPrivate, "private", false, "Only allow images in the bucket to be downloaded with the client, rather than from their url")
+		fs.Int64Var(&bucketMaxSize, "max-size", 0, "Specifies the maximum size in bytes of images in the bucket")
+		fs.StringVar(&bucketTypes, "types", "", "Specifies a comma separated list of the content types of images allowed in the bucket, such as 'image/png,image/gif'")
+	},
+}
+
+var listBucketsCommand = &command{
+	run: runListBuckets,
+}
+
+var deleteBucketCommand = &command{
+	run:   runDeleteBucket,
+	usage: "<name>...",
+}
+
+func runCreateBucket(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "mb must specify a single bucket name")
+		return exitUsage
+	}
+
+	bucket := &client.Bucket{
+		Name:          args[0],
+		Visibility:    client.VisibilityPublic,
+		MaxObjectSize: bucketMaxSize,
+	}
+
+	if bucketPrivate {
+		bucket.Visibility = client.VisibilityPrivate
+	}
+
+	for _, t := range strings.Split(bucketTypes, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			bucket.AllowedTypes = append(bucket.AllowedTypes, t)
+		}
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	bucket, err = c.CreateBucket(ctx, bucket)
+	if err != nil {
+		return opts.fail(fmt.Sprintf("failed to create bucket %s", args[0]), err)
+	}
+
+	if opts.json {
+		opts.printJSON(bucket)
+	} else {
+		fmt.Fprintf(opts.stdout, "created %s bucket %s\n", bucket.Visibility, bucket.Name)
+	}
+
+	return exitOK
+}
+
+func runListBuckets(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "buckets does not accept any arguments")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	buckets, err := c.ListBuckets(ctx)
+	if err != nil {
+		return opts.fail("failed to list buckets", err)
+	}
+
+	if opts.json {
+		opts.printJSON(buckets)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tVISIBILITY\tMAX SIZE\tTYPES\tCREATED")
+
+	for _, b := range buckets {
+		maxSize := "-"
+		if b.MaxObjectSize > 0 {
+			maxSize = formatSize(b.MaxObjectSize)
+		}
+
+		types := "*"
+		if len(b.AllowedTypes) > 0 {
+			types = strings.Join(b.AllowedTypes, ",")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.Name, b.Visibility, maxSize, types, b.Created.Format(time.RFC3339))
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
+
+func runDeleteBucket(ctx context.Context, opts *options, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(opts.stderr, "rb must specify at least one bucket name")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	code := exitOK
+	results := make([]*resultJSON, 0, len(args))
+
+	for _, name := range args {
+		res := &resultJSON{
+			Name: name,
+		}
+
+		err := c.DeleteBucket(ctx, name)
+		if err != nil {
+			res.Error = errorJSON(err)
+
+			if code == exitOK {
+				code = exitCode(err)
+			}
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "failed to delete bucket %s: %s\n", name, err.Error())
+			}
+		} else if !opts.json {
+			fmt.Fprintf(opts.stdout, "deleted bucket %s\n", name)
+		}
+
+		results = append(results, res)
+	}
+
+	if opts.json {
+		opts.printJSON(results)
+	}
+
+	return code
+}
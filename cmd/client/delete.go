@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var deleteCommand = &command{
+	run:   runDelete,
+	usage: "<name>...",
+}
+
+func runDelete(ctx context.Context, opts *options, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(opts.stderr, "rm must specify at least one image name")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	code := exitOK
+	results := make([]*resultJSON, 0, len(args))
+
+	for _, name := range args {
+		res := &resultJSON{
+			Name: name,
+		}
+
+		err := c.Delete(ctx, name)
+		if err != nil {
+			res.Error = errorJSON(err)
+
+			if code == exitOK {
+				code = exitCode(err)
+			}
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "failed to delete %s: %s\n", name, err.Error())
+			}
+		} else if !opts.json {
+			fmt.Fprintf(opts.stdout, "deleted %s\n", name)
+		}
+
+		results = append(results, res)
+	}
+
+	if opts.json {
+		opts.printJSON(results)
+	}
+
+	return code
+}
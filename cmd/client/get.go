@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	getOutput string
+	getForce  bool
+)
+
+var getCommand = &command{
+	run:   runGet,
+	usage: "<name>",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&getOutput, "o", "", "Specifies the file to write the image to, or '-' for stdout. Defaults to the image's name")
+		fs.BoolVar(&getForce, "f", false, "Overwrite the output file if it already exists")
+	},
+}
+
+func runGet(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "get must specify a single image name")
+		return exitUsage
+	}
+
+	name := args[0]
+
+	// images in a bucket are written to a file named without the bucket
+	output := getOutput
+	if output == "" {
+		output = path.Base(name)
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	res := &resultJSON{
+		Name: name,
+		File: output,
+	}
+
+	if output == "-" {
+		err = c.Download(ctx, name, opts.stdout)
+
+		// the image has been written to stdout, so
+		// any results are written to stderr instead
+		opts.stdout = opts.stderr
+	} else {
+		err = downloadFile(ctx, c, name, output, getForce)
+	}
+
+	if err != nil {
+		return opts.fail(fmt.Sprintf("failed to download %s", name), err)
+	}
+
+	if opts.json {
+		opts.printJSON(res)
+	} else if output != "-" {
+		fmt.Fprintf(opts.stdout, "downloaded %s to %s\n", name, output)
+	}
+
+	return exitOK
+}
+
+// downloadFile downloads an image to a file, removing the file if the download fails
+func downloadFile(ctx context.Context, c *client.Client, name, path string, force bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	fd, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = c.Download(ctx, name, fd)
+	if err != nil {
+		fd.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return fd.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+var listCommand = &command{
+	run:   runList,
+	usage: "[prefix]",
+}
+
+func runList(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(opts.stderr, "ls accepts a single name prefix")
+		return exitUsage
+	}
+
+	var prefix string
+
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	objects, err := c.List(ctx, prefix)
+	if err != nil {
+		return opts.fail("failed to list images", err)
+	}
+
+	if opts.json {
+		opts.printJSON(objects)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tSIZE\tCREATED\tURL")
+
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", obj.Name, obj.Size, obj.Created.Format(time.RFC3339), obj.URL)
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
@@ -2,63 +2,288 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 
-	"github.com/purehyperbole/catly/protocol/catly"
-	"google.golang.org/grpc"
+	"github.com/purehyperbole/catly/client"
 )
 
-var (
-	serverAddr = flag.String("server", "127.0.0.1:8000", "Specifies the address of the gRPC server. Defaults to 127.0.0.1:8000")
+// exit codes returned for each class of error
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitExists
+	exitInvalid
+	exitUnauthenticated
+	exitRateLimited
+	exitUnavailable
 )
 
+const usage = `catly is a client for uploading and managing images
+
+Usage:
+	catly [flags] <command> [command flags] [arguments]
+
+Commands:
+	upload    upload one or more images, accepting file paths, glob patterns, urls or directories with -r
+	get       download an image to a file or stdout
+	ls        list images, optionally filtered by a name prefix
+	stat      show information about one or more images
+	rm        delete one or more images
+	search    find images by their tags and metadata
+	similar   find images that look similar to a stored image or a sample file
+	watch     print an event for every image that is uploaded or deleted
+	presign   create a url that an image can be uploaded to once without a token
+	mb        create a bucket
+	buckets   list buckets
+	rb        delete one or more empty buckets
+	migrate   copy all images from one storage backend to another
+
+Flags:
+`
+
+// command a subcommand of the client
+type command struct {
+	run   func(ctx context.Context, opts *options, args []string) int
+	usage string
+	flags func(fs *flag.FlagSet)
+}
+
+// options common to all commands
+type options struct {
+	server string
+	token  string
+	tls    bool
+	caFile string
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = map[string]*command{
+	"upload":  uploadCommand,
+	"get":     getCommand,
+	"ls":      listCommand,
+	"stat":    statCommand,
+	"rm":      deleteCommand,
+	"search":  searchCommand,
+	"similar": similarCommand,
+	"watch":   watchCommand,
+	"presign": presignCommand,
+	"mb":      createBucketCommand,
+	"buckets": listBucketsCommand,
+	"rb":      deleteBucketCommand,
+	"migrate": migrateCommand,
+}
+
 func main() {
-	flag.Parse()
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	opts := &options{
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
 
-	if len(os.Args) < 2 {
-		fmt.Println("command must specify a valid file path")
-		os.Exit(1)
+	fs := flag.NewFlagSet("catly", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
 	}
 
-	// open the specified file
-	fd, err := os.Open(os.Args[1])
-	check(err, "failed to open specified file")
-	defer fd.Close()
+	opts.register(fs)
 
-	// read it's data into memory
-	data, err := io.ReadAll(fd)
-	check(err, "failed to read specified file")
+	err := fs.Parse(args)
+	if err != nil {
+		return exitUsage
+	}
 
-	// open the gRPC client and prepare to send the request
-	conn, err := grpc.Dial(*serverAddr, grpc.WithInsecure())
-	check(err, "failed to connect to server")
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
 
-	client := catly.NewObjectClient(conn)
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		// support the original usage of the client, which
+		// uploaded a single file specified as the first argument
+		_, err := os.Stat(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(opts.stderr, "unknown command '%s'\n", fs.Arg(0))
+			fs.Usage()
+			return exitUsage
+		}
 
-	// send the data
-	req := &catly.UploadObjectRequest{
-		Name: filepath.Base(os.Args[1]),
-		Data: data,
+		return uploadCommand.run(context.Background(), opts, fs.Args())
 	}
 
-	resp, err := client.Upload(context.Background(), req)
-	check(err, "failed to upload file")
+	// each command accepts the common flags after the command name
+	// as well as before it, along with any flags of its own
+	cfs := flag.NewFlagSet("catly "+fs.Arg(0), flag.ContinueOnError)
+	cfs.Usage = func() {
+		fmt.Fprintf(cfs.Output(), "Usage:\n\tcatly %s [flags] %s\n\nFlags:\n", fs.Arg(0), cmd.usage)
+		cfs.PrintDefaults()
+	}
 
-	if resp.Status != catly.ObjectStatus_ObjectOK {
-		check(errors.New(resp.Error), "file upload failed with")
+	opts.register(cfs)
+
+	if cmd.flags != nil {
+		cmd.flags(cfs)
+	}
+
+	err = cfs.Parse(fs.Args()[1:])
+	if err != nil {
+		return exitUsage
+	}
+
+	return cmd.run(context.Background(), opts, cfs.Args())
+}
+
+// register adds the common flags to a flag set, using
+// any values that have already been parsed as defaults
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", defaultString(o.server, "127.0.0.1:8000"), "Specifies the address of the gRPC server")
+	fs.StringVar(&o.token, "token", o.token, "Specifies the token used to authenticate with the server")
+	fs.BoolVar(&o.tls, "tls", o.tls, "Connect to the server using TLS")
+	fs.StringVar(&o.caFile, "ca", o.caFile, "Specifies a CA certificate file used to verify the server when using TLS")
+	fs.BoolVar(&o.json, "json", o.json, "Output results as json")
+}
+
+// client creates a new client from the common options
+func (o *options) client() (*client.Client, error) {
+	var opts []client.Option
+
+	if o.token != "" {
+		opts = append(opts, client.WithToken(o.token))
+	}
+
+	if o.tls {
+		cfg, err := tlsConfig(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls config: %w", err)
+		}
+
+		opts = append(opts, client.WithTLS(cfg))
 	}
 
-	fmt.Printf("your image is now available at: %s\n", resp.Url)
+	return client.New(o.server, opts...)
+}
+
+// printJSON writes a value to stdout as json
+func (o *options) printJSON(v interface{}) {
+	enc := json.NewEncoder(o.stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
 }
 
-func check(err error, pfx string) {
+// fail reports an error, returning the exit code for its class
+func (o *options) fail(pfx string, err error) int {
+	if o.json {
+		o.printJSON(errorJSON(err))
+	} else {
+		fmt.Fprintf(o.stderr, "%s: %s\n", pfx, err.Error())
+	}
+
+	return exitCode(err)
+}
+
+// resultJSON the json output for an operation on a single image
+type resultJSON struct {
+	File    string                  `json:"file,omitempty"`
+	Name    string                  `json:"name"`
+	URL     string                  `json:"url,omitempty"`
+	ViewURL string                  `json:"view_url,omitempty"`
+	Skipped string                  `json:"skipped,omitempty"`
+	Object  *client.ObjectInfo      `json:"object,omitempty"`
+	Similar []*client.SimilarObject `json:"similar,omitempty"`
+	Error   *errorOutput            `json:"error,omitempty"`
+}
+
+// errorOutput the json output for an error
+type errorOutput struct {
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func errorJSON(err error) *errorOutput {
+	if err == nil {
+		return nil
+	}
+
+	out := &errorOutput{
+		Message: err.Error(),
+	}
+
+	var e *client.Error
+	if errors.As(err, &e) {
+		out.Code = e.Code.String()
+		out.Reason = e.Reason.String()
+	}
+
+	return out
+}
+
+// exitCode returns the exit code for the class of an error
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, client.ErrFileDoesNotExist), errors.Is(err, client.ErrBucketDoesNotExist):
+		return exitNotFound
+	case errors.Is(err, client.ErrFileExists), errors.Is(err, client.ErrBucketExists), errors.Is(err, client.ErrDuplicate):
+		return exitExists
+	case errors.Is(err, client.ErrInvalidRequest), errors.Is(err, client.ErrTooLarge):
+		return exitInvalid
+	case errors.Is(err, client.ErrUnauthenticated):
+		return exitUnauthenticated
+	case errors.Is(err, client.ErrRateLimited):
+		return exitRateLimited
+	case errors.Is(err, client.ErrUnavailable):
+		return exitUnavailable
+	}
+
+	return exitError
+}
+
+// tlsConfig creates a tls config that will verify the server using
+// the provided CA certificate, or the system's roots if not provided
+func tlsConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
 	if err != nil {
-		fmt.Printf("%s: %s\n", pfx, err.Error())
-		os.Exit(1)
+		return nil, err
 	}
+
+	cfg.RootCAs = x509.NewCertPool()
+
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid certificates found in CA file")
+	}
+
+	return cfg, nil
+}
+
+func defaultString(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
 }
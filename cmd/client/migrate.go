@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog"
+)
+
+var (
+	migrateFrom    string
+	migrateTo      string
+	migrateWorkers int
+	migrateDryRun  bool
+	migrateFromKey string
+	migrateToKey   string
+)
+
+var migrateCommand = &command{
+	run:   runMigrate,
+	usage: "-from <storage path> -to <storage path>",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&migrateFrom, "from", "", "Specifies the storage path to copy images from, in the same format as CATLY_STORAGE_PATH")
+		fs.StringVar(&migrateTo, "to", "", "Specifies the storage path to copy images to, in the same format as CATLY_STORAGE_PATH")
+		fs.IntVar(&migrateWorkers, "workers", storage.DefaultMigrateWorkers, "Specifies the number of images to copy concurrently")
+		fs.BoolVar(&migrateDryRun, "dry-run", false, "Report the images that would be copied without copying them")
+		fs.StringVar(&migrateFromKey, "from-key-file", "", "Specifies a key file to decrypt images from encrypted source storage, in the same format as CATLY_ENCRYPTION_KEY_FILE")
+		fs.StringVar(&migrateToKey, "to-key-file", "", "Specifies a key file to encrypt images written to the destination storage, in the same format as CATLY_ENCRYPTION_KEY_FILE")
+	},
+}
+
+// migrateJSON the json output of a migration
+type migrateJSON struct {
+	*storage.MigrateResult
+	DryRun  bool          `json:"dry_run"`
+	Objects []*resultJSON `json:"objects"`
+}
+
+func runMigrate(ctx context.Context, opts *options, args []string) int {
+	if migrateFrom == "" || migrateTo == "" {
+		fmt.Fprintln(opts.stderr, "migrate must specify both -from and -to")
+		return exitUsage
+	}
+
+	if migrateFrom == storage.MemoryPath || migrateTo == storage.MemoryPath {
+		fmt.Fprintf(opts.stderr, "%s storage is not persisted, use %s<dir> to migrate persisted in memory storage\n", storage.MemoryPath, storage.MemoryPrefix)
+		return exitUsage
+	}
+
+	if migrateFrom == migrateTo {
+		fmt.Fprintln(opts.stderr, "migrate must specify different -from and -to storage")
+		return exitUsage
+	}
+
+	// only report problems found by the storage backends, such as data
+	// that had to be recovered, rather than every object that is read
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	fromKeys, err := loadKeyRing(migrateFromKey)
+	if err != nil {
+		return opts.fail("failed to load source encryption keys", err)
+	}
+
+	toKeys, err := loadKeyRing(migrateToKey)
+	if err != nil {
+		return opts.fail("failed to load destination encryption keys", err)
+	}
+
+	from, err := storage.Open(migrateFrom)
+	if err != nil {
+		return opts.fail("failed to open source storage", err)
+	}
+
+	if fromKeys != nil {
+		from = storage.NewEncryptedStore(from, fromKeys)
+	}
+
+	defer storage.Close(from)
+
+	to, err := openDestination(migrateTo, migrateDryRun)
+	if err != nil {
+		return opts.fail("failed to open destination storage", err)
+	}
+
+	if toKeys != nil {
+		to = storage.NewEncryptedStore(to, toKeys)
+	}
+
+	defer storage.Close(to)
+
+	// stop copying new images if interrupted, so the
+	// migration can be resumed by running it again
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	var objects []*resultJSON
+
+	res, err := storage.Migrate(ctx, from, to, &storage.MigrateOptions{
+		Workers: migrateWorkers,
+		DryRun:  migrateDryRun,
+		Progress: func(p storage.MigrateProgress) {
+			obj := &resultJSON{
+				Name: p.Name,
+			}
+
+			switch p.Status {
+			case storage.MigrateFailed:
+				obj.Error = errorJSON(p.Err)
+
+				if !opts.json {
+					fmt.Fprintf(opts.stderr, "failed to copy %s: %s\n", p.Name, p.Err.Error())
+				}
+			case storage.MigrateSkipped:
+				obj.Skipped = "already exists"
+
+				if !opts.json {
+					fmt.Fprintf(opts.stderr, "skipped %s: already exists\n", p.Name)
+				}
+			case storage.MigrateCopied:
+				if opts.json {
+					break
+				}
+
+				if migrateDryRun {
+					fmt.Fprintf(opts.stdout, "would copy %s (%s)\n", p.Name, formatSize(p.Size))
+				} else {
+					fmt.Fprintf(opts.stdout, "copied %s (%s)\n", p.Name, formatSize(p.Size))
+				}
+			}
+
+			objects = append(objects, obj)
+		},
+	})
+
+	if opts.json {
+		if objects == nil {
+			objects = []*resultJSON{}
+		}
+
+		opts.printJSON(&migrateJSON{
+			MigrateResult: res,
+			DryRun:        migrateDryRun,
+			Objects:       objects,
+		})
+	} else {
+		verb := "copied"
+		if migrateDryRun {
+			verb = "would copy"
+		}
+
+		fmt.Fprintf(opts.stdout, "%s %d images (%s), skipped %d, failed %d\n", verb, res.Copied, formatSize(res.Bytes), res.Skipped, res.Failed)
+	}
+
+	if err != nil {
+		fmt.Fprintf(opts.stderr, "migration interrupted: %s\n", err.Error())
+		return exitError
+	}
+
+	if res.Failed > 0 {
+		return exitError
+	}
+
+	return exitOK
+}
+
+// openDestination opens the storage to migrate to, creating it if it does not
+// exist. A dry run will not create it, and instead compares against empty storage
+func openDestination(path string, dryRun bool) (storage.Store, error) {
+	if !dryRun {
+		return storage.Create(path)
+	}
+
+	st, err := storage.Open(path)
+	if errors.Is(err, storage.ErrStorageDoesNotExist) {
+		return storage.NewMemoryStore(), nil
+	}
+
+	return st, err
+}
+
+// loadKeyRing loads the encryption keys from a key file, if one is specified
+func loadKeyRing(keyFile string) (*storage.KeyRing, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	keys, err := storage.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewKeyRing(keys...)
+}
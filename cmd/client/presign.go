@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	presignMaxSize int64
+	presignTypes   string
+	presignExpiry  time.Duration
+)
+
+var presignCommand = &command{
+	run:   runPresign,
+	usage: "<name>",
+	flags: func(fs *flag.FlagSet) {
+		fs.Int64Var(&presignMaxSize, "max-size", 0, "Specifies the maximum size in bytes of the image that can be uploaded (default: server maximum)")
+		fs.StringVar(&presignTypes, "types", "", "Specifies a comma separated list of the content types that can be uploaded (default: any supported type)")
+		fs.DurationVar(&presignExpiry, "expiry", 0, "Specifies how long the url can be used for (default: server default)")
+	},
+}
+
+func runPresign(ctx context.Context, opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(opts.stderr, "presign must specify the name of one image")
+		return exitUsage
+	}
+
+	uo := &client.UploadURLOptions{
+		MaxSize: presignMaxSize,
+		Expiry:  presignExpiry,
+	}
+
+	if presignTypes != "" {
+		uo.ContentTypes = strings.Split(presignTypes, ",")
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	u, err := c.CreateUploadURL(ctx, args[0], uo)
+	if err != nil {
+		return opts.fail("failed to create upload url", err)
+	}
+
+	if opts.json {
+		opts.printJSON(u)
+		return exitOK
+	}
+
+	fmt.Fprintln(opts.stdout, u.URL)
+
+	return exitOK
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+const (
+	progressBarWidth    = 30
+	progressNameWidth   = 32
+	progressRedrawDelay = 100 * time.Millisecond
+)
+
+// progressBars renders a progress bar for each file that is being uploaded, if
+// enabled. Completed files are passed to done and removed from the rendered bars
+type progressBars struct {
+	mu     sync.Mutex
+	w      io.Writer
+	tty    bool
+	done   func(p client.FileProgress)
+	active []string
+	files  map[string]client.FileProgress
+	lines  int
+	drawn  time.Time
+}
+
+func newProgressBars(w io.Writer, render bool, done func(p client.FileProgress)) *progressBars {
+	return &progressBars{
+		w:     w,
+		tty:   render,
+		done:  done,
+		files: make(map[string]client.FileProgress),
+	}
+}
+
+// update updates the progress of a file
+func (b *progressBars) update(p client.FileProgress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p.Status != client.FileUploading {
+		if _, ok := b.files[p.Path]; ok {
+			delete(b.files, p.Path)
+
+			for i := range b.active {
+				if b.active[i] == p.Path {
+					b.active = append(b.active[:i], b.active[i+1:]...)
+					break
+				}
+			}
+		}
+
+		b.clear()
+		b.done(p)
+		b.draw()
+
+		return
+	}
+
+	if _, ok := b.files[p.Path]; !ok {
+		b.active = append(b.active, p.Path)
+	}
+
+	b.files[p.Path] = p
+
+	// limit how often bars are redrawn as data is sent
+	if time.Since(b.drawn) < progressRedrawDelay {
+		return
+	}
+
+	b.clear()
+	b.draw()
+}
+
+// finish removes any rendered bars
+func (b *progressBars) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clear()
+}
+
+func (b *progressBars) clear() {
+	if b.lines < 1 {
+		return
+	}
+
+	// move the cursor to the first bar and clear everything below it
+	fmt.Fprintf(b.w, "\x1b[%dA\x1b[J", b.lines)
+	b.lines = 0
+}
+
+func (b *progressBars) draw() {
+	if !b.tty {
+		return
+	}
+
+	for _, path := range b.active {
+		p := b.files[path]
+		fmt.Fprintln(b.w, progressLine(p))
+	}
+
+	b.lines = len(b.active)
+	b.drawn = time.Now()
+}
+
+func progressLine(p client.FileProgress) string {
+	name := p.Name
+	if len(name) > progressNameWidth {
+		name = name[:progressNameWidth-3] + "..."
+	}
+
+	var ratio float64
+	if p.Size > 0 {
+		ratio = float64(p.Uploaded) / float64(p.Size)
+	}
+
+	if ratio > 1 {
+		ratio = 1
+	}
+
+	filled := int(ratio * progressBarWidth)
+
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if filled > 0 && filled < progressBarWidth {
+		bar = strings.Repeat("=", filled-1) + ">" + strings.Repeat(" ", progressBarWidth-filled)
+	}
+
+	return fmt.Sprintf(
+		"%-*s [%s] %3d%% %s/%s",
+		progressNameWidth,
+		name,
+		bar,
+		int(ratio*100),
+		formatSize(p.Uploaded),
+		formatSize(p.Size),
+	)
+}
+
+// formatSize formats a number of bytes in a human readable form
+func formatSize(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isTerminal reports if the writer is a terminal
+func isTerminal(w io.Writer) bool {
+	fd, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
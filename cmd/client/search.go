@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	searchTags    = tagsFlag{}
+	searchOwner   string
+	searchType    string
+	searchMinSize int64
+	searchMaxSize int64
+	searchAfter   string
+	searchBefore  string
+	searchBucket  string
+)
+
+var searchCommand = &command{
+	run: runSearch,
+	flags: func(fs *flag.FlagSet) {
+		fs.Var(searchTags, "tag", "Only find images with a tag, specified as 'key' or 'key=value'. Can be specified more than once")
+		fs.StringVar(&searchOwner, "owner", "", "Only find images uploaded by the principal")
+		fs.StringVar(&searchType, "type", "", "Only find images of the content type, such as 'image/png'")
+		fs.Int64Var(&searchMinSize, "min-size", 0, "Only find images of at least the size in bytes")
+		fs.Int64Var(&searchMaxSize, "max-size", 0, "Only find images of at most the size in bytes")
+		fs.StringVar(&searchAfter, "after", "", "Only find images uploaded at or after a time, such as '2006-01-02' or '2006-01-02T15:04:05Z'")
+		fs.StringVar(&searchBefore, "before", "", "Only find images uploaded before a time, such as '2006-01-02' or '2006-01-02T15:04:05Z'")
+		fs.StringVar(&searchBucket, "bucket", "", "Only find images in the bucket")
+	},
+}
+
+// tagsFlag a flag that can be specified more than once to set key/value tags
+type tagsFlag map[string]string
+
+func (t tagsFlag) String() string {
+	tags := make([]string, 0, len(t))
+
+	for key, value := range t {
+		tags = append(tags, formatTag(key, value))
+	}
+
+	sort.Strings(tags)
+
+	return strings.Join(tags, ",")
+}
+
+func (t tagsFlag) Set(tag string) error {
+	kv := strings.SplitN(tag, "=", 2)
+	if kv[0] == "" {
+		return fmt.Errorf("tag '%s' has no key", tag)
+	}
+
+	if len(kv) == 2 {
+		t[kv[0]] = kv[1]
+	} else {
+		t[kv[0]] = ""
+	}
+
+	return nil
+}
+
+func runSearch(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "search does not accept any arguments, use flags to filter images")
+		return exitUsage
+	}
+
+	query := &client.Query{
+		Bucket:      searchBucket,
+		Tags:        searchTags,
+		Owner:       searchOwner,
+		ContentType: searchType,
+		MinSize:     searchMinSize,
+		MaxSize:     searchMaxSize,
+	}
+
+	var err error
+
+	query.CreatedAfter, err = parseTime(searchAfter)
+	if err != nil {
+		fmt.Fprintf(opts.stderr, "invalid -after time: %s\n", err.Error())
+		return exitUsage
+	}
+
+	query.CreatedBefore, err = parseTime(searchBefore)
+	if err != nil {
+		fmt.Fprintf(opts.stderr, "invalid -before time: %s\n", err.Error())
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	objects, err := c.Search(ctx, query)
+	if err != nil {
+		return opts.fail("failed to search images", err)
+	}
+
+	if opts.json {
+		opts.printJSON(objects)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tSIZE\tCREATED\tOWNER\tTAGS")
+
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", obj.Name, obj.Size, obj.Created.Format(time.RFC3339), defaultString(obj.Owner, "-"), defaultString(tagsFlag(obj.Tags).String(), "-"))
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
+
+// parseTime parses an RFC 3339 time or a date. An empty time is the zero time
+func parseTime(t string) (time.Time, error) {
+	if t == "" {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err == nil {
+		return parsed, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", t, time.Local)
+}
+
+func formatTag(key, value string) string {
+	if value == "" {
+		return key
+	}
+
+	return key + "=" + value
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	similarFile     string
+	similarDistance int
+	similarLimit    int
+)
+
+var similarCommand = &command{
+	run:   runSimilar,
+	usage: "<name>",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&similarFile, "file", "", "Specifies a local image to find similar images to, instead of a stored image")
+		fs.IntVar(&similarDistance, "distance", 0, "Specifies the maximum number of bits the perceptual hashes of similar images differ by (default: server default)")
+		fs.IntVar(&similarLimit, "limit", 0, "Specifies the maximum number of similar images to find (default: server default)")
+	},
+}
+
+func runSimilar(ctx context.Context, opts *options, args []string) int {
+	if (similarFile == "") == (len(args) != 1) {
+		fmt.Fprintln(opts.stderr, "similar must specify either the name of one image or a -file")
+		return exitUsage
+	}
+
+	var data []byte
+
+	if similarFile != "" {
+		var err error
+
+		data, err = os.ReadFile(similarFile)
+		if err != nil {
+			return opts.fail("failed to read file", err)
+		}
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	var similar []*client.SimilarObject
+
+	if data != nil {
+		similar, err = c.FindSimilarData(ctx, data, similarDistance, similarLimit)
+	} else {
+		similar, err = c.FindSimilar(ctx, args[0], similarDistance, similarLimit)
+	}
+
+	if err != nil {
+		return opts.fail("failed to find similar images", err)
+	}
+
+	if opts.json {
+		opts.printJSON(similar)
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(opts.stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tDISTANCE\tSIZE\tURL")
+
+	for _, s := range similar {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", s.Object.Name, s.Distance, s.Object.Size, s.Object.URL)
+	}
+
+	tw.Flush()
+
+	return exitOK
+}
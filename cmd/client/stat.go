@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var statCommand = &command{
+	run:   runStat,
+	usage: "<name>...",
+}
+
+func runStat(ctx context.Context, opts *options, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(opts.stderr, "stat must specify at least one image name")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	code := exitOK
+	results := make([]*resultJSON, 0, len(args))
+
+	for i, name := range args {
+		res := &resultJSON{
+			Name: name,
+		}
+
+		info, err := c.Stat(ctx, name)
+		if err != nil {
+			res.Error = errorJSON(err)
+
+			if code == exitOK {
+				code = exitCode(err)
+			}
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "failed to stat %s: %s\n", name, err.Error())
+			}
+		} else {
+			res.Object = info
+
+			if !opts.json {
+				if i > 0 {
+					fmt.Fprintln(opts.stdout)
+				}
+
+				fmt.Fprintf(opts.stdout, "name:         %s\n", info.Name)
+				fmt.Fprintf(opts.stdout, "size:         %d\n", info.Size)
+				fmt.Fprintf(opts.stdout, "content type: %s\n", info.ContentType)
+				fmt.Fprintf(opts.stdout, "created:      %s\n", info.Created.Format(time.RFC3339))
+				fmt.Fprintf(opts.stdout, "url:          %s\n", info.URL)
+
+				if info.Checksum != "" {
+					fmt.Fprintf(opts.stdout, "checksum:     %s\n", info.Checksum)
+				}
+
+				if info.Owner != "" {
+					fmt.Fprintf(opts.stdout, "owner:        %s\n", info.Owner)
+				}
+
+				if info.Description != "" {
+					fmt.Fprintf(opts.stdout, "description:  %s\n", info.Description)
+				}
+
+				if len(info.Tags) > 0 {
+					fmt.Fprintf(opts.stdout, "tags:         %s\n", tagsFlag(info.Tags).String())
+				}
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	if opts.json {
+		opts.printJSON(results)
+	}
+
+	return code
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	uploadRecursive   bool
+	uploadWorkers     int
+	uploadJournal     string
+	uploadConflict    string
+	uploadBucket      string
+	uploadTags        = tagsFlag{}
+	uploadDescription string
+	uploadDuplicates  string
+	uploadDistance    int
+)
+
+var uploadCommand = &command{
+	run:   runUpload,
+	usage: "<file|glob|dir|url>...",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&uploadRecursive, "r", false, "Recursively upload all JPEG, PNG and GIF images in any directories specified")
+		fs.IntVar(&uploadWorkers, "workers", client.DefaultWorkers, "Specifies the number of files to upload concurrently")
+		fs.StringVar(&uploadJournal, "journal", "", "Specifies a journal file that records successful uploads, so an interrupted upload can be resumed")
+		fs.StringVar(&uploadConflict, "conflict", "fail", "Specifies how to handle images with names that already exist, either 'fail', 'skip' or 'rename'")
+		fs.StringVar(&uploadBucket, "bucket", "", "Specifies the bucket to upload images to")
+		fs.Var(uploadTags, "tag", "Specifies a tag to upload images with as 'key' or 'key=value'. Can be specified more than once")
+		fs.StringVar(&uploadDescription, "description", "", "Specifies a description to upload images with")
+		fs.StringVar(&uploadDuplicates, "duplicates", "allow", "Specifies how to handle images that look similar to stored images, either 'allow', 'flag' or 'reject'")
+		fs.IntVar(&uploadDistance, "distance", 0, "Specifies the maximum number of bits the perceptual hashes of similar images differ by (default: server default)")
+	},
+}
+
+func runUpload(ctx context.Context, opts *options, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(opts.stderr, "upload must specify at least one file")
+		return exitUsage
+	}
+
+	conflict, err := client.ParseConflictPolicy(uploadConflict)
+	if err != nil {
+		fmt.Fprintln(opts.stderr, err.Error())
+		return exitUsage
+	}
+
+	duplicates, err := client.ParseDuplicatePolicy(uploadDuplicates)
+	if err != nil {
+		fmt.Fprintln(opts.stderr, err.Error())
+		return exitUsage
+	}
+
+	// http and https urls are fetched by the server
+	var urls, local []string
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+			urls = append(urls, arg)
+		} else {
+			local = append(local, arg)
+		}
+	}
+
+	paths, err := expandPaths(local)
+	if err != nil {
+		fmt.Fprintf(opts.stderr, "invalid file path: %s\n", err.Error())
+		return exitUsage
+	}
+
+	var files, dirs []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			// missing files are reported when they are uploaded
+			files = append(files, path)
+			continue
+		}
+
+		if !uploadRecursive {
+			fmt.Fprintf(opts.stderr, "%s is a directory, use -r to upload its images\n", path)
+			return exitUsage
+		}
+
+		dirs = append(dirs, path)
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	bulk := &client.BulkOptions{
+		Workers:     uploadWorkers,
+		Conflict:    conflict,
+		Bucket:      uploadBucket,
+		Duplicates:  duplicates,
+		MaxDistance: uploadDistance,
+	}
+
+	if len(uploadTags) > 0 {
+		bulk.Tags = uploadTags
+	}
+
+	bulk.Description = uploadDescription
+
+	if uploadJournal != "" {
+		bulk.Journal, err = client.OpenJournal(uploadJournal)
+		if err != nil {
+			return opts.fail("failed to open journal", err)
+		}
+
+		defer bulk.Journal.Close()
+	}
+
+	// stop uploading new files if interrupted, so the
+	// journal reflects every file that has completed
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	code := exitOK
+	results := make([]*resultJSON, 0, len(paths))
+
+	bars := newProgressBars(opts.stderr, !opts.json && isTerminal(opts.stderr), func(p client.FileProgress) {
+		res := &resultJSON{
+			File:    p.Path,
+			Name:    p.Name,
+			URL:     p.URL,
+			ViewURL: p.ViewURL,
+			Similar: p.Similar,
+		}
+
+		switch p.Status {
+		case client.FileFailed:
+			res.Error = errorJSON(p.Err)
+
+			// report the first error we encountered
+			if code == exitOK {
+				code = exitCode(p.Err)
+			}
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "failed to upload %s: %s\n", p.Path, p.Err.Error())
+			}
+		case client.FileSkipped:
+			res.Skipped = p.Reason
+
+			if !opts.json {
+				fmt.Fprintf(opts.stderr, "skipped %s: %s\n", p.Path, p.Reason)
+			}
+		case client.FileUploaded:
+			if !opts.json {
+				fmt.Fprintf(opts.stdout, "your image %s is now available at: %s\n", p.Name, p.URL)
+
+				if p.ViewURL != "" {
+					fmt.Fprintf(opts.stdout, "share it with: %s\n", p.ViewURL)
+				}
+
+				for _, similar := range p.Similar {
+					fmt.Fprintf(opts.stderr, "%s looks similar to %s (distance %d)\n", p.Name, similar.Object.Name, similar.Distance)
+				}
+			}
+		}
+
+		results = append(results, res)
+	})
+
+	bulk.Progress = bars.update
+
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+
+		bars.update(uploadURL(ctx, c, u, bulk))
+	}
+
+	if len(files) > 0 {
+		_, err = c.UploadFiles(ctx, files, bulk)
+	}
+
+	for _, dir := range dirs {
+		if err != nil {
+			break
+		}
+
+		var dres []*client.FileProgress
+
+		dres, err = c.UploadDir(ctx, dir, bulk)
+		if err != nil && dres == nil {
+			bars.finish()
+			return opts.fail("failed to read directory "+dir, err)
+		}
+	}
+
+	bars.finish()
+
+	if opts.json {
+		opts.printJSON(results)
+	}
+
+	if err != nil {
+		fmt.Fprintf(opts.stderr, "upload interrupted: %s\n", err.Error())
+
+		if code == exitOK {
+			code = exitError
+		}
+	}
+
+	return code
+}
+
+// uploadURL uploads an image that the server fetches from a url. The
+// image is named after the last segment of the url's path
+func uploadURL(ctx context.Context, c *client.Client, rawURL string, bulk *client.BulkOptions) client.FileProgress {
+	p := client.FileProgress{
+		Path:   rawURL,
+		Status: client.FileUploaded,
+	}
+
+	var name string
+
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		name, _ = url.PathUnescape(path.Base(u.Path))
+	}
+
+	p.Name = name
+
+	if bulk.Bucket != "" {
+		p.Name = bulk.Bucket + "/" + name
+	}
+
+	uploadOpts := []client.UploadOption{
+		client.WithTags(bulk.Tags),
+		client.WithDescription(bulk.Description),
+		client.OnViewURL(func(url string) {
+			p.ViewURL = url
+		}),
+	}
+
+	switch bulk.Duplicates {
+	case client.DuplicateFlag:
+		uploadOpts = append(uploadOpts, client.FlagDuplicates(bulk.MaxDistance, func(similar []*client.SimilarObject) {
+			p.Similar = similar
+		}))
+	case client.DuplicateReject:
+		uploadOpts = append(uploadOpts, client.RejectDuplicates(bulk.MaxDistance))
+	}
+
+	p.URL, err = c.UploadFromURL(ctx, rawURL, p.Name, uploadOpts...)
+
+	var cerr *client.Error
+
+	switch {
+	case err == nil:
+	case errors.Is(err, client.ErrDuplicate) && errors.As(err, &cerr):
+		p.Status = client.FileSkipped
+		p.Reason = "looks similar to a stored image"
+		p.Similar = cerr.Similar
+
+		if len(cerr.Similar) > 0 {
+			p.Reason = fmt.Sprintf("looks similar to '%s'", cerr.Similar[0].Object.Name)
+		}
+	case errors.Is(err, client.ErrFileExists) && bulk.Conflict == client.ConflictSkip:
+		p.Status = client.FileSkipped
+		p.Reason = "name already exists"
+	default:
+		p.Status = client.FileFailed
+		p.Err = err
+	}
+
+	return p
+}
+
+// expandPaths expands any glob patterns in the provided paths
+func expandPaths(args []string) ([]string, error) {
+	var paths []string
+
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) < 1 {
+			return nil, fmt.Errorf("no files match '%s'", arg)
+		}
+
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
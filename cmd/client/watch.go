@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/purehyperbole/catly/client"
+)
+
+var (
+	watchBucket string
+	watchPrefix string
+	watchType   string
+	watchAfter  uint64
+)
+
+var watchCommand = &command{
+	run: runWatch,
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&watchBucket, "bucket", "", "Only watch images in the bucket")
+		fs.StringVar(&watchPrefix, "prefix", "", "Only watch images with names that start with the prefix")
+		fs.StringVar(&watchType, "type", "", "Only watch images of the content type, such as 'image/png'")
+		fs.Uint64Var(&watchAfter, "after", 0, "Resume watching after the event with the sequence number")
+	},
+}
+
+func runWatch(ctx context.Context, opts *options, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(opts.stderr, "watch does not accept any arguments, use flags to filter images")
+		return exitUsage
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return opts.fail("failed to connect to server", err)
+	}
+
+	defer c.Close()
+
+	// watch until interrupted
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	// events are printed as they are received, one per line
+	enc := json.NewEncoder(opts.stdout)
+
+	filter := &client.WatchFilter{
+		Bucket:      watchBucket,
+		Prefix:      watchPrefix,
+		ContentType: watchType,
+		After:       watchAfter,
+	}
+
+	err = c.Watch(ctx, filter, func(e *client.Event) error {
+		if e.Dropped > 0 {
+			fmt.Fprintf(opts.stderr, "missed %d events\n", e.Dropped)
+		}
+
+		if opts.json {
+			return enc.Encode(e)
+		}
+
+		_, err := fmt.Fprintf(opts.stdout, "%d\t%s\t%s\t%s\t%d\t%s\n", e.Sequence, e.Time.Format(time.RFC3339), e.Type, e.Object.Name, e.Object.Size, e.Object.URL)
+
+		return err
+	})
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return opts.fail("failed to watch images", err)
+	}
+
+	return exitOK
+}
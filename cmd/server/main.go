@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/purehyperbole/catly/api"
 	"github.com/purehyperbole/catly/protocol/catly"
 	"github.com/purehyperbole/catly/storage"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -26,13 +38,35 @@ const (
 	DefaultGRPCPort = "8000"
 	// DefaultStoragePath default storage path that will be used. By default,
 	// this is will use in-memory storage unless a path is specified
-	DefaultStoragePath = ":memory:"
+	DefaultStoragePath = storage.MemoryPath
+	// DefaultScrubRate default rate in bytes per second that objects are verified at
+	DefaultScrubRate = 1 << 24
+	// DefaultAdminAddr default address the admin service listens on, so
+	// it is only reachable from the server's host unless configured
+	DefaultAdminAddr = "127.0.0.1"
 )
 
 // storageProvider defines the interface that storage providers need to implement
 type storageProvider interface {
 	ReadObject(id string, w io.Writer) error
 	WriteObject(id string, r io.Reader) error
+	StatObject(id string) (*storage.ObjectInfo, error)
+	ListObjects(prefix, after string, limit int) ([]*storage.ObjectInfo, error)
+	DeleteObject(id string) error
+}
+
+// config the value of each environment variable read by the server, or its default if it
+// was not set. secrets are redacted when the config is requested from the admin service
+var config = make(map[string]string)
+
+// compactor is implemented by storage providers that can be compacted
+type compactor interface {
+	Compact() error
+}
+
+// evictor is implemented by storage providers that can evict objects
+type evictor interface {
+	OnEvict(fn func(id string))
 }
 
 func main() {
@@ -42,24 +76,277 @@ func main() {
 	grpcPort := getEnv("CATLY_GRPC_PORT", DefaultGRPCPort)
 	storagePath := getEnv("CATLY_STORAGE_PATH", DefaultStoragePath)
 	maxRequestSize := getEnvInt("CATLY_MAX_REQUEST_SIZE", DefaultMaxRequestSize)
+	rateLimitConfig := getEnv("CATLY_RATE_LIMIT_CONFIG", "")
+	authTokens := getEnv("CATLY_AUTH_TOKENS", "")
+	tlsCert := getEnv("CATLY_TLS_CERT", "")
+	tlsKey := getEnv("CATLY_TLS_KEY", "")
+	metricsPort := getEnv("CATLY_METRICS_PORT", "")
+	scrubInterval := getEnvInt("CATLY_SCRUB_INTERVAL", 0)
+	scrubRate := getEnvInt("CATLY_SCRUB_RATE", DefaultScrubRate)
+	encryptionKeys := getEnv("CATLY_ENCRYPTION_KEY", "")
+	encryptionKeyFile := getEnv("CATLY_ENCRYPTION_KEY_FILE", "")
+	webhookConfig := getEnv("CATLY_WEBHOOK_CONFIG", "")
+	webhookOutbox := getEnv("CATLY_WEBHOOK_OUTBOX", defaultOutboxPath(storagePath))
+	fetchSchemes := getEnv("CATLY_FETCH_SCHEMES", "http,https")
+	fetchTimeout := getEnvInt("CATLY_FETCH_TIMEOUT", int(api.DefaultFetchTimeout/time.Second))
+	fetchRedirects := getEnvInt("CATLY_FETCH_MAX_REDIRECTS", api.DefaultFetchRedirects)
+	uploadsPath := getEnv("CATLY_UPLOADS_PATH", filepath.Join(os.TempDir(), "catly-uploads"))
+	uploadsExpiry := getEnvInt("CATLY_UPLOADS_EXPIRY", int(api.DefaultTusExpiry/time.Second))
+	uploadURLKey := getEnv("CATLY_UPLOAD_URL_KEY", "")
+	viewPages := getEnv("CATLY_VIEW_PAGES", "false")
+	logLevel := getEnv("CATLY_LOG_LEVEL", "debug")
+	adminPort := getEnv("CATLY_ADMIN_PORT", "")
+	adminAddr := getEnv("CATLY_ADMIN_ADDR", DefaultAdminAddr)
+	adminPrincipals := getEnv("CATLY_ADMIN_PRINCIPALS", "")
+
+	level, err := zerolog.ParseLevel(logLevel)
+	check(err, "failed to parse CATLY_LOG_LEVEL")
+
+	zerolog.SetGlobalLevel(level)
 
-	// setup storage providers based on the different storage options
+	// setup storage providers based on the different storage options. multiple
+	// comma separated paths will replicate objects across each of them
 	log.Info().Msg(fmt.Sprintf("setting up storage in %s", storagePath))
 
 	var sp storageProvider
-	var err error
 
-	switch storagePath {
-	case DefaultStoragePath:
-		sp = storage.NewMemoryStore()
-	default:
-		err = os.MkdirAll(storagePath, 0744)
-		check(err, "failed to create storage directory")
+	paths := strings.Split(storagePath, ",")
+	stores := make([]storage.Store, len(paths))
+
+	for i, path := range paths {
+		paths[i] = strings.TrimSpace(path)
+
+		stores[i], err = openStore(paths[i])
+		check(err, "failed to setup storage")
+	}
+
+	if len(stores) == 1 {
+		sp = stores[0]
+	} else {
+		quorum := getEnvInt("CATLY_WRITE_QUORUM", len(stores)/2+1)
+
+		sp, err = storage.NewReplicatedStore(quorum, stores...)
+		check(err, "failed to setup replicated storage")
+	}
+
+	// config that can be reloaded by sending the server a SIGHUP
+	var reloaders []func() error
+
+	// encrypt objects before they are written to storage if a master key has
+	// been configured. keys in a key file can be rotated by sending a SIGHUP
+	if encryptionKeys != "" && encryptionKeyFile != "" {
+		check(errors.New("only one of CATLY_ENCRYPTION_KEY and CATLY_ENCRYPTION_KEY_FILE can be set"), "failed to setup encryption")
+	}
+
+	if encryptionKeys != "" || encryptionKeyFile != "" {
+		keys, err := loadKeys(encryptionKeys, encryptionKeyFile)
+		check(err, "failed to load encryption keys")
+
+		keyring, err := storage.NewKeyRing(keys...)
+		check(err, "failed to setup encryption")
+
+		sp = storage.NewEncryptedStore(sp, keyring)
+
+		if encryptionKeyFile != "" {
+			reloaders = append(reloaders, func() error {
+				keys, err := loadKeys("", encryptionKeyFile)
+				if err != nil {
+					return fmt.Errorf("failed to reload encryption keys: %w", err)
+				}
+
+				return keyring.SetKeys(keys...)
+			})
+		}
+	}
+
+	// stores that support compaction can be compacted
+	// while online by sending the server a SIGUSR1
+	var compactors []compactor
+
+	for _, st := range stores {
+		c, ok := st.(compactor)
+		if ok {
+			compactors = append(compactors, c)
+		}
+	}
+
+	go compactOnSignal(compactors)
+
+	// periodically verify the checksums of objects held on disk. corrupt objects
+	// are repaired from the other replicas, if there are any. if no interval is
+	// configured, objects are only verified when a scrub is started by an admin
+	scrubbers := startScrubbers(paths, stores, time.Duration(scrubInterval)*time.Second, int64(scrubRate))
+
+	// metrics are only served if a port has been configured,
+	// as they should not be exposed alongside the images
+	if metricsPort != "" {
+		log.Info().Msg(fmt.Sprintf("starting metrics listener on *:%s", metricsPort))
+
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%s", metricsPort), expvar.Handler())
+			check(err, "failed to start metrics listener")
+		}()
+	}
+
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	var streamInterceptors []grpc.StreamServerInterceptor
+
+	// setup token authentication if any tokens have been configured.
+	// tokens can be reloaded by sending the server a SIGHUP
+	var auth *api.TokenAuthenticator
+
+	if authTokens != "" {
+		var tokens map[string]string
+
+		err = loadJSON(authTokens, &tokens)
+		check(err, "failed to load auth tokens")
+
+		auth = api.NewTokenAuthenticator(tokens)
+
+		unaryInterceptors = append(unaryInterceptors, auth.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, auth.StreamServerInterceptor())
+
+		reloaders = append(reloaders, func() error {
+			var tokens map[string]string
+
+			err := loadJSON(authTokens, &tokens)
+			if err != nil {
+				return fmt.Errorf("failed to reload auth tokens: %w", err)
+			}
+
+			auth.SetTokens(tokens)
+
+			return nil
+		})
+	}
+
+	// the admin service can be restricted to a set of authenticated principals,
+	// so that it can be served alongside the object service
+	var authz *api.ServiceAuthorizer
+
+	if adminPrincipals != "" {
+		if auth == nil {
+			check(errors.New("CATLY_AUTH_TOKENS must be set to authenticate admin principals"), "failed to setup admin service")
+		}
+
+		principals := strings.Split(adminPrincipals, ",")
+
+		for i := range principals {
+			principals[i] = strings.TrimSpace(principals[i])
+		}
+
+		authz = api.NewServiceAuthorizer(api.AdminService, principals...)
+
+		unaryInterceptors = append(unaryInterceptors, authz.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, authz.StreamServerInterceptor())
+	}
+
+	// setup per client rate limiting. limits can be reloaded
+	// from the config file by sending the server a SIGHUP
+	var limits api.RateLimits
 
-		sp, err = storage.NewFileStore(storagePath)
-		check(err, "failed to setup file storage")
+	err = loadJSON(rateLimitConfig, &limits)
+	check(err, "failed to load rate limit config")
+
+	limiter := api.NewRateLimiter(limits)
+
+	unaryInterceptors = append(unaryInterceptors, limiter.UnaryServerInterceptor())
+	streamInterceptors = append(streamInterceptors, limiter.StreamServerInterceptor())
+
+	reloaders = append(reloaders, func() error {
+		var limits api.RateLimits
+
+		err := loadJSON(rateLimitConfig, &limits)
+		if err != nil {
+			return fmt.Errorf("failed to reload rate limit config: %w", err)
+		}
+
+		limiter.SetLimits(limits)
+
+		return nil
+	})
+
+	// send webhooks to the configured endpoints when images are uploaded or
+	// deleted. endpoints can be reloaded by sending the server a SIGHUP
+	var publishers []api.EventPublisher
+
+	if webhookConfig != "" {
+		var endpoints []*api.WebhookEndpoint
+
+		err = loadJSON(webhookConfig, &endpoints)
+		check(err, "failed to load webhook config")
+
+		if webhookOutbox == storage.MemoryPath {
+			log.Warn().Msg("webhook outbox is held in memory, so unsent webhooks will be lost if the server is stopped")
+		}
+
+		outbox, err := storage.Create(webhookOutbox)
+		check(err, "failed to setup webhook outbox")
+
+		dispatcher, err := api.NewWebhookDispatcher(outbox, endpoints)
+		check(err, "failed to setup webhooks")
+
+		go dispatcher.Run(context.Background())
+
+		publishers = append(publishers, dispatcher)
+
+		reloaders = append(reloaders, func() error {
+			var endpoints []*api.WebhookEndpoint
+
+			err := loadJSON(webhookConfig, &endpoints)
+			if err != nil {
+				return fmt.Errorf("failed to reload webhook config: %w", err)
+			}
+
+			dispatcher.SetEndpoints(endpoints)
+
+			return nil
+		})
+	}
+
+	go reloadOnHangup(reloaders)
+
+	// stream events to clients watching for uploaded and deleted images.
+	// recent events are held so that watchers can resume after reconnecting
+	broker := api.NewEventBroker(
+		getEnvInt("CATLY_WATCH_HISTORY", api.DefaultEventHistory),
+		getEnvInt("CATLY_WATCH_BUFFER", api.DefaultWatchBuffer),
+	)
+
+	// images can be uploaded from urls, which are fetched by the server. the
+	// fetcher refuses to connect to private, loopback and link-local addresses
+	schemes := strings.Split(fetchSchemes, ",")
+
+	for i := range schemes {
+		schemes[i] = strings.ToLower(strings.TrimSpace(schemes[i]))
+	}
+
+	fetcher := api.NewFetcher(
+		api.WithFetchSchemes(schemes...),
+		api.WithFetchTimeout(time.Duration(fetchTimeout)*time.Second),
+		api.WithFetchRedirects(fetchRedirects),
+	)
+
+	// upload urls are signed with a key, so they can be used without a token.
+	// if no key is configured, urls cannot be used once the server restarts
+	signingKey := []byte(uploadURLKey)
+
+	if uploadURLKey == "" {
+		log.Warn().Msg("no upload url key is configured, so upload urls will be invalid if the server is restarted")
+
+		signingKey = make([]byte, 32)
+
+		_, err = rand.Read(signingKey)
+		check(err, "failed to generate upload url key")
 	}
 
+	// used upload urls are recorded in storage, so they cannot be used again
+	// after the server restarts. they are removed once they have expired, and
+	// as internal objects, are never evicted from bounded memory storage
+	signer := api.NewUploadSigner(signingKey, api.WithUsedNonces(storage.NewNonces(sp)))
+
+	go signer.Run(context.Background())
+
 	// setup the grpc server
 	log.Info().Msg(fmt.Sprintf("starting gRPC listener on *:%s", grpcPort))
 
@@ -68,16 +355,129 @@ func main() {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", grpcPort))
 	check(err, "failed to start gRPC listener")
 
-	s := grpc.NewServer(
+	opts := []grpc.ServerOption{
 		grpc.MaxSendMsgSize(maxRequestSize),
 		grpc.MaxRecvMsgSize(maxRequestSize),
-	)
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+
+	if tlsCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(tlsCert, tlsKey)
+		check(err, "failed to load tls certificate")
+
+		opts = append(opts, grpc.Creds(creds))
+	}
 
-	catly.RegisterObjectServer(
-		s,
-		api.NewGRPCResource(address, sp),
+	s := grpc.NewServer(opts...)
+
+	// the settings of each bucket are held in storage alongside the images
+	buckets := storage.NewBuckets(sp)
+
+	// the tags, metadata and perceptual hash of each image are held in storage
+	// alongside the images, and indexed in memory so they can be searched. the
+	// index is rebuilt in the background, so searches may be incomplete until
+	// it is done. images stored before they were hashed are hashed as it is rebuilt
+	index := storage.NewIndex(sp, storage.WithHasher(api.PerceptualHash))
+
+	// images evicted from bounded memory storage are removed from the index.
+	// if there are other replicas, evicted images can still be read from them
+	if e, ok := stores[0].(evictor); ok && len(stores) == 1 {
+		e.OnEvict(index.Evicted)
+	}
+
+	go func() {
+		err := index.Rebuild(context.Background())
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("failed to build search index: %s", err.Error()))
+		}
+	}()
+
+	objectOpts := []api.GRPCOption{
+		api.WithMaxObjectSize(maxRequestSize),
+		api.WithBuckets(buckets),
+		api.WithIndex(index),
+		api.WithEvents(publishers...),
+		api.WithWatch(broker),
+		api.WithURLUploads(fetcher),
+		api.WithUploadURLs(signer),
+	}
+
+	// view pages show a preview card when an image is shared
+	views, err := strconv.ParseBool(viewPages)
+	check(err, "failed to parse CATLY_VIEW_PAGES")
+
+	if views {
+		objectOpts = append(objectOpts, api.WithViewPages())
+	}
+
+	objects := api.NewGRPCResource(address, sp, objectOpts...)
+
+	catly.RegisterObjectServer(s, objects)
+
+	admin := api.NewAdminResource(
+		api.WithScrubbers(scrubbers...),
+		api.WithIndexer(index),
+		api.WithObjects(objects),
+		api.WithConfig(config, "CATLY_ENCRYPTION_KEY", "CATLY_UPLOAD_URL_KEY"),
+		api.WithCache("buckets", buckets),
 	)
 
+	// the admin service is only served on its own listener, which should not be
+	// reachable by clients, or to admin principals alongside the object service
+	switch {
+	case adminPort != "":
+		// without tokens, anyone who can reach the listener can use the admin service
+		if auth == nil && !isLoopback(adminAddr) {
+			check(errors.New("CATLY_AUTH_TOKENS must be set to serve the admin service on a non-loopback address"), "failed to setup admin service")
+		}
+
+		address := net.JoinHostPort(adminAddr, adminPort)
+
+		log.Info().Msg(fmt.Sprintf("starting admin gRPC listener on %s", address))
+
+		adminListener, err := net.Listen("tcp", address)
+		check(err, "failed to start admin gRPC listener")
+
+		var adminUnary []grpc.UnaryServerInterceptor
+		var adminStream []grpc.StreamServerInterceptor
+
+		if auth != nil {
+			adminUnary = append(adminUnary, auth.UnaryServerInterceptor())
+			adminStream = append(adminStream, auth.StreamServerInterceptor())
+		}
+
+		if authz != nil {
+			adminUnary = append(adminUnary, authz.UnaryServerInterceptor())
+			adminStream = append(adminStream, authz.StreamServerInterceptor())
+		}
+
+		adminOpts := []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(adminUnary...),
+			grpc.ChainStreamInterceptor(adminStream...),
+		}
+
+		if tlsCert != "" {
+			creds, err := credentials.NewServerTLSFromFile(tlsCert, tlsKey)
+			check(err, "failed to load tls certificate")
+
+			adminOpts = append(adminOpts, grpc.Creds(creds))
+		}
+
+		as := grpc.NewServer(adminOpts...)
+
+		catly.RegisterAdminServer(as, admin)
+
+		go func() {
+			err := as.Serve(adminListener)
+			check(err, "failed to serve admin gRPC")
+		}()
+	case authz != nil:
+		catly.RegisterAdminServer(s, admin)
+	default:
+		log.Warn().Msg("the admin service is disabled, as neither CATLY_ADMIN_PORT or CATLY_ADMIN_PRINCIPALS are set")
+	}
+
 	go func() {
 		err := s.Serve(listener)
 		check(err, "failed to serve gRPC")
@@ -86,19 +486,244 @@ func main() {
 	// start the http server
 	log.Info().Msg(fmt.Sprintf("starting HTTP listener on *:%s", httpPort))
 
-	hr := api.NewHTTPResource(sp)
+	hr := api.NewHTTPResource(sp, api.WithPublicBuckets(buckets), api.WithSearch(index))
+
+	// resumable uploads are held in a scratch directory until they are
+	// complete. uploads that have not been sent any data recently expire
+	partials, err := storage.NewPartialStore(uploadsPath)
+	check(err, "failed to setup resumable uploads")
+
+	tus := api.NewTusResource(
+		objects,
+		partials,
+		api.WithTusExpiry(time.Duration(uploadsExpiry)*time.Second),
+	)
+
+	go tus.Run(context.Background())
+
+	// searches can reveal the names and metadata of images, so they
+	// are authenticated in the same way as resumable uploads
+	var uploads http.Handler = tus
+	var search http.Handler = http.HandlerFunc(hr.Search)
+
+	if auth != nil {
+		uploads = auth.Middleware(uploads)
+		search = auth.Middleware(search)
+	}
+
+	// the web ui is served from a path that is not a valid bucket name. images
+	// uploaded from it are authenticated in the same way as resumable uploads
+	var uiOpts []api.UIOption
+
+	if auth != nil {
+		uiOpts = append(uiOpts, api.WithUIAuthenticator(auth))
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", hr.GetObject)
+	mux.Handle("/search", search)
+	mux.Handle(api.DefaultTusPath, uploads)
+	mux.Handle(api.UploadURLPath, api.NewUploadURLResource(objects))
+	mux.Handle(api.UIPath, api.NewUIResource(objects, uiOpts...))
+	// the mux redirects the path without a trailing slash to the web ui,
+	// so serve it as an image instead, in case an image has that name
+	mux.HandleFunc(strings.TrimSuffix(api.UIPath, "/"), hr.GetObject)
 
-	err = http.ListenAndServe(
-		fmt.Sprintf(":%s", httpPort),
-		mux,
-	)
+	if views {
+		vr := api.NewViewResource(objects)
+
+		mux.HandleFunc(api.ViewPath, vr.View)
+		mux.HandleFunc(strings.TrimSuffix(api.ViewPath, "/"), hr.GetObject)
+		mux.HandleFunc(api.OEmbedPath, vr.OEmbed)
+	}
+
+	// requests are authenticated by the handlers that require it, so
+	// the principal of each request is identified before it is limited
+	handler := limiter.Middleware(mux)
+
+	if auth != nil {
+		handler = auth.Identify(handler)
+	}
+
+	hs := &http.Server{
+		Addr:    fmt.Sprintf(":%s", httpPort),
+		Handler: handler,
+	}
+
+	if tlsCert != "" {
+		err = hs.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = hs.ListenAndServe()
+	}
 
 	check(err, "failed to start HTTP listener")
 }
 
+// isLoopback reports whether an address only accepts connections from the local host
+func isLoopback(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// defaultOutboxPath returns the path of a directory next to the first storage
+// path to hold the webhook outbox. If images are held in memory, the outbox is
+// held in the temporary directory instead, so unsent webhooks are not lost
+func defaultOutboxPath(storagePath string) string {
+	path := strings.TrimSpace(strings.Split(storagePath, ",")[0])
+	if path == storage.MemoryPath {
+		return filepath.Join(os.TempDir(), "catly-webhooks")
+	}
+
+	for _, prefix := range []string{storage.MemoryPrefix, storage.BoltPrefix, storage.PackPrefix} {
+		path = strings.TrimPrefix(path, prefix)
+	}
+
+	return filepath.Join(filepath.Dir(filepath.Clean(path)), "catly-webhooks")
+}
+
+// openStore opens the storage at the specified path, which may be prefixed with
+// the storage backend to use. In memory storage is configured from the environment
+func openStore(path string) (storage.Store, error) {
+	if path != DefaultStoragePath {
+		return storage.Create(path)
+	}
+
+	eviction, err := storage.ParseEvictionPolicy(getEnv("CATLY_MEMORY_EVICTION", "none"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []storage.MemoryOption{
+		storage.WithMaxBytes(int64(getEnvInt("CATLY_MEMORY_MAX_BYTES", 0))),
+		storage.WithMaxObjects(int64(getEnvInt("CATLY_MEMORY_MAX_OBJECTS", 0))),
+		storage.WithEvictionPolicy(eviction),
+	}
+
+	// in memory storage can be persisted to a directory, so
+	// objects are not lost when the server is restarted
+	persistPath := getEnv("CATLY_MEMORY_PERSIST_PATH", "")
+	if persistPath == "" {
+		return storage.NewMemoryStore(opts...), nil
+	}
+
+	interval := getEnvInt("CATLY_MEMORY_SNAPSHOT_INTERVAL", int(storage.DefaultSnapshotInterval/time.Second))
+	opts = append(opts, storage.WithSnapshotInterval(time.Duration(interval)*time.Second))
+
+	return storage.Create(storage.MemoryPrefix+persistPath, opts...)
+}
+
+// startScrubbers starts a scrubber for each of the stores that are not held in memory,
+// using the other stores as replicas. If the interval is zero, stores are only scrubbed
+// when a scrub is started by an admin. The progress of each scrubber is published
+// to the 'scrub' metric
+func startScrubbers(paths []string, stores []storage.Store, interval time.Duration, rate int64) []api.Scrubber {
+	var scrubbers []api.Scrubber
+
+	stats := make(map[string]func() storage.ScrubStats)
+
+	for i, st := range stores {
+		if paths[i] == DefaultStoragePath {
+			continue
+		}
+
+		var replicas []storage.Store
+
+		for j := range stores {
+			if j != i {
+				replicas = append(replicas, stores[j])
+			}
+		}
+
+		scrubber := storage.NewScrubber(
+			paths[i],
+			st,
+			storage.WithScrubInterval(interval),
+			storage.WithScrubRate(rate),
+			storage.WithReplicas(replicas...),
+		)
+
+		go scrubber.Run(context.Background())
+
+		scrubbers = append(scrubbers, scrubber)
+		stats[paths[i]] = scrubber.Stats
+	}
+
+	expvar.Publish("scrub", expvar.Func(func() interface{} {
+		current := make(map[string]storage.ScrubStats, len(stats))
+
+		for path, fn := range stats {
+			current[path] = fn()
+		}
+
+		return current
+	}))
+
+	return scrubbers
+}
+
+// loadJSON reads a json config file. If no path is
+// specified, the value will be left unchanged
+func loadJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// loadKeys loads encryption master keys from a comma separated list of base64 keys, or a key file
+func loadKeys(keys, path string) ([][]byte, error) {
+	if path != "" {
+		return storage.ReadKeyFile(path)
+	}
+
+	return storage.ParseKeys(strings.ReplaceAll(keys, ",", "\n"))
+}
+
+// reloadOnHangup calls each of the reloaders whenever a SIGHUP is received
+func reloadOnHangup(reloaders []func() error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		for _, reload := range reloaders {
+			err := reload()
+			if err != nil {
+				log.Error().Msg(err.Error())
+			}
+		}
+
+		log.Info().Msg("reloaded config")
+	}
+}
+
+// compactOnSignal compacts each of the compactors whenever a SIGUSR1 is received
+func compactOnSignal(compactors []compactor) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+
+	for range sig {
+		log.Info().Msg("compacting storage")
+
+		for _, c := range compactors {
+			err := c.Compact()
+			if err != nil {
+				log.Error().Msg(fmt.Sprintf("failed to compact storage: %s", err.Error()))
+			}
+		}
+	}
+}
+
 func check(err error, pfx string) {
 	if err != nil {
 		log.Fatal().Msg(fmt.Sprintf("%s: %s", pfx, err.Error()))
@@ -108,18 +733,23 @@ func check(err error, pfx string) {
 func getEnv(name, defaultValue string) string {
 	e := os.Getenv(name)
 	if e == "" {
-		return defaultValue
+		e = defaultValue
 	}
 
+	config[name] = e
+
 	return e
 }
 
 func getEnvInt(name string, defaultValue int) int {
 	e := os.Getenv(name)
 	if e == "" {
+		config[name] = strconv.Itoa(defaultValue)
 		return defaultValue
 	}
 
+	config[name] = e
+
 	i, err := strconv.Atoi(e)
 	check(err, fmt.Sprintf("failed to read integer environment variable '%s'", name))
 
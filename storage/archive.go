@@ -0,0 +1,630 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ArchiveVersion the version of the archive format written by Export
+	ArchiveVersion = 1
+	// the name of the archive entry that holds the manifest
+	archiveManifest = "manifest.json"
+	// the prefix of the archive entries that hold the data of each object
+	archiveObjectPrefix = "objects/"
+	// the PAX record that holds the checksum of an object's data
+	archiveChecksumRecord = "CATLY.sha256"
+	// the maximum size of a manifest that will be imported
+	archiveManifestMaxSize = 1 << 30
+)
+
+// ArchiveManifest describes the objects held in an archive
+type ArchiveManifest struct {
+	// Version the version of the archive format
+	Version int `json:"version"`
+	// Created the time the archive was created
+	Created time.Time `json:"created"`
+	// Objects the objects held in the archive, in name order
+	Objects []*ArchiveObject `json:"objects"`
+}
+
+// ArchiveObject describes an object held in an archive
+type ArchiveObject struct {
+	// Name the unique name of the object
+	Name string `json:"name"`
+	// Size the size of the object's data in bytes
+	Size int64 `json:"size"`
+	// Created the time the object was written
+	Created time.Time `json:"created"`
+	// Checksum the hex encoded SHA-256 checksum of the object's data
+	Checksum string `json:"checksum"`
+	// Metadata the indexed metadata of the object, if any
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// ArchiveIndex holds the metadata of the objects that are exported and imported
+type ArchiveIndex interface {
+	Metadata(id string) (*Metadata, error)
+	PutMetadata(md *Metadata) error
+}
+
+// ExportOptions configures an export
+type ExportOptions struct {
+	// Compress compresses the archive with gzip
+	Compress bool
+	// Index if set, the metadata of each object is read from the index and
+	// recorded in the manifest, rather than exporting the objects that hold it
+	Index ArchiveIndex
+}
+
+// Export writes every object in a store to a tar archive. Each object's data is
+// written with a checksum, followed by a manifest describing every object that
+// was exported. Objects that are deleted while the export is running are left
+// out, but any other error stops the export, leaving the archive incomplete
+func Export(ctx context.Context, s Store, w io.Writer, opts *ExportOptions) (*ArchiveManifest, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var gz *gzip.Writer
+
+	out := w
+
+	if opts.Compress {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+
+	tw := tar.NewWriter(out)
+
+	manifest := &ArchiveManifest{
+		Version: ArchiveVersion,
+		Created: time.Now().UTC(),
+	}
+
+	var buf bytes.Buffer
+	var exportErr error
+
+	err := eachObject(ctx, s, func(info *ObjectInfo) {
+		// metadata is exported with the objects it describes
+		if opts.Index != nil && strings.HasPrefix(info.Name, metadataPrefix) {
+			return
+		}
+
+		obj, err := exportObject(tw, s, opts.Index, info, &buf)
+		if err != nil {
+			exportErr = err
+			cancel()
+			return
+		}
+
+		if obj != nil {
+			manifest.Objects = append(manifest.Objects, obj)
+		}
+	})
+
+	if exportErr != nil {
+		return nil, exportErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	err = writeArchiveEntry(tw, archiveManifest, manifest.Created, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// exportObject writes a single object to an archive. It returns nil
+// if the object was deleted before its data could be read
+func exportObject(tw *tar.Writer, s Store, index ArchiveIndex, info *ObjectInfo, buf *bytes.Buffer) (*ArchiveObject, error) {
+	buf.Reset()
+
+	err := s.ReadObject(info.Name, buf)
+	if errors.Is(err, ErrFileDoesNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", info.Name, err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+
+	obj := &ArchiveObject{
+		Name:     info.Name,
+		Size:     int64(buf.Len()),
+		Created:  info.Created,
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+
+	if index != nil && !IsInternal(info.Name) {
+		md, err := index.Metadata(info.Name)
+		if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+			return nil, fmt.Errorf("failed to read metadata of %s: %w", info.Name, err)
+		}
+
+		obj.Metadata = md
+	}
+
+	err = writeArchiveEntry(tw, archiveObjectPrefix+info.Name, info.Created, buf.Bytes(), map[string]string{
+		archiveChecksumRecord: obj.Checksum,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, modified time.Time, data []byte, records map[string]string) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       int64(len(data)),
+		Mode:       0644,
+		ModTime:    modified,
+		Format:     tar.FormatPAX,
+		PAXRecords: records,
+	})
+
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return nil
+}
+
+// ImportStatus the outcome of importing an object
+type ImportStatus int
+
+const (
+	// ImportImported the object was written to the store
+	ImportImported ImportStatus = iota
+	// ImportSkipped the object already exists in the store
+	ImportSkipped
+	// ImportFailed the object could not be imported
+	ImportFailed
+)
+
+// String returns the name of the status
+func (s ImportStatus) String() string {
+	switch s {
+	case ImportImported:
+		return "imported"
+	case ImportSkipped:
+		return "skipped"
+	case ImportFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// ImportProgress the outcome of importing a single object
+type ImportProgress struct {
+	// Name the name of the object
+	Name string
+	// Size the size of the object in bytes
+	Size int64
+	// Status the outcome of the object's import
+	Status ImportStatus
+	// Err the error the object failed with
+	Err error
+}
+
+// ImportOptions configures an import
+type ImportOptions struct {
+	// Overwrite replaces objects that already exist, rather than skipping them
+	Overwrite bool
+	// Verify checks the data of each object against the checksum in the
+	// archive, and reads each object back once it has been written
+	Verify bool
+	// Index if set, the metadata of each imported object is added to the index
+	Index ArchiveIndex
+	// MaxObjectSize if set, objects larger than this many bytes are not imported
+	MaxObjectSize int64
+	// Progress if set, is called once each object has been imported
+	Progress func(p ImportProgress)
+}
+
+// ImportResult a summary of an import
+type ImportResult struct {
+	// Imported the number of objects that were imported
+	Imported int64 `json:"imported"`
+	// Skipped the number of objects that already existed
+	Skipped int64 `json:"skipped"`
+	// Failed the number of objects that could not be imported
+	Failed int64 `json:"failed"`
+	// Bytes the total size of the objects that were imported
+	Bytes int64 `json:"bytes"`
+}
+
+// importer tracks the state of an import
+type importer struct {
+	store  Store
+	opts   *ImportOptions
+	result *ImportResult
+	// seen the names of the objects held in the archive
+	seen map[string]struct{}
+	// written the objects that were written to the store
+	written map[string]*ObjectInfo
+	// metadata the metadata read from metadata objects in the archive,
+	// which are imported through the index if one is set
+	metadata map[string]*Metadata
+}
+
+// Import writes the objects in a tar archive created by Export to a store. The
+// archive may be compressed with gzip. Objects that fail to import are reported,
+// and do not stop the import. An error is returned if the archive cannot be read,
+// has no manifest, or the context is cancelled
+func Import(ctx context.Context, s Store, r io.Reader, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+
+	tr, err := archiveReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		store:    s,
+		opts:     opts,
+		result:   &ImportResult{},
+		seen:     make(map[string]struct{}),
+		written:  make(map[string]*ObjectInfo),
+		metadata: make(map[string]*Metadata),
+	}
+
+	var manifest *ArchiveManifest
+	var buf bytes.Buffer
+
+	for {
+		if ctx.Err() != nil {
+			return im.result, ctx.Err()
+		}
+
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return im.result, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		// entries are held in memory while they are imported,
+		// so entries that are too large are rejected unread
+		limit := im.entryLimit(hdr.Name)
+
+		if limit > 0 && hdr.Size > limit {
+			if hdr.Name == archiveManifest {
+				return im.result, fmt.Errorf("%w: manifest is larger than %d bytes", ErrInvalidArchive, limit)
+			}
+
+			im.rejectEntry(hdr)
+
+			continue
+		}
+
+		buf.Reset()
+
+		var src io.Reader = tr
+		if limit > 0 {
+			src = io.LimitReader(tr, limit)
+		}
+
+		_, err = io.Copy(&buf, src)
+		if err != nil {
+			return im.result, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+		}
+
+		switch {
+		case hdr.Name == archiveManifest:
+			manifest = &ArchiveManifest{}
+
+			err = json.Unmarshal(buf.Bytes(), manifest)
+			if err != nil {
+				return im.result, fmt.Errorf("%w: failed to decode manifest: %s", ErrInvalidArchive, err)
+			}
+		case strings.HasPrefix(hdr.Name, archiveObjectPrefix):
+			im.importEntry(hdr, buf.Bytes())
+		default:
+			return im.result, fmt.Errorf("%w: unexpected entry %s", ErrInvalidArchive, hdr.Name)
+		}
+	}
+
+	if manifest == nil {
+		return im.result, fmt.Errorf("%w: manifest not found", ErrInvalidArchive)
+	}
+
+	im.finish(manifest)
+
+	return im.result, nil
+}
+
+// archiveReader returns a reader for a tar archive, decompressing it if it is gzipped
+func archiveReader(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+		}
+
+		return tar.NewReader(gz), nil
+	}
+
+	return tar.NewReader(br), nil
+}
+
+// entryLimit returns the maximum size of an archive entry, or 0 if it is unlimited
+func (im *importer) entryLimit(name string) int64 {
+	if name == archiveManifest {
+		return archiveManifestMaxSize
+	}
+
+	return im.opts.MaxObjectSize
+}
+
+// rejectEntry reports an object that is too large to import
+func (im *importer) rejectEntry(hdr *tar.Header) {
+	id := strings.TrimPrefix(hdr.Name, archiveObjectPrefix)
+	im.seen[id] = struct{}{}
+
+	im.report(ImportProgress{
+		Name:   id,
+		Size:   hdr.Size,
+		Status: ImportFailed,
+		Err:    fmt.Errorf("%w of %d bytes", ErrObjectTooLarge, im.opts.MaxObjectSize),
+	})
+}
+
+// importEntry imports the object held in an archive entry
+func (im *importer) importEntry(hdr *tar.Header, data []byte) {
+	id := strings.TrimPrefix(hdr.Name, archiveObjectPrefix)
+	im.seen[id] = struct{}{}
+
+	if im.opts.Index != nil && strings.HasPrefix(id, metadataPrefix) {
+		// metadata exported without an index is imported through it instead,
+		// so the index is kept in sync with the objects it describes
+		md := &Metadata{}
+
+		err := json.Unmarshal(data, md)
+		if err != nil {
+			im.report(ImportProgress{Name: id, Size: int64(len(data)), Status: ImportFailed, Err: err})
+			return
+		}
+
+		im.metadata[md.Name] = md
+
+		return
+	}
+
+	p := im.importObject(id, hdr, data)
+
+	if p.Status == ImportImported {
+		im.written[id] = &ObjectInfo{
+			Name:    id,
+			Size:    p.Size,
+			Created: hdr.ModTime,
+		}
+	}
+
+	im.report(p)
+}
+
+// importObject writes a single object to the store
+func (im *importer) importObject(id string, hdr *tar.Header, data []byte) ImportProgress {
+	p := ImportProgress{
+		Name: id,
+		Size: int64(len(data)),
+	}
+
+	if !validArchiveName(id) {
+		p.Status = ImportFailed
+		p.Err = ErrInvalidFileName
+		return p
+	}
+
+	sum := sha256.Sum256(data)
+
+	if im.opts.Verify && hdr.PAXRecords[archiveChecksumRecord] != hex.EncodeToString(sum[:]) {
+		p.Status = ImportFailed
+		p.Err = ErrChecksumMismatch
+		return p
+	}
+
+	_, err := im.store.StatObject(id)
+	switch {
+	case err == nil && !im.opts.Overwrite:
+		p.Status = ImportSkipped
+		return p
+	case err == nil:
+		err = im.replaceObject(id, data)
+	case errors.Is(err, ErrFileDoesNotExist):
+		err = im.store.WriteObject(id, bytes.NewReader(data))
+		if errors.Is(err, ErrFileExists) && !im.opts.Overwrite {
+			// another writer created the object since it was checked
+			p.Status = ImportSkipped
+			return p
+		} else if errors.Is(err, ErrFileExists) {
+			err = im.replaceObject(id, data)
+		}
+	default:
+		err = fmt.Errorf("failed to check object: %w", err)
+	}
+
+	if err != nil {
+		p.Status = ImportFailed
+		p.Err = err
+		return p
+	}
+
+	if im.opts.Verify {
+		h := sha256.New()
+
+		err = im.store.ReadObject(id, h)
+		if err == nil && !bytes.Equal(h.Sum(nil), sum[:]) {
+			err = ErrChecksumMismatch
+		}
+
+		if err != nil {
+			// remove the bad copy, so the object is imported again next time
+			im.store.DeleteObject(id)
+
+			p.Status = ImportFailed
+			p.Err = fmt.Errorf("failed to verify object: %w", err)
+
+			return p
+		}
+	}
+
+	log.Debug().
+		Str("file", id).
+		Msg(fmt.Sprintf("imported %d bytes", len(data)))
+
+	p.Status = ImportImported
+
+	return p
+}
+
+// replaceObject replaces the data of an existing object
+func (im *importer) replaceObject(id string, data []byte) error {
+	if rs, ok := im.store.(replacer); ok {
+		return rs.ReplaceObject(id, bytes.NewReader(data))
+	}
+
+	err := im.store.DeleteObject(id)
+	if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+		return err
+	}
+
+	return im.store.WriteObject(id, bytes.NewReader(data))
+}
+
+// finish reports the objects in the manifest that were missing from the
+// archive, and indexes the metadata of the objects that were imported
+func (im *importer) finish(manifest *ArchiveManifest) {
+	for _, obj := range manifest.Objects {
+		if obj.Metadata != nil {
+			im.metadata[obj.Name] = obj.Metadata
+		}
+
+		if _, ok := im.seen[obj.Name]; ok {
+			continue
+		}
+
+		im.report(ImportProgress{
+			Name:   obj.Name,
+			Size:   obj.Size,
+			Status: ImportFailed,
+			Err:    fmt.Errorf("%w: object not found", ErrInvalidArchive),
+		})
+	}
+
+	if im.opts.Index == nil {
+		return
+	}
+
+	for id, info := range im.written {
+		if IsInternal(id) {
+			continue
+		}
+
+		md, ok := im.metadata[id]
+		if !ok {
+			md = ObjectMetadata(info)
+		}
+
+		md.Name = id
+
+		err := im.opts.Index.PutMetadata(md)
+		if err != nil {
+			log.Warn().
+				Str("file", id).
+				Msg(err.Error())
+		}
+	}
+}
+
+func (im *importer) report(p ImportProgress) {
+	switch p.Status {
+	case ImportImported:
+		im.result.Imported++
+		im.result.Bytes += p.Size
+	case ImportSkipped:
+		im.result.Skipped++
+	case ImportFailed:
+		im.result.Failed++
+	}
+
+	if im.opts.Progress != nil {
+		im.opts.Progress(p)
+	}
+}
+
+// validArchiveName reports whether the name of an object in an archive is safe
+// to import, refusing absolute names and names that refer to directories
+func validArchiveName(id string) bool {
+	if id == "" || strings.HasPrefix(id, "/") {
+		return false
+	}
+
+	for _, part := range strings.Split(id, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteArchive copies an uncompressed archive, passing each entry's data through fn
+func rewriteArchive(t *testing.T, archive []byte, fn func(hdr *tar.Header, data []byte) []byte) []byte {
+	var out bytes.Buffer
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tw := tar.NewWriter(&out)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		data = fn(hdr, data)
+		if data == nil {
+			continue
+		}
+
+		hdr.Size = int64(len(data))
+
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+
+	return out.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	from := NewMemoryStore()
+	x := NewIndex(from)
+
+	writeTestObjects(t, from, 10)
+	require.NoError(t, from.WriteObject("cats/tabby.jpg", bytes.NewReader([]byte("purr"))))
+
+	err := x.PutMetadata(&Metadata{
+		Name:        "cats/tabby.jpg",
+		Owner:       "alice",
+		ContentType: "image/jpeg",
+		Size:        4,
+		Description: "a tabby cat",
+		Tags:        map[string]string{"colour": "orange"},
+	})
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+
+	manifest, err := Export(context.Background(), from, &archive, &ExportOptions{Compress: true, Index: x})
+	require.NoError(t, err)
+	require.Len(t, manifest.Objects, 11)
+	assert.Equal(t, ArchiveVersion, manifest.Version)
+	assert.Equal(t, []byte{0x1f, 0x8b}, archive.Bytes()[:2])
+
+	to := NewMemoryStore()
+	rebuilt := NewIndex(to)
+
+	var progress []ImportProgress
+
+	res, err := Import(context.Background(), to, &archive, &ImportOptions{
+		Verify: true,
+		Index:  rebuilt,
+		Progress: func(p ImportProgress) {
+			progress = append(progress, p)
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), res.Imported)
+	assert.Zero(t, res.Skipped)
+	assert.Zero(t, res.Failed)
+	assert.Len(t, progress, 11)
+
+	var buf bytes.Buffer
+	require.NoError(t, to.ReadObject("cats/tabby.jpg", &buf))
+	assert.Equal(t, "purr", buf.String())
+
+	md, err := rebuilt.Metadata("cats/tabby.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", md.Owner)
+	assert.Equal(t, "a tabby cat", md.Description)
+	assert.Equal(t, "orange", md.Tags["colour"])
+
+	// objects without metadata are indexed with their defaults
+	md, err = rebuilt.Metadata("cat-0001.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", md.ContentType)
+	assert.Equal(t, int64(6), md.Size)
+}
+
+func TestArchiveMetadataObjects(t *testing.T) {
+	from := NewMemoryStore()
+	x := NewIndex(from)
+
+	require.NoError(t, from.WriteObject("tabby.jpg", bytes.NewReader([]byte("purr"))))
+	require.NoError(t, x.PutMetadata(&Metadata{Name: "tabby.jpg", Owner: "alice"}))
+
+	// without an index, the objects holding metadata are exported as they are
+	var archive bytes.Buffer
+
+	manifest, err := Export(context.Background(), from, &archive, nil)
+	require.NoError(t, err)
+	require.Len(t, manifest.Objects, 2)
+
+	to := NewMemoryStore()
+	rebuilt := NewIndex(to)
+
+	res, err := Import(context.Background(), to, bytes.NewReader(archive.Bytes()), &ImportOptions{Index: rebuilt})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Imported)
+
+	md, err := rebuilt.Metadata("tabby.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", md.Owner)
+}
+
+func TestArchiveConflicts(t *testing.T) {
+	from := NewMemoryStore()
+	writeTestObjects(t, from, 5)
+
+	var archive bytes.Buffer
+
+	_, err := Export(context.Background(), from, &archive, nil)
+	require.NoError(t, err)
+
+	to := NewMemoryStore()
+	require.NoError(t, to.WriteObject("cat-0002.jpg", bytes.NewReader([]byte("hiss"))))
+
+	res, err := Import(context.Background(), to, bytes.NewReader(archive.Bytes()), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), res.Imported)
+	assert.Equal(t, int64(1), res.Skipped)
+
+	var buf bytes.Buffer
+	require.NoError(t, to.ReadObject("cat-0002.jpg", &buf))
+	assert.Equal(t, "hiss", buf.String())
+
+	res, err = Import(context.Background(), to, bytes.NewReader(archive.Bytes()), &ImportOptions{Overwrite: true, Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), res.Imported)
+	assert.Zero(t, res.Skipped)
+
+	buf.Reset()
+	require.NoError(t, to.ReadObject("cat-0002.jpg", &buf))
+	assert.Equal(t, "meow 2", buf.String())
+}
+
+func TestArchiveVerify(t *testing.T) {
+	from := NewMemoryStore()
+	writeTestObjects(t, from, 3)
+
+	var archive bytes.Buffer
+
+	_, err := Export(context.Background(), from, &archive, nil)
+	require.NoError(t, err)
+
+	corrupted := rewriteArchive(t, archive.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == archiveObjectPrefix+"cat-0001.jpg" {
+			data[0] ^= 0x01
+		}
+		return data
+	})
+
+	to := NewMemoryStore()
+
+	var failed []ImportProgress
+
+	res, err := Import(context.Background(), to, bytes.NewReader(corrupted), &ImportOptions{
+		Verify: true,
+		Progress: func(p ImportProgress) {
+			if p.Status == ImportFailed {
+				failed = append(failed, p)
+			}
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Imported)
+	assert.Equal(t, int64(1), res.Failed)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "cat-0001.jpg", failed[0].Name)
+	assert.ErrorIs(t, failed[0].Err, ErrChecksumMismatch)
+
+	_, err = to.StatObject("cat-0001.jpg")
+	assert.ErrorIs(t, err, ErrFileDoesNotExist)
+
+	// copies that are bad once written are removed
+	res, err = Import(context.Background(), corruptingStore{NewMemoryStore()}, bytes.NewReader(archive.Bytes()), &ImportOptions{Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.Failed)
+}
+
+func TestArchiveMaxObjectSize(t *testing.T) {
+	from := NewMemoryStore()
+	writeTestObjects(t, from, 3)
+	require.NoError(t, from.WriteObject("lion.jpg", bytes.NewReader(bytes.Repeat([]byte("roar"), 100))))
+
+	var archive bytes.Buffer
+
+	_, err := Export(context.Background(), from, &archive, nil)
+	require.NoError(t, err)
+
+	to := NewMemoryStore()
+
+	var failed []ImportProgress
+
+	res, err := Import(context.Background(), to, bytes.NewReader(archive.Bytes()), &ImportOptions{
+		MaxObjectSize: 100,
+		Progress: func(p ImportProgress) {
+			if p.Status == ImportFailed {
+				failed = append(failed, p)
+			}
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.Imported)
+	assert.Equal(t, int64(1), res.Failed)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "lion.jpg", failed[0].Name)
+	assert.Equal(t, int64(400), failed[0].Size)
+	assert.ErrorIs(t, failed[0].Err, ErrObjectTooLarge)
+
+	_, err = to.StatObject("lion.jpg")
+	assert.ErrorIs(t, err, ErrFileDoesNotExist)
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	from := NewMemoryStore()
+	writeTestObjects(t, from, 3)
+
+	var archive bytes.Buffer
+
+	_, err := Export(context.Background(), from, &archive, nil)
+	require.NoError(t, err)
+
+	// objects listed in the manifest must be in the archive
+	missing := rewriteArchive(t, archive.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == archiveObjectPrefix+"cat-0000.jpg" {
+			return nil
+		}
+		return data
+	})
+
+	res, err := Import(context.Background(), NewMemoryStore(), bytes.NewReader(missing), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Imported)
+	assert.Equal(t, int64(1), res.Failed)
+
+	noManifest := rewriteArchive(t, archive.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == archiveManifest {
+			return nil
+		}
+		return data
+	})
+
+	_, err = Import(context.Background(), NewMemoryStore(), bytes.NewReader(noManifest), nil)
+	assert.ErrorIs(t, err, ErrInvalidArchive)
+
+	unsafe := rewriteArchive(t, archive.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name == archiveObjectPrefix+"cat-0000.jpg" {
+			hdr.Name = archiveObjectPrefix + "../cat-0000.jpg"
+		}
+		return data
+	})
+
+	// the renamed object fails, and the object in the manifest is missing
+	res, err = Import(context.Background(), NewMemoryStore(), bytes.NewReader(unsafe), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Imported)
+	assert.Equal(t, int64(2), res.Failed)
+
+	_, err = Import(context.Background(), NewMemoryStore(), bytes.NewReader([]byte("not an archive")), nil)
+	assert.ErrorIs(t, err, ErrInvalidArchive)
+}
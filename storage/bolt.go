@@ -0,0 +1,544 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// the size of the chunks that object data is split into. each chunk is
+	// read in its own transaction, so large objects can be streamed without
+	// holding a transaction open for the whole response
+	boltChunkSize = 1 << 16
+	// the maximum size of each transaction used when compacting the database
+	boltCompactTxSize = 1 << 26
+)
+
+var (
+	boltMetadataBucket = []byte("metadata")
+	boltDataBucket     = []byte("data")
+)
+
+// BoltStore an implementation of the object storage that
+// writes objects to an embedded bbolt database file
+type BoltStore struct {
+	path string
+	// held while using the database, so it can be swapped after compaction
+	mu sync.RWMutex
+	// held by writes, so they can be paused while the database is compacted
+	writes sync.RWMutex
+	db     *bolt.DB
+}
+
+// boltMetadata the metadata stored for each object
+type boltMetadata struct {
+	// ID the unique id of the object's data
+	ID uint64 `json:"id"`
+	// Size the size of the object's data in bytes
+	Size int64 `json:"size"`
+	// Chunks the number of chunks the object's data is split into
+	Chunks int `json:"chunks"`
+	// Created the time the object was written
+	Created time.Time `json:"created"`
+	// Checksum the hex encoded SHA-256 checksum of the object's data
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// NewBoltStore creates a new bbolt store using the database file at the
+// specified path. The database file is created if it does not exist
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		path: path,
+		db:   db,
+	}, nil
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMetadataBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(boltDataBucket)
+
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create database buckets: %w", err)
+	}
+
+	return db, nil
+}
+
+// ReadObject reads an object from the database to the provided io.Writer
+func (s *BoltStore) ReadObject(id string, w io.Writer) error {
+	meta, err := s.metadata(id)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, boltChunkSize)
+
+	var rb int64
+
+	for i := 0; i < meta.Chunks; i++ {
+		err = s.view(func(tx *bolt.Tx) error {
+			chunk := tx.Bucket(boltDataBucket).Get(boltChunkKey(meta.ID, i))
+			if chunk == nil {
+				// the object has been deleted while it was being read
+				return ErrFileDoesNotExist
+			}
+
+			// the chunk is only valid for the life of the transaction
+			buf = append(buf[:0], chunk...)
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		wb, err := w.Write(buf)
+		if err != nil {
+			return fmt.Errorf("failed to write file data: %w", err)
+		}
+
+		if wb < len(buf) {
+			return ErrWriteIncomplete
+		}
+
+		rb += int64(wb)
+	}
+
+	log.Debug().
+		Str("file", id).
+		Str("database", s.path).
+		Msg(fmt.Sprintf("read %d bytes from database", rb))
+
+	return nil
+}
+
+// WriteObject writes an object to the database from the provided io.Reader
+func (s *BoltStore) WriteObject(id string, r io.Reader) error {
+	// fail early if the object already exists, so we don't
+	// needlessly read the whole upload
+	_, err := s.metadata(id)
+	if err == nil {
+		return ErrFileExists
+	}
+
+	if !errors.Is(err, ErrFileDoesNotExist) {
+		return err
+	}
+
+	// the upload is read before the transaction is started, so that
+	// other writes are not blocked while waiting on the uploader
+	chunks, wb, checksum, err := readChunks(r)
+	if err != nil {
+		return err
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(boltMetadataBucket)
+		db := tx.Bucket(boltDataBucket)
+
+		// the object is only created if it does not exist
+		// when the transaction is committed
+		if mb.Get([]byte(id)) != nil {
+			return ErrFileExists
+		}
+
+		return putChunks(mb, db, id, chunks, &boltMetadata{
+			Size:     wb,
+			Created:  time.Now(),
+			Checksum: checksum,
+		})
+	})
+
+	if err != nil {
+		if errors.Is(err, ErrFileExists) {
+			return err
+		}
+		return fmt.Errorf("file upload failed: %w", err)
+	}
+
+	log.Debug().
+		Str("file", id).
+		Str("database", s.path).
+		Msg(fmt.Sprintf("wrote %d bytes to database", wb))
+
+	return nil
+}
+
+// ReplaceObject atomically replaces the data of an existing object in the database
+func (s *BoltStore) ReplaceObject(id string, r io.Reader) error {
+	chunks, wb, checksum, err := readChunks(r)
+	if err != nil {
+		return err
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(boltMetadataBucket)
+		db := tx.Bucket(boltDataBucket)
+
+		v := mb.Get([]byte(id))
+		if v == nil {
+			return ErrFileDoesNotExist
+		}
+
+		var old boltMetadata
+
+		err := json.Unmarshal(v, &old)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < old.Chunks; i++ {
+			err = db.Delete(boltChunkKey(old.ID, i))
+			if err != nil {
+				return err
+			}
+		}
+
+		return putChunks(mb, db, id, chunks, &boltMetadata{
+			Size:     wb,
+			Created:  old.Created,
+			Checksum: checksum,
+		})
+	})
+
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return err
+		}
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	log.Debug().
+		Str("file", id).
+		Str("database", s.path).
+		Msg(fmt.Sprintf("replaced file with %d bytes in database", wb))
+
+	return nil
+}
+
+// StatObject returns information about an object in the database
+func (s *BoltStore) StatObject(id string) (*ObjectInfo, error) {
+	meta, err := s.metadata(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.info(id), nil
+}
+
+// ListObjects lists objects in the database in name order that
+// match the prefix and come after the specified name, up to a limit
+func (s *BoltStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltMetadataBucket).Cursor()
+
+		start := prefix
+		if after > start {
+			start = after
+		}
+
+		for k, v := c.Seek([]byte(start)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if string(k) <= after {
+				continue
+			}
+
+			var meta boltMetadata
+
+			err := json.Unmarshal(v, &meta)
+			if err != nil {
+				return fmt.Errorf("failed to read metadata for %s: %w", k, err)
+			}
+
+			objects = append(objects, meta.info(string(k)))
+
+			if limit > 0 && len(objects) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if objects == nil {
+		objects = []*ObjectInfo{}
+	}
+
+	return objects, nil
+}
+
+// DeleteObject removes an object and its data from the database
+func (s *BoltStore) DeleteObject(id string) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(boltMetadataBucket)
+		db := tx.Bucket(boltDataBucket)
+
+		v := mb.Get([]byte(id))
+		if v == nil {
+			return ErrFileDoesNotExist
+		}
+
+		var meta boltMetadata
+
+		err := json.Unmarshal(v, &meta)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < meta.Chunks; i++ {
+			err = db.Delete(boltChunkKey(meta.ID, i))
+			if err != nil {
+				return err
+			}
+		}
+
+		return mb.Delete([]byte(id))
+	})
+
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return err
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	log.Debug().
+		Str("file", id).
+		Str("database", s.path).
+		Msg("deleted file from database")
+
+	return nil
+}
+
+// Compact rewrites the database to a new file, reclaiming the space left by
+// deleted objects. Objects can be read while the database is compacted, but
+// writes and deletes will wait until compaction has completed
+func (s *BoltStore) Compact() error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	tmp := s.path + ".compact"
+
+	err := os.Remove(tmp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove previous compaction: %w", err)
+	}
+
+	dst, err := bolt.Open(tmp, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to create compacted database: %w", err)
+	}
+
+	s.mu.RLock()
+	src := s.db
+	s.mu.RUnlock()
+
+	err = bolt.Compact(dst, src, boltCompactTxSize)
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact database: %w", err)
+	}
+
+	err = dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact database: %w", err)
+	}
+
+	// open the compacted database before it is swapped into place,
+	// so the store always has a usable database if this fails
+	db, err := openBolt(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to open compacted database: %w", err)
+	}
+
+	before, _ := os.Stat(s.path)
+
+	// swap the compacted database into place, waiting
+	// for any reads of the old database to complete.
+	// the open database follows the file when renamed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		db.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace database: %w", err)
+	}
+
+	old := s.db
+	s.db = db
+
+	err = old.Close()
+	if err != nil {
+		log.Warn().
+			Str("database", s.path).
+			Msg(fmt.Sprintf("failed to close database after compaction: %s", err.Error()))
+	}
+
+	after, _ := os.Stat(s.path)
+
+	if before != nil && after != nil {
+		log.Info().
+			Str("database", s.path).
+			Msg(fmt.Sprintf("compacted database from %d to %d bytes", before.Size(), after.Size()))
+	}
+
+	return nil
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(fn)
+}
+
+func (s *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(fn)
+}
+
+func (s *BoltStore) metadata(id string) (*boltMetadata, error) {
+	var meta boltMetadata
+
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltMetadataBucket).Get([]byte(id))
+		if v == nil {
+			return ErrFileDoesNotExist
+		}
+
+		return json.Unmarshal(v, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+func (m *boltMetadata) info(id string) *ObjectInfo {
+	return &ObjectInfo{
+		Name:     id,
+		Size:     m.Size,
+		Created:  m.Created,
+		Checksum: m.Checksum,
+	}
+}
+
+// readChunks reads data into chunks, returning the chunks
+// along with the size and checksum of the data
+func readChunks(r io.Reader) ([][]byte, int64, string, error) {
+	var chunks [][]byte
+	var wb int64
+
+	h := sha256.New()
+
+	for {
+		chunk := make([]byte, boltChunkSize)
+
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			chunks = append(chunks, chunk[:n])
+			h.Write(chunk[:n])
+			wb += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("file upload failed: %w", err)
+		}
+	}
+
+	return chunks, wb, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// putChunks stores an object's chunks under a new id, along with its metadata
+func putChunks(mb, db *bolt.Bucket, id string, chunks [][]byte, meta *boltMetadata) error {
+	seq, err := db.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	meta.ID = seq
+	meta.Chunks = len(chunks)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	for i, chunk := range chunks {
+		err = db.Put(boltChunkKey(seq, i), chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mb.Put([]byte(id), data)
+}
+
+// boltChunkKey returns the key of a chunk of an object's data
+func boltChunkKey(id uint64, chunk int) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, id)
+	binary.BigEndian.PutUint32(key[8:], uint32(chunk))
+	return key
+}
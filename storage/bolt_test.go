@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "catly.db"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		bs.Close()
+	})
+
+	return bs
+}
+
+func TestBoltStorageReadFile(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	// write a file larger than a single chunk
+	data := make([]byte, boltChunkSize*3+100)
+	rand.Read(data)
+
+	err := bs.WriteObject("cat.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+
+	err = bs.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+}
+
+func TestBoltStorageReadFileNotExist(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	var b bytes.Buffer
+
+	err := bs.ReadObject("invisible-cat.jpg", &b)
+	require.Equal(t, ErrFileDoesNotExist, err)
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestBoltStorageWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catly.db")
+
+	bs, err := NewBoltStore(path)
+	require.NoError(t, err)
+
+	err = bs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = bs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileExists, err)
+
+	// check the file is persisted when the database is reopened
+	require.NoError(t, bs.Close())
+
+	bs, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer bs.Close()
+
+	var b bytes.Buffer
+
+	err = bs.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+}
+
+func TestBoltStorageWriteConcurrentConflict(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	var wg sync.WaitGroup
+	var errorCount int64
+
+	wg.Add(100)
+
+	// create 100 concurrent write requests
+	// we expect that 99 of them should fail
+	// as the file will already be created
+	for i := 0; i < 100; i++ {
+		go func() {
+			r := bytes.NewReader([]byte("meow"))
+
+			err := bs.WriteObject("cat.jpg", r)
+			if err != nil {
+				assert.Equal(t, ErrFileExists, err)
+				atomic.AddInt64(&errorCount, 1)
+			}
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	var b bytes.Buffer
+
+	err := bs.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	// check the other 99 requests failed
+	assert.Equal(t, int64(99), errorCount)
+}
+
+func TestBoltStorageWriteFileFailure(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	r := io.MultiReader(
+		bytes.NewReader([]byte("me")),
+		iotest.ErrReader(errors.New("connection reset")),
+	)
+
+	err := bs.WriteObject("cat.jpg", r)
+	require.Error(t, err)
+
+	_, err = bs.StatObject("cat.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestBoltStorageStatFile(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	err := bs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	info, err := bs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.False(t, info.Created.IsZero())
+	assert.Equal(t, "404cdd7bc109c432f8cc2443b45bcfe95980f5107215c645236e577929ac3e52", info.Checksum)
+
+	_, err = bs.StatObject("invisible-cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestBoltStorageListFiles(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	for _, name := range []string{"cat-3.jpg", "cat-1.jpg", "dog.jpg", "cat-2.jpg"} {
+		err := bs.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	objects, err := bs.ListObjects("cat-", "", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "cat-1.jpg", objects[0].Name)
+	assert.Equal(t, "cat-2.jpg", objects[1].Name)
+
+	objects, err = bs.ListObjects("cat-", objects[1].Name, 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cat-3.jpg", objects[0].Name)
+
+	objects, err = bs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 4)
+}
+
+func TestBoltStorageDeleteFile(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	err := bs.WriteObject("cat.jpg", bytes.NewReader(make([]byte, boltChunkSize*2)))
+	require.NoError(t, err)
+
+	err = bs.DeleteObject("cat.jpg")
+	require.NoError(t, err)
+
+	_, err = bs.StatObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = bs.DeleteObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	// the object's data should be removed
+	err = bs.view(func(tx *bolt.Tx) error {
+		assert.Equal(t, 0, tx.Bucket(boltDataBucket).Stats().KeyN)
+		return nil
+	})
+
+	require.NoError(t, err)
+}
+
+func TestBoltStorageCompact(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	for _, name := range []string{"cat-1.jpg", "cat-2.jpg", "cat-3.jpg", "cat-4.jpg"} {
+		err := bs.WriteObject(name, bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+
+	for _, name := range []string{"cat-1.jpg", "cat-2.jpg", "cat-3.jpg"} {
+		err := bs.DeleteObject(name)
+		require.NoError(t, err)
+	}
+
+	before, err := os.Stat(bs.path)
+	require.NoError(t, err)
+
+	err = bs.Compact()
+	require.NoError(t, err)
+
+	after, err := os.Stat(bs.path)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+
+	// the remaining object can still be read and written
+	var b bytes.Buffer
+
+	err = bs.ReadObject("cat-4.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+
+	err = bs.WriteObject("cat-4.jpg", bytes.NewReader(data))
+	require.Equal(t, ErrFileExists, err)
+
+	err = bs.WriteObject("cat-5.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// writes after compaction are kept when the database is reopened
+	require.NoError(t, bs.Close())
+
+	bs, err = NewBoltStore(bs.path)
+	require.NoError(t, err)
+
+	defer bs.Close()
+
+	_, err = bs.StatObject("cat-5.jpg")
+	require.NoError(t, err)
+
+	_, err = os.Stat(bs.path + ".compact")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBoltStorageReplaceFile(t *testing.T) {
+	bs := newTestBoltStore(t)
+
+	err := bs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = bs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	before, err := bs.StatObject("cat.jpg")
+	require.NoError(t, err)
+
+	err = bs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr!")))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	err = bs.ReadObject("cat.jpg", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "purr!", buf.String())
+
+	info, err := bs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, before.Created, info.Created)
+	assert.Equal(t, "df5078e76664a04dcff1deb04d2a7efac98ee07a285d42b3a90de5585c0a759a", info.Checksum)
+}
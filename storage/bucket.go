@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the prefix of the objects that hold the settings of each bucket
+const bucketPrefix = ".buckets/"
+
+// Visibility who can download the objects in a bucket
+type Visibility string
+
+const (
+	// VisibilityPublic objects can be downloaded by anyone from their url
+	VisibilityPublic Visibility = "public"
+	// VisibilityPrivate objects can only be downloaded by clients of the gRPC service
+	VisibilityPrivate Visibility = "private"
+)
+
+// Bucket a namespace that holds objects separately from other buckets
+type Bucket struct {
+	// Name the unique name of the bucket
+	Name string `json:"name"`
+	// Visibility who can download the objects in the bucket
+	Visibility Visibility `json:"visibility"`
+	// MaxObjectSize the maximum size in bytes of objects in the bucket. Zero is unlimited
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// AllowedTypes the content types of the objects that can be stored in the bucket.
+	// If empty, all supported types are allowed
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	// Created the time the bucket was created
+	Created time.Time `json:"created"`
+}
+
+// Buckets manages the buckets held in a store. The settings of each bucket are
+// stored as an object, so they are replicated, encrypted and migrated along with
+// the objects held in the bucket. Objects in a bucket are stored with an id
+// of the bucket's name and the object's name, separated by a '/'
+type Buckets struct {
+	store Store
+	mu    sync.RWMutex
+	cache map[string]*Bucket
+}
+
+// NewBuckets creates a new manager for the buckets held in a store
+func NewBuckets(store Store) *Buckets {
+	return &Buckets{
+		store: store,
+		cache: make(map[string]*Bucket),
+	}
+}
+
+// ObjectID returns the id an object in a bucket is stored with. Objects
+// that are not in a bucket are stored with their name
+func ObjectID(bucket, name string) string {
+	if bucket == "" {
+		return name
+	}
+
+	return bucket + "/" + name
+}
+
+// SplitObjectID splits the id of an object into its bucket and name
+func SplitObjectID(id string) (string, string) {
+	i := strings.IndexByte(id, '/')
+	if i < 0 {
+		return "", id
+	}
+
+	return id[:i], id[i+1:]
+}
+
+// IsInternal reports whether an object is held by catly itself, such
+// as the settings of a bucket or the metadata of an image, rather than
+// being an image. Internal objects have names that are not valid images
+func IsInternal(id string) bool {
+	return strings.HasPrefix(id, bucketPrefix) || strings.HasPrefix(id, metadataPrefix) || strings.HasPrefix(id, noncePrefix)
+}
+
+// ValidBucketName reports whether a bucket name is valid. Names must be between
+// 3 and 63 characters, containing only lowercase letters, numbers and hyphens,
+// and must start and end with a letter or number
+func ValidBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(name)-1:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// CreateBucket creates a new bucket with the provided settings
+func (b *Buckets) CreateBucket(bucket *Bucket) error {
+	if !ValidBucketName(bucket.Name) {
+		return ErrInvalidBucketName
+	}
+
+	if bucket.Visibility == "" {
+		bucket.Visibility = VisibilityPublic
+	}
+
+	if bucket.Created.IsZero() {
+		bucket.Created = time.Now().UTC().Truncate(time.Second)
+	}
+
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return fmt.Errorf("failed to encode bucket: %w", err)
+	}
+
+	err = b.store.WriteObject(bucketPrefix+bucket.Name, bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, ErrFileExists) {
+			return ErrBucketExists
+		}
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cache[bucket.Name] = copyBucket(bucket)
+
+	return nil
+}
+
+// Bucket returns the settings of a bucket
+func (b *Buckets) Bucket(name string) (*Bucket, error) {
+	if !ValidBucketName(name) {
+		return nil, ErrInvalidBucketName
+	}
+
+	b.mu.RLock()
+	bucket, ok := b.cache[name]
+	b.mu.RUnlock()
+
+	if ok {
+		return copyBucket(bucket), nil
+	}
+
+	var buf bytes.Buffer
+
+	err := b.store.ReadObject(bucketPrefix+name, &buf)
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return nil, ErrBucketDoesNotExist
+		}
+		return nil, fmt.Errorf("failed to read bucket: %w", err)
+	}
+
+	bucket = &Bucket{}
+
+	err = json.Unmarshal(buf.Bytes(), bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode bucket: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cache[name] = bucket
+
+	return copyBucket(bucket), nil
+}
+
+// ListBuckets lists all buckets in name order
+func (b *Buckets) ListBuckets() ([]*Bucket, error) {
+	var buckets []*Bucket
+	var after string
+
+	for {
+		objects, err := b.store.ListObjects(bucketPrefix, after, listBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list buckets: %w", err)
+		}
+
+		for _, info := range objects {
+			bucket, err := b.Bucket(strings.TrimPrefix(info.Name, bucketPrefix))
+			if err != nil {
+				// the bucket may have been deleted since it was listed
+				if errors.Is(err, ErrBucketDoesNotExist) {
+					continue
+				}
+				return nil, err
+			}
+
+			buckets = append(buckets, bucket)
+		}
+
+		if len(objects) < listBatchSize {
+			return buckets, nil
+		}
+
+		after = objects[len(objects)-1].Name
+	}
+}
+
+// DeleteBucket deletes a bucket. Buckets must be empty before they can be deleted
+func (b *Buckets) DeleteBucket(name string) error {
+	_, err := b.Bucket(name)
+	if err != nil {
+		return err
+	}
+
+	objects, err := b.store.ListObjects(ObjectID(name, ""), "", 1)
+	if err != nil {
+		return fmt.Errorf("failed to list bucket: %w", err)
+	}
+
+	if len(objects) > 0 {
+		return ErrBucketNotEmpty
+	}
+
+	b.mu.Lock()
+	delete(b.cache, name)
+	b.mu.Unlock()
+
+	err = b.store.DeleteObject(bucketPrefix + name)
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return ErrBucketDoesNotExist
+		}
+		return fmt.Errorf("failed to delete bucket: %w", err)
+	}
+
+	return nil
+}
+
+// Purge clears the cached settings of every bucket, so they are read
+// from the store again. Settings only need to be purged if they have
+// been changed in the store without using this manager
+func (b *Buckets) Purge() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cache = make(map[string]*Bucket)
+}
+
+func copyBucket(bucket *Bucket) *Bucket {
+	c := *bucket
+	c.AllowedTypes = append([]string(nil), bucket.AllowedTypes...)
+	return &c
+}
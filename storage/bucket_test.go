@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketNames(t *testing.T) {
+	valid := []string{"cat", "cats-and-dogs", "123", "a-1"}
+	invalid := []string{"", "ab", "-cat", "cat-", "Cats", "cat_dog", "cat.dog", "..", ".buckets", string(make([]byte, 64))}
+
+	for _, name := range valid {
+		assert.True(t, ValidBucketName(name), name)
+	}
+
+	for _, name := range invalid {
+		assert.False(t, ValidBucketName(name), name)
+	}
+
+	assert.Equal(t, "cat.jpg", ObjectID("", "cat.jpg"))
+	assert.Equal(t, "cats/cat.jpg", ObjectID("cats", "cat.jpg"))
+
+	bucket, name := SplitObjectID("cats/cat.jpg")
+	assert.Equal(t, "cats", bucket)
+	assert.Equal(t, "cat.jpg", name)
+
+	bucket, name = SplitObjectID("cat.jpg")
+	assert.Empty(t, bucket)
+	assert.Equal(t, "cat.jpg", name)
+
+	assert.True(t, IsInternal(bucketPrefix+"cats"))
+	assert.True(t, IsInternal(metadataID("cats/cat.jpg")))
+	assert.True(t, IsInternal(nonceID("n0nc3", time.Now())))
+	assert.False(t, IsInternal("cats/cat.jpg"))
+	assert.False(t, IsInternal(".buckets.jpg"))
+}
+
+func TestBuckets(t *testing.T) {
+	fs := newTestFileStore(t)
+	b := NewBuckets(fs)
+
+	err := b.CreateBucket(&Bucket{Name: "../cats"})
+	assert.Equal(t, ErrInvalidBucketName, err)
+
+	err = b.CreateBucket(&Bucket{Name: "cats", MaxObjectSize: 1024, AllowedTypes: []string{"image/png"}})
+	require.NoError(t, err)
+
+	err = b.CreateBucket(&Bucket{Name: "cats"})
+	assert.Equal(t, ErrBucketExists, err)
+
+	err = b.CreateBucket(&Bucket{Name: "dogs", Visibility: VisibilityPrivate})
+	require.NoError(t, err)
+
+	// buckets are read from storage when they are not cached
+	b = NewBuckets(fs)
+
+	cats, err := b.Bucket("cats")
+	require.NoError(t, err)
+	assert.Equal(t, VisibilityPublic, cats.Visibility)
+	assert.Equal(t, int64(1024), cats.MaxObjectSize)
+	assert.Equal(t, []string{"image/png"}, cats.AllowedTypes)
+	assert.False(t, cats.Created.IsZero())
+
+	_, err = b.Bucket("birds")
+	assert.Equal(t, ErrBucketDoesNotExist, err)
+
+	buckets, err := b.ListBuckets()
+	require.NoError(t, err)
+	require.Len(t, buckets, 2)
+	assert.Equal(t, "cats", buckets[0].Name)
+	assert.Equal(t, "dogs", buckets[1].Name)
+	assert.Equal(t, VisibilityPrivate, buckets[1].Visibility)
+
+	// buckets must be empty to be deleted
+	require.NoError(t, fs.WriteObject(ObjectID("cats", "cat.jpg"), bytes.NewReader([]byte("meow"))))
+
+	err = b.DeleteBucket("cats")
+	assert.Equal(t, ErrBucketNotEmpty, err)
+
+	require.NoError(t, fs.DeleteObject(ObjectID("cats", "cat.jpg")))
+	require.NoError(t, b.DeleteBucket("cats"))
+
+	err = b.DeleteBucket("cats")
+	assert.Equal(t, ErrBucketDoesNotExist, err)
+
+	buckets, err = b.ListBuckets()
+	require.NoError(t, err)
+	require.Len(t, buckets, 1)
+	assert.Equal(t, "dogs", buckets[0].Name)
+
+	// buckets changed by another manager are cached until they are purged
+	require.NoError(t, NewBuckets(fs).DeleteBucket("dogs"))
+
+	_, err = b.Bucket("dogs")
+	require.NoError(t, err)
+
+	b.Purge()
+
+	_, err = b.Bucket("dogs")
+	assert.Equal(t, ErrBucketDoesNotExist, err)
+}
@@ -0,0 +1,569 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MasterKeySize the size of a master key in bytes
+	MasterKeySize = 32
+	// the size of the plaintext chunks that objects are encrypted in
+	encryptedChunkSize = 1 << 16
+	// the magic bytes at the start of an encrypted object
+	encryptedMagic = "catlyenc"
+	// the version of the encrypted object format
+	encryptedVersion = 1
+	// the size of the fingerprint identifying the master key used to wrap a data key
+	keyFingerprintSize = 8
+	// the size of a data key
+	dataKeySize = 32
+	// the size of the nonces used by AES-GCM
+	gcmNonceSize = 12
+	// the size of the authentication tag added by AES-GCM
+	gcmTagSize = 16
+	// the size of the header of an encrypted object. The header holds the magic bytes,
+	// version, master key fingerprint and the wrapped data key with its nonce and tag
+	encryptedHeaderSize = len(encryptedMagic) + 1 + keyFingerprintSize + gcmNonceSize + dataKeySize + gcmTagSize
+)
+
+// errReadAborted is used to stop reading an object that failed to decrypt
+var errReadAborted = errors.New("read aborted")
+
+// KeyRing holds the master keys that wrap the data key of each encrypted object.
+// New objects are written using the primary key, and older keys are kept so that
+// existing objects can still be read
+type KeyRing struct {
+	mu      sync.RWMutex
+	primary *masterKey
+	keys    map[string]*masterKey
+}
+
+// masterKey a master key, identified by its fingerprint
+type masterKey struct {
+	fingerprint []byte
+	aead        cipher.AEAD
+}
+
+// NewKeyRing creates a new key ring from a set of master keys, where the first key
+// is the primary key used to encrypt new objects. Each key must be 32 bytes
+func NewKeyRing(keys ...[]byte) (*KeyRing, error) {
+	k := &KeyRing{}
+
+	err := k.SetKeys(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// SetKeys replaces the keys held by the key ring. Objects encrypted with a key
+// that is no longer held by the key ring will not be able to be read
+func (k *KeyRing) SetKeys(keys ...[]byte) error {
+	if len(keys) < 1 {
+		return fmt.Errorf("%w: no keys provided", ErrInvalidMasterKey)
+	}
+
+	ring := make(map[string]*masterKey, len(keys))
+
+	var primary *masterKey
+
+	for _, key := range keys {
+		if len(key) != MasterKeySize {
+			return fmt.Errorf("%w: keys must be %d bytes", ErrInvalidMasterKey, MasterKeySize)
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(key)
+
+		mk := &masterKey{
+			fingerprint: sum[:keyFingerprintSize],
+			aead:        aead,
+		}
+
+		ring[string(mk.fingerprint)] = mk
+
+		if primary == nil {
+			primary = mk
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.primary = primary
+	k.keys = ring
+
+	return nil
+}
+
+// ParseKeys parses base64 encoded master keys, with one key on each line.
+// Blank lines and lines starting with '#' are ignored
+func ParseKeys(data string) ([][]byte, error) {
+	var keys [][]byte
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMasterKey, err.Error())
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ReadKeyFile reads master keys from a file, in the format accepted by ParseKeys
+func ReadKeyFile(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	return ParseKeys(string(data))
+}
+
+// wrap encrypts a data key with the primary key, returning the header of an encrypted object
+func (k *KeyRing) wrap(dataKey []byte) ([]byte, error) {
+	k.mu.RLock()
+	primary := k.primary
+	k.mu.RUnlock()
+
+	header := make([]byte, len(encryptedMagic)+1+keyFingerprintSize, encryptedHeaderSize)
+
+	copy(header, encryptedMagic)
+	header[len(encryptedMagic)] = encryptedVersion
+	copy(header[len(encryptedMagic)+1:], primary.fingerprint)
+
+	nonce := make([]byte, gcmNonceSize)
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// the magic bytes, version and fingerprint are authenticated with the data key
+	header = append(header, nonce...)
+	header = primary.aead.Seal(header, nonce, dataKey, header[:len(encryptedMagic)+1+keyFingerprintSize])
+
+	return header, nil
+}
+
+// unwrap decrypts the data key from the header of an encrypted object, returning
+// it along with whether it was wrapped with the primary key
+func (k *KeyRing) unwrap(header []byte) ([]byte, bool, error) {
+	if len(header) < encryptedHeaderSize || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, false, fmt.Errorf("%w: not an encrypted file", ErrDecryptionFailed)
+	}
+
+	if header[len(encryptedMagic)] != encryptedVersion {
+		return nil, false, fmt.Errorf("%w: unsupported version %d", ErrDecryptionFailed, header[len(encryptedMagic)])
+	}
+
+	prefix := len(encryptedMagic) + 1 + keyFingerprintSize
+	fingerprint := header[len(encryptedMagic)+1 : prefix]
+
+	k.mu.RLock()
+	mk, ok := k.keys[string(fingerprint)]
+	primary := mk == k.primary
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, false, fmt.Errorf("%w: %s", ErrUnknownMasterKey, hex.EncodeToString(fingerprint))
+	}
+
+	nonce := header[prefix : prefix+gcmNonceSize]
+
+	dataKey, err := mk.aead.Open(nil, nonce, header[prefix+gcmNonceSize:encryptedHeaderSize], header[:prefix])
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: failed to unwrap data key", ErrDecryptionFailed)
+	}
+
+	return dataKey, primary, nil
+}
+
+// EncryptedStore a store that encrypts objects before writing them to another store.
+// Each object is encrypted with its own data key using AES-256-GCM, in chunks so
+// that objects can be streamed. The data key is wrapped with a master key and
+// stored in the object's header. Objects with a data key wrapped by an old
+// master key are re-wrapped with the primary key when they are next read,
+// if the underlying store supports replacing objects.
+//
+// Writes and deletes of an object wait for it to be re-wrapped, so a re-wrap
+// never replaces newer data. This only holds for writes made through the same
+// EncryptedStore, otherwise objects are only re-wrapped if the underlying store
+// records checksums that show the object has not changed since it was read
+type EncryptedStore struct {
+	store      Store
+	keys       *KeyRing
+	locks      nameLocks
+	rewrapping sync.Map
+	rewraps    sync.WaitGroup
+}
+
+// NewEncryptedStore creates a new encrypted store that writes objects to the provided store
+func NewEncryptedStore(store Store, keys *KeyRing) *EncryptedStore {
+	return &EncryptedStore{
+		store: store,
+		keys:  keys,
+		locks: nameLocks{locks: make(map[string]*nameLock)},
+	}
+}
+
+// ReadObject decrypts an object from the underlying store to the provided io.Writer
+func (s *EncryptedStore) ReadObject(id string, w io.Writer) error {
+	pr, pw := io.Pipe()
+
+	read := make(chan error, 1)
+
+	go func() {
+		err := s.store.ReadObject(id, pw)
+		pw.CloseWithError(err)
+		read <- err
+	}()
+
+	primary, err := decryptObject(w, pr, s.keys)
+
+	// stop the underlying store if the object could not be decrypted
+	pr.CloseWithError(errReadAborted)
+
+	// errors from the underlying store take precedence,
+	// such as the object not existing
+	rerr := <-read
+	if rerr != nil && !errors.Is(rerr, errReadAborted) {
+		return rerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !primary {
+		s.rewrap(id)
+	}
+
+	return nil
+}
+
+// WriteObject encrypts an object from the provided io.Reader and writes it to the underlying store
+func (s *EncryptedStore) WriteObject(id string, r io.Reader) error {
+	dataKey := make([]byte, dataKeySize)
+
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	header, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	pr, pw := io.Pipe()
+
+	encrypted := make(chan struct{})
+
+	go func() {
+		defer close(encrypted)
+		pw.CloseWithError(encryptObject(pw, r, header, dataKey))
+	}()
+
+	err = s.store.WriteObject(id, pr)
+
+	// stop encrypting if the underlying store stopped reading early, and wait
+	// so that the upload is not read after the write has completed
+	pr.CloseWithError(errReadAborted)
+	<-encrypted
+
+	return err
+}
+
+// StatObject returns information about an object, with the size of its decrypted data
+func (s *EncryptedStore) StatObject(id string) (*ObjectInfo, error) {
+	info, err := s.store.StatObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptedInfo(info), nil
+}
+
+// ListObjects lists objects in the underlying store, with the size of their decrypted data
+func (s *EncryptedStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	objects, err := s.store.ListObjects(prefix, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range objects {
+		objects[i] = decryptedInfo(info)
+	}
+
+	return objects, nil
+}
+
+// DeleteObject removes an object from the underlying store
+func (s *EncryptedStore) DeleteObject(id string) error {
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	return s.store.DeleteObject(id)
+}
+
+// Close waits for any objects that are being re-wrapped, and closes the underlying store
+func (s *EncryptedStore) Close() error {
+	s.rewraps.Wait()
+	return Close(s.store)
+}
+
+// rewrap re-wraps the data key of an object with the primary key in the background
+func (s *EncryptedStore) rewrap(id string) {
+	rs, ok := s.store.(replacer)
+	if !ok {
+		return
+	}
+
+	// only re-wrap each object once at a time
+	_, loaded := s.rewrapping.LoadOrStore(id, true)
+	if loaded {
+		return
+	}
+
+	s.rewraps.Add(1)
+
+	go func() {
+		defer s.rewraps.Done()
+		defer s.rewrapping.Delete(id)
+
+		err := s.rewrapObject(rs, id)
+		if err != nil {
+			log.Warn().
+				Str("file", id).
+				Msg(fmt.Sprintf("failed to re-wrap data key: %s", err.Error()))
+			return
+		}
+
+		log.Debug().
+			Str("file", id).
+			Msg("re-wrapped data key with primary key")
+	}()
+}
+
+// rewrapObject replaces the header of an object with one containing its data key wrapped
+// by the primary key. The encrypted data is not changed, as the data key is the same
+func (s *EncryptedStore) rewrapObject(rs replacer, id string) error {
+	// hold the object's lock, so it cannot be replaced
+	// through this store between being read and re-wrapped
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	var buf bytes.Buffer
+
+	err := s.store.ReadObject(id, &buf)
+	if err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+
+	// skip the object if it has been replaced by another writer since it was read
+	info, err := s.store.StatObject(id)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+
+	if info.Checksum != "" && info.Checksum != hex.EncodeToString(sum[:]) {
+		return nil
+	}
+
+	dataKey, primary, err := s.keys.unwrap(data)
+	if err != nil || primary {
+		return err
+	}
+
+	header, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	copy(data, header)
+
+	return rs.ReplaceObject(id, bytes.NewReader(data))
+}
+
+// encryptObject writes the header and encrypted chunks of an object's data. Each
+// chunk is authenticated with its position and whether it is the final chunk, so
+// chunks cannot be reordered or removed. The final chunk may be empty
+func encryptObject(w io.Writer, r io.Reader, header, dataKey []byte) error {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptedChunkSize)
+	out := make([]byte, 0, encryptedChunkSize+gcmTagSize)
+
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(r, buf)
+
+		final := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !final {
+			return err
+		}
+
+		out = aead.Seal(out[:0], chunkNonce(i), buf[:n], chunkAAD(final))
+
+		_, err = w.Write(out)
+		if err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// decryptObject writes the decrypted data of an object, returning
+// whether its data key was wrapped with the primary key
+func decryptObject(w io.Writer, r io.Reader, keys *KeyRing) (bool, error) {
+	br := bufio.NewReaderSize(r, encryptedChunkSize+gcmTagSize)
+
+	header := make([]byte, encryptedHeaderSize)
+
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, fmt.Errorf("%w: incomplete header", ErrDecryptionFailed)
+		}
+		return false, err
+	}
+
+	dataKey, primary, err := keys.unwrap(header)
+	if err != nil {
+		return false, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, encryptedChunkSize+gcmTagSize)
+
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, err
+		}
+
+		// a full chunk is only the final chunk if there is no more data after it
+		final := n < len(buf)
+		if !final {
+			_, err = br.Peek(1)
+			if errors.Is(err, io.EOF) {
+				final = true
+			} else if err != nil {
+				return false, err
+			}
+		}
+
+		data, err := aead.Open(buf[:0], chunkNonce(i), buf[:n], chunkAAD(final))
+		if err != nil {
+			return false, fmt.Errorf("%w: chunk %d failed authentication", ErrDecryptionFailed, i)
+		}
+
+		wb, err := w.Write(data)
+		if err != nil {
+			return false, fmt.Errorf("failed to write file data: %w", err)
+		}
+
+		if wb < len(data) {
+			return false, ErrWriteIncomplete
+		}
+
+		if final {
+			return primary, nil
+		}
+	}
+}
+
+// decryptedInfo returns the information about an encrypted object with the size of its decrypted data.
+// The checksum of the encrypted data is removed, as it does not match the decrypted data
+func decryptedInfo(info *ObjectInfo) *ObjectInfo {
+	size := info.Size - int64(encryptedHeaderSize)
+
+	// each chunk has a tag, and there is always a final chunk that is not full
+	full := size / (encryptedChunkSize + gcmTagSize)
+	size = full*encryptedChunkSize + size%(encryptedChunkSize+gcmTagSize) - gcmTagSize
+
+	if size < 0 {
+		size = 0
+	}
+
+	return &ObjectInfo{
+		Name:    info.Name,
+		Size:    size,
+		Created: info.Created,
+	}
+}
+
+// chunkNonce returns the nonce of a chunk. As every object has its own data
+// key, the position of the chunk can safely be used as the nonce
+func chunkNonce(i uint64) []byte {
+	nonce := make([]byte, gcmNonceSize)
+	binary.BigEndian.PutUint64(nonce[gcmNonceSize-8:], i)
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
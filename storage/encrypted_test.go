@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, MasterKeySize)
+
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	return key
+}
+
+func newTestEncryptedStore(t *testing.T, store Store, keys ...[]byte) *EncryptedStore {
+	keyring, err := NewKeyRing(keys...)
+	require.NoError(t, err)
+
+	return NewEncryptedStore(store, keyring)
+}
+
+func TestEncryptedStorageSetup(t *testing.T) {
+	_, err := NewKeyRing()
+	assert.True(t, errors.Is(err, ErrInvalidMasterKey))
+
+	_, err = NewKeyRing([]byte("too short"))
+	assert.True(t, errors.Is(err, ErrInvalidMasterKey))
+
+	k1 := newTestKey(t)
+	k2 := newTestKey(t)
+
+	keys, err := ParseKeys(fmt.Sprintf("# primary\n%s\n\n%s\n", base64.StdEncoding.EncodeToString(k1), base64.StdEncoding.EncodeToString(k2)))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{k1, k2}, keys)
+
+	_, err = ParseKeys("not base64!")
+	assert.True(t, errors.Is(err, ErrInvalidMasterKey))
+}
+
+func TestEncryptedStorageReadWriteFile(t *testing.T) {
+	ms := NewMemoryStore()
+	es := newTestEncryptedStore(t, ms, newTestKey(t))
+
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, encryptedChunkSize * 3}
+
+	for _, size := range sizes {
+		id := fmt.Sprintf("cat-%d.jpg", size)
+
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		err = es.WriteObject(id, bytes.NewReader(data))
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+
+		err = es.ReadObject(id, &buf)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, buf.Bytes()), id)
+
+		info, err := es.StatObject(id)
+		require.NoError(t, err)
+		assert.Equal(t, int64(size), info.Size, id)
+		assert.Empty(t, info.Checksum)
+
+		// the data held by the underlying store is encrypted
+		buf.Reset()
+
+		err = ms.ReadObject(id, &buf)
+		require.NoError(t, err)
+		assert.Greater(t, buf.Len(), size)
+
+		if size > encryptedChunkSize {
+			assert.False(t, bytes.Contains(buf.Bytes(), data), id)
+		}
+	}
+
+	objects, err := es.ListObjects("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, objects, len(sizes))
+
+	for _, info := range objects {
+		var size int64
+		fmt.Sscanf(info.Name, "cat-%d.jpg", &size)
+		assert.Equal(t, size, info.Size, info.Name)
+	}
+
+	err = es.WriteObject("cat-0.jpg", bytes.NewReader([]byte("meow")))
+	assert.Equal(t, ErrFileExists, err)
+
+	err = es.ReadObject("invisible-cat.jpg", &bytes.Buffer{})
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	require.NoError(t, es.DeleteObject("cat-0.jpg"))
+
+	_, err = ms.StatObject("cat-0.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestEncryptedStorageTamper(t *testing.T) {
+	ms := NewMemoryStore()
+	es := newTestEncryptedStore(t, ms, newTestKey(t))
+
+	data := make([]byte, encryptedChunkSize*2+10)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	require.NoError(t, es.WriteObject("cat.jpg", bytes.NewReader(data)))
+
+	var encrypted bytes.Buffer
+	require.NoError(t, ms.ReadObject("cat.jpg", &encrypted))
+
+	tampered := map[string][]byte{
+		// a flipped bit in the second chunk
+		"modified.jpg": func() []byte {
+			b := append([]byte{}, encrypted.Bytes()...)
+			b[encryptedHeaderSize+encryptedChunkSize+gcmTagSize+1] ^= 1
+			return b
+		}(),
+		// the final chunk has been removed
+		"truncated.jpg": encrypted.Bytes()[:encryptedHeaderSize+(encryptedChunkSize+gcmTagSize)*2],
+		// the first and second chunks have been swapped
+		"reordered.jpg": func() []byte {
+			c := encryptedChunkSize + gcmTagSize
+			b := append([]byte{}, encrypted.Bytes()[:encryptedHeaderSize]...)
+			b = append(b, encrypted.Bytes()[encryptedHeaderSize+c:encryptedHeaderSize+c*2]...)
+			b = append(b, encrypted.Bytes()[encryptedHeaderSize:encryptedHeaderSize+c]...)
+			return append(b, encrypted.Bytes()[encryptedHeaderSize+c*2:]...)
+		}(),
+		"plaintext.jpg": []byte("meow"),
+	}
+
+	for id, b := range tampered {
+		require.NoError(t, ms.WriteObject(id, bytes.NewReader(b)))
+
+		err = es.ReadObject(id, &bytes.Buffer{})
+		assert.True(t, errors.Is(err, ErrDecryptionFailed), id)
+	}
+
+	// objects encrypted with a key that is not configured cannot be read
+	other := newTestEncryptedStore(t, ms, newTestKey(t))
+
+	err = other.ReadObject("cat.jpg", &bytes.Buffer{})
+	assert.True(t, errors.Is(err, ErrUnknownMasterKey))
+}
+
+func TestEncryptedStorageKeyRotation(t *testing.T) {
+	fs := newTestFileStore(t)
+
+	k1 := newTestKey(t)
+	k2 := newTestKey(t)
+
+	es := newTestEncryptedStore(t, fs, k1)
+
+	require.NoError(t, es.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	var before bytes.Buffer
+	require.NoError(t, fs.ReadObject("cat.jpg", &before))
+
+	// rotate to a new primary key, keeping the old key to read existing objects
+	require.NoError(t, es.keys.SetKeys(k2, k1))
+
+	var buf bytes.Buffer
+
+	require.NoError(t, es.ReadObject("cat.jpg", &buf))
+	assert.Equal(t, "meow", buf.String())
+
+	// the object is re-wrapped with the new primary key once read
+	es.rewraps.Wait()
+
+	var after bytes.Buffer
+	require.NoError(t, fs.ReadObject("cat.jpg", &after))
+
+	assert.Equal(t, before.Len(), after.Len())
+	assert.NotEqual(t, before.Bytes()[:encryptedHeaderSize], after.Bytes()[:encryptedHeaderSize])
+	assert.Equal(t, before.Bytes()[encryptedHeaderSize:], after.Bytes()[encryptedHeaderSize:])
+
+	// the old key is no longer needed to read the object
+	require.NoError(t, es.keys.SetKeys(k2))
+
+	buf.Reset()
+
+	require.NoError(t, es.ReadObject("cat.jpg", &buf))
+	assert.Equal(t, "meow", buf.String())
+
+	info, err := fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, checksum(after.Bytes()), info.Checksum)
+}
+
+// blockingReplaceStore blocks replacing objects until it is released
+type blockingReplaceStore struct {
+	*MemoryStore
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingReplaceStore) ReplaceObject(id string, r io.Reader) error {
+	s.blocked <- struct{}{}
+	<-s.release
+
+	return s.MemoryStore.ReplaceObject(id, r)
+}
+
+func TestEncryptedStorageRewrapConcurrentWrite(t *testing.T) {
+	bs := &blockingReplaceStore{
+		MemoryStore: NewMemoryStore(),
+		blocked:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+
+	k1 := newTestKey(t)
+	k2 := newTestKey(t)
+
+	es := newTestEncryptedStore(t, bs, k1)
+
+	require.NoError(t, es.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, es.keys.SetKeys(k2, k1))
+
+	var buf bytes.Buffer
+	require.NoError(t, es.ReadObject("cat.jpg", &buf))
+
+	// the object is replaced while its old data is being re-wrapped
+	<-bs.blocked
+
+	replaced := make(chan error, 1)
+
+	go func() {
+		err := es.DeleteObject("cat.jpg")
+		if err == nil {
+			err = es.WriteObject("cat.jpg", bytes.NewReader([]byte("purr")))
+		}
+		replaced <- err
+	}()
+
+	select {
+	case <-replaced:
+		t.Fatal("object was replaced while it was being re-wrapped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(bs.release)
+
+	require.NoError(t, <-replaced)
+	es.rewraps.Wait()
+
+	// the new data is not overwritten by the re-wrapped old data
+	buf.Reset()
+	require.NoError(t, es.ReadObject("cat.jpg", &buf))
+	assert.Equal(t, "purr", buf.String())
+}
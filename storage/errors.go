@@ -3,12 +3,40 @@ package storage
 import "errors"
 
 var (
+	// ErrBucketDoesNotExist is returned when a requested bucket cannot be found
+	ErrBucketDoesNotExist = errors.New("the bucket you requested does not exist")
+	// ErrBucketExists is returned when creating a bucket that already exists with the same name
+	ErrBucketExists = errors.New("the bucket you have created must have a unique name")
+	// ErrBucketNotEmpty is returned when deleting a bucket that still contains files
+	ErrBucketNotEmpty = errors.New("the bucket must be empty before it can be deleted")
+	// ErrChecksumMismatch is returned when an object's data does not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrDecryptionFailed is returned when an encrypted file cannot be decrypted
+	ErrDecryptionFailed = errors.New("failed to decrypt file")
 	// ErrDirectoryPathIsFile is returned when the specified base directory is a file
 	ErrDirectoryPathIsFile = errors.New("storage base directory path is a file")
 	// ErrFileDoesNotExist is returned when a requested file cannot be found
 	ErrFileDoesNotExist = errors.New("the file you requested does not exist")
 	// ErrFileExists is returned when creating a file that already exists with the same filename
 	ErrFileExists = errors.New("the file you have uploaded must have a unique name")
+	// ErrInvalidArchive is returned when importing an archive that is not a valid export
+	ErrInvalidArchive = errors.New("archive is invalid")
+	// ErrInvalidBucketName is returned when a bucket's name is invalid
+	ErrInvalidBucketName = errors.New("bucket name should be between 3 and 63 characters and contain only lowercase letters, numbers and hyphens")
+	// ErrInvalidFileName is returned when a file's name cannot be stored
+	ErrInvalidFileName = errors.New("file name is invalid")
+	// ErrInvalidMasterKey is returned when an encryption master key is invalid
+	ErrInvalidMasterKey = errors.New("invalid encryption master key")
+	// ErrObjectTooLarge is returned when an object exceeds the maximum size that can be stored
+	ErrObjectTooLarge = errors.New("object exceeds the maximum size")
+	// ErrReplaceUnsupported is returned when replacing a file in storage that does not support it
+	ErrReplaceUnsupported = errors.New("storage does not support replacing files")
+	// ErrStorageDoesNotExist is returned when opening storage that does not exist
+	ErrStorageDoesNotExist = errors.New("storage does not exist")
+	// ErrStorageFull is returned when there is no space left to store a new file
+	ErrStorageFull = errors.New("storage is full")
+	// ErrUnknownMasterKey is returned when an encrypted file was encrypted with a master key that is not configured
+	ErrUnknownMasterKey = errors.New("file was encrypted with an unknown master key")
 	// ErrWriteIncomplete is returned when write operation to a requesters io.Writer is incomplete
 	ErrWriteIncomplete = errors.New("write incomplete")
 )
@@ -1,17 +1,29 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
-// FileStore an implementation of the object storage
-// that writes to files in a directory
+const (
+	// the directory that uploads are staged in until they are complete
+	fileStoreTempDir = ".tmp"
+	// the directory that the checksum of each file is recorded in
+	fileStoreChecksumDir = ".checksums"
+	// the directory that corrupt files are moved to
+	fileStoreQuarantineDir = ".quarantine"
+)
+
+// FileStore an implementation of the object storage that writes to files in a
+// directory. Objects in a bucket are written to a subdirectory for the bucket
 type FileStore struct {
 	// the base storage directory where files will be stored
 	baseDir string
@@ -30,6 +42,13 @@ func NewFileStore(baseDir string) (*FileStore, error) {
 
 	// TODO : check if directory is writable
 
+	for _, dir := range []string{fileStoreTempDir, fileStoreChecksumDir, fileStoreQuarantineDir} {
+		err = os.MkdirAll(filepath.Join(baseDir, dir), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage directory %s: %w", dir, err)
+		}
+	}
+
 	return &FileStore{
 		baseDir: baseDir,
 	}, nil
@@ -37,7 +56,10 @@ func NewFileStore(baseDir string) (*FileStore, error) {
 
 // ReadObject reads a file from the local storage directory to the provided io.Writer
 func (s *FileStore) ReadObject(id string, w io.Writer) error {
-	p := filepath.Join(s.baseDir, id)
+	p, err := s.path(id)
+	if err != nil {
+		return ErrFileDoesNotExist
+	}
 
 	// Here we open the file and return it as an io.Reader so it's contents can
 	// be streamed to the requester
@@ -52,6 +74,16 @@ func (s *FileStore) ReadObject(id string, w io.Writer) error {
 
 	defer fd.Close()
 
+	fi, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read requested file: %w", err)
+	}
+
+	// directories are not objects
+	if fi.IsDir() {
+		return ErrFileDoesNotExist
+	}
+
 	rb, err := io.Copy(w, fd)
 	if err != nil {
 		return err
@@ -67,31 +99,416 @@ func (s *FileStore) ReadObject(id string, w io.Writer) error {
 
 // WriteObject writes a file to the local storage directory from the provided io.Reader
 func (s *FileStore) WriteObject(id string, r io.Reader) error {
-	p := filepath.Join(s.baseDir, id)
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	// fail early if the file already exists, so we don't
+	// needlessly read the whole upload
+	_, err = os.Lstat(p)
+	if err == nil {
+		return ErrFileExists
+	}
+
+	// create the directory of the bucket the file is written to
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket directory: %w", err)
+	}
 
-	// we open the file with O_CREATE and O_EXCL, which will prevent race conditions
-	// when someone uploads a file with the same name as us at the same time
-	fd, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	// the data is written to a temporary file first, so a partially
+	// uploaded file will never be served to someone requesting it
+	tmp, wb, checksum, err := s.writeTemp(r)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	// we link the completed file into place, which will fail if the file exists.
+	// this prevents race conditions when someone uploads a file with the same
+	// name as us at the same time
+	err = os.Link(tmp, p)
 	if err != nil {
 		if errors.Is(err, os.ErrExist) {
 			return ErrFileExists
 		}
+		return err
+	}
+
+	s.recordChecksum(id, checksum)
+
+	log.Debug().
+		Str("file", id).
+		Str("directory", s.baseDir).
+		Msg(fmt.Sprintf("wrote %d bytes to disk", wb))
 
+	return nil
+}
+
+// ReplaceObject atomically replaces the data of an existing file in the local
+// storage directory. Requests for the file will receive either the old or new data
+func (s *FileStore) ReplaceObject(id string, r io.Reader) error {
+	_, err := s.StatObject(id)
+	if err != nil {
 		return err
 	}
 
-	defer fd.Close()
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
 
-	// copy data from the request's body to the file descriptor
-	wb, err := io.Copy(fd, r)
+	tmp, wb, checksum, err := s.writeTemp(r)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	err = os.Rename(tmp, p)
 	if err != nil {
-		return fmt.Errorf("file upload failed: %w", err)
+		return fmt.Errorf("failed to replace file: %w", err)
 	}
 
+	s.recordChecksum(id, checksum)
+
 	log.Debug().
 		Str("file", id).
 		Str("directory", s.baseDir).
-		Msg(fmt.Sprintf("wrote %d bytes to disk", wb))
+		Msg(fmt.Sprintf("replaced file with %d bytes", wb))
+
+	return nil
+}
+
+// StatObject returns information about a file in the local storage directory
+func (s *FileStore) StatObject(id string) (*ObjectInfo, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, ErrFileDoesNotExist
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileDoesNotExist
+		}
+		return nil, fmt.Errorf("failed to stat requested file: %w", err)
+	}
+
+	if fi.IsDir() {
+		return nil, ErrFileDoesNotExist
+	}
+
+	info := fileInfo(id, fi)
+
+	cp, err := s.checksumPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, err := os.ReadFile(cp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read file checksum: %w", err)
+	}
+
+	info.Checksum = string(checksum)
+
+	return info, nil
+}
+
+// ListObjects lists files in the local storage directory in name order
+// that match the prefix and come after the specified name, up to a limit
+func (s *FileStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	// objects in a bucket are held in the bucket's directory,
+	// so only that directory needs to be read to list them
+	i := strings.IndexByte(prefix, '/')
+	if i >= 0 {
+		if !s.bucketDir(prefix[:i]) {
+			return []*ObjectInfo{}, nil
+		}
+
+		objects, _, err := s.readDir(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+
+		return listPage(objects, prefix, after, limit), nil
+	}
+
+	objects, dirs, err := s.readDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if !strings.HasPrefix(dir, prefix) {
+			continue
+		}
+
+		bucket, _, err := s.readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, bucket...)
+	}
+
+	return listPage(objects, prefix, after, limit), nil
+}
+
+// DeleteObject removes a file from the local storage directory
+func (s *FileStore) DeleteObject(id string) error {
+	// check that we are not removing a directory
+	_, err := s.StatObject(id)
+	if err != nil {
+		return err
+	}
+
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrFileDoesNotExist
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	s.removeChecksum(id)
+
+	log.Debug().
+		Str("file", id).
+		Str("directory", s.baseDir).
+		Msg("deleted file from disk")
+
+	return nil
+}
+
+// RecordChecksum records the checksum of a file's data
+func (s *FileStore) RecordChecksum(id, checksum string) error {
+	p, err := s.checksumPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to record checksum: %w", err)
+	}
+
+	// the checksum is written to a temporary file
+	// first, so it is never read partially written
+	fd, err := os.CreateTemp(filepath.Join(s.baseDir, fileStoreTempDir), "checksum-*")
+	if err != nil {
+		return fmt.Errorf("failed to record checksum: %w", err)
+	}
+
+	defer os.Remove(fd.Name())
+
+	_, err = fd.WriteString(checksum)
+	if err != nil {
+		fd.Close()
+		return fmt.Errorf("failed to record checksum: %w", err)
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return fmt.Errorf("failed to record checksum: %w", err)
+	}
+
+	err = os.Rename(fd.Name(), p)
+	if err != nil {
+		return fmt.Errorf("failed to record checksum: %w", err)
+	}
+
+	return nil
+}
+
+// Quarantine moves a corrupt file out of the storage directory, so it is no
+// longer served. Quarantined files are kept for inspection in the '.quarantine'
+// directory, and a new file can be written with the same name
+func (s *FileStore) Quarantine(id string) error {
+	_, err := s.StatObject(id)
+	if err != nil {
+		return err
+	}
+
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	q := filepath.Join(s.baseDir, fileStoreQuarantineDir, id)
+
+	err = os.MkdirAll(filepath.Dir(q), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine file: %w", err)
+	}
+
+	err = os.Rename(p, q)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrFileDoesNotExist
+		}
+		return fmt.Errorf("failed to quarantine file: %w", err)
+	}
+
+	s.removeChecksum(id)
+
+	log.Warn().
+		Str("file", id).
+		Str("directory", s.baseDir).
+		Msg("quarantined corrupt file")
 
 	return nil
 }
+
+// writeTemp writes data to a new temporary file, returning
+// its path, along with the size and checksum of the data
+func (s *FileStore) writeTemp(r io.Reader) (string, int64, string, error) {
+	fd, err := os.CreateTemp(filepath.Join(s.baseDir, fileStoreTempDir), "upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	h := sha256.New()
+
+	// copy data from the request's body to the file descriptor
+	wb, err := io.Copy(io.MultiWriter(fd, h), r)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return "", 0, "", fmt.Errorf("file upload failed: %w", err)
+	}
+
+	err = fd.Chmod(0644)
+	if err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", 0, "", fmt.Errorf("file upload failed: %w", err)
+	}
+
+	return fd.Name(), wb, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordChecksum records the checksum of a file that has just been written.
+// if this fails, the file is still stored without a checksum, which the
+// scrubber will record later
+func (s *FileStore) recordChecksum(id, checksum string) {
+	err := s.RecordChecksum(id, checksum)
+	if err != nil {
+		log.Warn().
+			Str("file", id).
+			Str("directory", s.baseDir).
+			Msg(err.Error())
+	}
+}
+
+// path returns the path of a file in the storage directory. Files can only be
+// held in the storage directory or the directory of a bucket within it
+func (s *FileStore) path(id string) (string, error) {
+	bucket, name := SplitObjectID(id)
+
+	if bucket != "" && !s.bucketDir(bucket) {
+		return "", ErrInvalidFileName
+	}
+
+	// check there are no further slashes, or names that refer to directories,
+	// so files cannot be read or written in other parts of the filesystem
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", ErrInvalidFileName
+	}
+
+	return filepath.Join(s.baseDir, bucket, name), nil
+}
+
+// bucketDir reports whether a directory in the storage directory holds a bucket's files
+func (s *FileStore) bucketDir(dir string) bool {
+	switch dir {
+	case "", ".", "..", fileStoreTempDir, fileStoreChecksumDir, fileStoreQuarantineDir:
+		return false
+	}
+
+	return !strings.ContainsAny(dir, `/\`)
+}
+
+// readDir returns the files held in a directory of the storage directory,
+// along with the directories within it that hold the files of buckets
+func (s *FileStore) readDir(dir string) ([]*ObjectInfo, []string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.baseDir, dir))
+	if err != nil {
+		// a bucket's directory is not created until a file is written to it
+		if dir != "" && errors.Is(err, os.ErrNotExist) {
+			return []*ObjectInfo{}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	objects := make([]*ObjectInfo, 0, len(entries))
+
+	var dirs []string
+
+	for _, e := range entries {
+		if e.IsDir() {
+			if dir == "" && s.bucketDir(e.Name()) {
+				dirs = append(dirs, e.Name())
+			}
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			// the file may have been deleted since the directory was read
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		objects = append(objects, fileInfo(ObjectID(dir, e.Name()), fi))
+	}
+
+	return objects, dirs, nil
+}
+
+func (s *FileStore) checksumPath(id string) (string, error) {
+	_, err := s.path(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.baseDir, fileStoreChecksumDir, id), nil
+}
+
+func (s *FileStore) removeChecksum(id string) {
+	p, err := s.checksumPath(id)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn().
+			Str("file", id).
+			Str("directory", s.baseDir).
+			Msg(fmt.Sprintf("failed to remove file checksum: %s", err.Error()))
+	}
+}
+
+func fileInfo(id string, fi os.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Name:    id,
+		Size:    fi.Size(),
+		Created: fi.ModTime(),
+	}
+}
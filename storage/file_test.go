@@ -2,11 +2,14 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -129,3 +132,198 @@ func TestFileStorageWriteConcurrentConflict(t *testing.T) {
 	// check the other 99 requests failed
 	assert.Equal(t, int64(99), errorCount)
 }
+
+func TestFileStorageWriteFileFailure(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	r := io.MultiReader(
+		bytes.NewReader([]byte("me")),
+		iotest.ErrReader(errors.New("connection reset")),
+	)
+
+	err := fs.WriteObject("cat.jpg", r)
+	require.Error(t, err)
+
+	// check no partial file has been left behind
+	_, err = os.Stat(filepath.Join(fs.baseDir, "cat.jpg"))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := os.ReadDir(filepath.Join(fs.baseDir, fileStoreTempDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestFileStorageStatFile(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	err := fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	info, err := fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.False(t, info.Created.IsZero())
+	assert.Equal(t, "404cdd7bc109c432f8cc2443b45bcfe95980f5107215c645236e577929ac3e52", info.Checksum)
+
+	_, err = fs.StatObject("invisible-cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	// directories are not objects
+	_, err = fs.StatObject(fileStoreTempDir)
+	require.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestFileStorageListFiles(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	for _, name := range []string{"cat-3.jpg", "cat-1.jpg", "dog.jpg", "cat-2.jpg"} {
+		err := fs.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	objects, err := fs.ListObjects("cat-", "", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "cat-1.jpg", objects[0].Name)
+	assert.Equal(t, "cat-2.jpg", objects[1].Name)
+
+	objects, err = fs.ListObjects("cat-", objects[1].Name, 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cat-3.jpg", objects[0].Name)
+
+	objects, err = fs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 4)
+}
+
+func TestFileStorageDeleteFile(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	err := fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = fs.DeleteObject("cat.jpg")
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(fs.baseDir, "cat.jpg"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(fs.baseDir, fileStoreChecksumDir, "cat.jpg"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = fs.DeleteObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = fs.DeleteObject(fileStoreTempDir)
+	require.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestFileStorageQuarantineFile(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	err := fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = fs.Quarantine("cat.jpg")
+	require.NoError(t, err)
+
+	_, err = fs.StatObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	data, err := os.ReadFile(filepath.Join(fs.baseDir, fileStoreQuarantineDir, "cat.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), data)
+
+	err = fs.Quarantine("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	// a new file can be written with the same name
+	err = fs.WriteObject("cat.jpg", bytes.NewReader([]byte("purr")))
+	require.NoError(t, err)
+}
+
+func TestFileStorageReplaceFile(t *testing.T) {
+	fs := newTestFileStore(t)
+
+	err := fs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = fs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr!")))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	err = fs.ReadObject("cat.jpg", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "purr!", buf.String())
+
+	info, err := fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "df5078e76664a04dcff1deb04d2a7efac98ee07a285d42b3a90de5585c0a759a", info.Checksum)
+}
+
+func TestFileStorageBuckets(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	for _, id := range []string{"cat.jpg", "cats/cat.jpg", "cats/kitten.jpg", "dogs/dog.jpg"} {
+		err := fs.WriteObject(id, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	// objects in a bucket are written to the bucket's directory
+	data, err := os.ReadFile(filepath.Join(fs.baseDir, "cats", "cat.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "meow", string(data))
+
+	info, err := fs.StatObject("cats/cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cats/cat.jpg", info.Name)
+	assert.NotEmpty(t, info.Checksum)
+
+	objects, err := fs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, objects, 4)
+	assert.Equal(t, "cat.jpg", objects[0].Name)
+	assert.Equal(t, "cats/cat.jpg", objects[1].Name)
+	assert.Equal(t, "cats/kitten.jpg", objects[2].Name)
+	assert.Equal(t, "dogs/dog.jpg", objects[3].Name)
+
+	objects, err = fs.ListObjects("cats/", "cats/cat.jpg", 0)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cats/kitten.jpg", objects[0].Name)
+
+	objects, err = fs.ListObjects("birds/", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 0)
+
+	require.NoError(t, fs.DeleteObject("cats/cat.jpg"))
+
+	_, err = fs.StatObject("cats/cat.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	// objects cannot be written outside of the storage directory or a bucket's directory
+	for _, id := range []string{"../cat.jpg", "cats/../../cat.jpg", "cats/kittens/cat.jpg", "cats/..", ".tmp/cat.jpg", ".checksums/cat.jpg"} {
+		err = fs.WriteObject(id, bytes.NewReader([]byte("meow")))
+		assert.Equal(t, ErrInvalidFileName, err, id)
+
+		err = fs.ReadObject(id, &bytes.Buffer{})
+		assert.Equal(t, ErrFileDoesNotExist, err, id)
+	}
+
+	objects, err = fs.ListObjects("../", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 0)
+}
@@ -1,44 +1,158 @@
 package storage
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// EvictionPolicy determines what a bounded MemoryStore does when it is full
+type EvictionPolicy int
+
+const (
+	// EvictNone rejects new writes with ErrStorageFull
+	EvictNone EvictionPolicy = iota
+	// EvictLRU evicts the least recently read or written objects
+	EvictLRU
+	// EvictOldest evicts the oldest objects
+	EvictOldest
+)
+
+// ParseEvictionPolicy parses the name of an eviction policy
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch policy {
+	case "", "none":
+		return EvictNone, nil
+	case "lru":
+		return EvictLRU, nil
+	case "oldest":
+		return EvictOldest, nil
+	}
+
+	return EvictNone, fmt.Errorf("unknown eviction policy '%s'", policy)
+}
+
+// MemoryOption configures optional behaviour of a MemoryStore
+type MemoryOption func(s *MemoryStore)
+
+// WithMaxBytes limits the total size of the objects held in memory
+func WithMaxBytes(n int64) MemoryOption {
+	return func(s *MemoryStore) {
+		s.maxBytes = n
+	}
+}
+
+// WithMaxObjects limits the number of objects held in memory
+func WithMaxObjects(n int64) MemoryOption {
+	return func(s *MemoryStore) {
+		s.maxObjects = n
+	}
+}
+
+// WithEvictionPolicy sets how space is made for new objects when the store is full
+func WithEvictionPolicy(policy EvictionPolicy) MemoryOption {
+	return func(s *MemoryStore) {
+		s.eviction = policy
+	}
+}
+
+// WithSnapshotInterval sets how often a persistent MemoryStore writes a snapshot.
+// Snapshots are only written when the store is closed if the interval is zero
+func WithSnapshotInterval(d time.Duration) MemoryOption {
+	return func(s *MemoryStore) {
+		s.snapshotInterval = d
+	}
+}
+
+// MemoryStats reports the usage of a MemoryStore
+type MemoryStats struct {
+	// Objects the number of objects held in memory
+	Objects int64 `json:"objects"`
+	// Bytes the total size of the objects held in memory
+	Bytes int64 `json:"bytes"`
+	// MaxObjects the maximum number of objects, or zero if unlimited
+	MaxObjects int64 `json:"max_objects"`
+	// MaxBytes the maximum total size of objects, or zero if unlimited
+	MaxBytes int64 `json:"max_bytes"`
+	// Evictions the number of objects that have been evicted
+	Evictions int64 `json:"evictions"`
+	// Rejections the number of writes rejected because the store was full
+	Rejections int64 `json:"rejections"`
+}
+
 // MemoryStore an implementation of the object storage
 // that writes to files to an in memory hashmap
 type MemoryStore struct {
 	objects sync.Map
+	// held when adding or removing objects, so usage can be tracked
+	mu         sync.Mutex
+	order      *list.List
+	maxBytes   int64
+	maxObjects int64
+	eviction   EvictionPolicy
+	stats      MemoryStats
+	// called with the id of each object that is evicted
+	evicted []func(id string)
+	// the log that changes are written to, if the store is persistent
+	log              *memoryLog
+	snapshotInterval time.Duration
+	// held while writing a snapshot
+	snapshotMu sync.Mutex
+	snapshots  sync.WaitGroup
+	done       chan struct{}
+}
+
+// memoryObject an object held in memory
+type memoryObject struct {
+	data    []byte
+	created time.Time
+	// the hex encoded SHA-256 checksum of the object's data
+	checksum string
+	// the object's position in the eviction order. internal objects,
+	// such as bucket settings, are never evicted so have no position
+	element *list.Element
 }
 
-// NewMemoryStore creates a new in-memory store
-func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{}
+// NewMemoryStore creates a new in-memory store. By default, the store is
+// unbounded and will hold every object written. Internal objects are not
+// counted against the store's limits, and are never evicted
+func NewMemoryStore(opts ...MemoryOption) *MemoryStore {
+	s := &MemoryStore{
+		order: list.New(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 // ReadObject reads a file from the local storage directory to the provided io.Writer
 func (s *MemoryStore) ReadObject(id string, w io.Writer) error {
 	// load the object from the hashmap
-	obj, ok := s.objects.Load(id)
+	obj, ok := s.load(id)
 	if !ok {
 		return ErrFileDoesNotExist
 	}
 
-	data, ok := obj.([]byte)
-	if !ok {
-		return ErrFileDoesNotExist
+	if s.eviction == EvictLRU {
+		s.touch(obj)
 	}
 
 	// write the data to the requester's io.Writer
-	wb, err := w.Write(data)
+	wb, err := w.Write(obj.data)
 	if err != nil {
 		return fmt.Errorf("failed to write file data: %w", err)
 	}
 
-	if wb < len(data) {
+	if wb < len(obj.data) {
 		return ErrWriteIncomplete
 	}
 
@@ -63,15 +177,310 @@ func (s *MemoryStore) WriteObject(id string, r io.Reader) error {
 		return fmt.Errorf("failed to read bytes from request: %w", err)
 	}
 
-	// attempt to store it, fail if another writer beats us
-	_, loaded := s.objects.LoadOrStore(id, data)
+	obj := &memoryObject{
+		data:     data,
+		created:  time.Now(),
+		checksum: dataChecksum(data),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// fail if another writer beats us
+	_, loaded := s.objects.Load(id)
 	if loaded {
 		return ErrFileExists
 	}
 
+	if !IsInternal(id) {
+		err = s.reserve(int64(len(data)))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.persist(&memoryRecord{kind: memoryPut, name: id, data: data, created: obj.created})
+	if err != nil {
+		return err
+	}
+
+	s.add(id, obj)
+
 	log.Debug().
 		Str("file", id).
 		Msg(fmt.Sprintf("wrote %d bytes to memory", len(data)))
 
 	return nil
 }
+
+// ReplaceObject atomically replaces the data of an existing object
+func (s *MemoryStore) ReplaceObject(id string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read bytes from request: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.load(id)
+	if !ok {
+		return ErrFileDoesNotExist
+	}
+
+	delta := int64(len(data) - len(old.data))
+
+	// other objects are not evicted to make space for the new data
+	if old.element != nil && s.maxBytes > 0 && delta > 0 && s.stats.Bytes+delta > s.maxBytes {
+		s.stats.Rejections++
+		return ErrStorageFull
+	}
+
+	err = s.persist(&memoryRecord{kind: memoryPut, name: id, data: data, created: old.created})
+	if err != nil {
+		return err
+	}
+
+	s.objects.Store(id, &memoryObject{
+		data:     data,
+		created:  old.created,
+		checksum: dataChecksum(data),
+		element:  old.element,
+	})
+
+	if old.element != nil {
+		s.stats.Bytes += delta
+	}
+
+	log.Debug().
+		Str("file", id).
+		Msg(fmt.Sprintf("replaced file with %d bytes in memory", len(data)))
+
+	return nil
+}
+
+// StatObject returns information about a stored object
+func (s *MemoryStore) StatObject(id string) (*ObjectInfo, error) {
+	obj, ok := s.load(id)
+	if !ok {
+		return nil, ErrFileDoesNotExist
+	}
+
+	return obj.info(id), nil
+}
+
+// ListObjects lists stored objects in name order that match the prefix
+// and come after the specified name, up to a limit
+func (s *MemoryStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+
+	s.objects.Range(func(key, value interface{}) bool {
+		obj, ok := value.(*memoryObject)
+		if ok {
+			objects = append(objects, obj.info(key.(string)))
+		}
+		return true
+	})
+
+	return listPage(objects, prefix, after, limit), nil
+}
+
+// DeleteObject removes an object from memory
+func (s *MemoryStore) DeleteObject(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.objects.Load(id)
+	if !ok {
+		return ErrFileDoesNotExist
+	}
+
+	err := s.persist(&memoryRecord{kind: memoryDelete, name: id})
+	if err != nil {
+		return err
+	}
+
+	s.objects.Delete(id)
+	s.removed(value)
+
+	log.Debug().
+		Str("file", id).
+		Msg("deleted file from memory")
+
+	return nil
+}
+
+// OnEvict registers a function that is called with the id of each object that
+// is evicted. It is called while the store is locked, so must not use the store
+func (s *MemoryStore) OnEvict(fn func(id string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evicted = append(s.evicted, fn)
+}
+
+// Stats returns the current usage of the store
+func (s *MemoryStore) Stats() MemoryStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.MaxBytes = s.maxBytes
+	stats.MaxObjects = s.maxObjects
+
+	return stats
+}
+
+// reserve makes space for a new object of the specified size,
+// evicting objects if the store's eviction policy allows it
+func (s *MemoryStore) reserve(size int64) error {
+	if !s.full(size, 1) {
+		return nil
+	}
+
+	// reject objects that could never fit, rather than evicting everything
+	if s.eviction == EvictNone || (s.maxBytes > 0 && size > s.maxBytes) {
+		s.stats.Rejections++
+		return ErrStorageFull
+	}
+
+	return s.evict(size, 1)
+}
+
+// full reports whether adding the specified number of objects
+// and bytes would exceed the store's limits
+func (s *MemoryStore) full(size, count int64) bool {
+	return (s.maxBytes > 0 && s.stats.Bytes+size > s.maxBytes) ||
+		(s.maxObjects > 0 && s.stats.Objects+count > s.maxObjects)
+}
+
+// evict removes objects until the specified number of
+// objects and bytes can be added without exceeding the limits
+func (s *MemoryStore) evict(size, count int64) error {
+	for s.full(size, count) {
+		// the least recently used or oldest object is at the back.
+		// internal objects are not in the order, so are never evicted
+		e := s.order.Back()
+		if e == nil {
+			break
+		}
+
+		id := e.Value.(string)
+
+		value, ok := s.objects.Load(id)
+		if !ok {
+			s.order.Remove(e)
+			continue
+		}
+
+		err := s.persist(&memoryRecord{kind: memoryDelete, name: id})
+		if err != nil {
+			return err
+		}
+
+		s.objects.Delete(id)
+		s.removed(value)
+		s.stats.Evictions++
+
+		// the metadata of an object is removed with it, rather
+		// than being left behind for an object that does not exist
+		mid := metadataID(id)
+
+		_, ok = s.objects.Load(mid)
+		if ok {
+			err = s.persist(&memoryRecord{kind: memoryDelete, name: mid})
+			if err != nil {
+				return err
+			}
+
+			s.objects.Delete(mid)
+		}
+
+		for _, fn := range s.evicted {
+			fn(id)
+		}
+
+		log.Debug().
+			Str("file", id).
+			Msg("evicted file from memory")
+	}
+
+	return nil
+}
+
+// persist writes a change to the store's log before it is applied
+func (s *MemoryStore) persist(rec *memoryRecord) error {
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.log.append(rec)
+	if err != nil {
+		return fmt.Errorf("failed to write to log: %w", err)
+	}
+
+	return nil
+}
+
+// add stores a new object, adding it to the eviction order and the store's
+// usage if it is not internal. This must be called while holding the lock
+func (s *MemoryStore) add(id string, obj *memoryObject) {
+	if !IsInternal(id) {
+		obj.element = s.order.PushFront(id)
+
+		s.stats.Objects++
+		s.stats.Bytes += int64(len(obj.data))
+	}
+
+	s.objects.Store(id, obj)
+}
+
+// removed updates the store's usage after an object has been removed
+func (s *MemoryStore) removed(value interface{}) {
+	obj, ok := value.(*memoryObject)
+	if !ok || obj.element == nil {
+		return
+	}
+
+	s.order.Remove(obj.element)
+
+	s.stats.Objects--
+	s.stats.Bytes -= int64(len(obj.data))
+}
+
+// touch marks an object as recently used
+func (s *MemoryStore) touch(obj *memoryObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// moving an object that has since been removed has no effect
+	if obj.element != nil {
+		s.order.MoveToFront(obj.element)
+	}
+}
+
+func (s *MemoryStore) load(id string) (*memoryObject, bool) {
+	value, ok := s.objects.Load(id)
+	if !ok {
+		return nil, false
+	}
+
+	obj, ok := value.(*memoryObject)
+
+	return obj, ok
+}
+
+func (o *memoryObject) info(id string) *ObjectInfo {
+	return &ObjectInfo{
+		Name:     id,
+		Size:     int64(len(o.data)),
+		Created:  o.created,
+		Checksum: o.checksum,
+	}
+}
+
+// dataChecksum returns the hex encoded SHA-256 checksum of an object's data
+func dataChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
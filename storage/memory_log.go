@@ -0,0 +1,565 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultSnapshotInterval the default time between snapshots of a persistent MemoryStore
+	DefaultSnapshotInterval = 5 * time.Minute
+	// the name of the snapshot file
+	memorySnapshotFile = "snapshot"
+	// the prefix of log files, which is followed by the log's sequence number
+	memoryLogPrefix = "log-"
+	// the magic bytes at the start of a snapshot
+	memorySnapshotMagic = "catlysnp"
+	// the size of a record's header
+	memoryRecordHeaderSize = 4 + 1 + 2 + 8 + 8
+	// the largest object a record can hold, used to detect corrupt records
+	memoryRecordMaxSize = 1 << 32
+)
+
+// the kinds of record that can be written to the log
+const (
+	memoryPut byte = iota
+	memoryDelete
+)
+
+// memoryRecord a change to a MemoryStore
+type memoryRecord struct {
+	kind    byte
+	name    string
+	data    []byte
+	created time.Time
+}
+
+// memoryLog an append-only log of the changes made to a MemoryStore
+type memoryLog struct {
+	dir string
+	seq uint64
+	fd  *os.File
+	// the size of the log's complete records
+	size int64
+}
+
+// OpenMemoryStore creates a new in-memory store that persists its objects to the specified
+// directory. Every write and delete is appended to a log, and a snapshot of all objects is
+// written periodically. The store's objects are restored from the latest snapshot and
+// any logs written since when it is opened
+func OpenMemoryStore(dir string, opts ...MemoryOption) (*MemoryStore, error) {
+	s := NewMemoryStore(append([]MemoryOption{WithSnapshotInterval(DefaultSnapshotInterval)}, opts...)...)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("storage base directory does not exist: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return nil, ErrDirectoryPathIsFile
+	}
+
+	err = s.restore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.snapshotInterval > 0 {
+		s.done = make(chan struct{})
+		s.snapshots.Add(1)
+
+		go s.snapshotPeriodically()
+	}
+
+	return s, nil
+}
+
+// Snapshot writes all objects to a new snapshot, removing any logs it replaces
+func (s *MemoryStore) Snapshot() error {
+	if s.log == nil {
+		return nil
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.mu.Lock()
+
+	records := make([]*memoryRecord, 0, s.order.Len())
+
+	// internal objects are not in the eviction order
+	s.objects.Range(func(key, value interface{}) bool {
+		obj, ok := value.(*memoryObject)
+		if ok && obj.element == nil {
+			records = append(records, &memoryRecord{
+				kind:    memoryPut,
+				name:    key.(string),
+				data:    obj.data,
+				created: obj.created,
+			})
+		}
+		return true
+	})
+
+	// objects are written in reverse eviction order, so the order
+	// is the same once they have been restored from the snapshot
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		id := e.Value.(string)
+
+		obj, ok := s.load(id)
+		if !ok {
+			continue
+		}
+
+		records = append(records, &memoryRecord{
+			kind:    memoryPut,
+			name:    id,
+			data:    obj.data,
+			created: obj.created,
+		})
+	}
+
+	// changes made after this point are written to a new log,
+	// which will be replayed after the snapshot is restored
+	seq := s.log.seq + 1
+
+	err := s.log.rotate(seq)
+
+	s.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to rotate log: %w", err)
+	}
+
+	err = writeSnapshot(s.log.dir, seq, records)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	err = removeLogs(s.log.dir, seq)
+	if err != nil {
+		return fmt.Errorf("failed to remove old logs: %w", err)
+	}
+
+	log.Debug().
+		Str("directory", s.log.dir).
+		Msg(fmt.Sprintf("wrote snapshot of %d files", len(records)))
+
+	return nil
+}
+
+// Close writes a final snapshot and closes the store's log
+func (s *MemoryStore) Close() error {
+	if s.log == nil {
+		return nil
+	}
+
+	if s.done != nil {
+		close(s.done)
+		s.snapshots.Wait()
+	}
+
+	err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.log.fd.Close()
+}
+
+func (s *MemoryStore) snapshotPeriodically() {
+	defer s.snapshots.Done()
+
+	ticker := time.NewTicker(s.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			err := s.Snapshot()
+			if err != nil {
+				log.Error().Msg(err.Error())
+			}
+		}
+	}
+}
+
+// restore loads the latest snapshot and replays any logs written since
+func (s *MemoryStore) restore(dir string) error {
+	seq, err := readSnapshot(dir, s.apply)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	logs, err := listLogs(dir)
+	if err != nil {
+		return err
+	}
+
+	next := seq
+
+	for i, ls := range logs {
+		// logs older than the snapshot are already included in it
+		if ls < seq {
+			continue
+		}
+
+		// only the newest log can have been torn by a crash
+		err = replayLog(dir, ls, i == len(logs)-1, s.apply)
+		if err != nil {
+			return fmt.Errorf("failed to replay log: %w", err)
+		}
+
+		next = ls + 1
+	}
+
+	s.log, err = openLog(dir, next)
+	if err != nil {
+		return err
+	}
+
+	// the limits may have been lowered since the objects were written
+	if s.eviction != EvictNone {
+		s.mu.Lock()
+		err = s.evict(0, 0)
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info().
+		Str("directory", dir).
+		Msg(fmt.Sprintf("restored %d files from disk", s.stats.Objects))
+
+	return nil
+}
+
+// apply applies a restored record to the store
+func (s *MemoryStore) apply(rec *memoryRecord) {
+	value, ok := s.objects.LoadAndDelete(rec.name)
+	if ok {
+		s.removed(value)
+	}
+
+	if rec.kind != memoryPut {
+		return
+	}
+
+	s.add(rec.name, &memoryObject{
+		data:     rec.data,
+		created:  rec.created,
+		checksum: dataChecksum(rec.data),
+	})
+}
+
+// append writes a record to the end of the log, syncing it to disk
+func (l *memoryLog) append(rec *memoryRecord) error {
+	buf := encodeRecord(rec)
+
+	_, err := l.fd.Write(buf)
+	if err == nil {
+		err = l.fd.Sync()
+	}
+
+	if err != nil {
+		// remove any partially written record, so records
+		// appended after it are not lost when it is replayed
+		l.fd.Truncate(l.size)
+		return err
+	}
+
+	l.size += int64(len(buf))
+
+	return nil
+}
+
+// rotate closes the current log and starts a new log with the specified sequence number
+func (l *memoryLog) rotate(seq uint64) error {
+	next, err := openLog(l.dir, seq)
+	if err != nil {
+		return err
+	}
+
+	l.fd.Close()
+
+	l.fd = next.fd
+	l.seq = seq
+	l.size = next.size
+
+	return nil
+}
+
+func openLog(dir string, seq uint64) (*memoryLog, error) {
+	fd, err := os.OpenFile(logPath(dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	return &memoryLog{
+		dir:  dir,
+		seq:  seq,
+		fd:   fd,
+		size: info.Size(),
+	}, nil
+}
+
+func logPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d", memoryLogPrefix, seq))
+}
+
+// listLogs returns the sequence numbers of all logs in a directory in order
+func listLogs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	var logs []uint64
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), memoryLogPrefix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimPrefix(e.Name(), memoryLogPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		logs = append(logs, seq)
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i] < logs[j]
+	})
+
+	return logs, nil
+}
+
+// removeLogs removes all logs older than the specified sequence number
+func removeLogs(dir string, seq uint64) error {
+	logs, err := listLogs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, ls := range logs {
+		if ls >= seq {
+			break
+		}
+
+		err = os.Remove(logPath(dir, ls))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayLog applies each record of a log. A torn or corrupt record at the end of
+// the newest log, left by a crash while it was being written, is truncated. Any
+// other corrupt record fails the replay, as the records after it would be lost
+func replayLog(dir string, seq uint64, newest bool, apply func(rec *memoryRecord)) error {
+	path := logPath(dir, seq)
+
+	fd, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+
+	var offset int64
+
+	for {
+		rec, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			// a torn record is the last in the log
+			rest, _ := io.Copy(io.Discard, r)
+
+			if !newest || rest > 0 {
+				return fmt.Errorf("log %s is corrupt at offset %d: %w", path, offset, err)
+			}
+
+			log.Warn().
+				Str("log", path).
+				Msg(fmt.Sprintf("truncating log at offset %d: %s", offset, err.Error()))
+
+			return fd.Truncate(offset)
+		}
+
+		apply(rec)
+
+		offset += n
+	}
+}
+
+// writeSnapshot atomically writes a snapshot containing the specified records
+func writeSnapshot(dir string, seq uint64, records []*memoryRecord) error {
+	tmp, err := os.CreateTemp(dir, memorySnapshotFile+"-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+
+	header := make([]byte, len(memorySnapshotMagic)+8)
+	copy(header, memorySnapshotMagic)
+	binary.BigEndian.PutUint64(header[len(memorySnapshotMagic):], seq)
+
+	w.Write(header)
+
+	for _, rec := range records {
+		w.Write(encodeRecord(rec))
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, memorySnapshotFile))
+}
+
+// readSnapshot applies each record of the snapshot, returning the sequence number
+// of the first log written after it. If there is no snapshot, zero is returned
+func readSnapshot(dir string, apply func(rec *memoryRecord)) (uint64, error) {
+	fd, err := os.Open(filepath.Join(dir, memorySnapshotFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+
+	header := make([]byte, len(memorySnapshotMagic)+8)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:len(memorySnapshotMagic)]) != memorySnapshotMagic {
+		return 0, errors.New("snapshot is corrupt")
+	}
+
+	for {
+		rec, _, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		// snapshots are written atomically, so unlike
+		// the log, they should never contain a torn record
+		if err != nil {
+			return 0, fmt.Errorf("snapshot is corrupt: %w", err)
+		}
+
+		apply(rec)
+	}
+
+	return binary.BigEndian.Uint64(header[len(memorySnapshotMagic):]), nil
+}
+
+// encodeRecord encodes a record, prefixed with a checksum of its contents
+func encodeRecord(rec *memoryRecord) []byte {
+	buf := make([]byte, memoryRecordHeaderSize+len(rec.name)+len(rec.data))
+
+	buf[4] = rec.kind
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(rec.name)))
+	binary.BigEndian.PutUint64(buf[7:], uint64(len(rec.data)))
+	binary.BigEndian.PutUint64(buf[15:], uint64(rec.created.UnixNano()))
+
+	copy(buf[memoryRecordHeaderSize:], rec.name)
+	copy(buf[memoryRecordHeaderSize+len(rec.name):], rec.data)
+
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], packCRCTable))
+
+	return buf
+}
+
+// readRecord reads and verifies the next record, returning the number of bytes read.
+// io.EOF is only returned if there are no more records
+func readRecord(r *bufio.Reader) (*memoryRecord, int64, error) {
+	header := make([]byte, memoryRecordHeaderSize)
+
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errors.New("incomplete record")
+	}
+
+	nameLen := int(binary.BigEndian.Uint16(header[5:]))
+	dataLen := binary.BigEndian.Uint64(header[7:])
+
+	if dataLen > memoryRecordMaxSize {
+		return nil, 0, errors.New("invalid record size")
+	}
+
+	body := make([]byte, nameLen+int(dataLen))
+
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, 0, errors.New("incomplete record")
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:], packCRCTable), packCRCTable, body)
+	if crc != binary.BigEndian.Uint32(header) {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+
+	rec := &memoryRecord{
+		kind:    header[4],
+		name:    string(body[:nameLen]),
+		data:    body[nameLen:],
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(header[15:]))),
+	}
+
+	return rec, int64(memoryRecordHeaderSize + len(body)), nil
+}
@@ -2,6 +2,10 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -17,7 +21,7 @@ func newTestMemoryStore(t *testing.T) *MemoryStore {
 func TestMemoryStorageReadFile(t *testing.T) {
 	fs := newTestMemoryStore(t)
 
-	fs.objects.Store("cat.jpg", []byte("meow"))
+	fs.objects.Store("cat.jpg", &memoryObject{data: []byte("meow")})
 
 	var b bytes.Buffer
 
@@ -48,9 +52,9 @@ func TestMemoryStorageWriteFile(t *testing.T) {
 	value, ok := fs.objects.Load("cat.jpg")
 	require.True(t, ok)
 
-	data, ok := value.([]byte)
+	obj, ok := value.(*memoryObject)
 	require.True(t, ok)
-	assert.Equal(t, []byte("meow"), data)
+	assert.Equal(t, []byte("meow"), obj.data)
 }
 
 func TestMemoryStorageWriteConcurrentConflict(t *testing.T) {
@@ -83,10 +87,440 @@ func TestMemoryStorageWriteConcurrentConflict(t *testing.T) {
 	value, ok := fs.objects.Load("cat.jpg")
 	require.True(t, ok)
 
-	data, ok := value.([]byte)
+	obj, ok := value.(*memoryObject)
 	require.True(t, ok)
-	assert.Equal(t, []byte("meow"), data)
+	assert.Equal(t, []byte("meow"), obj.data)
 
 	// check the other 99 requests failed
 	assert.Equal(t, int64(99), errorCount)
 }
+
+func TestMemoryStorageStatFile(t *testing.T) {
+	fs := newTestMemoryStore(t)
+
+	err := fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	info, err := fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.False(t, info.Created.IsZero())
+	assert.Equal(t, checksum([]byte("meow")), info.Checksum)
+
+	_, err = fs.StatObject("invisible-cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestMemoryStorageListFiles(t *testing.T) {
+	fs := newTestMemoryStore(t)
+
+	for _, name := range []string{"cat-3.jpg", "cat-1.jpg", "dog.jpg", "cat-2.jpg"} {
+		err := fs.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	objects, err := fs.ListObjects("cat-", "", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "cat-1.jpg", objects[0].Name)
+	assert.Equal(t, "cat-2.jpg", objects[1].Name)
+
+	objects, err = fs.ListObjects("cat-", objects[1].Name, 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cat-3.jpg", objects[0].Name)
+
+	objects, err = fs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 4)
+}
+
+func TestMemoryStorageDeleteFile(t *testing.T) {
+	fs := newTestMemoryStore(t)
+
+	err := fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = fs.DeleteObject("cat.jpg")
+	require.NoError(t, err)
+
+	_, ok := fs.objects.Load("cat.jpg")
+	assert.False(t, ok)
+
+	err = fs.DeleteObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	// the name can be reused once deleted
+	err = fs.WriteObject("cat.jpg", bytes.NewReader([]byte("purr")))
+	require.NoError(t, err)
+}
+
+func TestMemoryStorageLimitReject(t *testing.T) {
+	fs := NewMemoryStore(WithMaxBytes(10), WithMaxObjects(2))
+
+	err := fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	// exceeds the byte limit
+	err = fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("meow meow")))
+	require.Equal(t, ErrStorageFull, err)
+
+	err = fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	// exceeds the object limit
+	err = fs.WriteObject("cat-3.jpg", bytes.NewReader([]byte("m")))
+	require.Equal(t, ErrStorageFull, err)
+
+	assert.Equal(t, MemoryStats{
+		Objects:    2,
+		Bytes:      8,
+		MaxObjects: 2,
+		MaxBytes:   10,
+		Rejections: 2,
+	}, fs.Stats())
+
+	// deleting frees up space
+	require.NoError(t, fs.DeleteObject("cat-1.jpg"))
+
+	err = fs.WriteObject("cat-3.jpg", bytes.NewReader([]byte("m")))
+	require.NoError(t, err)
+
+	stats := fs.Stats()
+	assert.Equal(t, int64(2), stats.Objects)
+	assert.Equal(t, int64(5), stats.Bytes)
+}
+
+func TestMemoryStorageEvictLRU(t *testing.T) {
+	fs := NewMemoryStore(WithMaxObjects(2), WithEvictionPolicy(EvictLRU))
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("meow"))))
+
+	// reading the first object makes the second the least recently used
+	var b bytes.Buffer
+	require.NoError(t, fs.ReadObject("cat-1.jpg", &b))
+
+	require.NoError(t, fs.WriteObject("cat-3.jpg", bytes.NewReader([]byte("meow"))))
+
+	_, err := fs.StatObject("cat-2.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	_, err = fs.StatObject("cat-1.jpg")
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(1), fs.Stats().Evictions)
+}
+
+func TestMemoryStorageEvictOldest(t *testing.T) {
+	fs := NewMemoryStore(WithMaxBytes(8), WithEvictionPolicy(EvictOldest))
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("meow"))))
+
+	// reads do not affect the order objects are evicted in
+	var b bytes.Buffer
+	require.NoError(t, fs.ReadObject("cat-1.jpg", &b))
+
+	// evicts both objects to make space
+	require.NoError(t, fs.WriteObject("cat-3.jpg", bytes.NewReader([]byte("meowww"))))
+
+	_, err := fs.StatObject("cat-1.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	_, err = fs.StatObject("cat-2.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	stats := fs.Stats()
+	assert.Equal(t, int64(2), stats.Evictions)
+	assert.Equal(t, int64(1), stats.Objects)
+	assert.Equal(t, int64(6), stats.Bytes)
+
+	// objects larger than the limit are rejected without evicting anything
+	err = fs.WriteObject("cat-4.jpg", bytes.NewReader(make([]byte, 9)))
+	require.Equal(t, ErrStorageFull, err)
+
+	_, err = fs.StatObject("cat-3.jpg")
+	assert.NoError(t, err)
+}
+
+func TestMemoryStorageEvictInternal(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir, WithMaxObjects(2), WithEvictionPolicy(EvictOldest))
+
+	b := NewBuckets(fs)
+	require.NoError(t, b.CreateBucket(&Bucket{Name: "cats", Visibility: VisibilityPrivate}))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, fs.WriteObject(fmt.Sprintf("cats/cat-%d.jpg", i), bytes.NewReader([]byte("meow"))))
+	}
+
+	// internal objects are not counted against the limits, or evicted
+	stats := fs.Stats()
+	assert.Equal(t, int64(3), stats.Evictions)
+	assert.Equal(t, int64(2), stats.Objects)
+
+	b.Purge()
+
+	bucket, err := b.Bucket("cats")
+	require.NoError(t, err)
+	assert.Equal(t, VisibilityPrivate, bucket.Visibility)
+
+	// and are kept in snapshots
+	require.NoError(t, fs.Close())
+
+	fs = openTestMemoryStore(t, dir, WithMaxObjects(2), WithEvictionPolicy(EvictOldest))
+	defer fs.Close()
+
+	bucket, err = NewBuckets(fs).Bucket("cats")
+	require.NoError(t, err)
+	assert.Equal(t, VisibilityPrivate, bucket.Visibility)
+	assert.Equal(t, int64(2), fs.Stats().Objects)
+}
+
+func openTestMemoryStore(t *testing.T, dir string, opts ...MemoryOption) *MemoryStore {
+	fs, err := OpenMemoryStore(dir, append([]MemoryOption{WithSnapshotInterval(0)}, opts...)...)
+	require.NoError(t, err)
+	return fs
+}
+
+// crash closes the store's log without writing a snapshot
+func crash(fs *MemoryStore) {
+	fs.log.fd.Close()
+}
+
+func TestMemoryStoragePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+	require.NoError(t, fs.DeleteObject("cat-1.jpg"))
+
+	before, err := fs.StatObject("cat-2.jpg")
+	require.NoError(t, err)
+
+	require.NoError(t, fs.Close())
+
+	// closing the store replaces the log with a snapshot
+	logs, err := listLogs(dir)
+	require.NoError(t, err)
+	assert.Len(t, logs, 1)
+
+	fs = openTestMemoryStore(t, dir)
+	defer fs.Close()
+
+	_, err = fs.StatObject("cat-1.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	var b bytes.Buffer
+
+	require.NoError(t, fs.ReadObject("cat-2.jpg", &b))
+	assert.Equal(t, []byte("purr"), b.Bytes())
+
+	after, err := fs.StatObject("cat-2.jpg")
+	require.NoError(t, err)
+	assert.True(t, before.Created.Equal(after.Created))
+
+	assert.Equal(t, int64(1), fs.Stats().Objects)
+}
+
+func TestMemoryStoragePersistenceReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+	require.NoError(t, fs.Snapshot())
+
+	// changes made after the snapshot are only in the log
+	require.NoError(t, fs.DeleteObject("cat-1.jpg"))
+	require.NoError(t, fs.WriteObject("cat-3.jpg", bytes.NewReader([]byte("hiss"))))
+
+	crash(fs)
+
+	fs = openTestMemoryStore(t, dir)
+	defer fs.Close()
+
+	_, err := fs.StatObject("cat-1.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	for name, data := range map[string]string{"cat-2.jpg": "purr", "cat-3.jpg": "hiss"} {
+		var b bytes.Buffer
+		require.NoError(t, fs.ReadObject(name, &b))
+		assert.Equal(t, []byte(data), b.Bytes())
+	}
+}
+
+func TestMemoryStoragePersistenceTornLog(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+
+	path := fs.log.fd.Name()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	crash(fs)
+
+	// simulate a crash while a record was being written
+	rec := encodeRecord(&memoryRecord{kind: memoryPut, name: "cat-2.jpg", data: []byte("purr")})
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = fd.Write(rec[:len(rec)-2])
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	fs = openTestMemoryStore(t, dir)
+	defer fs.Close()
+
+	torn, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), torn.Size())
+
+	_, err = fs.StatObject("cat-1.jpg")
+	assert.NoError(t, err)
+
+	_, err = fs.StatObject("cat-2.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+}
+
+func TestMemoryStoragePersistenceCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+
+	path := fs.log.fd.Name()
+
+	crash(fs)
+
+	// flip a bit in the last record's data
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0x01
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	fs = openTestMemoryStore(t, dir)
+	defer fs.Close()
+
+	_, err = fs.StatObject("cat-1.jpg")
+	assert.NoError(t, err)
+
+	_, err = fs.StatObject("cat-2.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestMemoryStoragePersistenceCorruptLog(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+
+	path := fs.log.fd.Name()
+
+	crash(fs)
+
+	// flip a bit in the first record's data, which is followed by another record
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[memoryRecordHeaderSize+len("cat-1.jpg")] ^= 0x01
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	_, err = OpenMemoryStore(dir, WithSnapshotInterval(0))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "record checksum mismatch")
+
+	// the log is left as it was, rather than truncated
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, after)
+}
+
+func TestMemoryStoragePersistenceCorruptOlderLog(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+
+	older := fs.log.fd.Name()
+
+	crash(fs)
+
+	// reopening the store starts a new log
+	fs = openTestMemoryStore(t, dir)
+
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+
+	crash(fs)
+
+	// only the newest log can be torn, so a bad record at the end of an older log is corrupt
+	data, err := os.ReadFile(older)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(older, data[:len(data)-2], 0644))
+
+	_, err = OpenMemoryStore(dir, WithSnapshotInterval(0))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "incomplete record")
+}
+
+func TestMemoryStoragePersistenceEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := openTestMemoryStore(t, dir, WithMaxObjects(1), WithEvictionPolicy(EvictOldest))
+
+	require.NoError(t, fs.WriteObject("cat-1.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cat-2.jpg", bytes.NewReader([]byte("purr"))))
+
+	crash(fs)
+
+	// evicted objects should not be restored
+	fs = openTestMemoryStore(t, dir)
+	defer fs.Close()
+
+	_, err := fs.StatObject("cat-1.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	assert.Equal(t, int64(1), fs.Stats().Objects)
+
+	_, err = os.Stat(filepath.Join(dir, memorySnapshotFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemoryStorageReplaceFile(t *testing.T) {
+	fs := NewMemoryStore(WithMaxBytes(8))
+
+	err := fs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = fs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr!")))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	err = fs.ReadObject("cat.jpg", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "purr!", buf.String())
+
+	// the replaced data must still fit within the limits
+	err = fs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr purr purr")))
+	require.True(t, errors.Is(err, ErrStorageFull))
+}
@@ -0,0 +1,644 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the prefix of the objects that hold the metadata of each object
+const metadataPrefix = ".metadata/"
+
+// Metadata describes an object and the tags it was uploaded with
+type Metadata struct {
+	// Name the id of the object the metadata describes
+	Name string `json:"name"`
+	// Owner the principal that uploaded the object. It is empty
+	// if the object was uploaded by an unauthenticated client
+	Owner string `json:"owner,omitempty"`
+	// ContentType the content type of the object's data
+	ContentType string `json:"content_type"`
+	// Size the size of the object's data in bytes
+	Size int64 `json:"size"`
+	// Created the time the object was uploaded
+	Created time.Time `json:"created"`
+	// Description a free text description of the object
+	Description string `json:"description,omitempty"`
+	// Tags user defined key/value tags
+	Tags map[string]string `json:"tags,omitempty"`
+	// PerceptualHash the hex encoded 64 bit perceptual hash of the object's
+	// image, which is empty if the image could not be hashed
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+}
+
+// SimilarObject an object that looks similar to another
+type SimilarObject struct {
+	// Metadata the metadata of the similar object
+	Metadata *Metadata
+	// Distance the number of bits the perceptual hashes of the objects differ by
+	Distance int
+}
+
+// Hasher computes the perceptual hash of an image
+type Hasher func(r io.Reader) (string, error)
+
+// IndexOption configures optional behaviour of an index
+type IndexOption func(x *Index)
+
+// WithHasher sets the hasher used to compute the perceptual hashes of
+// objects that are indexed without one when the index is rebuilt
+func WithHasher(hasher Hasher) IndexOption {
+	return func(x *Index) {
+		x.hasher = hasher
+	}
+}
+
+// Query filters the objects returned by a search. Filters that are
+// not set match every object, and objects must match every filter
+type Query struct {
+	// Bucket only match objects in the bucket
+	Bucket string
+	// Tags only match objects with every tag. A tag with
+	// an empty value matches any value of the tag
+	Tags map[string]string
+	// Owner only match objects uploaded by the principal
+	Owner string
+	// ContentType only match objects of the content type
+	ContentType string
+	// MinSize only match objects of at least the size in bytes
+	MinSize int64
+	// MaxSize only match objects of at most the size in bytes
+	MaxSize int64
+	// CreatedAfter only match objects uploaded at or after the time
+	CreatedAfter time.Time
+	// CreatedBefore only match objects uploaded before the time
+	CreatedBefore time.Time
+	// After only match objects with ids that sort after this id
+	After string
+	// Limit the maximum number of objects to return. Zero is unlimited
+	Limit int
+}
+
+// Index holds the metadata of every object in memory so it can be searched.
+// The metadata of each object is also stored as an object, so the index can
+// be rebuilt from storage and is replicated, encrypted and migrated along
+// with the objects it describes
+type Index struct {
+	store   Store
+	hasher  Hasher
+	mu      sync.RWMutex
+	objects map[string]*Metadata
+	// tags maps each tag key and value to the ids of the objects with the tag
+	tags map[string]map[string]map[string]struct{}
+	// hashes maps the ids of objects to their perceptual hashes
+	hashes map[string]uint64
+	// changes records the metadata put or deleted while the index is being
+	// rebuilt, so they can be applied to the rebuilt index. deleted objects
+	// are recorded as nil
+	changes map[string]*Metadata
+}
+
+// NewIndex creates a new, empty index of the metadata held in a store
+func NewIndex(store Store, opts ...IndexOption) *Index {
+	x := &Index{
+		store:   store,
+		objects: make(map[string]*Metadata),
+		tags:    make(map[string]map[string]map[string]struct{}),
+		hashes:  make(map[string]uint64),
+	}
+
+	for _, opt := range opts {
+		opt(x)
+	}
+
+	return x
+}
+
+// PutMetadata stores the metadata of an object and adds it to the index
+func (x *Index) PutMetadata(md *Metadata) error {
+	err := x.storeMetadata(md)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.put(copyMetadata(md))
+
+	return nil
+}
+
+// storeMetadata writes the metadata of an object to storage
+func (x *Index) storeMetadata(md *Metadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	id := metadataID(md.Name)
+
+	err = x.store.WriteObject(id, bytes.NewReader(data))
+	if errors.Is(err, ErrFileExists) {
+		// metadata may be left behind if an object was not deleted cleanly
+		err = x.store.DeleteObject(id)
+		if err == nil {
+			err = x.store.WriteObject(id, bytes.NewReader(data))
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+
+	return nil
+}
+
+// Metadata returns the indexed metadata of an object
+func (x *Index) Metadata(id string) (*Metadata, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	md, ok := x.objects[id]
+	if !ok {
+		return nil, ErrFileDoesNotExist
+	}
+
+	return copyMetadata(md), nil
+}
+
+// DeleteMetadata deletes the metadata of an object and removes it from the index
+func (x *Index) DeleteMetadata(id string) error {
+	x.mu.Lock()
+	x.delete(id)
+	x.mu.Unlock()
+
+	err := x.store.DeleteObject(metadataID(id))
+	if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+
+	return nil
+}
+
+// Evicted removes an object that has been evicted from storage from the index.
+// The stored metadata of an evicted object is removed along with it by the store
+func (x *Index) Evicted(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.delete(id)
+}
+
+// Len returns the number of objects in the index
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return len(x.objects)
+}
+
+// Search returns the metadata of the objects matching the query in id order
+func (x *Index) Search(q *Query) []*Metadata {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	candidates := x.objects
+
+	// start with the objects that have the least common of the queried tags
+	for key, value := range q.Tags {
+		ids := x.tagged(key, value)
+
+		if len(ids) < len(candidates) {
+			candidates = make(map[string]*Metadata, len(ids))
+
+			for id := range ids {
+				candidates[id] = x.objects[id]
+			}
+		}
+	}
+
+	results := make([]*Metadata, 0, len(candidates))
+
+	for id, md := range candidates {
+		if id > q.After && q.matches(md) {
+			results = append(results, md)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+
+	for i := range results {
+		results[i] = copyMetadata(results[i])
+	}
+
+	return results
+}
+
+// Similar returns the objects with perceptual hashes that differ from the hash by
+// no more than the maximum distance, closest first. If limit is greater than zero,
+// no more than limit objects will be returned. The object with the excluded id,
+// such as the object the hash was computed from, is not returned
+func (x *Index) Similar(hash string, maxDistance, limit int, exclude string) ([]*SimilarObject, error) {
+	h, err := parseHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var similar []*SimilarObject
+
+	for id, other := range x.hashes {
+		distance := bits.OnesCount64(h ^ other)
+
+		if id != exclude && distance <= maxDistance {
+			similar = append(similar, &SimilarObject{
+				Metadata: x.objects[id],
+				Distance: distance,
+			})
+		}
+	}
+
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Metadata.Name < similar[j].Metadata.Name
+	})
+
+	if limit > 0 && len(similar) > limit {
+		similar = similar[:limit]
+	}
+
+	for _, s := range similar {
+		s.Metadata = copyMetadata(s.Metadata)
+	}
+
+	return similar, nil
+}
+
+// Rebuild rebuilds the index from the metadata held in storage. Objects that
+// have no stored metadata, such as those uploaded before metadata was recorded,
+// are indexed from their name, size and creation time, and metadata that no
+// longer has an object is deleted. If the index has a hasher, the perceptual
+// hashes of objects that do not have one are computed and stored
+func (x *Index) Rebuild(ctx context.Context) error {
+	x.mu.Lock()
+	x.changes = make(map[string]*Metadata)
+	x.mu.Unlock()
+
+	defer func() {
+		x.mu.Lock()
+		x.changes = nil
+		x.mu.Unlock()
+	}()
+
+	stored := make(map[string]*Metadata)
+
+	err := x.eachMetadata(ctx, func(id string, md *Metadata) {
+		stored[id] = md
+	})
+
+	if err != nil {
+		return err
+	}
+
+	rebuilt := NewIndex(x.store)
+
+	var unhashed []*Metadata
+
+	err = eachObject(ctx, x.store, func(info *ObjectInfo) {
+		if IsInternal(info.Name) {
+			return
+		}
+
+		md, ok := stored[info.Name]
+		if !ok {
+			md = ObjectMetadata(info)
+		}
+
+		delete(stored, info.Name)
+
+		rebuilt.put(md)
+
+		if md.PerceptualHash == "" {
+			unhashed = append(unhashed, md)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if x.hasher != nil {
+		for _, md := range unhashed {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			x.hash(md)
+		}
+	}
+
+	// objects uploaded while the index was being rebuilt may not have been listed
+	x.mu.RLock()
+	for id := range x.changes {
+		delete(stored, id)
+	}
+	x.mu.RUnlock()
+
+	for id := range stored {
+		log.Debug().Str("file", id).Msg("deleting metadata of missing object")
+
+		err = x.store.DeleteObject(metadataID(id))
+		if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+			return fmt.Errorf("failed to delete metadata: %w", err)
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for id, md := range x.changes {
+		if md != nil {
+			rebuilt.put(md)
+		} else {
+			rebuilt.delete(id)
+		}
+	}
+
+	// the hashes computed since the objects were put in the rebuilt index
+	for _, md := range unhashed {
+		if md.PerceptualHash != "" && rebuilt.objects[md.Name] == md {
+			rebuilt.put(md)
+		}
+	}
+
+	x.objects = rebuilt.objects
+	x.tags = rebuilt.tags
+	x.hashes = rebuilt.hashes
+
+	log.Info().Msg(fmt.Sprintf("indexed metadata of %d objects", len(x.objects)))
+
+	return nil
+}
+
+// hash computes and stores the perceptual hash of an object. Objects
+// that cannot be hashed, such as those that have been deleted, are skipped
+func (x *Index) hash(md *Metadata) {
+	var buf bytes.Buffer
+
+	err := x.store.ReadObject(md.Name, &buf)
+	if err != nil {
+		log.Debug().Str("file", md.Name).Msg(fmt.Sprintf("failed to read object to hash: %s", err.Error()))
+		return
+	}
+
+	hash, err := x.hasher(&buf)
+	if err != nil {
+		log.Debug().Str("file", md.Name).Msg(fmt.Sprintf("failed to hash object: %s", err.Error()))
+		return
+	}
+
+	md.PerceptualHash = hash
+
+	err = x.storeMetadata(md)
+	if err != nil {
+		log.Warn().Str("file", md.Name).Msg(fmt.Sprintf("failed to store perceptual hash: %s", err.Error()))
+	}
+}
+
+// eachMetadata calls fn with the metadata of every object held in storage
+func (x *Index) eachMetadata(ctx context.Context, fn func(id string, md *Metadata)) error {
+	var after string
+
+	for {
+		objects, err := x.store.ListObjects(metadataPrefix, after, listBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to list metadata: %w", err)
+		}
+
+		for _, info := range objects {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			id, err := url.PathUnescape(strings.TrimPrefix(info.Name, metadataPrefix))
+			if err != nil {
+				continue
+			}
+
+			var buf bytes.Buffer
+
+			err = x.store.ReadObject(info.Name, &buf)
+			if err != nil {
+				// the metadata may have been deleted since it was listed
+				if errors.Is(err, ErrFileDoesNotExist) {
+					continue
+				}
+				return fmt.Errorf("failed to read metadata: %w", err)
+			}
+
+			md := &Metadata{}
+
+			err = json.Unmarshal(buf.Bytes(), md)
+			if err != nil {
+				log.Warn().Str("file", id).Msg(fmt.Sprintf("failed to decode metadata: %s", err.Error()))
+				continue
+			}
+
+			md.Name = id
+
+			fn(id, md)
+		}
+
+		if len(objects) < listBatchSize {
+			return ctx.Err()
+		}
+
+		after = objects[len(objects)-1].Name
+	}
+}
+
+// put adds metadata to the index, replacing any existing metadata for the object
+func (x *Index) put(md *Metadata) {
+	x.delete(md.Name)
+
+	x.objects[md.Name] = md
+
+	for key, value := range md.Tags {
+		values, ok := x.tags[key]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			x.tags[key] = values
+		}
+
+		ids, ok := values[value]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[value] = ids
+		}
+
+		ids[md.Name] = struct{}{}
+	}
+
+	if md.PerceptualHash != "" {
+		hash, err := parseHash(md.PerceptualHash)
+		if err == nil {
+			x.hashes[md.Name] = hash
+		}
+	}
+
+	if x.changes != nil {
+		x.changes[md.Name] = md
+	}
+}
+
+// delete removes the metadata of an object from the index
+func (x *Index) delete(id string) {
+	if x.changes != nil {
+		x.changes[id] = nil
+	}
+
+	md, ok := x.objects[id]
+	if !ok {
+		return
+	}
+
+	delete(x.objects, id)
+	delete(x.hashes, id)
+
+	for key, value := range md.Tags {
+		delete(x.tags[key][value], id)
+
+		if len(x.tags[key][value]) == 0 {
+			delete(x.tags[key], value)
+		}
+
+		if len(x.tags[key]) == 0 {
+			delete(x.tags, key)
+		}
+	}
+}
+
+// tagged returns the ids of the objects with a tag. If the value
+// is empty, objects with any value for the tag are returned
+func (x *Index) tagged(key, value string) map[string]struct{} {
+	if value != "" {
+		return x.tags[key][value]
+	}
+
+	if len(x.tags[key]) == 1 {
+		for _, ids := range x.tags[key] {
+			return ids
+		}
+	}
+
+	all := make(map[string]struct{})
+
+	for _, ids := range x.tags[key] {
+		for id := range ids {
+			all[id] = struct{}{}
+		}
+	}
+
+	return all
+}
+
+// matches reports whether an object's metadata matches every filter of the query
+func (q *Query) matches(md *Metadata) bool {
+	if q.Bucket != "" {
+		bucket, _ := SplitObjectID(md.Name)
+		if bucket != q.Bucket {
+			return false
+		}
+	}
+
+	for key, value := range q.Tags {
+		v, ok := md.Tags[key]
+		if !ok || (value != "" && v != value) {
+			return false
+		}
+	}
+
+	switch {
+	case q.Owner != "" && md.Owner != q.Owner:
+		return false
+	case q.ContentType != "" && md.ContentType != q.ContentType:
+		return false
+	case q.MinSize > 0 && md.Size < q.MinSize:
+		return false
+	case q.MaxSize > 0 && md.Size > q.MaxSize:
+		return false
+	case !q.CreatedAfter.IsZero() && md.Created.Before(q.CreatedAfter):
+		return false
+	case !q.CreatedBefore.IsZero() && !md.Created.Before(q.CreatedBefore):
+		return false
+	}
+
+	return true
+}
+
+// parseHash parses a hex encoded perceptual hash
+func parseHash(hash string) (uint64, error) {
+	h, err := strconv.ParseUint(hash, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid perceptual hash '%s'", hash)
+	}
+
+	return h, nil
+}
+
+// metadataID returns the id that an object's metadata is stored with. The
+// object's id is escaped, so the metadata of objects in buckets is not nested
+func metadataID(id string) string {
+	return metadataPrefix + url.PathEscape(id)
+}
+
+// ObjectMetadata returns the metadata of an object from its name, size and creation time
+func ObjectMetadata(info *ObjectInfo) *Metadata {
+	_, name := SplitObjectID(info.Name)
+
+	return &Metadata{
+		Name:        info.Name,
+		ContentType: mime.TypeByExtension(filepath.Ext(name)),
+		Size:        info.Size,
+		Created:     info.Created,
+	}
+}
+
+func copyMetadata(md *Metadata) *Metadata {
+	c := *md
+
+	if md.Tags != nil {
+		c.Tags = make(map[string]string, len(md.Tags))
+
+		for key, value := range md.Tags {
+			c.Tags[key] = value
+		}
+	}
+
+	return &c
+}
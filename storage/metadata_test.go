@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func names(results []*Metadata) []string {
+	n := make([]string, len(results))
+
+	for i, md := range results {
+		n[i] = md.Name
+	}
+
+	return n
+}
+
+func TestIndexSearch(t *testing.T) {
+	ms := NewMemoryStore()
+	x := NewIndex(ms)
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	objects := []*Metadata{
+		{Name: "cat.jpg", Owner: "team-cats", ContentType: "image/jpeg", Size: 100, Created: now.Add(-time.Hour), Tags: map[string]string{"grumpy": "", "colour": "orange"}},
+		{Name: "kitten.png", Owner: "team-cats", ContentType: "image/png", Size: 200, Created: now.Add(-48 * time.Hour), Tags: map[string]string{"colour": "black"}},
+		{Name: "cats/tabby.jpg", Owner: "team-dogs", ContentType: "image/jpeg", Size: 300, Created: now, Tags: map[string]string{"grumpy": "very"}, Description: "a very grumpy cat"},
+		{Name: "dog.gif", ContentType: "image/gif", Size: 400, Created: now.Add(-8 * 24 * time.Hour)},
+	}
+
+	for _, md := range objects {
+		require.NoError(t, x.PutMetadata(md))
+	}
+
+	assert.Equal(t, 4, x.Len())
+
+	tests := []struct {
+		name    string
+		query   *Query
+		results []string
+	}{
+		{"all", &Query{}, []string{"cat.jpg", "cats/tabby.jpg", "dog.gif", "kitten.png"}},
+		{"tag", &Query{Tags: map[string]string{"grumpy": ""}}, []string{"cat.jpg", "cats/tabby.jpg"}},
+		{"tag value", &Query{Tags: map[string]string{"grumpy": "very"}}, []string{"cats/tabby.jpg"}},
+		{"tags", &Query{Tags: map[string]string{"grumpy": "", "colour": "orange"}}, []string{"cat.jpg"}},
+		{"missing tag", &Query{Tags: map[string]string{"fluffy": ""}}, []string{}},
+		{"owner", &Query{Owner: "team-cats"}, []string{"cat.jpg", "kitten.png"}},
+		{"content type", &Query{ContentType: "image/jpeg"}, []string{"cat.jpg", "cats/tabby.jpg"}},
+		{"size", &Query{MinSize: 200, MaxSize: 300}, []string{"cats/tabby.jpg", "kitten.png"}},
+		{"created", &Query{CreatedAfter: now.Add(-7 * 24 * time.Hour), CreatedBefore: now}, []string{"cat.jpg", "kitten.png"}},
+		{"bucket", &Query{Bucket: "cats"}, []string{"cats/tabby.jpg"}},
+		{"grumpy cats uploaded by team cats last week", &Query{Tags: map[string]string{"grumpy": ""}, Owner: "team-cats", CreatedAfter: now.Add(-7 * 24 * time.Hour)}, []string{"cat.jpg"}},
+		{"page", &Query{After: "cat.jpg", Limit: 2}, []string{"cats/tabby.jpg", "dog.gif"}},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.results, names(x.Search(tc.query)), tc.name)
+	}
+
+	md, err := x.Metadata("cats/tabby.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "a very grumpy cat", md.Description)
+	assert.Equal(t, map[string]string{"grumpy": "very"}, md.Tags)
+
+	// modifying returned metadata does not modify the index
+	md.Tags["grumpy"] = "not at all"
+	assert.Len(t, x.Search(&Query{Tags: map[string]string{"grumpy": "very"}}), 1)
+
+	require.NoError(t, x.DeleteMetadata("cat.jpg"))
+
+	_, err = x.Metadata("cat.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	assert.Equal(t, []string{"cats/tabby.jpg"}, names(x.Search(&Query{Tags: map[string]string{"grumpy": ""}})))
+	assert.Empty(t, x.Search(&Query{Tags: map[string]string{"colour": "orange"}}))
+
+	_, err = ms.StatObject(metadataID("cat.jpg"))
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestIndexRebuild(t *testing.T) {
+	fs := newTestFileStore(t)
+	x := NewIndex(fs)
+
+	for _, id := range []string{"cat.jpg", "cats/tabby.jpg", "old.jpg"} {
+		require.NoError(t, fs.WriteObject(id, bytes.NewReader([]byte("meow"))))
+	}
+
+	require.NoError(t, x.PutMetadata(&Metadata{Name: "cat.jpg", Owner: "team-cats", ContentType: "image/jpeg", Size: 4, Tags: map[string]string{"grumpy": ""}}))
+	require.NoError(t, x.PutMetadata(&Metadata{Name: "cats/tabby.jpg", ContentType: "image/jpeg", Size: 4, Tags: map[string]string{"colour": "orange"}}))
+	require.NoError(t, x.PutMetadata(&Metadata{Name: "deleted.jpg", ContentType: "image/jpeg", Size: 4}))
+
+	// the metadata of objects in buckets is not stored in the bucket
+	objects, err := fs.ListObjects("cats/", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+
+	rebuilt := NewIndex(fs)
+	require.NoError(t, rebuilt.Rebuild(context.Background()))
+
+	assert.Equal(t, 3, rebuilt.Len())
+	assert.Equal(t, []string{"cat.jpg"}, names(rebuilt.Search(&Query{Tags: map[string]string{"grumpy": ""}, Owner: "team-cats"})))
+	assert.Equal(t, []string{"cats/tabby.jpg"}, names(rebuilt.Search(&Query{Tags: map[string]string{"colour": "orange"}})))
+
+	// objects without metadata are indexed from their name and size
+	md, err := rebuilt.Metadata("old.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", md.ContentType)
+	assert.Equal(t, int64(4), md.Size)
+	assert.False(t, md.Created.IsZero())
+
+	// metadata of objects that no longer exist is deleted
+	_, err = rebuilt.Metadata("deleted.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	_, err = fs.StatObject(metadataID("deleted.jpg"))
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestIndexEviction(t *testing.T) {
+	ms := NewMemoryStore(WithMaxObjects(2), WithEvictionPolicy(EvictOldest))
+	x := NewIndex(ms)
+
+	ms.OnEvict(x.Evicted)
+
+	for _, name := range []string{"cat.jpg", "kitten.jpg", "tabby.jpg"} {
+		require.NoError(t, ms.WriteObject(name, bytes.NewReader([]byte("meow"))))
+		require.NoError(t, x.PutMetadata(&Metadata{Name: name, Tags: map[string]string{"grumpy": ""}}))
+	}
+
+	// evicted objects are removed from the index, along with their stored metadata
+	assert.Equal(t, []string{"kitten.jpg", "tabby.jpg"}, names(x.Search(&Query{Tags: map[string]string{"grumpy": ""}})))
+
+	_, err := x.Metadata("cat.jpg")
+	assert.ErrorIs(t, err, ErrFileDoesNotExist)
+
+	_, err = ms.StatObject(metadataID("cat.jpg"))
+	assert.ErrorIs(t, err, ErrFileDoesNotExist)
+
+	_, err = ms.StatObject(metadataID("kitten.jpg"))
+	assert.NoError(t, err)
+}
+
+func TestIndexSimilar(t *testing.T) {
+	x := NewIndex(NewMemoryStore())
+
+	objects := []*Metadata{
+		{Name: "cat.jpg", PerceptualHash: "ff00ff00ff00ff00"},
+		{Name: "cats/tabby.jpg", PerceptualHash: "ff00ff00ff00ff01"},
+		{Name: "kitten.jpg", PerceptualHash: "ff00ff00ff00fff0"},
+		{Name: "dog.jpg", PerceptualHash: "00ff00ff00ff00ff"},
+		{Name: "unhashed.jpg"},
+	}
+
+	for _, md := range objects {
+		require.NoError(t, x.PutMetadata(md))
+	}
+
+	similar, err := x.Similar("ff00ff00ff00ff00", 4, 0, "")
+	require.NoError(t, err)
+	require.Len(t, similar, 3)
+	assert.Equal(t, "cat.jpg", similar[0].Metadata.Name)
+	assert.Equal(t, 0, similar[0].Distance)
+	assert.Equal(t, "cats/tabby.jpg", similar[1].Metadata.Name)
+	assert.Equal(t, 1, similar[1].Distance)
+	assert.Equal(t, "kitten.jpg", similar[2].Metadata.Name)
+	assert.Equal(t, 4, similar[2].Distance)
+
+	similar, err = x.Similar("ff00ff00ff00ff00", 4, 1, "cat.jpg")
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, "cats/tabby.jpg", similar[0].Metadata.Name)
+
+	// replaced and deleted objects are no longer similar
+	require.NoError(t, x.PutMetadata(&Metadata{Name: "cat.jpg", PerceptualHash: "00ff00ff00ff00ff"}))
+	require.NoError(t, x.DeleteMetadata("cats/tabby.jpg"))
+
+	similar, err = x.Similar("ff00ff00ff00ff00", 4, 0, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kitten.jpg"}, similarNames(similar))
+
+	_, err = x.Similar("not a hash", 4, 0, "")
+	assert.Error(t, err)
+}
+
+func TestIndexRebuildHashes(t *testing.T) {
+	fs := newTestFileStore(t)
+
+	hasher := func(r io.Reader) (string, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+
+		if string(data) != "meow" {
+			return "", errors.New("not an image")
+		}
+
+		return "ff00ff00ff00ff00", nil
+	}
+
+	require.NoError(t, fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("cats/tabby.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("notes.txt", bytes.NewReader([]byte("woof"))))
+
+	x := NewIndex(fs, WithHasher(hasher))
+	require.NoError(t, x.Rebuild(context.Background()))
+
+	similar, err := x.Similar("ff00ff00ff00ff00", 0, 0, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cat.jpg", "cats/tabby.jpg"}, similarNames(similar))
+
+	// computed hashes are stored with the metadata of the objects
+	rebuilt := NewIndex(fs)
+	require.NoError(t, rebuilt.Rebuild(context.Background()))
+
+	md, err := rebuilt.Metadata("cats/tabby.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "ff00ff00ff00ff00", md.PerceptualHash)
+
+	md, err = rebuilt.Metadata("notes.txt")
+	require.NoError(t, err)
+	assert.Empty(t, md.PerceptualHash)
+}
+
+func similarNames(similar []*SimilarObject) []string {
+	n := make([]string, len(similar))
+
+	for i, s := range similar {
+		n[i] = s.Metadata.Name
+	}
+
+	return n
+}
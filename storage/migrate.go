@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultMigrateWorkers the default number of objects copied concurrently
+const DefaultMigrateWorkers = 4
+
+// MigrateStatus the outcome of migrating an object
+type MigrateStatus int
+
+const (
+	// MigrateCopied the object was copied, or would be copied in a dry run
+	MigrateCopied MigrateStatus = iota
+	// MigrateSkipped the object already exists in the destination
+	MigrateSkipped
+	// MigrateFailed the object could not be copied
+	MigrateFailed
+)
+
+// String returns the name of the status
+func (s MigrateStatus) String() string {
+	switch s {
+	case MigrateCopied:
+		return "copied"
+	case MigrateSkipped:
+		return "skipped"
+	case MigrateFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// MigrateProgress the outcome of migrating a single object
+type MigrateProgress struct {
+	// Name the name of the object
+	Name string
+	// Size the size of the object in bytes
+	Size int64
+	// Status the outcome of the object's migration
+	Status MigrateStatus
+	// Err the error the object failed with
+	Err error
+}
+
+// MigrateOptions configures a migration
+type MigrateOptions struct {
+	// Workers the number of objects copied concurrently
+	Workers int
+	// DryRun reports the objects that would be copied without copying them
+	DryRun bool
+	// Progress if set, is called once each object has been migrated.
+	// Calls are never made concurrently
+	Progress func(p MigrateProgress)
+}
+
+// MigrateResult a summary of a migration
+type MigrateResult struct {
+	// Copied the number of objects that were copied
+	Copied int64 `json:"copied"`
+	// Skipped the number of objects that already existed
+	Skipped int64 `json:"skipped"`
+	// Failed the number of objects that could not be copied
+	Failed int64 `json:"failed"`
+	// Bytes the total size of the objects that were copied
+	Bytes int64 `json:"bytes"`
+}
+
+// Migrate copies every object from one store to another. Each copy is verified by
+// comparing a checksum of the data read back from the destination with the source,
+// and objects that already exist in the destination with the same data are skipped.
+// Objects that fail to copy are reported, and do not stop the migration. An error is
+// only returned if the source objects cannot be listed or the context is cancelled
+func Migrate(ctx context.Context, from, to Store, opts *MigrateOptions) (*MigrateResult, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = DefaultMigrateWorkers
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	result := &MigrateResult{}
+	queue := make(chan *ObjectInfo)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for info := range queue {
+				p := migrateObject(from, to, info, opts.DryRun)
+
+				mu.Lock()
+
+				switch p.Status {
+				case MigrateCopied:
+					result.Copied++
+					result.Bytes += p.Size
+				case MigrateSkipped:
+					result.Skipped++
+				case MigrateFailed:
+					result.Failed++
+				}
+
+				if opts.Progress != nil {
+					opts.Progress(p)
+				}
+
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := eachObject(ctx, from, func(info *ObjectInfo) {
+		select {
+		case queue <- info:
+		case <-ctx.Done():
+		}
+	})
+
+	close(queue)
+	wg.Wait()
+
+	return result, err
+}
+
+// migrateObject copies a single object, verifying its checksum once written
+func migrateObject(from, to Store, info *ObjectInfo, dryRun bool) MigrateProgress {
+	p := MigrateProgress{
+		Name: info.Name,
+		Size: info.Size,
+	}
+
+	existing, err := to.StatObject(info.Name)
+	switch {
+	case err == nil && existing.Size == info.Size:
+		return migrated(from, to, info, existing, p)
+	case err == nil:
+		p.Status = MigrateFailed
+		p.Err = fmt.Errorf("%w with a different size", ErrFileExists)
+		return p
+	case !errors.Is(err, ErrFileDoesNotExist):
+		p.Status = MigrateFailed
+		p.Err = fmt.Errorf("failed to check destination: %w", err)
+		return p
+	}
+
+	if dryRun {
+		p.Status = MigrateCopied
+		return p
+	}
+
+	sum, err := copyObject(from, to, info.Name)
+	if err != nil {
+		// another writer may have created the object since it was checked
+		if errors.Is(err, ErrFileExists) {
+			p.Status = MigrateSkipped
+			return p
+		}
+
+		p.Status = MigrateFailed
+		p.Err = err
+
+		return p
+	}
+
+	h := sha256.New()
+
+	err = to.ReadObject(info.Name, h)
+	if err == nil && !bytes.Equal(h.Sum(nil), sum) {
+		err = ErrChecksumMismatch
+	}
+
+	if err != nil {
+		// remove the bad copy, so the object is copied again next time
+		to.DeleteObject(info.Name)
+
+		p.Status = MigrateFailed
+		p.Err = fmt.Errorf("failed to verify copy: %w", err)
+
+		return p
+	}
+
+	log.Debug().
+		Str("file", info.Name).
+		Msg(fmt.Sprintf("migrated %d bytes", info.Size))
+
+	p.Status = MigrateCopied
+
+	return p
+}
+
+// migrated checks that an object that already exists in the destination has the same data
+// as the source. Recorded checksums are compared if both stores have them, otherwise the
+// data of both objects is read and hashed
+func migrated(from, to Store, info, existing *ObjectInfo, p MigrateProgress) MigrateProgress {
+	same := info.Checksum != "" && info.Checksum == existing.Checksum
+
+	if !same && (info.Checksum == "" || existing.Checksum == "") {
+		a, err := objectChecksum(from, info.Name)
+		if err != nil {
+			p.Status = MigrateFailed
+			p.Err = fmt.Errorf("failed to read source: %w", err)
+			return p
+		}
+
+		b, err := objectChecksum(to, info.Name)
+		if err != nil {
+			p.Status = MigrateFailed
+			p.Err = fmt.Errorf("failed to check destination: %w", err)
+			return p
+		}
+
+		same = bytes.Equal(a, b)
+	}
+
+	if !same {
+		p.Status = MigrateFailed
+		p.Err = fmt.Errorf("%w with different data", ErrFileExists)
+		return p
+	}
+
+	p.Status = MigrateSkipped
+
+	return p
+}
+
+// objectChecksum returns the SHA-256 checksum of an object's data
+func objectChecksum(s Store, id string) ([]byte, error) {
+	h := sha256.New()
+
+	err := s.ReadObject(id, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// copyObject streams an object from one store to another,
+// returning a checksum of the data read from the source
+func copyObject(from, to Store, id string) ([]byte, error) {
+	h := sha256.New()
+	pr, pw := io.Pipe()
+
+	read := make(chan error, 1)
+
+	go func() {
+		err := from.ReadObject(id, io.MultiWriter(pw, h))
+		pw.CloseWithError(err)
+		read <- err
+	}()
+
+	err := to.WriteObject(id, pr)
+
+	// unblock the source if the destination stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	rerr := <-read
+	if err == nil {
+		err = rerr
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrFileExists) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to copy: %w", err)
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingStore a store that flips a bit in the data of each object it writes
+type corruptingStore struct {
+	*MemoryStore
+}
+
+func (s corruptingStore) WriteObject(id string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > 0 {
+		data[0] ^= 0x01
+	}
+
+	return s.MemoryStore.WriteObject(id, bytes.NewReader(data))
+}
+
+func writeTestObjects(t *testing.T, s Store, count int) {
+	for i := 0; i < count; i++ {
+		err := s.WriteObject(fmt.Sprintf("cat-%04d.jpg", i), bytes.NewReader([]byte(fmt.Sprintf("meow %d", i))))
+		require.NoError(t, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	from := NewMemoryStore()
+	to := newTestPackStore(t, t.TempDir())
+
+	// span more than one page of listed objects
+	writeTestObjects(t, from, listBatchSize+10)
+
+	var mu sync.Mutex
+	var progress []MigrateProgress
+
+	res, err := Migrate(context.Background(), from, to, &MigrateOptions{
+		Workers: 8,
+		Progress: func(p MigrateProgress) {
+			mu.Lock()
+			progress = append(progress, p)
+			mu.Unlock()
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(listBatchSize+10), res.Copied)
+	assert.Equal(t, int64(0), res.Skipped)
+	assert.Equal(t, int64(0), res.Failed)
+	assert.Len(t, progress, listBatchSize+10)
+
+	for _, name := range []string{"cat-0000.jpg", "cat-1009.jpg"} {
+		var a, b bytes.Buffer
+		require.NoError(t, from.ReadObject(name, &a))
+		require.NoError(t, to.ReadObject(name, &b))
+		assert.Equal(t, a.Bytes(), b.Bytes())
+	}
+
+	// running the migration again skips everything
+	res, err = Migrate(context.Background(), from, to, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), res.Copied)
+	assert.Equal(t, int64(listBatchSize+10), res.Skipped)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	from := NewMemoryStore()
+	to := NewMemoryStore()
+
+	writeTestObjects(t, from, 3)
+	require.NoError(t, to.WriteObject("cat-0000.jpg", bytes.NewReader([]byte("meow 0"))))
+
+	res, err := Migrate(context.Background(), from, to, &MigrateOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Copied)
+	assert.Equal(t, int64(1), res.Skipped)
+
+	_, err = to.StatObject("cat-0001.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestMigrateConflict(t *testing.T) {
+	from := NewMemoryStore()
+	to := NewMemoryStore()
+
+	writeTestObjects(t, from, 1)
+	require.NoError(t, to.WriteObject("cat-0000.jpg", bytes.NewReader([]byte("purr"))))
+
+	var failed MigrateProgress
+
+	res, err := Migrate(context.Background(), from, to, &MigrateOptions{
+		Progress: func(p MigrateProgress) {
+			failed = p
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Failed)
+	assert.Equal(t, MigrateFailed, failed.Status)
+	assert.True(t, errors.Is(failed.Err, ErrFileExists))
+}
+
+// uncheckedStore a store that does not record the checksums of its objects
+type uncheckedStore struct {
+	*MemoryStore
+}
+
+func (s uncheckedStore) StatObject(id string) (*ObjectInfo, error) {
+	info, err := s.MemoryStore.StatObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Checksum = ""
+
+	return info, nil
+}
+
+func TestMigrateExistingData(t *testing.T) {
+	for _, to := range []Store{NewMemoryStore(), uncheckedStore{NewMemoryStore()}} {
+		from := NewMemoryStore()
+
+		writeTestObjects(t, from, 2)
+
+		// a copy with the same size, but different data, is not skipped
+		require.NoError(t, to.WriteObject("cat-0000.jpg", bytes.NewReader([]byte("meow 0"))))
+		require.NoError(t, to.WriteObject("cat-0001.jpg", bytes.NewReader([]byte("meow 9"))))
+
+		var mu sync.Mutex
+		var failed []MigrateProgress
+
+		res, err := Migrate(context.Background(), from, to, &MigrateOptions{
+			Progress: func(p MigrateProgress) {
+				mu.Lock()
+				if p.Status == MigrateFailed {
+					failed = append(failed, p)
+				}
+				mu.Unlock()
+			},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), res.Skipped)
+		assert.Equal(t, int64(1), res.Failed)
+		require.Len(t, failed, 1)
+		assert.Equal(t, "cat-0001.jpg", failed[0].Name)
+		assert.ErrorIs(t, failed[0].Err, ErrFileExists)
+	}
+}
+
+func TestMigrateChecksumMismatch(t *testing.T) {
+	from := NewMemoryStore()
+	to := corruptingStore{NewMemoryStore()}
+
+	writeTestObjects(t, from, 2)
+
+	var mu sync.Mutex
+	var failed []MigrateProgress
+
+	res, err := Migrate(context.Background(), from, to, &MigrateOptions{
+		Progress: func(p MigrateProgress) {
+			mu.Lock()
+			failed = append(failed, p)
+			mu.Unlock()
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Failed)
+
+	for _, p := range failed {
+		assert.True(t, errors.Is(p.Err, ErrChecksumMismatch))
+	}
+
+	// corrupt copies should be removed
+	objects, err := to.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 0)
+}
+
+func TestMigrateListFailure(t *testing.T) {
+	_, err := Migrate(context.Background(), failingStore{}, NewMemoryStore(), nil)
+	assert.True(t, errors.Is(err, errReplicaDown))
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the prefix of the objects that record each nonce that has been used
+const noncePrefix = ".nonces/"
+
+// Nonces records the nonces that have been used in storage, so that each
+// can only be used once, even if the server is restarted. Nonces are kept
+// until they expire, after which they can no longer be used anyway
+type Nonces struct {
+	store Store
+}
+
+// NewNonces creates a new record of used nonces, held in the provided store
+func NewNonces(store Store) *Nonces {
+	return &Nonces{
+		store: store,
+	}
+}
+
+// Used reports whether a nonce that expires at the specified time has been used
+func (n *Nonces) Used(nonce string, expires time.Time) (bool, error) {
+	_, err := n.store.StatObject(nonceID(nonce, expires))
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check nonce: %w", err)
+	}
+
+	return true, nil
+}
+
+// Use records that a nonce has been used, returning ErrFileExists if it has already been used
+func (n *Nonces) Use(nonce string, expires time.Time) error {
+	err := n.store.WriteObject(nonceID(nonce, expires), bytes.NewReader(nil))
+	if err != nil && !errors.Is(err, ErrFileExists) {
+		return fmt.Errorf("failed to record nonce: %w", err)
+	}
+
+	return err
+}
+
+// Expire removes the nonces that expired before the specified time,
+// returning the number of nonces that were removed
+func (n *Nonces) Expire(now time.Time) (int, error) {
+	var removed int
+
+	// nonces are named by their expiry, so are listed in the order they expire
+	for {
+		objects, err := n.store.ListObjects(noncePrefix, "", listBatchSize)
+		if err != nil {
+			return removed, fmt.Errorf("failed to list nonces: %w", err)
+		}
+
+		for _, info := range objects {
+			expires, err := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(info.Name, noncePrefix), "-", 2)[0], 10, 64)
+			if err == nil && !now.After(time.Unix(expires, 0)) {
+				return removed, nil
+			}
+
+			err = n.store.DeleteObject(info.Name)
+			if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+				return removed, fmt.Errorf("failed to remove nonce: %w", err)
+			}
+
+			removed++
+		}
+
+		if len(objects) < listBatchSize {
+			return removed, nil
+		}
+	}
+}
+
+// nonceID returns the name of the object that records a nonce. The expiry
+// is padded so that names are ordered by the time the nonces expire
+func nonceID(nonce string, expires time.Time) string {
+	return fmt.Sprintf("%s%020d-%s", noncePrefix, expires.Unix(), url.PathEscape(nonce))
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonces(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	n := NewNonces(fs)
+
+	now := time.Now().Truncate(time.Second)
+
+	used, err := n.Used("n0nc3", now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, n.Use("n0nc3", now.Add(time.Minute)))
+	require.NoError(t, n.Use("0ld", now.Add(-time.Minute)))
+
+	err = n.Use("n0nc3", now.Add(time.Minute))
+	assert.ErrorIs(t, err, ErrFileExists)
+
+	// used nonces are read from storage
+	n = NewNonces(fs)
+
+	used, err = n.Used("n0nc3", now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, used)
+
+	// only nonces that have expired are removed
+	removed, err := n.Expire(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	used, err = n.Used("0ld", now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	used, err = n.Used("n0nc3", now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, used)
+
+	objects, err := fs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.True(t, IsInternal(objects[0].Name))
+}
+
+func TestNoncesEviction(t *testing.T) {
+	ms := NewMemoryStore(WithMaxObjects(2), WithEvictionPolicy(EvictLRU))
+
+	n := NewNonces(ms)
+
+	expires := time.Now().Add(time.Minute)
+
+	require.NoError(t, n.Use("n0nc3", expires))
+
+	// filling the store must not evict the used nonce, which would let it be used again
+	for i := 0; i < 5; i++ {
+		require.NoError(t, ms.WriteObject(fmt.Sprintf("cat-%d.jpg", i), bytes.NewReader([]byte("meow"))))
+	}
+
+	assert.Equal(t, int64(3), ms.Stats().Evictions)
+
+	used, err := n.Used("n0nc3", expires)
+	require.NoError(t, err)
+	assert.True(t, used)
+
+	err = n.Use("n0nc3", expires)
+	assert.ErrorIs(t, err, ErrFileExists)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the number of objects listed from a store at a time when visiting every object
+const listBatchSize = 1000
+
+// ObjectInfo describes an object held in storage
+type ObjectInfo struct {
+	// Name the unique name of the object
+	Name string
+	// Size the size of the object's data in bytes
+	Size int64
+	// Created the time the object was written
+	Created time.Time
+	// Checksum the hex encoded SHA-256 checksum of the object's data, recorded
+	// when it was written. It is empty if the store did not record a checksum
+	Checksum string
+}
+
+// listPage sorts a set of objects by name and returns those that match the prefix
+// and come after the specified name. If limit is greater than zero, no more than
+// limit objects will be returned
+func listPage(objects []*ObjectInfo, prefix, after string, limit int) []*ObjectInfo {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	page := make([]*ObjectInfo, 0, len(objects))
+
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, prefix) || obj.Name <= after {
+			continue
+		}
+
+		page = append(page, obj)
+
+		if limit > 0 && len(page) >= limit {
+			break
+		}
+	}
+
+	return page
+}
+
+// eachObject calls fn with every object in a store in name order, listing
+// the objects in batches. It stops early if the context is cancelled
+func eachObject(ctx context.Context, s Store, fn func(info *ObjectInfo)) error {
+	var after string
+
+	for {
+		objects, err := s.ListObjects("", after, listBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, info := range objects {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			fn(info)
+		}
+
+		if len(objects) < listBatchSize {
+			return ctx.Err()
+		}
+
+		after = objects[len(objects)-1].Name
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// MemoryPath the path of a store that only holds objects in memory
+	MemoryPath = ":memory:"
+	// MemoryPrefix the prefix of paths to a directory that an in-memory store is persisted to
+	MemoryPrefix = "memory:"
+	// BoltPrefix the prefix of paths to a bbolt database file
+	BoltPrefix = "bolt:"
+	// PackPrefix the prefix of paths to a directory of pack segment files
+	PackPrefix = "pack:"
+)
+
+// Open opens an existing store from its path. Paths prefixed with 'memory:', 'bolt:'
+// or 'pack:' use the corresponding backend at the rest of the path, and any other
+// path is opened as a FileStore directory. The memory options are only used by
+// in-memory stores
+func Open(path string, opts ...MemoryOption) (Store, error) {
+	if path == MemoryPath {
+		return NewMemoryStore(opts...), nil
+	}
+
+	_, location := splitPath(path)
+
+	_, err := os.Stat(location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrStorageDoesNotExist, path)
+		}
+		return nil, err
+	}
+
+	return open(path, opts...)
+}
+
+// Create opens a store from its path like Open, first creating
+// any directories the store needs if they do not exist
+func Create(path string, opts ...MemoryOption) (Store, error) {
+	if path == MemoryPath {
+		return NewMemoryStore(opts...), nil
+	}
+
+	backend, location := splitPath(path)
+
+	// a bbolt database creates its own file in an existing directory
+	dir := location
+	if backend == BoltPrefix {
+		dir = filepath.Dir(location)
+	}
+
+	err := os.MkdirAll(dir, 0744)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return open(path, opts...)
+}
+
+func open(path string, opts ...MemoryOption) (Store, error) {
+	backend, location := splitPath(path)
+
+	switch backend {
+	case MemoryPrefix:
+		return OpenMemoryStore(location, opts...)
+	case BoltPrefix:
+		return NewBoltStore(location)
+	case PackPrefix:
+		return NewPackStore(location)
+	}
+
+	return NewFileStore(location)
+}
+
+// Close closes a store, if it needs to be closed
+func Close(s Store) error {
+	c, ok := s.(interface{ Close() error })
+	if !ok {
+		return nil
+	}
+
+	return c.Close()
+}
+
+// splitPath splits a path into its backend prefix and location
+func splitPath(path string) (string, string) {
+	for _, prefix := range []string{MemoryPrefix, BoltPrefix, PackPrefix} {
+		if strings.HasPrefix(path, prefix) {
+			return prefix, strings.TrimPrefix(path, prefix)
+		}
+	}
+
+	return "", path
+}
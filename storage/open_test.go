@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := Open(filepath.Join(dir, "files"))
+	assert.True(t, errors.Is(err, ErrStorageDoesNotExist))
+
+	_, err = Open(BoltPrefix + filepath.Join(dir, "catly.db"))
+	assert.True(t, errors.Is(err, ErrStorageDoesNotExist))
+
+	tests := map[string]Store{
+		MemoryPath:                  &MemoryStore{},
+		filepath.Join(dir, "files"): &FileStore{},
+		MemoryPrefix + filepath.Join(dir, "memory"):         &MemoryStore{},
+		BoltPrefix + filepath.Join(dir, "bolt", "catly.db"): &BoltStore{},
+		PackPrefix + filepath.Join(dir, "pack"):             &PackStore{},
+	}
+
+	for path, expected := range tests {
+		st, err := Create(path)
+		require.NoError(t, err, path)
+		assert.IsType(t, expected, st)
+
+		err = st.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+		require.NoError(t, Close(st))
+
+		if path == MemoryPath {
+			continue
+		}
+
+		// the object should be there once the storage is reopened
+		st, err = Open(path)
+		require.NoError(t, err, path)
+
+		_, err = st.StatObject("cat.jpg")
+		assert.NoError(t, err, path)
+		require.NoError(t, Close(st))
+	}
+}
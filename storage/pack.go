@@ -0,0 +1,866 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultPackSegmentSize the default size a segment can grow to before a new segment is started
+	DefaultPackSegmentSize = 1 << 26
+	// the ratio of live data in a segment below which it will be compacted
+	packCompactThreshold = 0.5
+	// the extension of segment files
+	packSegmentExt = ".pack"
+	// the magic number at the start of each record
+	packRecordMagic = 0x6361746c
+	// the magic bytes at the end of a sealed segment
+	packFooterMagic = "catlyftr"
+	// the size of a record's header
+	packHeaderSize = 4 + 1 + 2 + 8 + 8 + 4
+	// the size of the trailer at the end of a segment's footer
+	packTrailerSize = 8 + 4 + len(packFooterMagic)
+	// the size of each entry in a segment's footer, excluding the name
+	packFooterEntrySize = 1 + 2 + 8 + 8 + 8
+)
+
+// the kinds of record that can be stored in a segment
+const (
+	packObject byte = iota
+	packTombstone
+	// an object whose record holds the SHA-256 checksum of its data
+	// between its name and its data. objects written before checksums
+	// were recorded use packObject records, which have no checksum
+	packChecksummedObject
+)
+
+var packCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// PackStore an implementation of the object storage that appends objects to large
+// segment files, which is suited to storing many small images. An index of where
+// each object is stored is held in memory, and is rebuilt from the footers of
+// each segment when the store is opened. Deleted objects are marked with a
+// tombstone record, and the space they use is reclaimed by compaction
+type PackStore struct {
+	dir         string
+	segmentSize int64
+	mu          sync.RWMutex
+	index       map[string]*packEntry
+	segments    map[uint32]*packSegment
+	active      *packSegment
+}
+
+// packEntry the location of an object in a segment
+type packEntry struct {
+	segment *packSegment
+	offset  int64
+	size    int64
+	created time.Time
+	// the SHA-256 checksum of the object's data, if it was recorded
+	checksum []byte
+}
+
+// packSegment a segment file that records are appended to
+type packSegment struct {
+	id   uint32
+	path string
+	fd   *os.File
+	// the size of the segment file
+	size int64
+	// the total and live bytes of object data held in the segment
+	data int64
+	live int64
+	// the names of objects deleted by tombstones in the segment
+	tombstones []string
+	// the records of the segment, which are written to its footer when sealed
+	records []*packRecord
+	sealed  bool
+	readers sync.WaitGroup
+}
+
+// packRecord a record in a segment
+type packRecord struct {
+	kind     byte
+	name     string
+	offset   int64
+	size     int64
+	created  time.Time
+	checksum []byte
+}
+
+// NewPackStore creates a new pack store in the specified directory, loading any existing segments
+func NewPackStore(dir string) (*PackStore, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("storage base directory does not exist: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return nil, ErrDirectoryPathIsFile
+	}
+
+	s := &PackStore{
+		dir:         dir,
+		segmentSize: DefaultPackSegmentSize,
+		index:       make(map[string]*packEntry),
+		segments:    make(map[uint32]*packSegment),
+	}
+
+	err = s.load()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ReadObject reads an object from its segment to the provided io.Writer
+func (s *PackStore) ReadObject(id string, w io.Writer) error {
+	s.mu.RLock()
+
+	e, ok := s.index[id]
+	if ok {
+		// prevent the segment from being removed by compaction while it's being read
+		e.segment.readers.Add(1)
+	}
+
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrFileDoesNotExist
+	}
+
+	defer e.segment.readers.Done()
+
+	rb, err := io.Copy(w, io.NewSectionReader(e.segment.fd, e.offset, e.size))
+	if err != nil {
+		return fmt.Errorf("failed to write file data: %w", err)
+	}
+
+	log.Debug().
+		Str("file", id).
+		Str("segment", e.segment.path).
+		Msg(fmt.Sprintf("read %d bytes from segment", rb))
+
+	return nil
+}
+
+// WriteObject appends an object to the active segment from the provided io.Reader
+func (s *PackStore) WriteObject(id string, r io.Reader) error {
+	// fail early if the object already exists, so we don't
+	// needlessly read the whole upload
+	s.mu.RLock()
+	_, exists := s.index[id]
+	s.mu.RUnlock()
+
+	if exists {
+		return ErrFileExists
+	}
+
+	// the upload is read before the store is locked,
+	// so other writes don't wait on the uploader
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("file upload failed: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists = s.index[id]
+	if exists {
+		return ErrFileExists
+	}
+
+	sum := sha256.Sum256(data)
+
+	rec, err := s.append(packChecksummedObject, id, sum[:], data, time.Now())
+	if err != nil {
+		return fmt.Errorf("file upload failed: %w", err)
+	}
+
+	s.apply(s.active, rec)
+
+	log.Debug().
+		Str("file", id).
+		Str("segment", s.active.path).
+		Msg(fmt.Sprintf("wrote %d bytes to segment", len(data)))
+
+	return nil
+}
+
+// ReplaceObject replaces the data of an existing object by appending a new
+// record to the active segment. Requests for the object will receive either
+// the old or new data
+func (s *PackStore) ReplaceObject(id string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("file upload failed: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, exists := s.index[id]
+	if !exists {
+		return ErrFileDoesNotExist
+	}
+
+	sum := sha256.Sum256(data)
+
+	rec, err := s.append(packChecksummedObject, id, sum[:], data, e.created)
+	if err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	s.apply(s.active, rec)
+
+	log.Debug().
+		Str("file", id).
+		Str("segment", s.active.path).
+		Msg(fmt.Sprintf("replaced %d bytes in segment", len(data)))
+
+	return nil
+}
+
+// StatObject returns information about an object
+func (s *PackStore) StatObject(id string) (*ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.index[id]
+	if !ok {
+		return nil, ErrFileDoesNotExist
+	}
+
+	return e.info(id), nil
+}
+
+// ListObjects lists objects in name order that match the prefix
+// and come after the specified name, up to a limit
+func (s *PackStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	s.mu.RLock()
+
+	objects := make([]*ObjectInfo, 0, len(s.index))
+
+	for id, e := range s.index {
+		if strings.HasPrefix(id, prefix) {
+			objects = append(objects, e.info(id))
+		}
+	}
+
+	s.mu.RUnlock()
+
+	return listPage(objects, prefix, after, limit), nil
+}
+
+// DeleteObject removes an object by appending a tombstone to the active segment
+func (s *PackStore) DeleteObject(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.index[id]
+	if !ok {
+		return ErrFileDoesNotExist
+	}
+
+	rec, err := s.append(packTombstone, id, nil, nil, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	s.apply(s.active, rec)
+
+	log.Debug().
+		Str("file", id).
+		Str("segment", s.active.path).
+		Msg("wrote tombstone to segment")
+
+	return nil
+}
+
+// Compact rewrites the live objects of sparse sealed segments to
+// the active segment, removing the sparse segments once complete
+func (s *PackStore) Compact() error {
+	s.mu.Lock()
+
+	var candidates []*packSegment
+
+	for _, seg := range s.segments {
+		if seg.sealed && (seg.data == 0 || float64(seg.live)/float64(seg.data) < packCompactThreshold) {
+			candidates = append(candidates, seg)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].id < candidates[j].id
+	})
+
+	var removed []*packSegment
+	var err error
+
+	for _, seg := range candidates {
+		err = s.compact(seg)
+		if err != nil {
+			break
+		}
+
+		delete(s.segments, seg.id)
+		removed = append(removed, seg)
+	}
+
+	// the copied records must be persisted before the segments they were copied from are removed
+	if len(removed) > 0 {
+		serr := s.active.fd.Sync()
+		if serr != nil && err == nil {
+			err = serr
+			removed = nil
+		}
+	}
+
+	s.mu.Unlock()
+
+	// wait for any reads of the removed segments to finish before removing them
+	for _, seg := range removed {
+		seg.readers.Wait()
+		seg.fd.Close()
+
+		rerr := os.Remove(seg.path)
+		if rerr != nil {
+			log.Error().
+				Str("segment", seg.path).
+				Msg(fmt.Sprintf("failed to remove compacted segment: %s", rerr.Error()))
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to compact segments: %w", err)
+	}
+
+	log.Info().
+		Str("directory", s.dir).
+		Msg(fmt.Sprintf("compacted %d segments", len(removed)))
+
+	return nil
+}
+
+// Close closes all segment files
+func (s *PackStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+
+	for _, seg := range s.segments {
+		cerr := seg.fd.Close()
+		if cerr != nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// compact copies the live objects and any tombstones that are still
+// needed from a segment to the active segment
+func (s *PackStore) compact(seg *packSegment) error {
+	var live []string
+
+	for id, e := range s.index {
+		if e.segment == seg {
+			live = append(live, id)
+		}
+	}
+
+	for _, id := range live {
+		e := s.index[id]
+
+		data := make([]byte, e.size)
+
+		_, err := seg.fd.ReadAt(data, e.offset)
+		if err != nil {
+			return err
+		}
+
+		// objects written before checksums were recorded are given one
+		checksum := e.checksum
+		if checksum == nil {
+			sum := sha256.Sum256(data)
+			checksum = sum[:]
+		}
+
+		rec, err := s.append(packChecksummedObject, id, checksum, data, e.created)
+		if err != nil {
+			return err
+		}
+
+		s.apply(s.active, rec)
+	}
+
+	for _, id := range seg.tombstones {
+		// the object has been written again since it was deleted
+		if _, ok := s.index[id]; ok {
+			continue
+		}
+
+		// the tombstone is only needed if an older segment
+		// may contain the object that it deleted
+		var older bool
+
+		for other := range s.segments {
+			if other < seg.id {
+				older = true
+				break
+			}
+		}
+
+		if !older {
+			continue
+		}
+
+		rec, err := s.append(packTombstone, id, nil, nil, time.Now())
+		if err != nil {
+			return err
+		}
+
+		s.apply(s.active, rec)
+	}
+
+	return nil
+}
+
+// append writes a record to the active segment, starting
+// a new segment if the active segment is full
+func (s *PackStore) append(kind byte, name string, checksum, data []byte, created time.Time) (*packRecord, error) {
+	if len(name) > math.MaxUint16 {
+		return nil, fmt.Errorf("name exceeds the maximum length of %d bytes", math.MaxUint16)
+	}
+
+	size := int64(packHeaderSize + len(name) + len(checksum) + len(data))
+
+	if s.active.size > 0 && s.active.size+size > s.segmentSize {
+		err := s.active.seal()
+		if err != nil {
+			return nil, err
+		}
+
+		next, err := s.create(s.active.id + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		s.active = next
+	}
+
+	buf := make([]byte, size)
+
+	binary.BigEndian.PutUint32(buf, packRecordMagic)
+	buf[4] = kind
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(name)))
+	binary.BigEndian.PutUint64(buf[7:], uint64(len(data)))
+	binary.BigEndian.PutUint64(buf[15:], uint64(created.UnixNano()))
+
+	copy(buf[packHeaderSize:], name)
+	copy(buf[packHeaderSize+len(name):], checksum)
+	copy(buf[packHeaderSize+len(name)+len(checksum):], data)
+
+	binary.BigEndian.PutUint32(buf[23:], crc32.Checksum(buf[packHeaderSize:], packCRCTable))
+
+	_, err := s.active.fd.WriteAt(buf, s.active.size)
+	if err != nil {
+		// remove any partially written record
+		s.active.fd.Truncate(s.active.size)
+		return nil, err
+	}
+
+	rec := &packRecord{
+		kind:     kind,
+		name:     name,
+		offset:   s.active.size + packHeaderSize + int64(len(name)+len(checksum)),
+		size:     int64(len(data)),
+		created:  created,
+		checksum: checksum,
+	}
+
+	s.active.size += size
+	s.active.records = append(s.active.records, rec)
+
+	return rec, nil
+}
+
+// apply updates the index with a record from a segment
+func (s *PackStore) apply(seg *packSegment, rec *packRecord) {
+	if existing, ok := s.index[rec.name]; ok {
+		existing.segment.live -= existing.size
+		delete(s.index, rec.name)
+	}
+
+	switch rec.kind {
+	case packObject, packChecksummedObject:
+		s.index[rec.name] = &packEntry{
+			segment:  seg,
+			offset:   rec.offset,
+			size:     rec.size,
+			created:  rec.created,
+			checksum: rec.checksum,
+		}
+
+		seg.data += rec.size
+		seg.live += rec.size
+	case packTombstone:
+		seg.tombstones = append(seg.tombstones, rec.name)
+	}
+}
+
+// load opens all segments in the store's directory, rebuilding the index
+func (s *PackStore) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	var ids []uint32
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != packSegmentExt {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), packSegmentExt), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for i, id := range ids {
+		seg, records, err := s.open(id)
+		if err != nil {
+			return err
+		}
+
+		for _, rec := range records {
+			s.apply(seg, rec)
+		}
+
+		if seg.sealed {
+			continue
+		}
+
+		// only the last segment should be unsealed,
+		// unless we failed while sealing a segment
+		if i < len(ids)-1 {
+			err = seg.seal()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		s.active = seg
+	}
+
+	if s.active == nil {
+		var next uint32
+
+		if len(ids) > 0 {
+			next = ids[len(ids)-1] + 1
+		}
+
+		s.active, err = s.create(next)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// create creates a new segment
+func (s *PackStore) create(id uint32) (*packSegment, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, packSegmentExt))
+
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	seg := &packSegment{
+		id:   id,
+		path: path,
+		fd:   fd,
+	}
+
+	s.segments[id] = seg
+
+	return seg, nil
+}
+
+// open opens an existing segment, reading its records from its footer. If the segment
+// has not been sealed, its records are scanned and any incomplete record is removed
+func (s *PackStore) open(id uint32) (*packSegment, []*packRecord, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, packSegmentExt))
+
+	fd, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+
+	seg := &packSegment{
+		id:   id,
+		path: path,
+		fd:   fd,
+	}
+
+	s.segments[id] = seg
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+
+	seg.size = fi.Size()
+
+	records, ok, err := seg.readFooter()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ok {
+		seg.sealed = true
+		return seg, records, nil
+	}
+
+	records, valid, err := seg.scan()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if valid < seg.size {
+		log.Warn().
+			Str("segment", path).
+			Msg(fmt.Sprintf("removing %d bytes of incomplete records from segment", seg.size-valid))
+
+		err = fd.Truncate(valid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to truncate segment: %w", err)
+		}
+
+		seg.size = valid
+	}
+
+	seg.records = records
+
+	return seg, records, nil
+}
+
+// seal writes the segment's footer, which contains the location of all of its records
+func (seg *packSegment) seal() error {
+	var footer bytes.Buffer
+
+	entry := make([]byte, packFooterEntrySize)
+
+	for _, rec := range seg.records {
+		entry[0] = rec.kind
+		binary.BigEndian.PutUint16(entry[1:], uint16(len(rec.name)))
+		binary.BigEndian.PutUint64(entry[3:], uint64(rec.offset))
+		binary.BigEndian.PutUint64(entry[11:], uint64(rec.size))
+		binary.BigEndian.PutUint64(entry[19:], uint64(rec.created.UnixNano()))
+
+		footer.Write(entry)
+		footer.WriteString(rec.name)
+		footer.Write(rec.checksum)
+	}
+
+	trailer := make([]byte, packTrailerSize)
+
+	binary.BigEndian.PutUint64(trailer, uint64(seg.size))
+	binary.BigEndian.PutUint32(trailer[8:], crc32.Checksum(footer.Bytes(), packCRCTable))
+	copy(trailer[12:], packFooterMagic)
+
+	footer.Write(trailer)
+
+	_, err := seg.fd.WriteAt(footer.Bytes(), seg.size)
+	if err != nil {
+		seg.fd.Truncate(seg.size)
+		return fmt.Errorf("failed to seal segment: %w", err)
+	}
+
+	err = seg.fd.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to seal segment: %w", err)
+	}
+
+	seg.size += int64(footer.Len())
+	seg.records = nil
+	seg.sealed = true
+
+	return nil
+}
+
+// readFooter reads the records from the footer of a sealed segment
+func (seg *packSegment) readFooter() ([]*packRecord, bool, error) {
+	if seg.size < int64(packTrailerSize) {
+		return nil, false, nil
+	}
+
+	trailer := make([]byte, packTrailerSize)
+
+	_, err := seg.fd.ReadAt(trailer, seg.size-int64(packTrailerSize))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read segment footer: %w", err)
+	}
+
+	if string(trailer[12:]) != packFooterMagic {
+		return nil, false, nil
+	}
+
+	start := int64(binary.BigEndian.Uint64(trailer))
+	end := seg.size - int64(packTrailerSize)
+
+	if start > end {
+		return nil, false, nil
+	}
+
+	footer := make([]byte, end-start)
+
+	_, err = seg.fd.ReadAt(footer, start)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read segment footer: %w", err)
+	}
+
+	if crc32.Checksum(footer, packCRCTable) != binary.BigEndian.Uint32(trailer[8:]) {
+		return nil, false, nil
+	}
+
+	var records []*packRecord
+
+	for len(footer) >= packFooterEntrySize {
+		nameLen := int(binary.BigEndian.Uint16(footer[1:]))
+		sumLen := checksumSize(footer[0])
+
+		if len(footer) < packFooterEntrySize+nameLen+sumLen {
+			return nil, false, fmt.Errorf("segment %s has a corrupt footer", seg.path)
+		}
+
+		rec := &packRecord{
+			kind:    footer[0],
+			offset:  int64(binary.BigEndian.Uint64(footer[3:])),
+			size:    int64(binary.BigEndian.Uint64(footer[11:])),
+			created: time.Unix(0, int64(binary.BigEndian.Uint64(footer[19:]))),
+			name:    string(footer[packFooterEntrySize : packFooterEntrySize+nameLen]),
+		}
+
+		if sumLen > 0 {
+			rec.checksum = append([]byte{}, footer[packFooterEntrySize+nameLen:packFooterEntrySize+nameLen+sumLen]...)
+		}
+
+		records = append(records, rec)
+
+		footer = footer[packFooterEntrySize+nameLen+sumLen:]
+	}
+
+	return records, true, nil
+}
+
+// scan reads each record of an unsealed segment, returning the
+// records and the size of the segment up to the last valid record
+func (seg *packSegment) scan() ([]*packRecord, int64, error) {
+	var records []*packRecord
+	var offset int64
+
+	header := make([]byte, packHeaderSize)
+
+	for offset+packHeaderSize <= seg.size {
+		_, err := seg.fd.ReadAt(header, offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		if binary.BigEndian.Uint32(header) != packRecordMagic {
+			break
+		}
+
+		nameLen := int64(binary.BigEndian.Uint16(header[5:]))
+		sumLen := int64(checksumSize(header[4]))
+		dataLen := int64(binary.BigEndian.Uint64(header[7:]))
+
+		if dataLen < 0 || offset+packHeaderSize+nameLen+sumLen+dataLen > seg.size {
+			break
+		}
+
+		body := make([]byte, nameLen+sumLen+dataLen)
+
+		_, err = seg.fd.ReadAt(body, offset+packHeaderSize)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		if crc32.Checksum(body, packCRCTable) != binary.BigEndian.Uint32(header[23:]) {
+			break
+		}
+
+		rec := &packRecord{
+			kind:    header[4],
+			name:    string(body[:nameLen]),
+			offset:  offset + packHeaderSize + nameLen + sumLen,
+			size:    dataLen,
+			created: time.Unix(0, int64(binary.BigEndian.Uint64(header[15:]))),
+		}
+
+		if sumLen > 0 {
+			// copy the checksum, so the record's data is not retained
+			rec.checksum = append([]byte{}, body[nameLen:nameLen+sumLen]...)
+		}
+
+		records = append(records, rec)
+
+		offset += packHeaderSize + nameLen + sumLen + dataLen
+	}
+
+	return records, offset, nil
+}
+
+// checksumSize returns the size of the checksum held by a kind of record
+func checksumSize(kind byte) int {
+	if kind == packChecksummedObject {
+		return sha256.Size
+	}
+
+	return 0
+}
+
+func (e *packEntry) info(id string) *ObjectInfo {
+	info := &ObjectInfo{
+		Name:    id,
+		Size:    e.size,
+		Created: e.created,
+	}
+
+	if e.checksum != nil {
+		info.Checksum = hex.EncodeToString(e.checksum)
+	}
+
+	return info
+}
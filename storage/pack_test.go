@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPackStore(t *testing.T, dir string) *PackStore {
+	ps, err := NewPackStore(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		ps.Close()
+	})
+
+	return ps
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+packSegmentExt))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestPackStorageSetup(t *testing.T) {
+	_, err := NewPackStore("/tmp/does-not-exist")
+	require.Error(t, err)
+
+	f, err := os.Create(testStorageDirFile)
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(testStorageDirFile)
+
+	_, err = NewPackStore(testStorageDirFile)
+	require.Equal(t, ErrDirectoryPathIsFile, err)
+
+	dir := t.TempDir()
+
+	ps := newTestPackStore(t, dir)
+	assert.NotNil(t, ps.active)
+	assert.Len(t, segmentFiles(t, dir), 1)
+}
+
+func TestPackStorageReadFile(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	err := ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+
+	err = ps.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+}
+
+func TestPackStorageReadFileNotExist(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	var b bytes.Buffer
+
+	err := ps.ReadObject("invisible-cat.jpg", &b)
+	require.Equal(t, ErrFileDoesNotExist, err)
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestPackStorageWriteFile(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	err := ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileExists, err)
+
+	e, ok := ps.index["cat.jpg"]
+	require.True(t, ok)
+
+	data := make([]byte, e.size)
+	_, err = e.segment.fd.ReadAt(data, e.offset)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), data)
+}
+
+func TestPackStorageWriteConcurrentConflict(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	var wg sync.WaitGroup
+	var errorCount int64
+
+	wg.Add(100)
+
+	// create 100 concurrent write requests
+	// we expect that 99 of them should fail
+	// as the file will already be created
+	for i := 0; i < 100; i++ {
+		go func() {
+			r := bytes.NewReader([]byte("meow"))
+
+			err := ps.WriteObject("cat.jpg", r)
+			if err != nil {
+				atomic.AddInt64(&errorCount, 1)
+			}
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	var b bytes.Buffer
+
+	err := ps.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	// check the other 99 requests failed
+	assert.Equal(t, int64(99), errorCount)
+
+	// only a single record should have been written
+	assert.Len(t, ps.active.records, 1)
+}
+
+func TestPackStorageWriteFileFailure(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	r := io.MultiReader(
+		bytes.NewReader([]byte("me")),
+		iotest.ErrReader(errors.New("connection reset")),
+	)
+
+	err := ps.WriteObject("cat.jpg", r)
+	require.Error(t, err)
+
+	_, err = ps.StatObject("cat.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+	assert.Equal(t, int64(0), ps.active.size)
+}
+
+func TestPackStorageStatFile(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	err := ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	info, err := ps.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "cat.jpg", info.Name)
+	assert.Equal(t, int64(4), info.Size)
+	assert.False(t, info.Created.IsZero())
+
+	_, err = ps.StatObject("invisible-cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestPackStorageListFiles(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	for _, name := range []string{"cat-3.jpg", "cat-1.jpg", "dog.jpg", "cat-2.jpg"} {
+		err := ps.WriteObject(name, bytes.NewReader([]byte("meow")))
+		require.NoError(t, err)
+	}
+
+	objects, err := ps.ListObjects("cat-", "", 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "cat-1.jpg", objects[0].Name)
+	assert.Equal(t, "cat-2.jpg", objects[1].Name)
+
+	objects, err = ps.ListObjects("cat-", objects[1].Name, 2)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "cat-3.jpg", objects[0].Name)
+
+	objects, err = ps.ListObjects("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, objects, 4)
+}
+
+func TestPackStorageDeleteFile(t *testing.T) {
+	ps := newTestPackStore(t, t.TempDir())
+
+	err := ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	err = ps.DeleteObject("cat.jpg")
+	require.NoError(t, err)
+
+	_, err = ps.StatObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = ps.DeleteObject("cat.jpg")
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	// the name can be reused once deleted
+	err = ps.WriteObject("cat.jpg", bytes.NewReader([]byte("purr")))
+	require.NoError(t, err)
+}
+
+func TestPackStorageReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	ps := newTestPackStore(t, dir)
+
+	err := ps.ReplaceObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Equal(t, ErrFileDoesNotExist, err)
+
+	err = ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	before, err := ps.StatObject("cat.jpg")
+	require.NoError(t, err)
+
+	err = ps.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr!")))
+	require.NoError(t, err)
+
+	require.NoError(t, ps.Close())
+
+	// the replacement is kept when the segment is reopened
+	ps = newTestPackStore(t, dir)
+
+	var buf bytes.Buffer
+
+	err = ps.ReadObject("cat.jpg", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "purr!", buf.String())
+
+	info, err := ps.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, before.Created.Unix(), info.Created.Unix())
+	assert.Equal(t, "df5078e76664a04dcff1deb04d2a7efac98ee07a285d42b3a90de5585c0a759a", info.Checksum)
+}
+
+func TestPackStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := NewPackStore(dir)
+	require.NoError(t, err)
+
+	// use small segments, so objects are spread across sealed segments
+	ps.segmentSize = 256
+
+	data := make([]byte, 100)
+
+	for i := 0; i < 10; i++ {
+		rand.Read(data)
+		err = ps.WriteObject(fmt.Sprintf("cat-%d.jpg", i), bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, ps.DeleteObject("cat-0.jpg"))
+	require.NoError(t, ps.DeleteObject("cat-9.jpg"))
+	require.NoError(t, ps.WriteObject("cat-0.jpg", bytes.NewReader([]byte("meow"))))
+
+	assert.Greater(t, len(segmentFiles(t, dir)), 2)
+
+	expected := make(map[string][]byte)
+
+	for id := range ps.index {
+		var b bytes.Buffer
+		require.NoError(t, ps.ReadObject(id, &b))
+		expected[id] = b.Bytes()
+	}
+
+	require.NoError(t, ps.Close())
+
+	ps = newTestPackStore(t, dir)
+
+	require.Len(t, ps.index, len(expected))
+
+	for id, data := range expected {
+		var b bytes.Buffer
+		require.NoError(t, ps.ReadObject(id, &b))
+		assert.Equal(t, data, b.Bytes())
+	}
+
+	_, err = ps.StatObject("cat-9.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestPackStorageChecksum(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := NewPackStore(dir)
+	require.NoError(t, err)
+
+	ps.segmentSize = 256
+
+	data := make([]byte, 100)
+	sums := make(map[string]string)
+
+	for i := 0; i < 5; i++ {
+		rand.Read(data)
+		id := fmt.Sprintf("cat-%d.jpg", i)
+		require.NoError(t, ps.WriteObject(id, bytes.NewReader(data)))
+		sums[id] = checksum(data)
+	}
+
+	// objects written before checksums were recorded have none
+	rec, err := ps.append(packObject, "old.jpg", nil, []byte("meow"), time.Now())
+	require.NoError(t, err)
+	ps.apply(ps.active, rec)
+
+	require.NoError(t, ps.Close())
+
+	// checksums are read from the footers of sealed segments and the records of the active segment
+	ps = newTestPackStore(t, dir)
+
+	for id, sum := range sums {
+		info, err := ps.StatObject(id)
+		require.NoError(t, err)
+		assert.Equal(t, sum, info.Checksum, id)
+	}
+
+	info, err := ps.StatObject("old.jpg")
+	require.NoError(t, err)
+	assert.Empty(t, info.Checksum)
+
+	var b bytes.Buffer
+	require.NoError(t, ps.ReadObject("old.jpg", &b))
+	assert.Equal(t, "meow", b.String())
+
+	// the scrubber can detect corruption of objects in segments
+	e := ps.index["cat-2.jpg"]
+
+	b1 := make([]byte, 1)
+	_, err = e.segment.fd.ReadAt(b1, e.offset)
+	require.NoError(t, err)
+
+	b1[0] ^= 0x01
+
+	_, err = e.segment.fd.WriteAt(b1, e.offset)
+	require.NoError(t, err)
+
+	s := NewScrubber("pack", ps)
+	require.NoError(t, s.Scrub(context.Background()))
+	assert.Equal(t, int64(1), s.Stats().Unverified)
+
+	corrupt := s.Corrupt()
+	require.Len(t, corrupt, 1)
+	assert.Equal(t, "cat-2.jpg", corrupt[0].Name)
+}
+
+func TestPackStorageReopenIncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := NewPackStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, ps.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	size := ps.active.size
+	path := ps.active.path
+
+	require.NoError(t, ps.Close())
+
+	// simulate a crash while a record was being written
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte{0x63, 0x61, 0x74, 0x6c, 0x00, 0x00})
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	ps = newTestPackStore(t, dir)
+
+	assert.Equal(t, size, ps.active.size)
+
+	var b bytes.Buffer
+
+	require.NoError(t, ps.ReadObject("cat.jpg", &b))
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	require.NoError(t, ps.WriteObject("dog.jpg", bytes.NewReader([]byte("woof"))))
+}
+
+func TestPackStorageCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := NewPackStore(dir)
+	require.NoError(t, err)
+
+	ps.segmentSize = 512
+
+	data := make([]byte, 100)
+
+	for i := 0; i < 20; i++ {
+		rand.Read(data)
+		err = ps.WriteObject(fmt.Sprintf("cat-%02d.jpg", i), bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+
+	// delete most objects, leaving the early segments sparse
+	for i := 0; i < 20; i++ {
+		if i%4 == 0 {
+			continue
+		}
+
+		require.NoError(t, ps.DeleteObject(fmt.Sprintf("cat-%02d.jpg", i)))
+	}
+
+	expected := make(map[string][]byte)
+
+	for id := range ps.index {
+		var b bytes.Buffer
+		require.NoError(t, ps.ReadObject(id, &b))
+		expected[id] = b.Bytes()
+	}
+
+	before := len(segmentFiles(t, dir))
+
+	require.NoError(t, ps.Compact())
+
+	assert.Less(t, len(segmentFiles(t, dir)), before)
+
+	for id, data := range expected {
+		var b bytes.Buffer
+		require.NoError(t, ps.ReadObject(id, &b))
+		assert.Equal(t, data, b.Bytes())
+	}
+
+	// deleted objects should stay deleted after the store is reopened
+	require.NoError(t, ps.Close())
+
+	ps = newTestPackStore(t, dir)
+
+	require.Len(t, ps.index, len(expected))
+
+	for id, data := range expected {
+		var b bytes.Buffer
+		require.NoError(t, ps.ReadObject(id, &b))
+		assert.Equal(t, data, b.Bytes())
+	}
+}
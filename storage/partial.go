@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the extension of the file that holds the data of a partial upload
+	partialDataExt = ".part"
+	// the extension of the file that describes a partial upload
+	partialInfoExt = ".info"
+)
+
+var (
+	// ErrOffsetMismatch is returned when appending to a partial upload at an offset other than its end
+	ErrOffsetMismatch = errors.New("upload offset does not match the size of the upload")
+	// ErrPartialTooLarge is returned when appending more data than the length of a partial upload
+	ErrPartialTooLarge = errors.New("upload exceeds its declared length")
+)
+
+// PartialUpload describes an upload that has not yet been completed
+type PartialUpload struct {
+	// ID the unique id of the upload
+	ID string `json:"id"`
+	// Length the total size of the upload in bytes
+	Length int64 `json:"length"`
+	// Offset the number of bytes that have been uploaded so far
+	Offset int64 `json:"-"`
+	// Metadata the metadata provided when the upload was created
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Owner the authenticated principal that created the upload, if any
+	Owner string `json:"owner,omitempty"`
+	// Created the time the upload was created
+	Created time.Time `json:"created"`
+	// Modified the time data was last appended to the upload
+	Modified time.Time `json:"-"`
+}
+
+// PartialStore holds uploads that have not yet been completed in a scratch
+// directory, so that they can be resumed after a connection is lost. Each
+// upload is held as a data file that is appended to, and a file describing it
+type PartialStore struct {
+	dir string
+}
+
+// NewPartialStore creates a new partial store in the specified directory,
+// creating the directory if it does not exist
+func NewPartialStore(dir string) (*PartialStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial upload directory: %w", err)
+	}
+
+	return &PartialStore{
+		dir: dir,
+	}, nil
+}
+
+// CreatePartial creates a new partial upload with no data
+func (s *PartialStore) CreatePartial(p *PartialUpload) error {
+	info, data, err := s.paths(p.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Lstat(info)
+	if err == nil {
+		return ErrFileExists
+	}
+
+	fd, err := os.OpenFile(data, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return ErrFileExists
+		}
+
+		return fmt.Errorf("failed to create partial upload: %w", err)
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return fmt.Errorf("failed to create partial upload: %w", err)
+	}
+
+	// the info is written to a temporary file and renamed, so that
+	// an upload is never described by an incomplete file
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	tmp := info + ".tmp"
+
+	err = os.WriteFile(tmp, encoded, 0644)
+	if err == nil {
+		err = os.Rename(tmp, info)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(data)
+		return fmt.Errorf("failed to create partial upload: %w", err)
+	}
+
+	return nil
+}
+
+// GetPartial returns a partial upload, including how much of it has been uploaded
+func (s *PartialStore) GetPartial(id string) (*PartialUpload, error) {
+	info, data, err := s.paths(id)
+	if err != nil {
+		return nil, ErrFileDoesNotExist
+	}
+
+	encoded, err := os.ReadFile(info)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileDoesNotExist
+		}
+
+		return nil, fmt.Errorf("failed to read partial upload: %w", err)
+	}
+
+	var p PartialUpload
+
+	err = json.Unmarshal(encoded, &p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partial upload: %w", err)
+	}
+
+	fi, err := os.Stat(data)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileDoesNotExist
+		}
+
+		return nil, fmt.Errorf("failed to read partial upload: %w", err)
+	}
+
+	p.Offset = fi.Size()
+	p.Modified = fi.ModTime()
+
+	return &p, nil
+}
+
+// AppendPartial appends data to a partial upload at the offset, which must be the
+// end of the upload. Data that would exceed the length of the upload is rejected.
+// Otherwise, data that is read before an error is encountered is kept, so the
+// upload can be resumed from where it failed. The new offset of the upload is
+// returned. Callers must not append to an upload concurrently
+func (s *PartialStore) AppendPartial(id string, offset int64, r io.Reader) (int64, error) {
+	p, err := s.GetPartial(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.Offset != offset {
+		return p.Offset, ErrOffsetMismatch
+	}
+
+	_, data, _ := s.paths(id)
+
+	fd, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, fmt.Errorf("failed to open partial upload: %w", err)
+	}
+
+	defer fd.Close()
+
+	written, err := io.Copy(fd, io.LimitReader(r, p.Length-offset))
+
+	if err == nil {
+		// reject data that exceeds the declared length of the upload,
+		// discarding any of it that has already been written
+		var extra [1]byte
+
+		n, _ := io.ReadFull(r, extra[:])
+		if n > 0 {
+			terr := fd.Truncate(offset)
+			if terr != nil {
+				return offset + written, fmt.Errorf("failed to discard partial upload data: %w", terr)
+			}
+
+			return offset, ErrPartialTooLarge
+		}
+	}
+
+	offset += written
+
+	serr := fd.Sync()
+	if serr != nil && err == nil {
+		err = fmt.Errorf("failed to write partial upload: %w", serr)
+	}
+
+	// update the modified time, even if no data was written,
+	// so that uploads that are being resumed do not expire
+	now := time.Now()
+	os.Chtimes(data, now, now)
+
+	log.Debug().
+		Str("upload", id).
+		Str("directory", s.dir).
+		Msg(fmt.Sprintf("appended %d bytes to partial upload", written))
+
+	return offset, err
+}
+
+// OpenPartial opens the data of a partial upload for reading
+func (s *PartialStore) OpenPartial(id string) (io.ReadSeekCloser, error) {
+	_, data, err := s.paths(id)
+	if err != nil {
+		return nil, ErrFileDoesNotExist
+	}
+
+	fd, err := os.Open(data)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileDoesNotExist
+		}
+
+		return nil, fmt.Errorf("failed to open partial upload: %w", err)
+	}
+
+	return fd, nil
+}
+
+// DeletePartial deletes a partial upload and its data
+func (s *PartialStore) DeletePartial(id string) error {
+	info, data, err := s.paths(id)
+	if err != nil {
+		return ErrFileDoesNotExist
+	}
+
+	// the info is removed first, so an upload without info is never resumed
+	err = os.Remove(info)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrFileDoesNotExist
+		}
+
+		return fmt.Errorf("failed to delete partial upload: %w", err)
+	}
+
+	err = os.Remove(data)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete partial upload: %w", err)
+	}
+
+	return nil
+}
+
+// ExpirePartials deletes the partial uploads that have not been
+// modified since the provided time, returning how many were deleted
+func (s *PartialStore) ExpirePartials(before time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list partial uploads: %w", err)
+	}
+
+	var expired int
+
+	for _, e := range entries {
+		name := e.Name()
+
+		var id string
+
+		switch {
+		case strings.HasSuffix(name, partialDataExt):
+			id = strings.TrimSuffix(name, partialDataExt)
+		case strings.HasSuffix(name, partialInfoExt+".tmp"):
+			// left behind if the server stopped while creating an upload
+			id = strings.TrimSuffix(name, partialInfoExt+".tmp")
+		default:
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil || fi.ModTime().After(before) {
+			continue
+		}
+
+		for _, ext := range []string{partialInfoExt, partialInfoExt + ".tmp", partialDataExt} {
+			err = os.Remove(filepath.Join(s.dir, id+ext))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return expired, fmt.Errorf("failed to delete partial upload: %w", err)
+			}
+		}
+
+		if strings.HasSuffix(name, partialDataExt) {
+			expired++
+		}
+
+		log.Debug().
+			Str("upload", id).
+			Str("directory", s.dir).
+			Msg("deleted expired partial upload")
+	}
+
+	return expired, nil
+}
+
+// paths returns the paths of the files describing and holding
+// the data of an upload, checking that the id is a valid file name
+func (s *PartialStore) paths(id string) (string, string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", "", ErrInvalidFileName
+	}
+
+	base := filepath.Join(s.dir, id)
+
+	return base + partialInfoExt, base + partialDataExt, nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPartialStore(t *testing.T) *PartialStore {
+	d, err := os.MkdirTemp("/tmp", "partial-*")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll(d)
+	})
+
+	ps, err := NewPartialStore(filepath.Join(d, "uploads"))
+	require.NoError(t, err)
+
+	return ps
+}
+
+func TestPartialStore(t *testing.T) {
+	ps := newTestPartialStore(t)
+
+	err := ps.CreatePartial(&PartialUpload{
+		ID:       "upload-1",
+		Length:   10,
+		Metadata: map[string]string{"name": "cat.jpg"},
+		Owner:    "alice",
+		Created:  time.Now(),
+	})
+	require.NoError(t, err)
+
+	err = ps.CreatePartial(&PartialUpload{ID: "upload-1", Length: 10})
+	assert.Equal(t, ErrFileExists, err)
+
+	p, err := ps.GetPartial("upload-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), p.Length)
+	assert.Equal(t, int64(0), p.Offset)
+	assert.Equal(t, "cat.jpg", p.Metadata["name"])
+	assert.Equal(t, "alice", p.Owner)
+
+	offset, err := ps.AppendPartial("upload-1", 0, strings.NewReader("meow"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), offset)
+
+	// data must be appended at the end of the upload
+	offset, err = ps.AppendPartial("upload-1", 2, strings.NewReader("meow"))
+	assert.Equal(t, ErrOffsetMismatch, err)
+	assert.Equal(t, int64(4), offset)
+
+	// data read before a failure is kept
+	offset, err = ps.AppendPartial("upload-1", 4, io.MultiReader(
+		strings.NewReader("pu"),
+		iotest.ErrReader(io.ErrUnexpectedEOF),
+	))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, int64(6), offset)
+
+	// data beyond the length of the upload is rejected
+	offset, err = ps.AppendPartial("upload-1", 6, strings.NewReader("rrrrrr"))
+	assert.Equal(t, ErrPartialTooLarge, err)
+	assert.Equal(t, int64(6), offset)
+
+	offset, err = ps.AppendPartial("upload-1", 6, strings.NewReader("rrrr"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), offset)
+
+	r, err := ps.OpenPartial("upload-1")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "meowpurrrr", buf.String())
+
+	require.NoError(t, ps.DeletePartial("upload-1"))
+	assert.Equal(t, ErrFileDoesNotExist, ps.DeletePartial("upload-1"))
+
+	_, err = ps.GetPartial("upload-1")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	// ids cannot refer to files outside of the directory
+	_, err = ps.GetPartial("../upload-1")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	err = ps.CreatePartial(&PartialUpload{ID: "../upload-1"})
+	assert.Equal(t, ErrInvalidFileName, err)
+}
+
+func TestPartialStoreExpire(t *testing.T) {
+	ps := newTestPartialStore(t)
+
+	for _, id := range []string{"stale", "active"} {
+		require.NoError(t, ps.CreatePartial(&PartialUpload{ID: id, Length: 10}))
+	}
+
+	_, err := ps.AppendPartial("stale", 0, strings.NewReader("meow"))
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(ps.dir, "stale"+partialDataExt), old, old))
+
+	expired, err := ps.ExpirePartials(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	_, err = ps.GetPartial("stale")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	_, err = ps.GetPartial("active")
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(ps.dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
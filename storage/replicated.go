@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the time a replica that has failed is tried after healthy replicas
+const replicaRetryInterval = 30 * time.Second
+
+var (
+	// ErrInvalidQuorum is returned when the write quorum is not between one and the number of replicas
+	ErrInvalidQuorum = errors.New("write quorum must be between one and the number of replicas")
+	// ErrQuorumNotReached is returned when too few replicas acknowledged a write
+	ErrQuorumNotReached = errors.New("write quorum not reached")
+)
+
+// ReplicatedStore an implementation of the object storage that replicates
+// objects across multiple underlying stores. Writes succeed once a quorum
+// of replicas have acknowledged them, and replicas found to be missing an
+// object when it is read are repaired in the background.
+//
+// Writes and deletes of the same name are serialized, so only one of any
+// concurrent writes will succeed. This only holds for writes made through
+// the same ReplicatedStore, so replicas should not be shared between stores
+type ReplicatedStore struct {
+	replicas []*replica
+	quorum   int
+	locks    nameLocks
+	repairs  sync.WaitGroup
+	mu       sync.Mutex
+	pending  map[string]struct{}
+}
+
+// replica an underlying store and its health
+type replica struct {
+	store    Store
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+// NewReplicatedStore creates a new store that replicates objects across the
+// provided stores, requiring a quorum of them to acknowledge each write
+func NewReplicatedStore(quorum int, stores ...Store) (*ReplicatedStore, error) {
+	if quorum < 1 || quorum > len(stores) {
+		return nil, ErrInvalidQuorum
+	}
+
+	replicas := make([]*replica, len(stores))
+
+	for i, s := range stores {
+		replicas[i] = &replica{store: s}
+	}
+
+	return &ReplicatedStore{
+		replicas: replicas,
+		quorum:   quorum,
+		locks:    nameLocks{locks: make(map[string]*nameLock)},
+		pending:  make(map[string]struct{}),
+	}, nil
+}
+
+// ReadObject reads an object from the first healthy replica that has it. Any
+// replicas that are missing the object are repaired in the background
+func (s *ReplicatedStore) ReadObject(id string, w io.Writer) error {
+	var missing []*replica
+	var lastErr error
+
+	for _, r := range s.ordered() {
+		cw := &countingWriter{w: w}
+
+		err := r.store.ReadObject(id, cw)
+		if err == nil {
+			s.repair(id, r, missing)
+			return nil
+		}
+
+		if errors.Is(err, ErrFileDoesNotExist) {
+			missing = append(missing, r)
+			continue
+		}
+
+		r.failed(err)
+
+		// we can't read from another replica once
+		// data has been written to the requester
+		if cw.n > 0 {
+			return err
+		}
+
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+
+	return ErrFileDoesNotExist
+}
+
+// WriteObject streams an object to all replicas concurrently, succeeding once
+// a quorum have written it. If the quorum is not reached, the object is removed
+// from the replicas that did write it
+func (s *ReplicatedStore) WriteObject(id string, r io.Reader) error {
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	// an object written with a quorum may be missing from some
+	// replicas, so it exists if any replica has a copy of it
+	for _, rep := range s.replicas {
+		_, err := rep.store.StatObject(id)
+		if err == nil {
+			return ErrFileExists
+		}
+	}
+
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	results := make([]error, len(s.replicas))
+
+	var wg sync.WaitGroup
+
+	for i, rep := range s.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+
+		wg.Add(1)
+
+		go func(i int, rep *replica, pr *io.PipeReader) {
+			defer wg.Done()
+
+			err := rep.store.WriteObject(id, pr)
+
+			// unblock any writes if the replica stopped reading early
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.Close()
+			}
+
+			results[i] = err
+		}(i, rep, pr)
+	}
+
+	// errors reading the upload are distinguished from
+	// the errors of replicas that have stopped reading
+	src := &errorReader{r: r}
+
+	_, err := io.Copy(&fanoutWriter{writers: writers}, src)
+
+	for _, pw := range writers {
+		if src.err != nil {
+			pw.CloseWithError(src.err)
+		} else {
+			pw.Close()
+		}
+	}
+
+	wg.Wait()
+
+	var written []*replica
+	var exists bool
+
+	for i, rerr := range results {
+		switch {
+		case rerr == nil:
+			written = append(written, s.replicas[i])
+		case errors.Is(rerr, ErrFileExists):
+			exists = true
+		case src.err == nil:
+			s.replicas[i].failed(rerr)
+		}
+	}
+
+	if err == nil && len(written) >= s.quorum {
+		log.Debug().
+			Str("file", id).
+			Msg(fmt.Sprintf("wrote file to %d of %d replicas", len(written), len(s.replicas)))
+
+		return nil
+	}
+
+	// remove the partially replicated object, so it can be written again
+	for _, rep := range written {
+		derr := rep.store.DeleteObject(id)
+		if derr != nil {
+			log.Error().
+				Str("file", id).
+				Msg(fmt.Sprintf("failed to remove partially replicated file: %s", derr.Error()))
+		}
+	}
+
+	switch {
+	case src.err != nil:
+		return fmt.Errorf("file upload failed: %w", src.err)
+	case exists:
+		return ErrFileExists
+	}
+
+	return fmt.Errorf("%w: %d replicas acknowledged, %d required", ErrQuorumNotReached, len(written), s.quorum)
+}
+
+// StatObject returns information about an object from the first healthy replica that has it
+func (s *ReplicatedStore) StatObject(id string) (*ObjectInfo, error) {
+	var lastErr error
+
+	for _, r := range s.ordered() {
+		info, err := r.store.StatObject(id)
+		if err == nil {
+			return info, nil
+		}
+
+		if !errors.Is(err, ErrFileDoesNotExist) {
+			r.failed(err)
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	return nil, ErrFileDoesNotExist
+}
+
+// ListObjects lists the objects held by any replica in name order
+// that match the prefix and come after the specified name, up to a limit
+func (s *ReplicatedStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	objects := make(map[string]*ObjectInfo)
+
+	var lastErr error
+	var listed bool
+
+	for _, r := range s.replicas {
+		page, err := r.store.ListObjects(prefix, after, limit)
+		if err != nil {
+			r.failed(err)
+			lastErr = err
+			continue
+		}
+
+		listed = true
+
+		for _, obj := range page {
+			if _, ok := objects[obj.Name]; !ok {
+				objects[obj.Name] = obj
+			}
+		}
+	}
+
+	if !listed {
+		return nil, lastErr
+	}
+
+	merged := make([]*ObjectInfo, 0, len(objects))
+
+	for _, obj := range objects {
+		merged = append(merged, obj)
+	}
+
+	return listPage(merged, prefix, after, limit), nil
+}
+
+// DeleteObject removes an object from all replicas
+func (s *ReplicatedStore) DeleteObject(id string) error {
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	var deleted bool
+	var lastErr error
+
+	for _, r := range s.replicas {
+		err := r.store.DeleteObject(id)
+		switch {
+		case err == nil:
+			deleted = true
+		case !errors.Is(err, ErrFileDoesNotExist):
+			r.failed(err)
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("failed to delete file from all replicas: %w", lastErr)
+	}
+
+	if !deleted {
+		return ErrFileDoesNotExist
+	}
+
+	return nil
+}
+
+// ReplaceObject atomically replaces the data of an existing object on each
+// replica that holds it. Every replica must support replacing objects
+func (s *ReplicatedStore) ReplaceObject(id string, r io.Reader) error {
+	for _, rp := range s.replicas {
+		_, ok := rp.store.(replacer)
+		if !ok {
+			return ErrReplaceUnsupported
+		}
+	}
+
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read bytes from request: %w", err)
+	}
+
+	var replaced bool
+
+	for _, rp := range s.replicas {
+		err := rp.store.(replacer).ReplaceObject(id, bytes.NewReader(data))
+		switch {
+		case err == nil:
+			replaced = true
+		case !errors.Is(err, ErrFileDoesNotExist):
+			rp.failed(err)
+			return fmt.Errorf("failed to replace file on all replicas: %w", err)
+		}
+	}
+
+	if !replaced {
+		return ErrFileDoesNotExist
+	}
+
+	return nil
+}
+
+// Close waits for any repairs that are in progress to complete
+func (s *ReplicatedStore) Close() error {
+	s.repairs.Wait()
+	return nil
+}
+
+// ordered returns the replicas with healthy replicas first
+func (s *ReplicatedStore) ordered() []*replica {
+	ordered := make([]*replica, 0, len(s.replicas))
+	var unhealthy []*replica
+
+	for _, r := range s.replicas {
+		if r.healthy() {
+			ordered = append(ordered, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+
+	return append(ordered, unhealthy...)
+}
+
+// repair copies an object from a replica to the replicas that are missing it
+func (s *ReplicatedStore) repair(id string, source *replica, missing []*replica) {
+	if len(missing) < 1 {
+		return
+	}
+
+	s.mu.Lock()
+	if _, ok := s.pending[id]; ok {
+		s.mu.Unlock()
+		return
+	}
+	s.pending[id] = struct{}{}
+	s.mu.Unlock()
+
+	s.repairs.Add(1)
+
+	go func() {
+		defer s.repairs.Done()
+
+		defer func() {
+			s.mu.Lock()
+			delete(s.pending, id)
+			s.mu.Unlock()
+		}()
+
+		// hold the lock so the object isn't deleted while it's being repaired
+		unlock := s.locks.lock(id)
+		defer unlock()
+
+		var buf bytes.Buffer
+
+		err := source.store.ReadObject(id, &buf)
+		if err != nil {
+			if !errors.Is(err, ErrFileDoesNotExist) {
+				log.Error().
+					Str("file", id).
+					Msg(fmt.Sprintf("failed to read file for repair: %s", err.Error()))
+			}
+			return
+		}
+
+		for _, r := range missing {
+			err = r.store.WriteObject(id, bytes.NewReader(buf.Bytes()))
+			if err != nil && !errors.Is(err, ErrFileExists) {
+				r.failed(err)
+
+				log.Error().
+					Str("file", id).
+					Msg(fmt.Sprintf("failed to repair replica: %s", err.Error()))
+
+				continue
+			}
+
+			log.Debug().
+				Str("file", id).
+				Msg("repaired file on replica")
+		}
+	}()
+}
+
+func (r *replica) failed(err error) {
+	r.mu.Lock()
+	r.failedAt = time.Now()
+	r.mu.Unlock()
+
+	log.Warn().Msg(fmt.Sprintf("storage replica failed: %s", err.Error()))
+}
+
+func (r *replica) healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Since(r.failedAt) > replicaRetryInterval
+}
+
+// fanoutWriter writes data to multiple pipes, ignoring any that have been
+// closed by their reader, until all of them have failed
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	if f.failed == nil {
+		f.failed = make([]bool, len(f.writers))
+	}
+
+	var lastErr error
+	var ok bool
+
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+
+		_, err := w.Write(p)
+		if err != nil {
+			f.failed[i] = true
+			lastErr = err
+			continue
+		}
+
+		ok = true
+	}
+
+	if !ok {
+		return 0, lastErr
+	}
+
+	return len(p), nil
+}
+
+// errorReader records the error returned by a reader
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		e.err = err
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to a writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// nameLocks provides a lock for each object name
+type nameLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks a name, returning a function that unlocks it
+func (l *nameLocks) lock(name string) func() {
+	l.mu.Lock()
+
+	nl, ok := l.locks[name]
+	if !ok {
+		nl = &nameLock{}
+		l.locks[name] = nl
+	}
+
+	nl.refs++
+
+	l.mu.Unlock()
+
+	nl.mu.Lock()
+
+	return func() {
+		nl.mu.Unlock()
+
+		l.mu.Lock()
+
+		nl.refs--
+		if nl.refs == 0 {
+			delete(l.locks, name)
+		}
+
+		l.mu.Unlock()
+	}
+}
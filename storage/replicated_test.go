@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errReplicaDown = errors.New("replica is down")
+
+// failingStore a store where every operation fails
+type failingStore struct{}
+
+func (failingStore) ReadObject(id string, w io.Writer) error {
+	return errReplicaDown
+}
+
+func (failingStore) WriteObject(id string, r io.Reader) error {
+	return errReplicaDown
+}
+
+func (failingStore) StatObject(id string) (*ObjectInfo, error) {
+	return nil, errReplicaDown
+}
+
+func (failingStore) ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error) {
+	return nil, errReplicaDown
+}
+
+func (failingStore) DeleteObject(id string) error {
+	return errReplicaDown
+}
+
+func newTestReplicatedStore(t *testing.T, quorum int, stores ...Store) *ReplicatedStore {
+	rs, err := NewReplicatedStore(quorum, stores...)
+	require.NoError(t, err)
+
+	return rs
+}
+
+func TestReplicatedStorageSetup(t *testing.T) {
+	_, err := NewReplicatedStore(0, NewMemoryStore())
+	assert.True(t, errors.Is(err, ErrInvalidQuorum))
+
+	_, err = NewReplicatedStore(2, NewMemoryStore())
+	assert.True(t, errors.Is(err, ErrInvalidQuorum))
+}
+
+func TestReplicatedStorageWriteFile(t *testing.T) {
+	m := NewMemoryStore()
+	f := newTestFileStore(t)
+
+	rs := newTestReplicatedStore(t, 2, m, f, failingStore{})
+
+	data := make([]byte, 1<<20)
+	_, err := io.ReadFull(bytes.NewReader(bytes.Repeat([]byte("meow"), 1<<18)), data)
+	require.NoError(t, err)
+
+	err = rs.WriteObject("cat.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// both healthy replicas should have the file
+	for _, s := range []Store{m, f} {
+		var b bytes.Buffer
+
+		err = s.ReadObject("cat.jpg", &b)
+		require.NoError(t, err)
+		assert.Equal(t, data, b.Bytes())
+	}
+
+	err = rs.WriteObject("cat.jpg", bytes.NewReader(data))
+	assert.True(t, errors.Is(err, ErrFileExists))
+}
+
+func TestReplicatedStorageWriteQuorumNotReached(t *testing.T) {
+	m := NewMemoryStore()
+
+	rs := newTestReplicatedStore(t, 2, m, failingStore{})
+
+	err := rs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrQuorumNotReached))
+
+	// the partially replicated file should be removed
+	_, err = m.StatObject("cat.jpg")
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+}
+
+func TestReplicatedStorageWriteFileFailure(t *testing.T) {
+	m1 := NewMemoryStore()
+	m2 := NewMemoryStore()
+
+	rs := newTestReplicatedStore(t, 1, m1, m2)
+
+	r := io.MultiReader(
+		bytes.NewReader([]byte("meow")),
+		iotest.ErrReader(errors.New("connection reset")),
+	)
+
+	err := rs.WriteObject("cat.jpg", r)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrQuorumNotReached))
+
+	for _, s := range []Store{m1, m2} {
+		_, err = s.StatObject("cat.jpg")
+		assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+	}
+
+	// failed uploads do not mark replicas as unhealthy
+	for _, r := range rs.replicas {
+		assert.True(t, r.healthy())
+	}
+}
+
+func TestReplicatedStorageWriteConcurrentConflict(t *testing.T) {
+	rs := newTestReplicatedStore(t, 2, NewMemoryStore(), newTestFileStore(t), NewMemoryStore())
+
+	var wg sync.WaitGroup
+	var errorCount int64
+
+	wg.Add(100)
+
+	// create 100 concurrent write requests
+	// we expect that 99 of them should fail
+	// as the file will already be created
+	for i := 0; i < 100; i++ {
+		go func() {
+			r := bytes.NewReader([]byte("meow"))
+
+			err := rs.WriteObject("cat.jpg", r)
+			if err != nil {
+				assert.True(t, errors.Is(err, ErrFileExists))
+				atomic.AddInt64(&errorCount, 1)
+			}
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	var b bytes.Buffer
+
+	err := rs.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	assert.Equal(t, int64(99), errorCount)
+}
+
+func TestReplicatedStorageReadRepair(t *testing.T) {
+	m1 := NewMemoryStore()
+	m2 := NewMemoryStore()
+
+	rs := newTestReplicatedStore(t, 1, failingStore{}, m1, m2)
+
+	// the file is only held by one of the replicas
+	err := m2.WriteObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+
+	err = rs.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	require.NoError(t, rs.Close())
+
+	b.Reset()
+
+	err = m1.ReadObject("cat.jpg", &b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	// the failed replica should be tried last
+	assert.False(t, rs.replicas[0].healthy())
+	assert.Equal(t, rs.replicas[0], rs.ordered()[2])
+
+	err = rs.ReadObject("dog.jpg", &b)
+	assert.True(t, errors.Is(err, errReplicaDown))
+}
+
+func TestReplicatedStorageStatListDelete(t *testing.T) {
+	m1 := NewMemoryStore()
+	m2 := NewMemoryStore()
+
+	rs := newTestReplicatedStore(t, 1, m1, m2)
+
+	require.NoError(t, m1.WriteObject("a.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, m2.WriteObject("b.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, rs.WriteObject("c.jpg", bytes.NewReader([]byte("meow"))))
+
+	info, err := rs.StatObject("b.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size)
+
+	objects, err := rs.ListObjects("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+	assert.Equal(t, "a.jpg", objects[0].Name)
+	assert.Equal(t, "b.jpg", objects[1].Name)
+	assert.Equal(t, "c.jpg", objects[2].Name)
+
+	objects, err = rs.ListObjects("", "a.jpg", 1)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "b.jpg", objects[0].Name)
+
+	require.NoError(t, rs.DeleteObject("c.jpg"))
+
+	for _, s := range []Store{m1, m2} {
+		_, err = s.StatObject("c.jpg")
+		assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+	}
+
+	err = rs.DeleteObject("c.jpg")
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+}
+
+func TestReplicatedStorageReplaceFile(t *testing.T) {
+	m1 := NewMemoryStore()
+	m2 := NewMemoryStore()
+
+	rs := newTestReplicatedStore(t, 1, m1, m2)
+
+	require.NoError(t, rs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, rs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("purr!"))))
+
+	for _, s := range []Store{m1, m2} {
+		var buf bytes.Buffer
+
+		require.NoError(t, s.ReadObject("cat.jpg", &buf))
+		assert.Equal(t, "purr!", buf.String())
+	}
+
+	err := rs.ReplaceObject("invisible-cat.jpg", bytes.NewReader([]byte("meow")))
+	assert.True(t, errors.Is(err, ErrFileDoesNotExist))
+
+	// every replica must support replacing files
+	rs = newTestReplicatedStore(t, 1, m1, failingStore{})
+
+	err = rs.ReplaceObject("cat.jpg", bytes.NewReader([]byte("meow")))
+	assert.Equal(t, ErrReplaceUnsupported, err)
+}
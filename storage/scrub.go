@@ -0,0 +1,516 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultScrubInterval the default time between each scrub of a store
+const DefaultScrubInterval = 24 * time.Hour
+
+// CorruptStatus what the scrubber did with a corrupt object
+type CorruptStatus int
+
+const (
+	// CorruptFlagged the object was reported, but left in place
+	CorruptFlagged CorruptStatus = iota
+	// CorruptQuarantined the object was moved out of the store
+	CorruptQuarantined
+	// CorruptRepaired the object was replaced with a good copy from a replica
+	CorruptRepaired
+)
+
+// String returns the name of the status
+func (s CorruptStatus) String() string {
+	switch s {
+	case CorruptFlagged:
+		return "flagged"
+	case CorruptQuarantined:
+		return "quarantined"
+	case CorruptRepaired:
+		return "repaired"
+	}
+
+	return "unknown"
+}
+
+// CorruptObject an object whose data no longer matches its checksum
+type CorruptObject struct {
+	// Store the name of the store the object is held in
+	Store string
+	// Name the name of the object
+	Name string
+	// Expected the checksum recorded when the object was written
+	Expected string
+	// Actual the checksum of the object's data when it was scrubbed
+	Actual string
+	// Detected the time the corruption was detected
+	Detected time.Time
+	// Status what was done with the corrupt object
+	Status CorruptStatus
+}
+
+// ScrubStats reports the progress of a scrubber
+type ScrubStats struct {
+	// Passes the number of complete passes over the store
+	Passes int64 `json:"passes"`
+	// Objects the number of objects that have been scrubbed
+	Objects int64 `json:"objects"`
+	// Bytes the number of bytes that have been scrubbed
+	Bytes int64 `json:"bytes"`
+	// Unverified the number of objects scrubbed that had no checksum
+	Unverified int64 `json:"unverified"`
+	// Corrupt the number of corrupt objects that have been found
+	Corrupt int64 `json:"corrupt"`
+	// Repaired the number of corrupt objects repaired from a replica
+	Repaired int64 `json:"repaired"`
+	// Quarantined the number of corrupt objects that have been quarantined
+	Quarantined int64 `json:"quarantined"`
+	// Errors the number of objects that could not be read
+	Errors int64 `json:"errors"`
+	// LastPass the time the last complete pass finished
+	LastPass time.Time `json:"last_pass"`
+}
+
+// ScrubOption configures optional behaviour of a Scrubber
+type ScrubOption func(s *Scrubber)
+
+// WithScrubRate limits the rate that objects are read at in bytes per second
+func WithScrubRate(bytesPerSecond int64) ScrubOption {
+	return func(s *Scrubber) {
+		s.rate = bytesPerSecond
+	}
+}
+
+// WithScrubInterval sets the time to wait after each pass over the store before starting
+// the next. If the interval is zero, the store is only scrubbed when a pass is triggered
+func WithScrubInterval(d time.Duration) ScrubOption {
+	return func(s *Scrubber) {
+		s.interval = d
+	}
+}
+
+// WithReplicas sets other stores holding copies of the objects,
+// that corrupt objects can be repaired from
+func WithReplicas(replicas ...Store) ScrubOption {
+	return func(s *Scrubber) {
+		s.replicas = replicas
+	}
+}
+
+// checksumRecorder is implemented by stores that can record
+// the checksum of objects written before checksums were recorded
+type checksumRecorder interface {
+	RecordChecksum(id, checksum string) error
+}
+
+// quarantiner is implemented by stores that can move corrupt objects aside
+type quarantiner interface {
+	Quarantine(id string) error
+}
+
+// Scrubber periodically re-reads every object in a store, comparing
+// its data with the checksum recorded when it was written
+type Scrubber struct {
+	name     string
+	store    Store
+	replicas []Store
+	rate     int64
+	interval time.Duration
+	// signals Run to start a pass, holding at most one waiting pass
+	trigger chan struct{}
+	// held while scrubbing, so only one pass runs at a time
+	running sync.Mutex
+	mu      sync.Mutex
+	corrupt map[string]*CorruptObject
+	stats   ScrubStats
+}
+
+// NewScrubber creates a new scrubber for a store. The name is used
+// to identify the store in logs and reports of corrupt objects
+func NewScrubber(name string, store Store, opts ...ScrubOption) *Scrubber {
+	s := &Scrubber{
+		name:     name,
+		store:    store,
+		interval: DefaultScrubInterval,
+		trigger:  make(chan struct{}, 1),
+		corrupt:  make(map[string]*CorruptObject),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Run scrubs the store periodically until the context is cancelled, starting
+// a pass early whenever one is triggered. If the scrubber has no interval,
+// the store is only scrubbed when a pass is triggered
+func (s *Scrubber) Run(ctx context.Context) {
+	var next <-chan time.Time
+
+	if s.interval > 0 {
+		next = time.After(0)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-next:
+		case <-s.trigger:
+		}
+
+		err := s.Scrub(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().
+				Str("store", s.name).
+				Msg(fmt.Sprintf("scrub failed: %s", err.Error()))
+		}
+
+		if s.interval > 0 {
+			next = time.After(s.interval)
+		}
+	}
+}
+
+// Trigger starts a pass over the store once any pass in progress has
+// finished, returning false if a triggered pass is already waiting to
+// start. Passes are only started while the scrubber is running
+func (s *Scrubber) Trigger() bool {
+	select {
+	case s.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Name returns the name of the store the scrubber verifies
+func (s *Scrubber) Name() string {
+	return s.name
+}
+
+// Scrub makes a single pass over every object in the store. Objects that
+// fail verification are repaired from a replica if possible, otherwise they
+// are quarantined if the store supports it, or flagged
+func (s *Scrubber) Scrub(ctx context.Context) error {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	log.Debug().
+		Str("store", s.name).
+		Msg("starting scrub")
+
+	throttle := newThrottle(ctx, s.rate)
+	found := make(map[string]bool)
+
+	err := eachObject(ctx, s.store, func(info *ObjectInfo) {
+		corrupt := s.scrubObject(throttle, info.Name)
+		if corrupt {
+			found[info.Name] = true
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// objects that were not found to be corrupt in this pass have been
+	// repaired or deleted. quarantined objects are no longer in the store,
+	// so they are always kept in the report
+	for id, obj := range s.corrupt {
+		if !found[id] && obj.Status != CorruptQuarantined {
+			delete(s.corrupt, id)
+		}
+	}
+
+	s.stats.Passes++
+	s.stats.LastPass = time.Now()
+
+	log.Info().
+		Str("store", s.name).
+		Msg(fmt.Sprintf("completed scrub, %d corrupt objects", len(found)))
+
+	return nil
+}
+
+// Corrupt returns the corrupt objects found by the scrubber in name order
+func (s *Scrubber) Corrupt() []*CorruptObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects := make([]*CorruptObject, 0, len(s.corrupt))
+
+	for _, obj := range s.corrupt {
+		c := *obj
+		objects = append(objects, &c)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects
+}
+
+// Stats returns the progress of the scrubber
+func (s *Scrubber) Stats() ScrubStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// scrubObject verifies a single object, returning true if it is corrupt
+func (s *Scrubber) scrubObject(throttle *throttle, id string) bool {
+	info, actual, err := s.checksum(throttle, id)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	s.stats.Objects++
+	s.stats.Bytes += info.Size
+	s.mu.Unlock()
+
+	if info.Checksum == "" {
+		s.unverified(id, actual)
+		return false
+	}
+
+	if info.Checksum == actual {
+		return false
+	}
+
+	// the object may have been replaced while it was being read,
+	// so check it again before reporting it as corrupt
+	info, actual, err = s.checksum(throttle, id)
+	if err != nil || info.Checksum == actual {
+		return false
+	}
+
+	obj := &CorruptObject{
+		Store:    s.name,
+		Name:     id,
+		Expected: info.Checksum,
+		Actual:   actual,
+		Detected: time.Now(),
+		Status:   CorruptFlagged,
+	}
+
+	log.Error().
+		Str("store", s.name).
+		Str("file", id).
+		Msg(fmt.Sprintf("checksum mismatch, expected %s got %s", info.Checksum, actual))
+
+	err = s.repair(id, info.Checksum)
+	if err == nil {
+		obj.Status = CorruptRepaired
+	} else {
+		log.Warn().
+			Str("store", s.name).
+			Str("file", id).
+			Msg(fmt.Sprintf("could not repair corrupt file: %s", err.Error()))
+
+		q, ok := s.store.(quarantiner)
+		if ok {
+			err = q.Quarantine(id)
+			if err == nil {
+				obj.Status = CorruptQuarantined
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Corrupt++
+
+	switch obj.Status {
+	case CorruptRepaired:
+		s.stats.Repaired++
+	case CorruptQuarantined:
+		s.stats.Quarantined++
+	}
+
+	s.corrupt[id] = obj
+
+	return true
+}
+
+// checksum reads an object, returning its information and the checksum of its data.
+// errors are recorded, unless the object was deleted or the scrub was cancelled
+func (s *Scrubber) checksum(throttle *throttle, id string) (*ObjectInfo, string, error) {
+	info, err := s.store.StatObject(id)
+	if err == nil {
+		h := sha256.New()
+
+		err = s.store.ReadObject(id, throttle.writer(h))
+		if err == nil {
+			return info, hex.EncodeToString(h.Sum(nil)), nil
+		}
+	}
+
+	if !errors.Is(err, ErrFileDoesNotExist) && throttle.ctx.Err() == nil {
+		s.failed(id, err)
+	}
+
+	return nil, "", err
+}
+
+// repair replaces a corrupt object with a copy from a
+// replica that matches the object's recorded checksum
+func (s *Scrubber) repair(id, checksum string) error {
+	if len(s.replicas) < 1 {
+		return errors.New("no replicas configured")
+	}
+
+	for _, replica := range s.replicas {
+		var buf bytes.Buffer
+
+		h := sha256.New()
+
+		err := replica.ReadObject(id, io.MultiWriter(&buf, h))
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != checksum {
+			continue
+		}
+
+		err = s.replace(id, &buf)
+		if err != nil {
+			return err
+		}
+
+		log.Info().
+			Str("store", s.name).
+			Str("file", id).
+			Msg("repaired corrupt file from replica")
+
+		return nil
+	}
+
+	return errors.New("no replica has a good copy")
+}
+
+// replace swaps a corrupt object for a good copy, atomically if the store
+// supports it. Otherwise the corrupt object must be deleted before the good
+// copy can be written, as stores reject writes to an existing object
+func (s *Scrubber) replace(id string, r io.Reader) error {
+	if rs, ok := s.store.(replacer); ok {
+		return rs.ReplaceObject(id, r)
+	}
+
+	err := s.store.DeleteObject(id)
+	if err != nil && !errors.Is(err, ErrFileDoesNotExist) {
+		return err
+	}
+
+	return s.store.WriteObject(id, r)
+}
+
+// unverified records the checksum of an object written before
+// checksums were recorded, if the store supports it
+func (s *Scrubber) unverified(id, checksum string) {
+	s.mu.Lock()
+	s.stats.Unverified++
+	s.mu.Unlock()
+
+	r, ok := s.store.(checksumRecorder)
+	if !ok {
+		return
+	}
+
+	err := r.RecordChecksum(id, checksum)
+	if err != nil {
+		log.Warn().
+			Str("store", s.name).
+			Str("file", id).
+			Msg(err.Error())
+	}
+}
+
+func (s *Scrubber) failed(id string, err error) {
+	s.mu.Lock()
+	s.stats.Errors++
+	s.mu.Unlock()
+
+	log.Error().
+		Str("store", s.name).
+		Str("file", id).
+		Msg(fmt.Sprintf("failed to scrub file: %s", err.Error()))
+}
+
+// throttle limits the rate that data is read at across many writers
+type throttle struct {
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottle(ctx context.Context, rate int64) *throttle {
+	return &throttle{
+		ctx:   ctx,
+		rate:  rate,
+		start: time.Now(),
+	}
+}
+
+// writer wraps a writer, so that writes to it are throttled
+func (t *throttle) writer(w io.Writer) io.Writer {
+	return &throttledWriter{t: t, w: w}
+}
+
+// wait sleeps until n more bytes can be written without exceeding the rate
+func (t *throttle) wait(n int) error {
+	t.written += int64(n)
+
+	if t.rate < 1 {
+		return t.ctx.Err()
+	}
+
+	due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return t.ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type throttledWriter struct {
+	t *throttle
+	w io.Writer
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	err := w.t.wait(len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(p)
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checksumStore a memory store that reports fixed checksums for its objects
+type checksumStore struct {
+	*MemoryStore
+	checksums map[string]string
+}
+
+func (s *checksumStore) StatObject(id string) (*ObjectInfo, error) {
+	info, err := s.MemoryStore.StatObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Checksum = s.checksums[id]
+
+	return info, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// corruptFile flips a bit in a file, without changing its size
+func corruptFile(t *testing.T, fs *FileStore, id string) {
+	p := filepath.Join(fs.baseDir, id)
+
+	data, err := os.ReadFile(p)
+	require.NoError(t, err)
+
+	data[0] ^= 0x01
+
+	require.NoError(t, os.WriteFile(p, data, 0644))
+}
+
+func TestScrubberQuarantine(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	require.NoError(t, fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+	require.NoError(t, fs.WriteObject("dog.jpg", bytes.NewReader([]byte("woof"))))
+
+	corruptFile(t, fs, "cat.jpg")
+
+	s := NewScrubber("files", fs)
+
+	require.NoError(t, s.Scrub(context.Background()))
+
+	corrupt := s.Corrupt()
+	require.Len(t, corrupt, 1)
+	assert.Equal(t, "files", corrupt[0].Store)
+	assert.Equal(t, "cat.jpg", corrupt[0].Name)
+	assert.Equal(t, checksum([]byte("meow")), corrupt[0].Expected)
+	assert.Equal(t, checksum([]byte("leow")), corrupt[0].Actual)
+	assert.Equal(t, CorruptQuarantined, corrupt[0].Status)
+
+	// the corrupt file should no longer be served
+	_, err := fs.StatObject("cat.jpg")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	_, err = os.Stat(filepath.Join(fs.baseDir, fileStoreQuarantineDir, "cat.jpg"))
+	assert.NoError(t, err)
+
+	stats := s.Stats()
+	assert.Equal(t, int64(1), stats.Passes)
+	assert.Equal(t, int64(2), stats.Objects)
+	assert.Equal(t, int64(8), stats.Bytes)
+	assert.Equal(t, int64(1), stats.Corrupt)
+	assert.Equal(t, int64(1), stats.Quarantined)
+
+	// quarantined files are still reported after the next pass
+	require.NoError(t, s.Scrub(context.Background()))
+	assert.Len(t, s.Corrupt(), 1)
+}
+
+func TestScrubberRepair(t *testing.T) {
+	primary := newTestFileStore(t)
+	defer os.RemoveAll(primary.baseDir)
+
+	replica := newTestFileStore(t)
+	defer os.RemoveAll(replica.baseDir)
+
+	for _, fs := range []*FileStore{primary, replica} {
+		require.NoError(t, fs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+	}
+
+	corruptFile(t, primary, "cat.jpg")
+
+	s := NewScrubber("primary", primary, WithReplicas(replica))
+
+	require.NoError(t, s.Scrub(context.Background()))
+
+	corrupt := s.Corrupt()
+	require.Len(t, corrupt, 1)
+	assert.Equal(t, CorruptRepaired, corrupt[0].Status)
+	assert.Equal(t, int64(1), s.Stats().Repaired)
+
+	var b bytes.Buffer
+
+	require.NoError(t, primary.ReadObject("cat.jpg", &b))
+	assert.Equal(t, []byte("meow"), b.Bytes())
+
+	// repaired files are removed from the report once they pass a scrub
+	require.NoError(t, s.Scrub(context.Background()))
+	assert.Len(t, s.Corrupt(), 0)
+}
+
+// replaceOnlyStore a store that can only replace existing objects
+type replaceOnlyStore struct {
+	*checksumStore
+}
+
+func (s replaceOnlyStore) WriteObject(id string, r io.Reader) error {
+	return errors.New("write failed")
+}
+
+func (s replaceOnlyStore) DeleteObject(id string) error {
+	return errors.New("delete failed")
+}
+
+func TestScrubberRepairReplace(t *testing.T) {
+	cs := &checksumStore{
+		MemoryStore: NewMemoryStore(),
+		checksums:   map[string]string{"cat.jpg": checksum([]byte("purr"))},
+	}
+
+	require.NoError(t, cs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	replica := NewMemoryStore()
+	require.NoError(t, replica.WriteObject("cat.jpg", bytes.NewReader([]byte("purr"))))
+
+	// the corrupt object is replaced in place, rather than deleted and rewritten
+	s := NewScrubber("memory", replaceOnlyStore{cs}, WithReplicas(replica))
+
+	require.NoError(t, s.Scrub(context.Background()))
+
+	corrupt := s.Corrupt()
+	require.Len(t, corrupt, 1)
+	assert.Equal(t, CorruptRepaired, corrupt[0].Status)
+
+	var b bytes.Buffer
+
+	require.NoError(t, cs.ReadObject("cat.jpg", &b))
+	assert.Equal(t, "purr", b.String())
+}
+
+func TestScrubberFlag(t *testing.T) {
+	cs := &checksumStore{
+		MemoryStore: NewMemoryStore(),
+		checksums:   map[string]string{"cat.jpg": checksum([]byte("purr"))},
+	}
+
+	require.NoError(t, cs.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	// the replica's copy is also corrupt, so it cannot be repaired
+	replica := NewMemoryStore()
+	require.NoError(t, replica.WriteObject("cat.jpg", bytes.NewReader([]byte("hiss"))))
+
+	s := NewScrubber("memory", cs, WithReplicas(replica))
+
+	require.NoError(t, s.Scrub(context.Background()))
+
+	corrupt := s.Corrupt()
+	require.Len(t, corrupt, 1)
+	assert.Equal(t, CorruptFlagged, corrupt[0].Status)
+
+	_, err := cs.StatObject("cat.jpg")
+	assert.NoError(t, err)
+}
+
+func TestScrubberRecordChecksum(t *testing.T) {
+	fs := newTestFileStore(t)
+	defer os.RemoveAll(fs.baseDir)
+
+	// files written before checksums were recorded have no checksum
+	require.NoError(t, os.WriteFile(filepath.Join(fs.baseDir, "cat.jpg"), []byte("meow"), 0644))
+
+	info, err := fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Empty(t, info.Checksum)
+
+	s := NewScrubber("files", fs)
+
+	require.NoError(t, s.Scrub(context.Background()))
+	assert.Equal(t, int64(1), s.Stats().Unverified)
+
+	info, err = fs.StatObject("cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, checksum([]byte("meow")), info.Checksum)
+}
+
+func TestScrubberRate(t *testing.T) {
+	ms := NewMemoryStore()
+
+	require.NoError(t, ms.WriteObject("cat.jpg", bytes.NewReader(make([]byte, 5000))))
+
+	s := NewScrubber("memory", ms, WithScrubRate(10000))
+
+	start := time.Now()
+
+	require.NoError(t, s.Scrub(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	// cancelling the scrub stops it while throttled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := s.Scrub(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int64(1), s.Stats().Passes)
+	assert.Equal(t, int64(0), s.Stats().Errors)
+}
+
+func TestScrubberTrigger(t *testing.T) {
+	ms := NewMemoryStore()
+
+	require.NoError(t, ms.WriteObject("cat.jpg", bytes.NewReader([]byte("meow"))))
+
+	s := NewScrubber("memory", ms, WithScrubInterval(0))
+	assert.Equal(t, "memory", s.Name())
+
+	// only one triggered pass can be waiting to start
+	assert.True(t, s.Trigger())
+	assert.False(t, s.Trigger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		return s.Stats().Passes == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// without an interval, passes are only started when triggered
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(1), s.Stats().Passes)
+
+	assert.True(t, s.Trigger())
+
+	assert.Eventually(t, func() bool {
+		return s.Stats().Passes == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(context.Background(), 0)
+
+	// an unlimited throttle never waits
+	n, err := io.Copy(th.writer(io.Discard), bytes.NewReader(make([]byte, 1<<20)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), n)
+}
@@ -0,0 +1,18 @@
+package storage
+
+import "io"
+
+// Store defines the interface implemented by each of the storage backends
+type Store interface {
+	ReadObject(id string, w io.Writer) error
+	WriteObject(id string, r io.Reader) error
+	StatObject(id string) (*ObjectInfo, error)
+	ListObjects(prefix, after string, limit int) ([]*ObjectInfo, error)
+	DeleteObject(id string) error
+}
+
+// replacer is implemented by stores that can atomically replace the data of an
+// existing object, so that it is never missing while it is being rewritten
+type replacer interface {
+	ReplaceObject(id string, r io.Reader) error
+}